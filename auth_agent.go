@@ -0,0 +1,57 @@
+package socker
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrNoAgent reports the ssh-agent isn't available.
+var ErrNoAgent = errors.New("ssh-agent is unavailable: SSH_AUTH_SOCK isn't set")
+
+// agentConn is the connection to ssh-agent shared by all Auth instances, it's kept
+// open since agent signers sign through it.
+var agentConn struct {
+	sync.Mutex
+	sock   string
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+// agentSigners return the signers of keys held by ssh-agent from SSH_AUTH_SOCK.
+func agentSigners() ([]ssh.Signer, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, ErrNoAgent
+	}
+
+	agentConn.Lock()
+	defer agentConn.Unlock()
+	if agentConn.client != nil && agentConn.sock == sock {
+		signers, err := agentConn.client.Signers()
+		if err == nil {
+			return signers, nil
+		}
+		agentConn.conn.Close()
+		agentConn.client = nil
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	client := agent.NewClient(conn)
+	signers, err := client.Signers()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	agentConn.sock = sock
+	agentConn.conn = conn
+	agentConn.client = client
+	return signers, nil
+}
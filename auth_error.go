@@ -0,0 +1,135 @@
+package socker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	authPassword  = "password"
+	authPublicKey = "publickey"
+)
+
+// AuthError is returned if the ssh authentication failed, it reports how each auth
+// method is handled, so it's easy to tell wrong credentials from disabled methods.
+type AuthError struct {
+	User string
+	// Configured is the auth methods configured by Auth.
+	Configured []string
+	// Attempted is the methods offered by server and attempted by client in order.
+	Attempted []string
+	// Rejected is the attempted methods rejected by server.
+	Rejected []string
+	// Partial is the attempted methods accepted by server but further authentication
+	// is required.
+	Partial []string
+	// KeyErr is the error of loading keys from ssh-agent or Auth.Credentials, the
+	// publickey method is attempted without these keys.
+	KeyErr error
+	Err    error
+}
+
+// NotOffered return the configured methods which are not offered by server.
+func (e *AuthError) NotOffered() []string {
+	var methods []string
+	for _, m := range e.Configured {
+		if !stringsContain(e.Attempted, m) {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+func (e *AuthError) Error() string {
+	msg := fmt.Sprintf("ssh: unable to authenticate user %s: rejected %v, partial success %v, not offered by server %v",
+		e.User, e.Rejected, e.Partial, e.NotOffered())
+	if e.KeyErr != nil {
+		msg += ", load keys failed: " + e.KeyErr.Error()
+	}
+	return msg
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// authTrace record the auth methods attempted during one handshake.
+type authTrace struct {
+	attempted []string
+	keyErr    error
+}
+
+func (t *authTrace) attempt(method string) {
+	if t != nil && !stringsContain(t.attempted, method) {
+		t.attempted = append(t.attempted, method)
+	}
+}
+
+// keyError record the first error of loading keys.
+func (t *authTrace) keyError(err error) {
+	if t != nil && t.keyErr == nil {
+		t.keyErr = err
+	}
+}
+
+// traceConfig return a copy of the config whose auth methods are traced and bound to
+// the dial context.
+func (a *Auth) traceConfig(ctx context.Context, config *ssh.ClientConfig) (*ssh.ClientConfig, *authTrace) {
+	if config != a.config {
+		return config, nil
+	}
+	trace := &authTrace{}
+	traced := *config
+	traced.Auth = a.authMethods(ctx, config.Timeout, a.keys, trace)
+	return &traced, trace
+}
+
+func (a *Auth) configuredMethods() []string {
+	var methods []string
+	for _, m := range a.methods() {
+		switch {
+		case m == MethodPassword && (a.Password != "" || a.PasswordCallback != nil):
+			m = authPassword
+		case m == MethodKey && (len(a.keys.signers) > 0 || a.Credentials != nil), m == MethodAgent:
+			m = authPublicKey
+		default:
+			continue
+		}
+		if !stringsContain(methods, m) {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+var triedMethodsRe = regexp.MustCompile(`attempted methods \[([^\]]*)\]`)
+
+// authError convert the authentication failure of handshake to *AuthError.
+func (a *Auth) authError(err error, trace *authTrace) error {
+	if trace == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+		return err
+	}
+	e := &AuthError{
+		User:       a.User,
+		Configured: a.configuredMethods(),
+		Attempted:  trace.attempted,
+		KeyErr:     trace.keyErr,
+		Err:        err,
+	}
+	var tried []string
+	if match := triedMethodsRe.FindStringSubmatch(err.Error()); match != nil {
+		tried = strings.Fields(match[1])
+	}
+	for _, m := range e.Attempted {
+		if stringsContain(tried, m) {
+			e.Rejected = append(e.Rejected, m)
+		} else {
+			e.Partial = append(e.Partial, m)
+		}
+	}
+	return e
+}
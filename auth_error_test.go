@@ -0,0 +1,185 @@
+package socker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startAuthServer start a ssh server which only offers password auth and rejects
+// all passwords.
+func startAuthServer(t *testing.T) net.Listener {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(hostSigner)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ssh.NewServerConn(conn, config)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestAuthError(t *testing.T) {
+	l := startAuthServer(t)
+	defer l.Close()
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Dial(l.Addr().String(), &Auth{
+		User:       "root",
+		Password:   "secret",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})),
+	})
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expect AuthError, got %v", err)
+	}
+	if !reflect.DeepEqual(authErr.Rejected, []string{authPassword}) ||
+		!reflect.DeepEqual(authErr.NotOffered(), []string{authPublicKey}) ||
+		len(authErr.Partial) != 0 {
+		t.Errorf("auth error mismatch: %s", authErr)
+	}
+}
+
+func TestAuthMethods(t *testing.T) {
+	l := startAuthServer(t)
+	defer l.Close()
+
+	var prompts int
+	auth := &Auth{
+		User: "root",
+		PasswordCallback: func() (string, error) {
+			prompts++
+			return "secret", nil
+		},
+		Methods: []string{MethodAgent, MethodPassword},
+	}
+	_, err := Dial(l.Addr().String(), auth)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expect AuthError, got %v", err)
+	}
+	if prompts != 1 || !reflect.DeepEqual(authErr.Configured, []string{authPublicKey, authPassword}) {
+		t.Errorf("auth methods mismatch: %d %v", prompts, authErr.Configured)
+	}
+
+	_, err = (&Auth{User: "root", Password: "secret", Methods: []string{"gssapi"}}).SSHConfig()
+	if err == nil {
+		t.Error("unknown method should be rejected")
+	}
+	_, err = (&Auth{User: "root", Password: "secret", Methods: []string{MethodKey}}).SSHConfig()
+	if err == nil {
+		t.Error("disabled password should be skipped")
+	}
+}
+
+type failedCredentials struct{}
+
+func (failedCredentials) Signers(context.Context) ([]ssh.Signer, error) {
+	return nil, errors.New("provider is down")
+}
+
+// startKeyPasswordServer start a ssh server which rejects all public keys and only
+// accepts the password "secret".
+func startKeyPasswordServer(t *testing.T) net.Listener {
+	return startTestServer(t, func(conn net.Conn, _ *ssh.ServerConfig) {
+		hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		hostSigner, err := ssh.NewSignerFromKey(hostKey)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		config := &ssh.ServerConfig{
+			PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+				return nil, errors.New("unknown key")
+			},
+			PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if string(password) != "secret" {
+					return nil, errors.New("wrong password")
+				}
+				return nil, nil
+			},
+		}
+		config.AddHostKey(hostSigner)
+		serveExec(conn, config, 0)
+	})
+}
+
+func TestAuthKeyErrorFallback(t *testing.T) {
+	l := startKeyPasswordServer(t)
+	defer l.Close()
+
+	sock, has := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	defer func() {
+		if has {
+			os.Setenv("SSH_AUTH_SOCK", sock)
+		}
+	}()
+
+	// unavailable keys don't abort the handshake, the password is still tried.
+	for _, auth := range []*Auth{
+		{User: "root", Password: "secret", Methods: []string{MethodAgent, MethodPassword}},
+		{User: "root", Password: "secret", Methods: []string{MethodKey, MethodPassword}, Credentials: failedCredentials{}},
+	} {
+		agent, err := Dial(l.Addr().String(), auth)
+		if err != nil {
+			t.Fatalf("methods %v: %v", auth.Methods, err)
+		}
+		agent.Close()
+	}
+
+	_, err := Dial(l.Addr().String(), &Auth{User: "root", Methods: []string{MethodAgent}})
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || authErr.KeyErr != ErrNoAgent {
+		t.Fatalf("expect AuthError with key error, got %v", err)
+	}
+	if !strings.Contains(authErr.Error(), ErrNoAgent.Error()) {
+		t.Errorf("key error isn't reported: %s", authErr)
+	}
+}
@@ -0,0 +1,34 @@
+package socker
+
+import (
+	"crypto"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SignFunc sign the digest with the private key held outside of the process, such
+// as PKCS#11 tokens, HSM or KMS services. It has the same semantics as
+// crypto.Signer.Sign.
+type SignFunc func(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+
+type funcSigner struct {
+	pub  crypto.PublicKey
+	sign SignFunc
+}
+
+func (s funcSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s funcSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.sign(rand, digest, opts)
+}
+
+// NewFuncSigner create a ssh signer whose signing is done by the callback, the public
+// key must be *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey. The signer can
+// be used by Auth.Signers. Keys implemented crypto.Signer, e.g. keys from PKCS#11
+// libraries, can be converted by ssh.NewSignerFromSigner directly.
+func NewFuncSigner(pub crypto.PublicKey, sign SignFunc) (ssh.Signer, error) {
+	return ssh.NewSignerFromSigner(funcSigner{pub: pub, sign: sign})
+}
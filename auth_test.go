@@ -0,0 +1,118 @@
+package socker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIdentityFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newKey := func(name string, encrypted bool) ssh.Signer {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+		if encrypted {
+			block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, der, []byte("passphrase"), x509.PEMCipherAES256)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+		if err == nil {
+			err = ioutil.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	plain := newKey("id_plain", false)
+	encrypted := newKey("id_encrypted", true)
+	other := newKey("id_other", false)
+
+	auth := &Auth{
+		User:            "root",
+		PrivateKeyFiles: []string{filepath.Join(dir, "id_encrypted"), filepath.Join(dir, "id_plain")},
+		Methods:         []string{MethodKey, MethodAgent},
+		IdentitiesOnly:  true,
+	}
+	_, err = auth.SSHConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auth.keys.signers) != 1 || len(auth.keys.identities) != 2 {
+		t.Fatalf("identities mismatch: %d %d", len(auth.keys.signers), len(auth.keys.identities))
+	}
+	matched := auth.keys.filter([]ssh.Signer{other, encrypted, plain})
+	if len(matched) != 2 || matched[0] != encrypted || matched[1] != plain {
+		t.Error("agent keys aren't filtered by identities")
+	}
+
+	auth = &Auth{
+		User:            "root",
+		PrivateKeyFiles: []string{filepath.Join(dir, "id_encrypted")},
+		Methods:         []string{MethodKey, MethodAgent},
+	}
+	if _, err = auth.SSHConfig(); err == nil {
+		t.Error("passphrase protected key should be rejected without IdentitiesOnly")
+	}
+}
+
+func TestFuncSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signs int
+	signer, err := NewFuncSigner(key.Public(), func(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+		signs++
+		return key.Sign(rand, digest, opts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("socker")
+	sig, err := signer.Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = signer.PublicKey().Verify(data, sig); err != nil || signs != 1 {
+		t.Errorf("verify signature failed: %v", err)
+	}
+
+	auth := &Auth{User: "root", Signers: []ssh.Signer{signer}}
+	if _, err = auth.SSHConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if len(auth.keys.signers) != 1 {
+		t.Error("signers aren't used")
+	}
+}
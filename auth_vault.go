@@ -0,0 +1,193 @@
+package socker
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// VaultCertProvider request user certificates from the ssh secrets engine of
+// HashiCorp Vault, and cache the certificate until it's near expiry.
+type VaultCertProvider struct {
+	// Addr is the address of Vault like "https://vault:8200".
+	Addr  string
+	Token string
+	// Mount is the mount path of ssh secrets engine, default is "ssh".
+	Mount string
+	Role  string
+	// TTL is the requested ttl like "30m", empty means the default ttl of role.
+	TTL        string
+	Principals []string
+	// Signer is the key to be signed, if it's nil, an ephemeral ed25519 key is
+	// generated and never leaves the process.
+	Signer ssh.Signer
+	// RenewBefore is the duration before expiry the certificate is renewed, default
+	// is 1 minute.
+	RenewBefore time.Duration
+	// Client is the http client, default is a client with VaultTimeout.
+	Client *http.Client
+
+	mu     sync.Mutex
+	cert   *ssh.Certificate
+	signer ssh.Signer
+	call   *vaultCall
+}
+
+// VaultTimeout is the timeout of requests to Vault if VaultCertProvider.Client is nil.
+var VaultTimeout = 30 * time.Second
+
+var _ CredentialProvider = (*VaultCertProvider)(nil)
+
+// vaultCall is the certificate request shared by concurrent callers.
+type vaultCall struct {
+	done   chan struct{}
+	cert   *ssh.Certificate
+	signer ssh.Signer
+	err    error
+	// canceled reports the request is failed since the context of leader is done.
+	canceled bool
+}
+
+// Signers return the cached certificate, or request a new one if it's near expiry.
+// Concurrent requests are coalesced, the lock isn't held while requesting so callers
+// waiting for the request can still be canceled by their context.
+func (p *VaultCertProvider) Signers(ctx context.Context) ([]ssh.Signer, error) {
+	renewBefore := p.RenewBefore
+	if renewBefore <= 0 {
+		renewBefore = time.Minute
+	}
+
+	p.mu.Lock()
+	if p.cert != nil && time.Now().Add(renewBefore).Before(time.Unix(int64(p.cert.ValidBefore), 0)) {
+		signer := p.signer
+		p.mu.Unlock()
+		return []ssh.Signer{signer}, nil
+	}
+	call := p.call
+	if call != nil {
+		p.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// the leader is canceled by it's own context, retry with ours.
+		if call.canceled {
+			return p.Signers(ctx)
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		return []ssh.Signer{call.signer}, nil
+	}
+	call = &vaultCall{done: make(chan struct{})}
+	p.call = call
+	p.mu.Unlock()
+
+	call.cert, call.signer, call.err = p.request(ctx)
+	call.canceled = call.err != nil && ctx.Err() != nil
+	p.mu.Lock()
+	p.call = nil
+	if call.err == nil {
+		p.cert, p.signer = call.cert, call.signer
+	}
+	p.mu.Unlock()
+	close(call.done)
+	if call.err != nil {
+		return nil, call.err
+	}
+	return []ssh.Signer{call.signer}, nil
+}
+
+func (p *VaultCertProvider) request(ctx context.Context) (*ssh.Certificate, ssh.Signer, error) {
+	key := p.Signer
+	if key == nil {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err = ssh.NewSignerFromKey(priv)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	cert, err := p.sign(ctx, key.PublicKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, signer, nil
+}
+
+func (p *VaultCertProvider) sign(ctx context.Context, pub ssh.PublicKey) (*ssh.Certificate, error) {
+	mount := p.Mount
+	if mount == "" {
+		mount = "ssh"
+	}
+	body, err := json.Marshal(map[string]string{
+		"public_key":       string(ssh.MarshalAuthorizedKey(pub)),
+		"valid_principals": strings.Join(p.Principals, ","),
+		"ttl":              p.TTL,
+		"cert_type":        "user",
+	})
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/v1/%s/sign/%s", strings.TrimRight(p.Addr, "/"), strings.Trim(mount, "/"), p.Role)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Vault-Token", p.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: VaultTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault sign request failed: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var result struct {
+		Data struct {
+			SignedKey string `json:"signed_key"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault response: %s", err.Error())
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(result.Data.SignedKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signed key: %s", err.Error())
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("signed key isn't certificate")
+	}
+	return cert, nil
+}
@@ -0,0 +1,161 @@
+package socker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVaultCertProvider(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v1/ssh-client/sign/deploy" || r.Header.Get("X-Vault-Token") != "token" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req["public_key"]))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cert := &ssh.Certificate{
+			Key:             pub,
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{req["valid_principals"]},
+			ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		}
+		if err = cert.SignCert(rand.Reader, ca); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]string{"signed_key": string(ssh.MarshalAuthorizedKey(cert))},
+		})
+	}))
+	defer server.Close()
+
+	p := &VaultCertProvider{
+		Addr:       server.URL,
+		Token:      "token",
+		Mount:      "ssh-client",
+		Role:       "deploy",
+		Principals: []string{"root"},
+	}
+	for i := 0; i < 2; i++ {
+		signers, err := p.Signers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, ok := signers[0].PublicKey().(*ssh.Certificate)
+		if !ok || cert.ValidPrincipals[0] != "root" {
+			t.Fatal("signer isn't certificate")
+		}
+	}
+	if requests != 1 {
+		t.Errorf("certificate isn't cached: %d requests", requests)
+	}
+
+	p.RenewBefore = 2 * time.Hour
+	if _, err = p.Signers(context.Background()); err != nil || requests != 2 {
+		t.Errorf("certificate isn't renewed: %v", err)
+	}
+
+	p.Token = "invalid"
+	p.RenewBefore = 2 * time.Hour
+	if _, err = p.Signers(context.Background()); err == nil {
+		t.Error("vault error should be returned")
+	}
+}
+
+func TestVaultCertProviderCoalesce(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		http.Error(w, "sealed", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	p := &VaultCertProvider{Addr: server.URL, Token: "token", Role: "deploy"}
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := p.Signers(context.Background())
+			errs <- err
+		}()
+	}
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// waiting callers aren't blocked by the lock and return with their context.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := p.Signers(ctx); err != context.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	release <- struct{}{}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err == nil {
+			t.Error("vault error should be returned")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("concurrent requests aren't coalesced: %d", n)
+	}
+}
+
+type blockingCredentials struct {
+	err chan error
+}
+
+func (c blockingCredentials) Signers(ctx context.Context) ([]ssh.Signer, error) {
+	<-ctx.Done()
+	c.err <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestCredentialsDialTimeout(t *testing.T) {
+	l := startKeyPasswordServer(t)
+	defer l.Close()
+
+	creds := blockingCredentials{err: make(chan error, 1)}
+	start := time.Now()
+	_, err := Dial(l.Addr().String(), &Auth{
+		User:        "root",
+		Methods:     []string{MethodKey},
+		Credentials: creds,
+		TimeoutMs:   200,
+	})
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || authErr.KeyErr != context.DeadlineExceeded {
+		t.Fatalf("expect credentials timeout, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second || <-creds.err != context.DeadlineExceeded {
+		t.Error("credentials aren't bounded by dial timeout")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/cosiner/socker/remotepath"
 )
 
 func TestFilepath(t *testing.T) {
@@ -28,3 +30,13 @@ func TestFilepath(t *testing.T) {
 		t.Error("test volumeName failed")
 	}
 }
+
+func TestRemotepath(t *testing.T) {
+	fpath := virtualFilepath{PathSeparator: '/', PathListSeparator: ':', IsUnix: true}
+	for _, path := range []string{"app/../bin", `a\b/./c`, "/etc//hosts", `C:\Users`, ""} {
+		if fpath.Clean(path) != remotepath.Clean(path) || fpath.IsAbs(path) != remotepath.IsAbs(path) ||
+			fpath.Join("/home/user", path) != remotepath.Join("/home/user", path) {
+			t.Errorf("remotepath differs from remote paths: %q", path)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package socker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Hash algorithms supported by HashTree, LhashTree and SyncHash.
+const (
+	HashMD5    = "md5"
+	HashSHA1   = "sha1"
+	HashSHA256 = "sha256"
+	HashSHA512 = "sha512"
+)
+
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case HashMD5:
+		return md5.New(), nil
+	case HashSHA1:
+		return sha1.New(), nil
+	case HashSHA256, "":
+		return sha256.New(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm: %s", algo)
+}
+
+// HashTree compute the hash of each regular file under the remote directory,
+// the result is a map from slash separated relative path to hex encoded hash.
+// The hashes are computed remotely by the *sum tools if remote command execution
+// is available, otherwise files are read and hashed via sftp. The manifest of a
+// single file has the only path ".".
+func (s *SSH) HashTree(dir, algo string) map[string]string {
+	var (
+		tree map[string]string
+		err  error
+	)
+	s.withErrorCheck(func() error {
+		tree, err = s.treeHashes(s.rfs, s.rpath(dir), algo, true)
+		return err
+	})
+	return tree
+}
+
+// LhashTree do the same thing as HashTree but for local host, files are always
+// hashed in process.
+func (s *SSH) LhashTree(dir, algo string) map[string]string {
+	var (
+		tree map[string]string
+		err  error
+	)
+	s.withErrorCheck(func() error {
+		tree, err = s.treeHashes(s.lfs, s.lpath(dir), algo, false)
+		return err
+	})
+	return tree
+}
+
+func (s *SSH) treeHashes(fs Fs, dir, algo string, remote bool) (map[string]string, error) {
+	if remote {
+		tree, err := s.execHashTree(dir, algo)
+		if tree != nil || err != nil {
+			return tree, err
+		}
+	}
+	return s.hashTree(fs, dir, algo)
+}
+
+// syncDelta record the hashes of both sides of sync, files with the same hash are
+// skipped.
+type syncDelta struct {
+	root     string
+	src, dst map[string]string
+	// copied is the relative paths of copied files.
+	copied []string
+}
+
+func (d *syncDelta) unchanged(fpath Filepath, path string) (rel string, unchanged bool) {
+	rel, err := fpath.Rel(d.root, path)
+	if err != nil {
+		return "", false
+	}
+	rel = fpath.ToSlash(rel)
+	sum := d.src[rel]
+	return rel, sum != "" && sum == d.dst[rel]
+}
+
+// syncTree sync path to dstPath, the delta sync is applied if SyncHash is enabled.
+func (s *SSH) syncTree(fs, dstFs Fs, path, dstPath string, srcRemote bool) error {
+	if s.syncHash == "" {
+		return s.sync(fs, dstFs, path, dstPath, nil)
+	}
+	src, err := s.treeHashes(fs, path, s.syncHash, srcRemote)
+	if err != nil {
+		return err
+	}
+	dst, err := s.treeHashes(dstFs, dstPath, s.syncHash, !srcRemote)
+	if err != nil && !dstFs.IsNotExist(err) {
+		return err
+	}
+	delta := &syncDelta{root: path, src: src, dst: dst}
+	err = s.sync(fs, dstFs, path, dstPath, delta)
+	if err != nil || len(delta.copied) == 0 {
+		return err
+	}
+
+	dst, err = s.treeHashes(dstFs, dstPath, s.syncHash, !srcRemote)
+	if err != nil {
+		return err
+	}
+	for _, rel := range delta.copied {
+		// files not hashed in source, such as symlinks, aren't verified.
+		if sum := src[rel]; sum != "" && dst[rel] != sum {
+			return fmt.Errorf("verify %s failed: hash mismatch", dstFs.Filepath().Join(dstPath, dstFs.Filepath().FromSlash(rel)))
+		}
+	}
+	return nil
+}
+
+func (s *SSH) hashTree(fs Fs, dir, algo string) (map[string]string, error) {
+	if _, err := newHash(algo); err != nil {
+		return nil, err
+	}
+
+	tree := make(map[string]string)
+	fpath := fs.Filepath()
+	err := s.walk(fs, dir, func(path string, isRegular bool) error {
+		if !isRegular {
+			return nil
+		}
+		rel, err := fpath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		sum, err := s.hashFile(fs, path, algo)
+		if err != nil {
+			return err
+		}
+		tree[fpath.ToSlash(rel)] = sum
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+func (s *SSH) walk(fs Fs, path string, fn func(path string, isRegular bool) error) error {
+	info, err := fs.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fn(path, info.Mode().IsRegular())
+	}
+
+	items, err := s.readdir(fs, path, -1)
+	if err != nil {
+		return err
+	}
+	fpath := fs.Filepath()
+	for _, item := range items {
+		name := fpath.Join(path, item.Name())
+		if item.IsDir() {
+			err = s.walk(fs, name, fn)
+		} else {
+			err = fn(name, item.Mode().IsRegular())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SSH) hashFile(fs Fs, path, algo string) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	fd, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	_, err = io.CopyBuffer(h, fd, make([]byte, 32*1024))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// execHashTree return nil map and nil error if the tree can't be hashed remotely.
+func (s *SSH) execHashTree(dir, algo string) (map[string]string, error) {
+	if algo == "" {
+		algo = HashSHA256
+	}
+	if _, err := newHash(algo); err != nil {
+		return nil, err
+	}
+	if s.conn == nil || !s.rfs.Filepath().IsAbs("/") || s.checkExec("HashTree") != nil {
+		return nil, nil
+	}
+
+	sess, session, err := s.openSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		sess.Close()
+		session.Release()
+	}()
+
+	cmd := fmt.Sprintf("cd %s && find . -type f -exec %ssum {} +", shellQuote(dir), algo)
+	out, err := sess.Output(cmd)
+	if err != nil {
+		return nil, nil
+	}
+	return parseHashSums(out)
+}
+
+// parseHashSums parse the output of *sum tools, it returns nil map if some file names
+// are escaped by the tools.
+func parseHashSums(out []byte) (map[string]string, error) {
+	tree := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if line[0] == '\\' {
+			return nil, nil
+		}
+		index := strings.Index(line, "  ")
+		if index < 0 {
+			return nil, fmt.Errorf("invalid hash sum line: %s", line)
+		}
+		tree[strings.TrimPrefix(line[index+2:], "./")] = line[:index]
+	}
+	return tree, scanner.Err()
+}
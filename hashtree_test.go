@@ -0,0 +1,111 @@
+package socker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseHashSums(t *testing.T) {
+	out := []byte("d41d8cd98f00b204e9800998ecf8427e  ./a\n60b725f10c9c85c70d97880dfe8191b3  ./dir/b c\n")
+	tree, err := parseHashSums(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 2 || tree["a"] != "d41d8cd98f00b204e9800998ecf8427e" || tree["dir/b c"] != "60b725f10c9c85c70d97880dfe8191b3" {
+		t.Fatal("parse hash sums failed:", tree)
+	}
+
+	tree, err = parseHashSums([]byte("\\d41d8cd98f00b204e9800998ecf8427e  ./a\\nb\n"))
+	if err != nil || tree != nil {
+		t.Fatal("escaped file names should be rejected")
+	}
+}
+
+func TestLhashTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "b"), []byte("a\n"), 0644)
+
+	local := LocalOnly()
+	tree := local.LhashTree(dir, HashMD5)
+	if err := local.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 2 || tree["a"] != "d41d8cd98f00b204e9800998ecf8427e" || tree["sub/b"] != "60b725f10c9c85c70d97880dfe8191b3" {
+		t.Fatal("hash tree failed:", tree)
+	}
+}
+
+func TestHashTreeSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a"), []byte("a\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("b\n"), 0644)
+
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	tree := agent.HashTree(src, HashSHA256)
+	if err = agent.Error(); err != nil {
+		t.Fatal(err)
+	}
+	local := agent.LhashTree(src, HashSHA256)
+	if len(tree) != 2 || tree["a"] != local["a"] || tree["sub/b"] != local["sub/b"] {
+		t.Fatalf("remote hash tree mismatch: %v %v", tree, local)
+	}
+	if file := agent.HashTree(filepath.Join(src, "a"), HashSHA256); file["."] != tree["a"] {
+		t.Fatalf("unexpected hash of single file: %v", file)
+	}
+
+	agent.SyncHash(HashSHA256)
+	agent.Put(src, dst)
+	if err = agent.Error(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(filepath.Join(dst, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(src, "sub", "b"), []byte("changed\n"), 0644)
+	agent.Put(src, dst)
+	if err = agent.Error(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(filepath.Join(dst, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("unchanged file shouldn't be copied")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dst, "sub", "b")); string(data) != "changed\n" {
+		t.Errorf("changed file isn't copied: %q", data)
+	}
+
+	back := filepath.Join(dir, "back")
+	agent.Get(dst, back)
+	if err = agent.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if tree = agent.LhashTree(back, HashSHA256); tree["a"] != local["a"] || len(tree) != 2 {
+		t.Errorf("unexpected tree after get: %v", tree)
+	}
+}
@@ -1,9 +1,14 @@
 package socker
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,14 +19,41 @@ import (
 var (
 	ErrMuxClosed    = errors.New("mux has been closed")
 	ErrNoAuthMethod = errors.New("no auth method can be applied to agent")
+	ErrTooManyConns = errors.New("too many open connections")
+	ErrGateLoop     = errors.New("gate chain contains loop")
 )
 
+// GateDirect is the gate value which means connecting directly.
+const GateDirect = "none"
+
+// MuxOptions are the fleet-wide defaults of MuxAuth and each Auth instance, they
+// are used if the fields of MuxAuth and Auth aren't set.
+type MuxOptions struct {
+	// TimeoutMs and MaxSession are the defaults of Auth.TimeoutMs and Auth.MaxSession.
+	TimeoutMs  int
+	MaxSession int
+	// Retry is the default of MuxAuth.Retry, it's used if MuxAuth.Retry.Attempts
+	// is 0.
+	Retry RetryPolicy
+	// KeepAliveSeconds and PingSeconds are the defaults of MuxAuth.KeepAliveSeconds
+	// and MuxAuth.PingSeconds.
+	KeepAliveSeconds int
+	PingSeconds      int
+}
+
 // MuxAuth holds auth and gate configs
 type MuxAuth struct {
 	// AuthMethods holds all auth methods to destination host. The key can be any
 	// string.
 	AuthMethods map[string]*Auth
 
+	// GateAgents are the auth methods of gate addresses like "bastion:22", they are
+	// consulted before AgentAuths and DefaultAuth, so credentials of gates don't
+	// need to be in the rules of destination hosts. Since the connection to an
+	// address is shared, the address is always authenticated by it even if it's
+	// dialed as destination host.
+	GateAgents map[string]*Auth
+
 	// DefaultAuth is the default auth method, it must be a key in AuthMethods field,
 	// only used if no auth method is matched for destination, can be empty.
 	DefaultAuth string
@@ -32,10 +64,169 @@ type MuxAuth struct {
 	// AgentGates define the rule which gate is used to connect to destination host.
 	// The key is the format of "matcher:matchor", the value must be an valid "host:port"
 	// like string.
+	//
+	// A gate is dialed by Mux.Dial too, so it can have it's own gate. The value can
+	// also be a comma-separated chain like "bastion:22,jump:22", hops are dialed in
+	// order and the last one is the gate of destination host. The first hop of a chain
+	// is always connected directly.
+	//
+	// Redundant gates are separated by "|" like "bastion-a:22|bastion-b:22", if dialing
+	// through one of them failed, the next is tried. GateDirect means connecting
+	// directly, it's useful to stop matching of ordered rules.
+	//
+	// A proxy url like "http://proxy:3128" or "socks5://proxy:1080" makes the tcp
+	// connection established through the proxy, it can only be the first hop of a
+	// chain.
 	AgentGates map[string]string
 
+	// AgentAuthRules and AgentGateRules are the ordered form of AgentAuths and AgentGates,
+	// they are always checked before the map forms and the first matched rule wins
+	// regardless of the rule priority.
+	AgentAuthRules []MatchEntry
+	AgentGateRules []MatchEntry
+	// MostSpecific make the most specific pattern win if several patterns of the
+	// same priority matched, e.g. "ipnet:10.1.0.0/16" wins "ipnet:10.0.0.0/8".
+	// Otherwise they are ordered by the pattern string.
+	MostSpecific bool
+
 	// KeepAliveSeconds limit the lifetime of idle ssh connection, default is 300.
 	KeepAliveSeconds int
+	// AgentKeepAlives define the KeepAliveSeconds of matched destination hosts, e.g.
+	// keep gates longer since they are expensive to reconnect. The key is the format
+	// of "matcher:matchor". It can't be changed by Mux.Reload.
+	AgentKeepAlives map[string]int
+
+	// PingSeconds is the interval keepalive@openssh.com requests are sent on cached
+	// connections, connections which don't respond in PingTimeoutSeconds are closed
+	// and removed from cache. 0 means disabled. It can't be changed by Mux.Reload.
+	PingSeconds        int
+	PingTimeoutSeconds int
+	// PingSession make ping open a trivial session instead of sending global request,
+	// which also detects connections can't open new channels.
+	PingSession bool
+	// PingRedial make connections evicted by ping redialed in background, so next
+	// Dial gets a fresh connection without waiting for the handshake.
+	PingRedial bool
+
+	// MaxConnBytes recycle connections after the bytes transferred exceeds it, 0 means
+	// unlimited. Recycled connections are removed from cache so new Dial creates
+	// new connections, they are closed after all references are released.
+	MaxConnBytes int64
+
+	// KeepWarm decide which connections are kept warm instead of closed after idle
+	// for KeepAliveSeconds, nil means none. WarmAddrs are dialed proactively while
+	// the schedule reports they should be kept warm. They can't be changed by
+	// Mux.Reload.
+	KeepWarm  Schedule `json:"-"`
+	WarmAddrs []string
+
+	// Hooks are callbacks invoked on connection lifecycle events, they can't be
+	// changed by Mux.Reload.
+	Hooks MuxHooks `json:"-"`
+	// LeaseLeakSeconds make MuxHooks.OnLeaseLeak called for leases held longer than
+	// it, 0 means disabled. It can't be changed by Mux.Reload.
+	LeaseLeakSeconds int
+	// PanicHandler is called with the panics recovered in background goroutines of
+	// Mux, DefaultPanicHandler is used if it's nil. It can't be changed by Mux.Reload.
+	PanicHandler PanicHandler `json:"-"`
+
+	// ProcessTag tag remote processes started by dialed connections, see
+	// SSH.TagProcesses and Mux.CleanupOrphans. It can't be changed by Mux.Reload.
+	ProcessTag string
+
+	// DryRun make connections dialed by Mux write remote command lines to it instead
+	// of running them, see SSH.DryRun. It can't be changed by Mux.Reload.
+	DryRun io.Writer `json:"-"`
+
+	// Retry define how failed dials are retried, the default is no retry.
+	Retry RetryPolicy
+	// Breaker make dials to hosts which failed repeatedly fail fast for a while,
+	// the default is disabled.
+	Breaker BreakerPolicy
+
+	// Transports create the connections to addresses which have no gate, such as
+	// connecting through access proxies, see TeleportTransport. The first matched
+	// rule wins and unmatched addresses are dialed directly. They can't be changed
+	// by Mux.Reload and aren't closed by Mux.
+	Transports []TransportRule `json:"-"`
+
+	// Faults inject failures for resilience testing, it should be nil in production.
+	// It can't be changed by Mux.Reload.
+	Faults FaultInjector `json:"-"`
+
+	// MaxConns limit the count of open ssh connections including gates, 0 means
+	// unlimited. Dial beyond the limit will close the least recently used connection
+	// which isn't referenced, if there is no such connection, it will wait until
+	// some connections are closed or the context is done. It can't be changed by
+	// Mux.Reload.
+	MaxConns int
+	// MaxConnsFailFast make Dial beyond the limit fail with ErrTooManyConns immediately
+	// instead of waiting.
+	MaxConnsFailFast bool
+	// ConnsPerHost is the max count of connections to each host, 0 or 1 means single.
+	// Sessions such as commands are spread across the connections, while sftp and
+	// port forwardings use the first one. Extra connections are dialed in background
+	// once all connections have active sessions, they are limited by MaxConns but
+	// never wait. It can't be changed by Mux.Reload.
+	ConnsPerHost int
+
+	// DialRate limit the rate of new connections to each destination host, and
+	// GateDialRate limit the rate of new connections through each gate, so a burst
+	// of dials doesn't trip MaxStartups or fail2ban of the bastion. Retries are
+	// limited too. They can't be changed by Mux.Reload.
+	DialRate     RateLimit
+	GateDialRate RateLimit
+
+	// LocalAddr is the default local address for each Auth instance which hasn't
+	// set it's own, see Auth.LocalAddr.
+	LocalAddr string
+	// Proxy is the default proxy url for each Auth instance which hasn't set it's
+	// own, see Auth.Proxy.
+	Proxy string
+	// Defaults are the fleet-wide defaults of dials, such as timeouts.
+	Defaults MuxOptions
+	// TransportDialer is the default dialer of raw tcp connections for each Auth
+	// instance which hasn't set it's own, see Auth.Dialer. It can't be changed by
+	// Mux.Reload.
+	TransportDialer func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
+
+	// TunnelPresets define named tunnels which can be opened by Mux.OpenPreset.
+	TunnelPresets map[string]TunnelPreset
+
+	// HostNames map the host of dialed address to the real host name like the HostName
+	// option of OpenSSH, the dialed address is still used for matching and caching.
+	// If the value has port, it replaces the dialed port.
+	HostNames map[string]string
+
+	// DefaultPort is appended to addresses without port, default is DefaultSSHPort.
+	// Addresses are normalized by NormalizeAddr before matching and caching, so do
+	// the gates and the addresses of GateAgents and HostLabels. Plain patterns match
+	// hosts case-insensitively. It can't be changed by Mux.Reload.
+	DefaultPort int
+
+	// HostLabels attach labels like "env": "prod" to addresses, the addresses matching
+	// a label selector are returned by Mux.Select.
+	HostLabels map[string]map[string]string
+	// HostVars attach custom variables to addresses for command templates, see
+	// Mux.Render.
+	HostVars map[string]map[string]string
+
+	// Groups define named groups of replicas dialed by Mux.DialGroup.
+	Groups map[string]AddrGroup
+}
+
+// auths return all the Auth instances in AuthMethods and GateAgents.
+func (a *MuxAuth) auths() []*Auth {
+	auths := make([]*Auth, 0, len(a.AuthMethods)+len(a.GateAgents))
+	for _, auth := range a.AuthMethods {
+		auths = append(auths, auth)
+	}
+	for _, auth := range a.GateAgents {
+		if auth != nil {
+			auths = append(auths, auth)
+		}
+	}
+	return auths
 }
 
 // ApplyDefaultHostCheck apply the checking function or ssh.InsecureIgnoreHostKey to each Auth instance.
@@ -43,13 +234,119 @@ func (a *MuxAuth) ApplyDefaultHostCheck(check ssh.HostKeyCallback) {
 	if check == nil {
 		check = ssh.InsecureIgnoreHostKey()
 	}
-	for _, auth := range a.AuthMethods {
+	for _, auth := range a.auths() {
 		if auth.HostKeyCheck == nil {
 			auth.HostKeyCheck = check
 		}
 	}
 }
 
+// ApplyDefaultLocalAddr apply the local address to each Auth instance which hasn't set it.
+func (a *MuxAuth) ApplyDefaultLocalAddr(addr string) {
+	if addr == "" {
+		return
+	}
+	for _, auth := range a.auths() {
+		if auth.LocalAddr == "" {
+			auth.LocalAddr = addr
+		}
+	}
+}
+
+// ApplyDefaultProxy apply the proxy url to each Auth instance which hasn't set it.
+func (a *MuxAuth) ApplyDefaultProxy(proxy string) {
+	if proxy == "" {
+		return
+	}
+	for _, auth := range a.auths() {
+		if auth.Proxy == "" {
+			auth.Proxy = proxy
+		}
+	}
+}
+
+// ApplyDefaultDialer apply the dialer to each Auth instance which hasn't set it.
+func (a *MuxAuth) ApplyDefaultDialer(dialer func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	if dialer == nil {
+		return
+	}
+	for _, auth := range a.auths() {
+		if auth.Dialer == nil {
+			auth.Dialer = dialer
+		}
+	}
+}
+
+// ApplyDefaultTimeout apply the timeout to each Auth instance which hasn't set it.
+func (a *MuxAuth) ApplyDefaultTimeout(ms int) {
+	if ms <= 0 {
+		return
+	}
+	for _, auth := range a.auths() {
+		if auth.TimeoutMs <= 0 {
+			auth.TimeoutMs = ms
+		}
+	}
+}
+
+// ApplyDefaultMaxSession apply the session limit to each Auth instance which hasn't
+// set it.
+func (a *MuxAuth) ApplyDefaultMaxSession(n int) {
+	if n <= 0 {
+		return
+	}
+	for _, auth := range a.auths() {
+		if auth.MaxSession <= 0 {
+			auth.MaxSession = n
+		}
+	}
+}
+
+func (a *MuxAuth) keepAliveSeconds() int {
+	const defaultKeepAliveSeconds = 300
+	if a.KeepAliveSeconds > 0 {
+		return a.KeepAliveSeconds
+	}
+	if a.Defaults.KeepAliveSeconds > 0 {
+		return a.Defaults.KeepAliveSeconds
+	}
+	return defaultKeepAliveSeconds
+}
+
+func (a *MuxAuth) pingSeconds() int {
+	if a.PingSeconds > 0 {
+		return a.PingSeconds
+	}
+	return a.Defaults.PingSeconds
+}
+
+func (a *MuxAuth) retryPolicy() RetryPolicy {
+	if a.Retry.Attempts == 0 {
+		return a.Defaults.Retry
+	}
+	return a.Retry
+}
+
+func (a *MuxAuth) keepAliveRules() map[string]string {
+	rules := make(map[string]string, len(a.AgentKeepAlives))
+	for pattern, seconds := range a.AgentKeepAlives {
+		rules[pattern] = strconv.Itoa(seconds)
+	}
+	return rules
+}
+
+// keepAliveInterval return the shortest keepalive duration, idle connections are
+// checked at this interval.
+func (a *MuxAuth) keepAliveInterval() time.Duration {
+	seconds := a.keepAliveSeconds()
+	for _, s := range a.AgentKeepAlives {
+		if s > 0 && s < seconds {
+			seconds = s
+		}
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func (a *MuxAuth) checkAuth(id string, auth *Auth) error {
 	_, err := auth.SSHConfig()
 	if err != nil {
@@ -69,6 +366,15 @@ func (a *MuxAuth) Validate() error {
 		}
 	}
 
+	for addr, auth := range a.GateAgents {
+		if auth == nil {
+			return fmt.Errorf("auth method of gate %s is nil", addr)
+		}
+		if _, err := auth.SSHConfig(); err != nil {
+			return fmt.Errorf("auth method of gate %s is invalid: %s", addr, err.Error())
+		}
+	}
+
 	if a.DefaultAuth != "" && a.AuthMethods[a.DefaultAuth] == nil {
 		return errors.New("default auth method is not exist")
 	}
@@ -77,13 +383,118 @@ func (a *MuxAuth) Validate() error {
 			return fmt.Errorf("agent auth method %s is not exist", id)
 		}
 	}
+	for _, rule := range a.AgentAuthRules {
+		if a.AuthMethods[rule.Value] == nil {
+			return fmt.Errorf("agent auth method %s is not exist", rule.Value)
+		}
+	}
+	for _, gate := range a.AgentGates {
+		if _, err := parseGates(gate); err != nil {
+			return err
+		}
+	}
+	for _, rule := range a.AgentGateRules {
+		if _, err := parseGates(rule.Value); err != nil {
+			return err
+		}
+	}
+	for _, retry := range []RetryPolicy{a.Retry, a.Defaults.Retry} {
+		if retry.Attempts < 0 || retry.Jitter < 0 || retry.Jitter > 1 {
+			return errors.New("invalid retry policy")
+		}
+	}
+	if a.Breaker.Failures < 0 || a.Breaker.CooldownMs < 0 {
+		return errors.New("invalid breaker policy")
+	}
+	if err := a.DialRate.validate(); err != nil {
+		return err
+	}
+	if err := a.GateDialRate.validate(); err != nil {
+		return err
+	}
+	for addr, labels := range a.HostLabels {
+		for key := range labels {
+			if key == "" || strings.ContainsAny(key, "=!&|") {
+				return fmt.Errorf("invalid label key %q of %s", key, addr)
+			}
+		}
+	}
+	for pattern, seconds := range a.AgentKeepAlives {
+		if seconds <= 0 {
+			return fmt.Errorf("keepalive seconds of %s must be positive", pattern)
+		}
+	}
+	for name, g := range a.Groups {
+		if err := g.validate(name); err != nil {
+			return err
+		}
+	}
+	for name, preset := range a.TunnelPresets {
+		if preset.Via == "" || preset.Remote == "" {
+			return fmt.Errorf("tunnel preset %s is invalid: via and remote address are required", name)
+		}
+	}
 	return nil
 }
 
+// MatchEntry is a "matcher:matchor" pattern and the value applied to matched address.
+type MatchEntry struct {
+	Pattern string
+	Value   string
+}
+
 type priorityMatcher struct {
-	Priority int
+	// Order is the 1-based position of ordered rules, 0 means unordered.
+	Order       int
+	Priority    int
+	Specificity int
 	Matcher
-	Value string
+	Pattern string
+	Value   string
+	Auth    *Auth
+}
+
+func newPriorityMatcher(pattern, value string, order int, mostSpecific bool) (priorityMatcher, error) {
+	rule, addr := SplitRuleAndAddr(pattern)
+	matcher, priority, err := createMatcher(rule, addr)
+	if err != nil {
+		return priorityMatcher{}, err
+	}
+	m := priorityMatcher{
+		Order:    order,
+		Priority: priority,
+		Matcher:  matcher,
+		Pattern:  pattern,
+		Value:    value,
+	}
+	if mostSpecific {
+		m.Specificity = ruleSpecificity(rule, addr)
+	}
+	return m, nil
+}
+
+func buildMatchers(entries map[string]string, rules []MatchEntry, mostSpecific bool) ([]priorityMatcher, error) {
+	matchers := make([]priorityMatcher, 0, len(entries)+len(rules))
+	for i, rule := range rules {
+		if rule.Pattern != "" && rule.Value != "" {
+			m, err := newPriorityMatcher(rule.Pattern, rule.Value, i+1, mostSpecific)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, m)
+		}
+	}
+	for pattern, value := range entries {
+		if pattern != "" && value != "" {
+			m, err := newPriorityMatcher(pattern, value, 0, mostSpecific)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, m)
+		}
+	}
+	sort.Sort(byPriority(matchers))
+	return matchers, nil
 }
 
 type byPriority []priorityMatcher
@@ -93,7 +504,20 @@ func (b byPriority) Len() int {
 }
 
 func (b byPriority) Less(i, j int) bool {
-	return b[i].Priority > b[j].Priority
+	x, y := &b[i], &b[j]
+	if (x.Order > 0) != (y.Order > 0) {
+		return x.Order > 0
+	}
+	if x.Order != y.Order {
+		return x.Order < y.Order
+	}
+	if x.Priority != y.Priority {
+		return x.Priority > y.Priority
+	}
+	if x.Specificity != y.Specificity {
+		return x.Specificity > y.Specificity
+	}
+	return x.Pattern < y.Pattern
 }
 
 func (b byPriority) Swap(i, j int) {
@@ -101,120 +525,454 @@ func (b byPriority) Swap(i, j int) {
 }
 
 type Mux struct {
-	closed int32
+	closed   int32
+	draining int32
 
+	mu            sync.RWMutex
+	auth          MuxAuth
+	fingerprint   string
+	localAddr     string
+	hostNames     map[string]string
+	labels        map[string]map[string]string
+	vars          map[string]map[string]string
+	groups        map[string]addrGroup
+	mostSpecific  bool
 	authMethods   map[string]*Auth
+	gateAuths     map[string]*Auth
 	defaultAuthID string
 	agents        []priorityMatcher
 	gates         []priorityMatcher
+	retry         RetryPolicy
+	breaker       BreakerPolicy
+
+	sshsMu  sync.RWMutex
+	sshs    map[string]*SSH
+	retired []*SSH
+
+	inflightMu sync.Mutex
+	inflight   map[string]*dialCall
 
-	sshsMu sync.RWMutex
-	sshs   map[string]*SSH
+	breakersMu sync.Mutex
+	breakers   map[string]*breaker
+
+	presets     map[string]TunnelPreset
+	tunnelsMu   sync.Mutex
+	tunnels     map[string]*Tunnel
+	presetCalls map[string]*dialCall
 
 	aliveChan chan struct{}
+	aliveConf chan struct{}
+	done      chan struct{}
+
+	aliveMu       sync.Mutex
+	aliveIdle     time.Duration
+	aliveInterval time.Duration
+
+	connSlots    chan struct{}
+	connFailFast bool
+	dialRate     *rateLimiter
+	gateDialRate *rateLimiter
+	dialer       dialFunc
+	defaultPort  int
+	leaseLeak    time.Duration
+	connsPerHost int
+	panicHandler PanicHandler
+	maxConnBytes int64
+	faults       FaultInjector
+	transports   []transportMatcher
+	hooks        MuxHooks
+	schedule     Schedule
+	pingSession  bool
+	pingRedial   bool
+	procTag      string
+	middlewares  []Middleware
+	idleRules    []priorityMatcher
+	dryRun       io.Writer
+
+	counters muxCounters
+	// maxOutput is applied to dialed instances, see Mux.SetMaxOutputBytes.
+	maxOutput int64
 }
 
 func NewMux(auth MuxAuth) (*Mux, error) {
+	var m Mux
+	m.dialer = auth.TransportDialer
+	m.defaultPort = auth.DefaultPort
+	err := m.load(auth)
+	if err != nil {
+		return nil, err
+	}
+	m.transports, err = buildTransports(auth.Transports)
+	if err != nil {
+		return nil, err
+	}
+
+	m.sshs = make(map[string]*SSH)
+	m.inflight = make(map[string]*dialCall)
+	m.tunnels = make(map[string]*Tunnel)
+	m.presetCalls = make(map[string]*dialCall)
+	if auth.MaxConns > 0 {
+		m.connSlots = make(chan struct{}, auth.MaxConns)
+		m.connFailFast = auth.MaxConnsFailFast
+	}
+
+	m.dialRate = newRateLimiter(auth.DialRate)
+	m.gateDialRate = newRateLimiter(auth.GateDialRate)
+	m.maxConnBytes = auth.MaxConnBytes
+	m.faults = auth.Faults
+	m.hooks = auth.Hooks
+	m.leaseLeak = time.Duration(auth.LeaseLeakSeconds) * time.Second
+	m.connsPerHost = auth.ConnsPerHost
+	m.panicHandler = auth.PanicHandler
+	m.schedule = auth.KeepWarm
+	m.procTag = auth.ProcessTag
+	m.dryRun = auth.DryRun
+	m.done = make(chan struct{})
+	m.idleRules, err = buildMatchers(auth.keepAliveRules(), nil, auth.MostSpecific)
+	if err != nil {
+		return nil, err
+	}
+	m.keepAlive(time.Duration(auth.keepAliveSeconds())*time.Second, auth.keepAliveInterval())
+	if m.schedule != nil && len(auth.WarmAddrs) > 0 {
+		m.warm(append([]string(nil), auth.WarmAddrs...))
+	}
+	if pingSeconds := auth.pingSeconds(); pingSeconds > 0 {
+		const defaultPingTimeoutSeconds = 15
+		if auth.PingTimeoutSeconds <= 0 {
+			auth.PingTimeoutSeconds = defaultPingTimeoutSeconds
+		}
+		m.pingSession = auth.PingSession
+		m.pingRedial = auth.PingRedial
+		m.ping(time.Duration(pingSeconds)*time.Second, time.Duration(auth.PingTimeoutSeconds)*time.Second)
+	}
+	return &m, nil
+}
+
+// load build the auth and gate tables and swap them atomically.
+func (m *Mux) load(auth MuxAuth) error {
 	auth.ApplyDefaultHostCheck(nil)
+	auth.ApplyDefaultLocalAddr(auth.LocalAddr)
+	auth.ApplyDefaultProxy(auth.Proxy)
+	auth.ApplyDefaultDialer(m.dialer)
+	auth.ApplyDefaultTimeout(auth.Defaults.TimeoutMs)
+	auth.ApplyDefaultMaxSession(auth.Defaults.MaxSession)
 
 	err := auth.Validate()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	var m Mux
+	fingerprint := auth.Fingerprint()
 
-	m.authMethods = make(map[string]*Auth)
+	authMethods := make(map[string]*Auth)
 	for id, auth := range auth.AuthMethods {
 		if id != "" && auth != nil {
-			m.authMethods[id] = auth
+			authMethods[id] = auth
 		}
 	}
 
-	m.gates = make([]priorityMatcher, 0, len(auth.AgentGates))
-	for addr, gate := range auth.AgentGates {
-		if addr != "" && gate != "" {
-			matcher, priority, err := createMatcher(SplitRuleAndAddr(addr))
-			if err != nil {
-				return nil, err
-			}
-			m.gates = append(m.gates, priorityMatcher{
-				Matcher:  matcher,
-				Priority: priority,
-				Value:    gate,
-			})
-		}
+	gates, err := buildMatchers(auth.AgentGates, auth.AgentGateRules, auth.MostSpecific)
+	if err != nil {
+		return err
+	}
+	agents, err := buildMatchers(auth.AgentAuths, auth.AgentAuthRules, auth.MostSpecific)
+	if err != nil {
+		return err
+	}
+	for i := range agents {
+		agents[i].Auth = authMethods[agents[i].Value]
 	}
-	sort.Sort(byPriority(m.gates))
 
-	m.defaultAuthID = auth.DefaultAuth
-	m.agents = make([]priorityMatcher, 0, len(auth.AgentAuths))
-	for addr, authID := range auth.AgentAuths {
-		if addr != "" && authID != "" {
-			matcher, priority, err := createMatcher(SplitRuleAndAddr(addr))
-			if err != nil {
-				return nil, err
-			}
+	gateAuths := make(map[string]*Auth)
+	for addr, auth := range auth.GateAgents {
+		gateAuths[m.normalize(addr)] = auth
+	}
 
-			m.agents = append(m.agents, priorityMatcher{
-				Matcher:  matcher,
-				Priority: priority,
-				Value:    authID,
-			})
-		}
+	hostNames := make(map[string]string)
+	for host, name := range auth.HostNames {
+		hostNames[strings.ToLower(host)] = name
 	}
-	sort.Sort(byPriority(m.agents))
 
-	m.sshs = make(map[string]*SSH)
+	presets := make(map[string]TunnelPreset)
+	for name, preset := range auth.TunnelPresets {
+		presets[name] = preset
+	}
 
-	const defaultKeepAliveSeconds = 300
-	if auth.KeepAliveSeconds <= 0 {
-		auth.KeepAliveSeconds = defaultKeepAliveSeconds
+	m.mu.Lock()
+	m.auth = auth
+	m.fingerprint = fingerprint
+	m.authMethods = authMethods
+	m.gateAuths = gateAuths
+	m.gates = gates
+	m.localAddr = auth.LocalAddr
+	m.hostNames = hostNames
+	m.labels = copyLabels(auth.HostLabels, m.normalize)
+	m.vars = copyLabels(auth.HostVars, m.normalize)
+	m.groups = buildGroups(auth.Groups, m.normalize)
+	m.mostSpecific = auth.MostSpecific
+	m.defaultAuthID = auth.DefaultAuth
+	m.agents = agents
+	m.retry = auth.retryPolicy()
+	m.breaker = auth.Breaker
+	m.mu.Unlock()
+
+	m.tunnelsMu.Lock()
+	m.presets = presets
+	m.tunnelsMu.Unlock()
+	return nil
+}
+
+// Reload replace the auth and gate configs atomically, cached connections and opened
+// tunnels are kept alive, the new configs are only applied to new connections.
+// Agents added by AddAgent are discarded. If the configs is invalid, the previous
+// configs are kept. The configs are always applied even if the fingerprint is
+// unchanged, since functions such as Auth.HostKeyCheck aren't fingerprinted.
+func (m *Mux) Reload(auth MuxAuth) error {
+	if m.isClosed() {
+		return ErrMuxClosed
 	}
-	m.keepAlive(time.Duration(auth.KeepAliveSeconds) * defaultKeepAliveSeconds)
-	return &m, nil
+	return m.load(auth)
 }
 
-func (m *Mux) match(matchers []priorityMatcher, addr string) string {
-	var val string
+// Fingerprint return the fingerprint of configs the Mux is created or reloaded with.
+func (m *Mux) Fingerprint() string {
+	m.mu.RLock()
+	fingerprint := m.fingerprint
+	m.mu.RUnlock()
+	return fingerprint
+}
+
+func (m *Mux) match(matchers []priorityMatcher, addr string) *priorityMatcher {
 	for i := range matchers {
 		if matchers[i].Matcher(addr) {
-			val = matchers[i].Value
-			break
+			return &matchers[i]
 		}
 	}
-	return val
+	return nil
 }
 
 func (m *Mux) AgentGate(addr string) string {
-	gate := m.match(m.gates, addr)
-	return gate
+	addr = m.normalize(addr)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if matched := m.match(m.gates, addr); matched != nil {
+		return matched.Value
+	}
+	return ""
 }
 
-func (m *Mux) AgentAuth(addr string) (*Auth, error) {
-	authID := m.match(m.agents, addr)
-	if authID == "" {
-		authID = m.defaultAuthID
+// resolveHost return the real address to connect by MuxAuth.HostNames.
+func (m *Mux) resolveHost(addr string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.hostNames) == 0 {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	name, has := m.hostNames[host]
+	if !has {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(name); err == nil || port == "" {
+		return name
+	}
+	return net.JoinHostPort(name, port)
+}
+
+// parseGates split the gate value into alternative chains, alternatives are separated
+// by "|" and hops of each chain are separated by ",".
+func parseGates(gate string) ([][]string, error) {
+	if gate == "" || gate == GateDirect {
+		return nil, nil
+	}
+	alts := strings.Split(gate, "|")
+	chains := make([][]string, 0, len(alts))
+	for _, alt := range alts {
+		hops := strings.Split(alt, ",")
+		for i := range hops {
+			hops[i] = strings.TrimSpace(hops[i])
+			if hops[i] == "" {
+				return nil, fmt.Errorf("invalid gate chain: %s", gate)
+			}
+			if isProxyGate(hops[i]) {
+				if i > 0 {
+					return nil, fmt.Errorf("proxy gate must be the first hop: %s", gate)
+				}
+				if _, err := parseProxyURL(hops[i]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		chains = append(chains, hops)
 	}
+	return chains, nil
+}
 
-	if authID != "" {
-		return m.authMethods[authID], nil
+// GateChain return the hops used to connect to destination host, the last one is
+// the direct gate of it. Hops of nested gates are included too. If there are
+// alternative gates, the first ones are used. Passwords of proxy urls are redacted.
+func (m *Mux) GateChain(addr string) ([]string, error) {
+	addr = m.normalize(addr)
+	var chain []string
+	visited := []string{addr}
+	for {
+		chains, err := parseGates(m.AgentGate(addr))
+		chains = m.normalizeHops(chains)
+		if err != nil || len(chains) == 0 {
+			return chain, err
+		}
+		hops := chains[0]
+		for _, hop := range hops {
+			if stringsContain(visited, hop) {
+				return nil, ErrGateLoop
+			}
+			visited = append(visited, hop)
+		}
+		chain = append(hops, chain...)
+		if len(hops) > 1 || isProxyGate(hops[0]) {
+			for i, hop := range chain {
+				chain[i] = redactProxy(hop)
+			}
+			return chain, nil
+		}
+		addr = hops[0]
+	}
+}
+
+// gateChains return the alternative gate chains of the address, chains whose direct
+// gate is connected are moved to front, so dead gates won't be tried first each time.
+func (m *Mux) gateChains(addr string) ([][]string, error) {
+	chains, err := parseGates(m.AgentGate(addr))
+	chains = m.normalizeHops(chains)
+	if err != nil || len(chains) <= 1 {
+		return chains, err
+	}
+	m.sshsMu.RLock()
+	sort.SliceStable(chains, func(i, j int) bool {
+		_, ci := m.sshs[chains[i][len(chains[i])-1]]
+		_, cj := m.sshs[chains[j][len(chains[j])-1]]
+		return ci && !cj
+	})
+	m.sshsMu.RUnlock()
+	return chains, nil
+}
+
+func stringsContain(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mux) AgentAuth(addr string) (*Auth, error) {
+	auth := m.agentAuth(m.normalize(addr))
+	if auth != nil {
+		return auth, nil
 	}
 	return nil, ErrNoAuthMethod
 }
 
-func (m *Mux) keepAlive(idle time.Duration) {
+func (m *Mux) agentAuth(addr string) *Auth {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if gateAuth, has := m.gateAuths[addr]; has {
+		return gateAuth
+	}
+	if matched := m.match(m.agents, addr); matched != nil {
+		return matched.Auth
+	}
+	if m.defaultAuthID != "" {
+		return m.authMethods[m.defaultAuthID]
+	}
+	return nil
+}
+
+// AddAgent register the auth method for destination hosts matched by the pattern,
+// which is the format of "matcher:matchor" like the keys of MuxAuth.AgentAuths.
+// Previous auth method registered with the same pattern will be replaced. Cached
+// connections are not affected. The auth method is copied, so it isn't modified and
+// changes after added aren't applied. Host keys aren't checked if Auth.HostKeyCheck
+// is nil.
+func (m *Mux) AddAgent(pattern string, auth *Auth) error {
+	if auth == nil {
+		return errors.New("auth method is nil")
+	}
+	copied := *auth
+	copied.config, copied.keys = nil, authKeys{}
+	auth = &copied
+	if auth.HostKeyCheck == nil {
+		auth.HostKeyCheck = ssh.InsecureIgnoreHostKey()
+	}
+	if auth.LocalAddr == "" {
+		m.mu.RLock()
+		auth.LocalAddr = m.localAddr
+		m.mu.RUnlock()
+	}
+	_, err := auth.SSHConfig()
+	if err != nil {
+		return fmt.Errorf("auth method for %s is invalid: %s", pattern, err.Error())
+	}
+	m.mu.RLock()
+	matcher, err := newPriorityMatcher(pattern, "", 0, m.mostSpecific)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	matcher.Auth = auth
+
+	m.mu.Lock()
+	agents := m.removeAgent(pattern)
+	agents = append(agents, matcher)
+	sort.Sort(byPriority(agents))
+	m.agents = agents
+	m.mu.Unlock()
+	return nil
+}
+
+// RemoveAgent remove the auth method registered with the pattern, either by
+// MuxAuth.AgentAuths or AddAgent, it reports whether the pattern exists.
+func (m *Mux) RemoveAgent(pattern string) bool {
+	m.mu.Lock()
+	agents := m.removeAgent(pattern)
+	removed := len(agents) != len(m.agents)
+	m.agents = agents
+	m.mu.Unlock()
+	return removed
+}
+
+// removeAgent return a copy of agents without the pattern.
+func (m *Mux) removeAgent(pattern string) []priorityMatcher {
+	rule, addr := SplitRuleAndAddr(pattern)
+	agents := make([]priorityMatcher, 0, len(m.agents)+1)
+	for _, agent := range m.agents {
+		r, a := SplitRuleAndAddr(agent.Pattern)
+		if r != rule || a != addr {
+			agents = append(agents, agent)
+		}
+	}
+	return agents
+}
+
+func (m *Mux) keepAlive(idle, interval time.Duration) {
 	m.aliveChan = make(chan struct{}, 1)
+	m.aliveConf = make(chan struct{}, 1)
+	m.aliveIdle, m.aliveInterval = idle, interval
 	go func() {
 		var (
-			timer    = time.NewTimer(idle)
+			timer    = time.NewTimer(interval)
 			timerNil bool
 		)
 
 		for {
 			select {
 			case now := <-timer.C:
-				if m.checkAlive(now, idle) {
-					timer.Reset(idle)
+				idle, interval := m.keepAliveConfig()
+				if idle > 0 && m.checkAlive(now, idle) {
+					timer.Reset(interval)
 				} else {
 					timerNil = true
 				}
@@ -226,35 +984,205 @@ func (m *Mux) keepAlive(idle time.Duration) {
 					return
 				}
 
-				if timerNil {
-					timer = time.NewTimer(idle)
+				if idle, interval := m.keepAliveConfig(); timerNil && idle > 0 {
+					timer = time.NewTimer(interval)
 					timerNil = false
 				}
+			case <-m.aliveConf:
+				if !timerNil && !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				idle, interval := m.keepAliveConfig()
+				timerNil = idle <= 0
+				if !timerNil {
+					timer.Reset(interval)
+				}
 			}
 		}
 	}()
 }
 
-func (m *Mux) checkAlive(now time.Time, idle time.Duration) bool {
-	var (
-		sshs     []*SSH
-		hasAlive bool
-	)
+func (m *Mux) keepAliveConfig() (idle, interval time.Duration) {
+	m.aliveMu.Lock()
+	defer m.aliveMu.Unlock()
+	return m.aliveIdle, m.aliveInterval
+}
+
+// SetKeepAlive change the lifetime of idle connections at runtime, the durations of
+// MuxAuth.AgentKeepAlives still apply to matched hosts. Zero or negative idle pauses
+// closing idle connections including the matched hosts, until it's set again.
+func (m *Mux) SetKeepAlive(idle time.Duration) {
+	interval := idle
+	for _, rule := range m.idleRules {
+		seconds, _ := strconv.Atoi(rule.Value)
+		if d := time.Duration(seconds) * time.Second; d > 0 && d < interval {
+			interval = d
+		}
+	}
+	m.aliveMu.Lock()
+	m.aliveIdle, m.aliveInterval = idle, interval
+	m.aliveMu.Unlock()
+	if m.isClosed() {
+		return
+	}
+	select {
+	case m.aliveConf <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Mux) checkAlive(now time.Time, idle time.Duration) (hasAlive bool) {
+	defer m.recoverPanic("keepalive")
+
+	sshs, retired, hasAlive := m.removeIdle(now, idle)
+	for _, s := range sshs {
+		m.counters.incr(&m.counters.idleEvictions)
+		m.closeConn(s, EvictIdle)
+	}
+	for _, s := range retired {
+		m.closeConn(s, EvictRecycle)
+	}
+	return hasAlive
+}
+
+// removeIdle remove the idle connections from cache and return them with the retired
+// connections to close. The lock is released by defer since the schedule and match
+// rules are user code which may panic.
+func (m *Mux) removeIdle(now time.Time, idle time.Duration) (sshs, retired []*SSH, hasAlive bool) {
 	m.sshsMu.Lock()
+	defer m.sshsMu.Unlock()
 	for addr, s := range m.sshs {
 		openAt, refs := s.Status()
-		if refs <= 0 && now.Sub(openAt) >= idle {
+		if refs <= 0 && now.Sub(openAt) >= m.idleTimeout(addr, idle) && !m.keepWarm(addr, now) {
 			sshs = append(sshs, s)
 			delete(m.sshs, addr)
 		} else {
 			hasAlive = true
 		}
 	}
+	retired = m.closeRetired()
+	hasAlive = hasAlive || len(m.retired) > 0
+	return sshs, retired, hasAlive
+}
+
+// idleTimeout return the keepalive duration of the address by MuxAuth.AgentKeepAlives.
+func (m *Mux) idleTimeout(addr string, idle time.Duration) time.Duration {
+	if matched := m.match(m.idleRules, addr); matched != nil {
+		seconds, _ := strconv.Atoi(matched.Value)
+		return time.Duration(seconds) * time.Second
+	}
+	return idle
+}
+
+func (m *Mux) ping(interval, timeout time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
+				m.checkPing(timeout)
+			}
+		}
+	}()
+}
+
+func (m *Mux) checkPing(timeout time.Duration) {
+	m.sshsMu.RLock()
+	sshs := make(map[string]*SSH, len(m.sshs))
+	for addr, s := range m.sshs {
+		sshs[addr] = s
+	}
+	m.sshsMu.RUnlock()
+
+	var wg sync.WaitGroup
+	for addr, s := range sshs {
+		wg.Add(1)
+		go func(addr string, s *SSH) {
+			defer wg.Done()
+			defer m.recoverPanic("ping")
+
+			var err error
+			if m.pingSession {
+				err = s.Probe(timeout)
+			} else {
+				err = s.Ping(timeout)
+			}
+			if err == nil || !m.evict(addr, s, EvictPing) {
+				return
+			}
+			m.counters.incr(&m.counters.pingEvictions)
+			if m.pingRedial && !m.isClosed() {
+				agent, err := m.Dial(addr)
+				if err == nil {
+					agent.Close()
+				}
+			}
+		}(addr, s)
+	}
+	wg.Wait()
+}
+
+func (m *Mux) exceedBytes(s *SSH) bool {
+	if m.maxConnBytes <= 0 {
+		return false
+	}
+	in, out := s.Traffic()
+	return in+out >= m.maxConnBytes
+}
+
+// retire remove the connection exceeds MaxConnBytes from cache, it will be closed
+// by keepalive after all references are released.
+func (m *Mux) retire(addr string) {
+	m.sshsMu.Lock()
+	s, has := m.sshs[addr]
+	if has && m.exceedBytes(s) {
+		delete(m.sshs, addr)
+		m.retired = append(m.retired, s)
+		m.counters.incr(&m.counters.recycles)
+	}
 	m.sshsMu.Unlock()
-	for _, s := range sshs {
-		s.Close()
+}
+
+// closeRetired remove retired connections which aren't referenced, it must be
+// called with sshsMu locked.
+func (m *Mux) closeRetired() []*SSH {
+	var (
+		closed []*SSH
+		n      int
+	)
+	for _, s := range m.retired {
+		if _, refs := s.Status(); refs <= 0 {
+			closed = append(closed, s)
+		} else {
+			m.retired[n] = s
+			n++
+		}
 	}
-	return hasAlive
+	for i := n; i < len(m.retired); i++ {
+		m.retired[i] = nil
+	}
+	m.retired = m.retired[:n]
+	return closed
+}
+
+// evict remove the connection from cache and close it if it's still cached.
+func (m *Mux) evict(addr string, s *SSH, reason string) bool {
+	m.sshsMu.Lock()
+	cached := m.sshs[addr] == s
+	if cached {
+		delete(m.sshs, addr)
+	}
+	m.sshsMu.Unlock()
+	if cached {
+		m.closeConn(s, reason)
+	}
+	return cached
 }
 
 func (m *Mux) markClosed() bool {
@@ -262,7 +1190,7 @@ func (m *Mux) markClosed() bool {
 }
 
 func (m *Mux) isClosed() bool {
-	return atomic.LoadInt32(&m.closed) == 1
+	return atomic.LoadInt32(&m.closed) == 1 || atomic.LoadInt32(&m.draining) == 1
 }
 
 func (m *Mux) Close() error {
@@ -272,65 +1200,287 @@ func (m *Mux) Close() error {
 	if m.aliveChan != nil {
 		close(m.aliveChan)
 	}
+	close(m.done)
+	m.closeTunnels()
 	m.sshsMu.Lock()
+	sshs := m.retired
 	for _, s := range m.sshs {
-		s.Close()
+		sshs = append(sshs, s)
 	}
+	m.retired = nil
 	m.sshsMu.Unlock()
+	for _, s := range sshs {
+		m.closeConn(s, "")
+	}
 	return nil
 }
 
+// Shutdown stop new dials and close opened presets, then wait for all references
+// of cached connections are released before closing the Mux. If the context is
+// done before that, the Mux is closed immediately and the context error is returned.
+func (m *Mux) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&m.draining, 1)
+	m.closeTunnels()
+
+	const pollInterval = 50 * time.Millisecond
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for m.leased() {
+		select {
+		case <-ctx.Done():
+			m.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return m.Close()
+}
+
+// leased reports whether some cached connections are still referenced by callers,
+// references held by connections using them as gate are excluded.
+func (m *Mux) leased() bool {
+	m.sshsMu.RLock()
+	defer m.sshsMu.RUnlock()
+
+	sshs := append([]*SSH(nil), m.retired...)
+	for _, s := range m.sshs {
+		sshs = append(sshs, s)
+	}
+	for _, s := range sshs {
+		_, refs := s.Status()
+		for _, c := range sshs {
+			if c.gate != nil && c.gate._refs == s._refs {
+				refs--
+			}
+		}
+		if refs > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Mux) Dial(addr string) (*SSH, error) {
-	if m.isClosed() {
-		return nil, ErrMuxClosed
+	return m.DialContext(context.Background(), addr)
+}
+
+// DialTimeout do the same thing as Dial, but the whole dialing including the gate hops
+// and retries is limited by the timeout, regardless of Auth.TimeoutMs.
+func (m *Mux) DialTimeout(addr string, timeout time.Duration) (*SSH, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.DialContext(ctx, addr)
+}
+
+// DialContext do the same thing as Dial, but the whole dialing including the gate
+// hop is canceled once the context is done.
+func (m *Mux) DialContext(ctx context.Context, addr string) (*SSH, error) {
+	addr = m.normalize(addr)
+	mws := m.useMiddlewares()
+	var agent *SSH
+	err := runOp(ctx, mws, Operation{Kind: OpDial, Addr: addr}, func(ctx context.Context) error {
+		if agent != nil {
+			agent.Close()
+		}
+		var err error
+		agent, err = m.dialChain(ctx, addr, nil, nil)
+		return err
+	})
+	if err != nil {
+		if agent != nil {
+			agent.Close()
+		}
+		return nil, err
 	}
+	agent.middlewares = mws
+	agent.maxOutput = int(atomic.LoadInt64(&m.maxOutput))
+	return agent, nil
+}
 
-	var (
-		agent *SSH
-		gate  *SSH
-		has   bool
+// SetMaxOutputBytes set SSH.MaxOutputBytes of instances returned by Dial and
+// DialContext, including the ones used by Broadcast, RunAll and RcmdRetry. Instances
+// dialed before aren't affected, 0 means no limit.
+func (m *Mux) SetMaxOutputBytes(n int) {
+	atomic.StoreInt64(&m.maxOutput, int64(n))
+}
 
-		err error
-	)
+// dialChain dial the address through the gate chain, if hops is nil, the chain is
+// resolved from configs, an empty hops means connect directly. The visited addresses
+// are used to detect gate loops.
+func (m *Mux) dialChain(ctx context.Context, addr string, hops, visited []string) (*SSH, error) {
+	if m.isClosed() {
+		return nil, ErrMuxClosed
+	}
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
 
-	gateAddr := m.AgentGate(addr)
 	m.sshsMu.RLock()
-	agent, has = m.sshs[addr]
-	if !has {
-		if gateAddr != "" {
-			gate, has = m.sshs[gateAddr]
-			if has {
-				gate = gate.NopClose()
-			}
+	agent, has := m.sshs[addr]
+	if has {
+		if m.exceedBytes(agent) {
+			agent = nil
+		} else {
+			agent.touch()
+			agent = agent.NopClose()
 		}
-	} else {
-		agent = agent.NopClose()
 	}
 	m.sshsMu.RUnlock()
 	if agent != nil {
+		m.counters.incr(&m.counters.cacheHits)
 		return agent, nil
 	}
+	if has {
+		m.retire(addr)
+	}
 
-	if gate == nil && gateAddr != "" {
-		gate, err = m.Dial(gateAddr)
-		if err != nil {
-			return nil, err
+	// coalesce concurrent dials of the same address, followers wait for the leader
+	// and get the connection from cache.
+	m.inflightMu.Lock()
+	call, has := m.inflight[addr]
+	if has {
+		m.inflightMu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
+		if call.err != nil && call.err != context.Canceled && call.err != context.DeadlineExceeded {
+			return nil, call.err
+		}
+		return m.dialChain(ctx, addr, hops, visited)
+	}
+	call = &dialCall{done: make(chan struct{})}
+	m.inflight[addr] = call
+	m.inflightMu.Unlock()
+	m.counters.incr(&m.counters.cacheMisses)
+
+	// followers are released by defer even if the match rules panic.
+	defer func() {
+		m.inflightMu.Lock()
+		delete(m.inflight, addr)
+		m.inflightMu.Unlock()
+		close(call.done)
+	}()
+	agent, call.err = m.dialRoute(ctx, addr, hops, visited)
+	return agent, call.err
+}
+
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+// dialRoute dial the address through the hops or the gates resolved from configs.
+func (m *Mux) dialRoute(ctx context.Context, addr string, hops, visited []string) (*SSH, error) {
+	if hops != nil {
+		return m.dialVia(ctx, addr, hops, false, visited)
 	}
-	if gate != nil {
-		defer gate.Close()
+	chains, err := m.gateChains(addr)
+	if err != nil {
+		return nil, err
 	}
+	if len(chains) == 0 {
+		return m.dial(ctx, addr, "", nil)
+	}
+	var agent *SSH
+	for _, chain := range chains {
+		agent, err = m.dialVia(ctx, addr, chain, true, visited)
+		if err == nil || err == ErrGateLoop || err == ErrMuxClosed || ctx.Err() != nil {
+			break
+		}
+	}
+	return agent, err
+}
 
-	return m.dial(addr, gate)
+// dialVia dial the address through the last hop of the chain. If resolve is true and
+// the chain has only one hop, the gate is dialed as normal address, otherwise the
+// chain is explicit and the first hop is connected directly.
+func (m *Mux) dialVia(ctx context.Context, addr string, hops []string, resolve bool, visited []string) (*SSH, error) {
+	if len(hops) == 0 {
+		return m.dial(ctx, addr, "", nil)
+	}
+	gateAddr := hops[len(hops)-1]
+	if gateAddr == addr || stringsContain(visited, gateAddr) {
+		return nil, ErrGateLoop
+	}
+	if isProxyGate(gateAddr) {
+		return m.dial(ctx, addr, gateAddr, nil)
+	}
+	if resolve && len(hops) == 1 {
+		hops = nil
+	} else {
+		hops = hops[:len(hops)-1]
+	}
+
+	gate, err := m.dialChain(ctx, gateAddr, hops, append(visited, addr))
+	if err != nil {
+		return nil, err
+	}
+	defer gate.Close()
+	return m.dial(ctx, addr, gateAddr, gate)
 }
 
-func (m *Mux) dial(addr string, gate *SSH) (*SSH, error) {
+func (m *Mux) dial(ctx context.Context, addr, gateAddr string, gate *SSH) (*SSH, error) {
 	auth, err := m.AgentAuth(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	agent, err := Dial(addr, auth, gate)
+	err = m.breakerAllow(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		agent *SSH
+		start = time.Now()
+	)
+	m.counters.incr(&m.counters.dials)
+	retry := m.retryPolicy()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			start = time.Now()
+			m.counters.incr(&m.counters.dials)
+		}
+		// the connection slot is taken after the rate limit is waited, and released
+		// before retrying, so dials waiting for the rate or backoff don't hold slots.
+		err = m.waitDialRate(ctx, addr, gateAddr)
+		if err == nil {
+			if err = m.acquireConn(ctx); err != nil {
+				m.counters.dialFailed(err)
+				m.dialed(addr, gateAddr, start, nil, err)
+				break
+			}
+			err = m.injectDial(ctx, addr)
+			if err == nil {
+				agent, err = m.dialAgent(ctx, addr, auth, gateAddr, gate)
+			}
+			if err != nil {
+				m.releaseConn()
+			}
+		}
+		m.dialed(addr, gateAddr, start, agent, err)
+		if err == nil {
+			agent.TagProcesses(m.procTag)
+			agent.DryRun(m.dryRun)
+			if m.connsPerHost > 1 {
+				traffic := agent.traffic
+				agent.lanes = newConnLanes(m.connsPerHost, auth.MaxSession, func() (*ssh.Client, error) {
+					return m.dialLane(addr, auth, traffic)
+				}, m.releaseConn)
+			}
+			break
+		}
+		m.counters.dialFailed(err)
+
+		backoff, ok := retry.backoff(attempt, err)
+		if !ok || sleepContext(ctx, backoff) != nil {
+			break
+		}
+	}
+	m.breakerDone(addr, err)
 	if err != nil {
 		return nil, err
 	}
@@ -352,7 +1502,92 @@ func (m *Mux) dial(addr string, gate *SSH) (*SSH, error) {
 	m.sshsMu.Unlock()
 
 	if tmp != nil {
-		tmp.Close()
+		m.closeConn(tmp, "")
 	}
 	return agent, nil
 }
+
+func (m *Mux) acquireConn(ctx context.Context) error {
+	if m.connSlots == nil {
+		return nil
+	}
+	select {
+	case m.connSlots <- struct{}{}:
+		return nil
+	default:
+	}
+	if m.evictLRU() {
+		select {
+		case m.connSlots <- struct{}{}:
+			return nil
+		default:
+		}
+	}
+	if m.connFailFast {
+		return ErrTooManyConns
+	}
+	select {
+	case m.connSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// evictLRU close the least recently used connection which isn't referenced.
+func (m *Mux) evictLRU() bool {
+	var (
+		lruAddr string
+		lru     *SSH
+	)
+	m.sshsMu.Lock()
+	for addr, s := range m.sshs {
+		_, refs := s.Status()
+		if refs <= 0 && (lru == nil || s.UsedAt().Before(lru.UsedAt())) {
+			lruAddr, lru = addr, s
+		}
+	}
+	if lru != nil {
+		delete(m.sshs, lruAddr)
+	}
+	m.sshsMu.Unlock()
+
+	if lru == nil {
+		return false
+	}
+	m.counters.incr(&m.counters.lruEvictions)
+	m.closeConn(lru, EvictLRU)
+	return true
+}
+
+func (m *Mux) releaseConn() {
+	if m.connSlots == nil {
+		return
+	}
+	select {
+	case <-m.connSlots:
+	default:
+	}
+}
+
+// Go dial the address, call fn with the SSH instance and close it after fn returned,
+// so fn doesn't need to care about the reference count. It's convenient to be used
+// with errgroup:
+//
+//	g, ctx := errgroup.WithContext(ctx)
+//	for _, addr := range addrs {
+//		addr := addr
+//		g.Go(func() error {
+//			return mux.Go(ctx, addr, fn)
+//		})
+//	}
+//	err := g.Wait()
+func (m *Mux) Go(ctx context.Context, addr string, fn func(*SSH) error) error {
+	agent, err := m.DialContext(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	return fn(agent)
+}
@@ -0,0 +1,44 @@
+package socker
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultSSHPort is the port appended to addresses without port by default.
+const DefaultSSHPort = 22
+
+// NormalizeAddr return the "host:port" address with lowercase host, the default port
+// is appended if the address has no port, 0 means DefaultSSHPort. E.g. "Web-1"
+// becomes "web-1:22" and "::1" becomes "[::1]:22".
+func NormalizeAddr(addr string, defaultPort int) string {
+	if addr == "" {
+		return addr
+	}
+	if defaultPort <= 0 {
+		defaultPort = DefaultSSHPort
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), strconv.Itoa(defaultPort)
+	}
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
+
+// normalize return the address normalized by MuxAuth.DefaultPort.
+func (m *Mux) normalize(addr string) string {
+	return NormalizeAddr(addr, m.defaultPort)
+}
+
+// normalizeHops normalize the hops of gate chains, proxy urls are kept.
+func (m *Mux) normalizeHops(chains [][]string) [][]string {
+	for _, hops := range chains {
+		for i, hop := range hops {
+			if !isProxyGate(hop) {
+				hops[i] = m.normalize(hop)
+			}
+		}
+	}
+	return chains
+}
@@ -0,0 +1,67 @@
+package socker
+
+import (
+	"testing"
+)
+
+func TestNormalizeAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr   string
+		port   int
+		expect string
+	}{
+		{"10.0.0.5", 0, "10.0.0.5:22"},
+		{"10.0.0.5:2222", 0, "10.0.0.5:2222"},
+		{"Web-1.Example.COM", 2222, "web-1.example.com:2222"},
+		{"::1", 0, "[::1]:22"},
+		{"[::1]", 0, "[::1]:22"},
+		{"[::1]:23", 0, "[::1]:23"},
+		{"", 0, ""},
+	} {
+		if got := NormalizeAddr(c.addr, c.port); got != c.expect {
+			t.Errorf("normalize %s: expect %s, got %s", c.addr, c.expect, got)
+		}
+	}
+}
+
+func TestMuxNormalizeAddr(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+			"admin":   {User: "admin", Password: "secret"},
+		},
+		DefaultAuth: "default",
+		AgentAuths:  map[string]string{"DB-1": "admin"},
+		AgentGates:  map[string]string{"glob:db-*": "Bastion"},
+		HostLabels:  map[string]map[string]string{"Web-1": {"role": "web"}},
+		DefaultPort: 2222,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	m.sshs["web-1:2222"] = LocalOnly()
+	agent, err := m.Dial("WEB-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.Close()
+	if len(m.sshs) != 1 {
+		t.Errorf("address should be normalized before caching: %v", m.sshs)
+	}
+
+	if auth, err := m.AgentAuth("db-1:2222"); err != nil || auth.User != "admin" {
+		t.Errorf("plain pattern should match normalized address: %+v %v", auth, err)
+	}
+	chain, err := m.GateChain("db-1")
+	if err != nil || len(chain) != 1 || chain[0] != "bastion:2222" {
+		t.Errorf("gates should be normalized: %v %v", chain, err)
+	}
+	if labels := m.Labels("web-1:2222"); labels["role"] != "web" {
+		t.Errorf("label addresses should be normalized: %v", labels)
+	}
+	if addrs, err := m.Select("role=web"); err != nil || len(addrs) != 1 || addrs[0] != "web-1:2222" {
+		t.Errorf("unexpected selected addresses: %v %v", addrs, err)
+	}
+}
@@ -0,0 +1,147 @@
+package socker
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open, host failed repeatedly")
+
+// States of circuit breakers reported by MuxHooks.OnBreaker.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerPolicy make Mux fail fast for hosts which failed repeatedly. After Failures
+// consecutive dial failures of an address, dials to it fail with ErrCircuitOpen for
+// CooldownMs, then a trial dial is allowed, it closes the breaker if succeeded or
+// opens it again if failed.
+type BreakerPolicy struct {
+	// Failures is the count of consecutive failures opens the breaker, 0 means
+	// disabled.
+	Failures int
+	// CooldownMs is the duration the breaker keeps open, default is 30000.
+	CooldownMs int
+}
+
+func (p *BreakerPolicy) cooldown() time.Duration {
+	const defaultCooldownMs = 30000
+	if p.CooldownMs <= 0 {
+		return defaultCooldownMs * time.Millisecond
+	}
+	return time.Duration(p.CooldownMs) * time.Millisecond
+}
+
+// BreakerEvent describe the state transition of the circuit breaker of an address.
+type BreakerEvent struct {
+	Addr string
+	// From and To are the states before and after the transition.
+	From string
+	To   string
+	// Failures is the count of consecutive failures.
+	Failures int
+	// Err is the last dial error, nil if the breaker is closed.
+	Err error
+}
+
+type breaker struct {
+	state    string
+	failures int
+	openAt   time.Time
+}
+
+func (m *Mux) breakerPolicy() BreakerPolicy {
+	m.mu.RLock()
+	p := m.breaker
+	m.mu.RUnlock()
+	return p
+}
+
+// breakerAllow reports whether the address can be dialed, the open breaker turns
+// to half-open after the cool-down and allows the trial dial.
+func (m *Mux) breakerAllow(addr string) error {
+	p := m.breakerPolicy()
+	if p.Failures <= 0 {
+		return nil
+	}
+	m.breakersMu.Lock()
+	b := m.breakers[addr]
+	if b == nil || b.state != BreakerOpen {
+		m.breakersMu.Unlock()
+		return nil
+	}
+	if time.Since(b.openAt) < p.cooldown() {
+		m.breakersMu.Unlock()
+		return ErrCircuitOpen
+	}
+	b.state = BreakerHalfOpen
+	e := BreakerEvent{Addr: addr, From: BreakerOpen, To: BreakerHalfOpen, Failures: b.failures}
+	m.breakersMu.Unlock()
+	m.breakerChanged(e)
+	return nil
+}
+
+// breakerDone record the result of dial, canceled dials and dials rejected by
+// MaxConns aren't failures of the host.
+func (m *Mux) breakerDone(addr string, err error) {
+	if err != nil {
+		switch dialFailureReason(err) {
+		case FailureCanceled, FailureLimit:
+			return
+		}
+	}
+	p := m.breakerPolicy()
+
+	m.breakersMu.Lock()
+	b := m.breakers[addr]
+	if err == nil || p.Failures <= 0 {
+		if b == nil {
+			m.breakersMu.Unlock()
+			return
+		}
+		delete(m.breakers, addr)
+		from := b.state
+		m.breakersMu.Unlock()
+		if from != BreakerClosed {
+			m.breakerChanged(BreakerEvent{Addr: addr, From: from, To: BreakerClosed})
+		}
+		return
+	}
+
+	if b == nil {
+		if m.breakers == nil {
+			m.breakers = make(map[string]*breaker)
+		}
+		b = &breaker{state: BreakerClosed}
+		m.breakers[addr] = b
+	}
+	b.failures++
+	from := b.state
+	if from == BreakerHalfOpen || b.failures >= p.Failures {
+		b.state = BreakerOpen
+		b.openAt = time.Now()
+	}
+	e := BreakerEvent{Addr: addr, From: from, To: b.state, Failures: b.failures, Err: err}
+	m.breakersMu.Unlock()
+	if e.From != e.To {
+		m.breakerChanged(e)
+	}
+}
+
+func (m *Mux) breakerChanged(e BreakerEvent) {
+	if m.hooks.OnBreaker != nil {
+		m.hooks.OnBreaker(e)
+	}
+}
+
+// BreakerState return the state of circuit breaker of the address.
+func (m *Mux) BreakerState(addr string) string {
+	m.breakersMu.Lock()
+	defer m.breakersMu.Unlock()
+	if b := m.breakers[m.normalize(addr)]; b != nil {
+		return b.state
+	}
+	return BreakerClosed
+}
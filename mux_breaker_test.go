@@ -0,0 +1,73 @@
+package socker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDialBreaker(t *testing.T) {
+	var (
+		attempts int
+		events   []BreakerEvent
+	)
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth: "default",
+		Breaker:     BreakerPolicy{Failures: 2, CooldownMs: 50},
+		Hooks: MuxHooks{
+			OnDial: func(ConnEvent) {
+				attempts++
+			},
+			OnBreaker: func(e BreakerEvent) {
+				events = append(events, e)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	const addr = "127.0.0.1:1"
+	for i := 0; i < 2; i++ {
+		if _, err = m.Dial(addr); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("dial should fail by the host: %v", err)
+		}
+	}
+	if _, err = m.Dial(addr); err != ErrCircuitOpen {
+		t.Fatalf("dial should fail fast: %v", err)
+	}
+	if attempts != 2 || m.BreakerState(addr) != BreakerOpen {
+		t.Fatalf("unexpected breaker: %d attempts, %s", attempts, m.BreakerState(addr))
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err = m.Dial(addr); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("trial dial should be allowed: %v", err)
+	}
+	if attempts != 3 || m.BreakerState(addr) != BreakerOpen {
+		t.Fatalf("unexpected breaker: %d attempts, %s", attempts, m.BreakerState(addr))
+	}
+
+	m.breakerDone(addr, nil)
+	if m.BreakerState(addr) != BreakerClosed {
+		t.Errorf("breaker should be closed: %s", m.BreakerState(addr))
+	}
+
+	expects := [][2]string{
+		{BreakerClosed, BreakerOpen},
+		{BreakerOpen, BreakerHalfOpen},
+		{BreakerHalfOpen, BreakerOpen},
+		{BreakerOpen, BreakerClosed},
+	}
+	if len(events) != len(expects) {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	for i, e := range events {
+		if e.Addr != addr || e.From != expects[i][0] || e.To != expects[i][1] {
+			t.Errorf("unexpected event %d: %+v", i, e)
+		}
+	}
+}
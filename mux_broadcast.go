@@ -0,0 +1,191 @@
+package socker
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BroadcastConcurrency is the max count of hosts Mux.Broadcast runs command on
+// concurrently.
+var BroadcastConcurrency = 16
+
+// BroadcastResult is the result of command run on one host by Mux.Broadcast.
+type BroadcastResult struct {
+	Addr string
+	// Output is the combined stdout and stderr.
+	Output []byte
+	// Code is the exit code of command, -1 if it isn't run or exited without status.
+	Code int
+	// Err is the error of dialing or running command, it's an *ExitError if the
+	// command exits with non-zero status.
+	Err error
+	// Resumed reports whether the command isn't run since it has succeeded in the
+	// stored run, see Mux.BroadcastResume.
+	Resumed bool
+}
+
+// Broadcast run the command on every address matched by the label selector, see
+// Mux.Select. Connections are dialed by DialContext so cached ones are reused, at most
+// BroadcastConcurrency hosts run the command concurrently. The results are in the
+// order of matched addresses, hosts not started before the context is done have the
+// context error.
+func (m *Mux) Broadcast(ctx context.Context, selector, cmd string) ([]BroadcastResult, error) {
+	return m.BroadcastResume(ctx, selector, cmd, nil, "")
+}
+
+// BroadcastResume do the same thing as Broadcast, but the results are saved to the
+// store with the run id, and hosts which have succeeded in the stored run are skipped
+// with Resumed results, so the broadcast can be invoked again to retry failed hosts
+// only. Nil store means Broadcast.
+func (m *Mux) BroadcastResume(ctx context.Context, selector, cmd string, store Store, run string) ([]BroadcastResult, error) {
+	return m.broadcastAll(ctx, selector, CmdStep{Cmd: cmd}.Name(), func(string) (string, error) {
+		return cmd, nil
+	}, store, run)
+}
+
+// broadcastAll run the command returned by cmdOf on each address matched by the
+// selector, hosts whose command can't be created fail with the error.
+func (m *Mux) broadcastAll(ctx context.Context, selector, step string, cmdOf func(addr string) (string, error), store Store, run string) ([]BroadcastResult, error) {
+	addrs, err := m.Select(selector)
+	if err != nil {
+		return nil, err
+	}
+	return m.runHosts(ctx, addrs, BroadcastConcurrency, step, cmdOf, store, run)
+}
+
+// runHosts run the command returned by cmdOf on each address with the concurrency.
+func (m *Mux) runHosts(ctx context.Context, addrs []string, concurrency int, step string, cmdOf func(addr string) (string, error), store Store, run string) ([]BroadcastResult, error) {
+	var (
+		succeeded map[string]bool
+		err       error
+	)
+	if store != nil {
+		if run == "" {
+			return nil, errNoRunID
+		}
+		succeeded, err = SucceededHosts(store, run)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		results = make([]BroadcastResult, len(addrs))
+		indexes = make([]int, 0, len(addrs))
+	)
+	for i, addr := range addrs {
+		results[i] = BroadcastResult{Addr: addr, Code: -1}
+		if succeeded[addr] {
+			results[i].Code = 0
+			results[i].Resumed = true
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	runLimited(ctx, indexes, concurrency, "broadcast", func(i int) {
+		r := &results[i]
+		startAt := time.Now()
+		if cmd, err := cmdOf(r.Addr); err != nil {
+			r.Err = err
+		} else {
+			m.broadcast(ctx, r, cmd)
+		}
+		if store != nil {
+			record := RunRecord{Run: run, Addr: r.Addr, Step: step, Total: 1, Status: StepChanged, StartAt: startAt, EndAt: time.Now()}
+			if r.Err != nil {
+				record.Status, record.Err = StepFailed, r.Err.Error()
+			}
+			if err := store.Save(record); err != nil && r.Err == nil {
+				r.Err = err
+			}
+		}
+	}, func(i int, err error) {
+		results[i].Code, results[i].Err = -1, err
+	})
+	return results, nil
+}
+
+// runLimited call run with each index in goroutines, at most concurrency calls run
+// at the same time. Indexes not started before the context is done fail with the
+// context error, panics of run are recovered and also reported by fail.
+func runLimited(ctx context.Context, indexes []int, concurrency int, goroutine string, run func(i int), fail func(i int, err error)) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var (
+		slots = make(chan struct{}, concurrency)
+		wg    sync.WaitGroup
+	)
+	for _, i := range indexes {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			fail(i, ctx.Err())
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			defer recoverError(goroutine, func(err error) { fail(i, err) })
+
+			run(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (m *Mux) broadcast(ctx context.Context, r *BroadcastResult, cmd string) {
+	agent, err := m.DialContext(ctx, r.Addr)
+	if err != nil {
+		r.Err = err
+		return
+	}
+	defer agent.Close()
+
+	agent.RcmdContext(ctx, cmd)
+	r.Output = agent.Output()
+	r.Err = agent.Error()
+	err = r.Err
+	if e, ok := err.(*OutputTruncatedError); ok {
+		err = e.Err
+	}
+	switch err := err.(type) {
+	case nil:
+		r.Code = 0
+	case *ExitError:
+		r.Code = err.Code
+	}
+}
+
+// RunOption configure RunAll.
+type RunOption func(o *runOptions)
+
+type runOptions struct {
+	concurrency int
+}
+
+// Concurrency set the max count of hosts running the command concurrently, default is
+// BroadcastConcurrency.
+func Concurrency(n int) RunOption {
+	return func(o *runOptions) {
+		o.concurrency = n
+	}
+}
+
+// RunAll do the same thing as Broadcast, but the command is run on the addresses
+// instead of addresses matched by label selector. The results are in the order of
+// addresses.
+func (m *Mux) RunAll(ctx context.Context, addrs []string, cmd string, opts ...RunOption) []BroadcastResult {
+	o := runOptions{concurrency: BroadcastConcurrency}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	results, _ := m.runHosts(ctx, addrs, o.concurrency, CmdStep{Cmd: cmd}.Name(), func(string) (string, error) {
+		return cmd, nil
+	}, nil, "")
+	return results
+}
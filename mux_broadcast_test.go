@@ -0,0 +1,146 @@
+package socker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBroadcast(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret", TimeoutMs: 1000}},
+		DefaultAuth: "default",
+		HostLabels: map[string]map[string]string{
+			closed:          {"role": "db"},
+			"web-1.invalid": {"role": "web"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	results, err := m.Broadcast(context.Background(), "role=db", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Addr != closed || results[0].Err == nil || results[0].Code != -1 {
+		t.Errorf("unexpected results: %+v", results)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = m.Broadcast(ctx, "role", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			t.Errorf("canceled broadcast should fail: %+v", r)
+		}
+	}
+
+	if _, err = m.Broadcast(context.Background(), "&&", "true"); err == nil {
+		t.Error("invalid selector should be rejected")
+	}
+}
+
+func TestBroadcastResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewJSONLStore(filepath.Join(dir, "runs.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+		HostLabels: map[string]map[string]string{
+			"web-1:22":    {"role": "web"},
+			"127.0.0.1:1": {"role": "web"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	var cmds bytes.Buffer
+	agent := LocalOnly()
+	agent.DryRun(&cmds)
+	m.sshs["web-1:22"] = agent
+
+	for i := 0; i < 2; i++ {
+		results, err := m.BroadcastResume(context.Background(), "role=web", "uptime", store, "run-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || results[0].Addr != "127.0.0.1:1" || results[0].Err == nil || results[0].Resumed {
+			t.Errorf("failed host should be run: %+v", results)
+		}
+		if r := results[1]; r.Err != nil || r.Code != 0 || r.Resumed != (i == 1) {
+			t.Errorf("unexpected result of attempt %d: %+v", i, r)
+		}
+	}
+	if n := strings.Count(cmds.String(), "uptime"); n != 1 {
+		t.Errorf("succeeded host should be skipped: %q", cmds.String())
+	}
+	succeeded, err := SucceededHosts(store, "run-1")
+	if err != nil || len(succeeded) != 1 || !succeeded["web-1:22"] {
+		t.Errorf("unexpected succeeded hosts: %v %v", succeeded, err)
+	}
+}
+
+func TestRunAll(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret", TimeoutMs: 1000}},
+		DefaultAuth: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	addrs := []string{l.Addr().String(), "web-1.invalid", l.Addr().String()}
+	results := m.RunAll(context.Background(), addrs, "echo ok", Concurrency(1))
+	if len(results) != 3 {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	for i, r := range results {
+		if r.Addr != addrs[i] {
+			t.Errorf("results should be in order: %+v", r)
+		}
+		if ok := r.Err == nil && string(r.Output) == "ok\n" && r.Code == 0; ok != (i != 1) {
+			t.Errorf("unexpected result: %+v", r)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, r := range m.RunAll(ctx, addrs, "echo ok") {
+		if r.Err == nil {
+			t.Errorf("canceled run should fail: %+v", r)
+		}
+	}
+}
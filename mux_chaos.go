@@ -0,0 +1,106 @@
+package socker
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrChaosDropped  = errors.New("chaos: dial dropped")
+	ErrChaosDisabled = errors.New("chaos: fault injector isn't configured")
+)
+
+// FaultInjector injects failures into Mux for resilience testing, it's only used
+// if MuxAuth.Faults is set and should never be used in production.
+type FaultInjector interface {
+	// InjectDial is called before dialing each new connection, it can block to
+	// delay the dialing, returned error will fail the dialing.
+	InjectDial(ctx context.Context, addr string) error
+}
+
+// Chaos is a simple FaultInjector which can drop and delay dials.
+type Chaos struct {
+	mu    sync.Mutex
+	drops int
+	delay time.Duration
+}
+
+var _ FaultInjector = (*Chaos)(nil)
+
+// DropNextDials make next n dials fail with ErrChaosDropped.
+func (c *Chaos) DropNextDials(n int) {
+	c.mu.Lock()
+	c.drops = n
+	c.mu.Unlock()
+}
+
+// DelayDials make each dial wait for the duration before connecting, 0 means no delay.
+func (c *Chaos) DelayDials(d time.Duration) {
+	c.mu.Lock()
+	c.delay = d
+	c.mu.Unlock()
+}
+
+func (c *Chaos) InjectDial(ctx context.Context, addr string) error {
+	c.mu.Lock()
+	drop := c.drops > 0
+	if drop {
+		c.drops--
+	}
+	delay := c.delay
+	c.mu.Unlock()
+
+	if drop {
+		return ErrChaosDropped
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Mux) injectDial(ctx context.Context, addr string) error {
+	if m.faults == nil {
+		return nil
+	}
+	return m.faults.InjectDial(ctx, addr)
+}
+
+// KillRandomConn close a random cached connection as it's broken, references of
+// it will fail on next operation. It returns the address of killed connection or
+// empty string if there is no cached connection. It's only available if MuxAuth.Faults
+// is set.
+func (m *Mux) KillRandomConn() (string, error) {
+	if m.faults == nil {
+		return "", ErrChaosDisabled
+	}
+
+	m.sshsMu.RLock()
+	addrs := make([]string, 0, len(m.sshs))
+	for addr := range m.sshs {
+		addrs = append(addrs, addr)
+	}
+	m.sshsMu.RUnlock()
+	if len(addrs) == 0 {
+		return "", nil
+	}
+
+	addr := addrs[rand.Intn(len(addrs))]
+	m.sshsMu.RLock()
+	s := m.sshs[addr]
+	m.sshsMu.RUnlock()
+	if s == nil || s.conn == nil {
+		return "", nil
+	}
+	return addr, s.conn.Close()
+}
@@ -0,0 +1,90 @@
+package socker
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// IsTransportError report whether the error of running remote command is caused by
+// broken connection instead of the command itself.
+func IsTransportError(err error) bool {
+	switch err.(type) {
+	case *ssh.ExitMissingError, net.Error:
+		return true
+	}
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, ErrConnClosed:
+		return true
+	}
+	return false
+}
+
+// DefaultCmdRetryable is the default RetryPolicy.Retryable of Mux.RcmdRetry, it
+// retry the transport errors and dial errors retried by DefaultRetryable. Errors of
+// commands such as *ExitError are never retried.
+func DefaultCmdRetryable(err error) bool {
+	if _, ok := AsExitError(err); ok {
+		return false
+	}
+	return IsTransportError(err) || DefaultRetryable(err)
+}
+
+// RetryExitCodes return the RetryPolicy.Retryable of Mux.RcmdRetry which retry the
+// errors of DefaultCmdRetryable and the commands exited with one of the codes.
+func RetryExitCodes(codes ...int) func(err error) bool {
+	return func(err error) bool {
+		if e, ok := AsExitError(err); ok {
+			for _, code := range codes {
+				if e.Code == code {
+					return true
+				}
+			}
+			return false
+		}
+		return DefaultCmdRetryable(err)
+	}
+}
+
+// RcmdRetry run the idempotent command on the address and retry it by the policy, the
+// default Retryable of policy is DefaultCmdRetryable. The cached connection is evicted
+// with EvictBroken on transport errors so the next attempt redials. The output and
+// error are of the last attempt.
+func (m *Mux) RcmdRetry(ctx context.Context, addr, cmd string, policy RetryPolicy) ([]byte, error) {
+	addr = m.normalize(addr)
+	if policy.Retryable == nil {
+		policy.Retryable = DefaultCmdRetryable
+	}
+	for attempt := 0; ; attempt++ {
+		out, err := m.rcmdOnce(ctx, addr, cmd)
+		if err == nil {
+			return out, nil
+		}
+		if ctx.Err() != nil {
+			return out, err
+		}
+		wait, ok := policy.backoff(attempt, err)
+		if !ok {
+			return out, err
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return out, err
+		}
+	}
+}
+
+func (m *Mux) rcmdOnce(ctx context.Context, addr, cmd string) ([]byte, error) {
+	agent, err := m.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer agent.Close()
+	agent.RcmdContext(ctx, cmd)
+	err = agent.Error()
+	if IsTransportError(err) {
+		m.evictAddr(addr, EvictBroken)
+	}
+	return agent.Output(), err
+}
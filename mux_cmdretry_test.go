@@ -0,0 +1,85 @@
+package socker
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRcmdRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := startExecServer(t)
+	defer l.Close()
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// the command succeeds at the third attempt.
+	cmd := Command("sh", "-c", `n=$(cat "$0" 2>/dev/null || echo 0); n=$((n+1)); echo $n >"$0"; [ $n -ge 3 ] || exit 75; echo done`, filepath.Join(dir, "count"))
+	out, err := m.RcmdRetry(context.Background(), l.Addr().String(), cmd, RetryPolicy{Attempts: 2, BackoffMs: 1})
+	if e, ok := err.(*ExitError); !ok || e.Code != 75 {
+		t.Fatalf("exit code isn't retried by default: %v", err)
+	}
+	out, err = m.RcmdRetry(context.Background(), l.Addr().String(), cmd, RetryPolicy{Attempts: 3, BackoffMs: 1, Retryable: RetryExitCodes(75)})
+	if err != nil || string(out) != "done\n" {
+		t.Errorf("unexpected result: %v %q", err, out)
+	}
+}
+
+func TestRcmdRetryMaxOutputBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := startExecServer(t)
+	defer l.Close()
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.SetMaxOutputBytes(4)
+
+	// the output is truncated at every attempt, the exit code is still retried.
+	cmd := Command("sh", "-c", `n=$(cat "$0" 2>/dev/null || echo 0); n=$((n+1)); echo $n >"$0"; echo attempt-$n; [ $n -ge 2 ] || exit 75`, filepath.Join(dir, "count"))
+	out, err := m.RcmdRetry(context.Background(), l.Addr().String(), cmd, RetryPolicy{Attempts: 3, BackoffMs: 1, Retryable: RetryExitCodes(75)})
+	e, ok := err.(*OutputTruncatedError)
+	if !ok || e.Err != nil || string(out) != "atte" {
+		t.Fatalf("unexpected result: %v %q", err, out)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "count"))
+	if string(data) != "2\n" {
+		t.Errorf("exit code of truncated output should be retried: %q", data)
+	}
+	if DefaultCmdRetryable(&OutputTruncatedError{Limit: 4, Err: &ExitError{Code: 75}}) {
+		t.Error("command errors with truncated output shouldn't be retried")
+	}
+	if ee, ok := AsExitError(&OutputTruncatedError{Err: &ExitError{Code: 75}}); !ok || ee.Code != 75 {
+		t.Errorf("exit error should be unwrapped: %v", ee)
+	}
+}
+
+func TestDefaultCmdRetryable(t *testing.T) {
+	if !DefaultCmdRetryable(io.EOF) || !DefaultCmdRetryable(ErrConnClosed) {
+		t.Error("transport errors should be retried")
+	}
+	if DefaultCmdRetryable(&ExitError{Code: 1}) || DefaultCmdRetryable(context.Canceled) {
+		t.Error("command errors shouldn't be retried")
+	}
+}
@@ -0,0 +1,538 @@
+package socker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ConfigLoader parse the configs file into MuxAuth.
+type ConfigLoader func(data []byte) (MuxAuth, error)
+
+var configLoaders = map[string]ConfigLoader{
+	".json": loadJSONConfig,
+}
+
+// RegisterConfigLoader register the loader for configs files with the extension,
+// such as ".yaml" with the Unmarshal of a YAML library.
+func RegisterConfigLoader(ext string, loader ConfigLoader) {
+	configLoaders[strings.ToLower(ext)] = loader
+}
+
+func loadJSONConfig(data []byte) (MuxAuth, error) {
+	var auth MuxAuth
+	err := json.Unmarshal(data, &auth)
+	return auth, err
+}
+
+// LoadConfigFile load MuxAuth from the configs file, the format is determined by
+// file extension. Files without registered extension named "config" or "ssh_config",
+// such as "~/.ssh/config", are loaded by LoadSSHConfig.
+func LoadConfigFile(path string) (MuxAuth, error) {
+	loader := configLoaders[strings.ToLower(filepath.Ext(path))]
+	if loader == nil && isSSHConfigFile(path) {
+		return LoadSSHConfig(path)
+	}
+	if loader == nil {
+		return MuxAuth{}, fmt.Errorf("unsupported configs file: %s", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return MuxAuth{}, err
+	}
+	auth, err := loader(data)
+	if err != nil {
+		return MuxAuth{}, fmt.Errorf("parse configs file %s failed: %s", path, err.Error())
+	}
+	return auth, nil
+}
+
+// SaveConfigFile save the configs as JSON to file which can be loaded by
+// LoadConfigFile, the extension must be ".json".
+func SaveConfigFile(path string, auth MuxAuth) error {
+	if strings.ToLower(filepath.Ext(path)) != ".json" {
+		return fmt.Errorf("unsupported configs file: %s", path)
+	}
+	data, err := json.MarshalIndent(auth, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// MarshalYAML return the configs encoded by MarshalJSON as generic maps and slices,
+// it's the yaml.Marshaler of YAML libraries. YAML isn't supported by the package, the
+// loader of YAML library could be registered by RegisterConfigLoader.
+func (a MuxAuth) MarshalYAML() (interface{}, error) {
+	data, err := a.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	err = dec.Decode(&v)
+	return v, err
+}
+
+func isSSHConfigFile(path string) bool {
+	name := filepath.Base(path)
+	return name == "config" || name == "ssh_config"
+}
+
+type fingerprintWriter struct {
+	h hash.Hash
+}
+
+// fingerprintKey is the random key secrets are hashed with, so the fingerprint can't
+// be used to guess them.
+var fingerprintKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+func (w fingerprintWriter) secret(s string) {
+	if s == "" {
+		w.str("")
+		return
+	}
+	mac := hmac.New(sha256.New, fingerprintKey)
+	mac.Write([]byte(s))
+	w.str(string(mac.Sum(nil)))
+}
+
+func (w fingerprintWriter) str(s string) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(s)))
+	w.h.Write(size[:])
+	w.h.Write([]byte(s))
+}
+
+func (w fingerprintWriter) int(i int) {
+	w.str(strconv.Itoa(i))
+}
+
+func (w fingerprintWriter) bool(b bool) {
+	w.str(strconv.FormatBool(b))
+}
+
+func (w fingerprintWriter) strMap(m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.int(len(keys))
+	for _, k := range keys {
+		w.str(k)
+		w.str(m[k])
+	}
+}
+
+func (w fingerprintWriter) entries(entries []MatchEntry) {
+	w.int(len(entries))
+	for _, e := range entries {
+		w.str(e.Pattern)
+		w.str(e.Value)
+	}
+}
+
+// Fingerprint return a stable hash of the normalized configs, configs with the
+// same fingerprint behave the same. It's useful to detect whether configs loaded
+// from file are changed.
+//
+// The Auth.HostKeyCheck and Auth.Dialer functions can't be compared and are ignored.
+// Passwords and private keys are hashed with a random key of the process, so the
+// fingerprint is only stable in the same process.
+func (a *MuxAuth) Fingerprint() string {
+	w := fingerprintWriter{h: sha256.New()}
+
+	ids := make([]string, 0, len(a.AuthMethods))
+	for id, auth := range a.AuthMethods {
+		if id != "" && auth != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	w.int(len(ids))
+	for _, id := range ids {
+		w.str(id)
+		a.writeAuth(w, a.AuthMethods[id])
+	}
+	gates := make([]string, 0, len(a.GateAgents))
+	for addr, auth := range a.GateAgents {
+		if auth != nil {
+			gates = append(gates, addr)
+		}
+	}
+	sort.Strings(gates)
+	w.int(len(gates))
+	for _, addr := range gates {
+		w.str(addr)
+		a.writeAuth(w, a.GateAgents[addr])
+	}
+
+	w.str(a.DefaultAuth)
+	w.strMap(normalizePatterns(a.AgentAuths))
+	w.strMap(normalizePatterns(a.AgentGates))
+	w.entries(normalizeEntries(a.AgentAuthRules))
+	w.entries(normalizeEntries(a.AgentGateRules))
+	w.bool(a.MostSpecific)
+	w.int(a.keepAliveSeconds())
+	w.strMap(normalizePatterns(a.keepAliveRules()))
+	w.int(a.pingSeconds())
+	w.int(a.PingTimeoutSeconds)
+	w.bool(a.PingSession)
+	w.bool(a.PingRedial)
+	w.str(strconv.FormatInt(a.MaxConnBytes, 10))
+	w.int(a.MaxConns)
+	w.bool(a.MaxConnsFailFast)
+	w.int(a.ConnsPerHost)
+	w.int(a.LeaseLeakSeconds)
+	for _, r := range []RateLimit{a.DialRate, a.GateDialRate} {
+		w.str(strconv.FormatFloat(r.Rate, 'g', -1, 64))
+		w.int(r.Burst)
+	}
+	w.str(a.LocalAddr)
+	w.str(a.Proxy)
+	w.strMap(a.HostNames)
+	addrs := make([]string, 0, len(a.HostLabels))
+	for addr := range a.HostLabels {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	w.int(len(addrs))
+	for _, addr := range addrs {
+		w.str(addr)
+		w.strMap(a.HostLabels[addr])
+	}
+	addrs = addrs[:0]
+	for addr := range a.HostVars {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	w.int(len(addrs))
+	for _, addr := range addrs {
+		w.str(addr)
+		w.strMap(a.HostVars[addr])
+	}
+	retry := a.retryPolicy()
+	w.int(retry.Attempts)
+	w.int(retry.BackoffMs)
+	w.int(retry.MaxBackoffMs)
+	w.str(strconv.FormatFloat(retry.Jitter, 'g', -1, 64))
+	w.int(a.Breaker.Failures)
+	w.int(a.Breaker.CooldownMs)
+
+	groups := make([]string, 0, len(a.Groups))
+	for name := range a.Groups {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	w.int(len(groups))
+	for _, name := range groups {
+		w.str(name)
+		w.str(strings.Join(a.Groups[name].Addrs, ","))
+		w.str(a.Groups[name].Balance)
+	}
+
+	names := make([]string, 0, len(a.TunnelPresets))
+	for name := range a.TunnelPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.int(len(names))
+	for _, name := range names {
+		preset := a.TunnelPresets[name]
+		w.str(name)
+		w.str(preset.Via)
+		w.str(preset.Remote)
+		w.str(preset.localAddr())
+	}
+	return hex.EncodeToString(w.h.Sum(nil))
+}
+
+// writeAuth write the Auth instance with defaults of MuxAuth applied.
+func (a *MuxAuth) writeAuth(w fingerprintWriter, auth *Auth) {
+	localAddr := auth.LocalAddr
+	if localAddr == "" {
+		localAddr = a.LocalAddr
+	}
+	proxy := auth.Proxy
+	if proxy == "" {
+		proxy = a.Proxy
+	}
+	timeoutMs, maxSession := auth.TimeoutMs, auth.MaxSession
+	if timeoutMs <= 0 {
+		timeoutMs = a.Defaults.TimeoutMs
+	}
+	if maxSession <= 0 {
+		maxSession = a.Defaults.MaxSession
+	}
+	w.str(auth.User)
+	w.secret(auth.Password)
+	w.secret(auth.PrivateKey)
+	w.str(auth.PrivateKeyFile)
+	w.int(timeoutMs)
+	w.int(maxSession)
+	w.str(localAddr)
+	w.str(proxy)
+	w.str(auth.OutputEncoding)
+	w.str(strings.Join(auth.Methods, ","))
+	w.str(strings.Join(auth.PrivateKeyFiles, ","))
+	w.bool(auth.IdentitiesOnly)
+	w.int(len(auth.Signers))
+	for _, signer := range auth.Signers {
+		if signer != nil {
+			w.str(ssh.FingerprintSHA256(signer.PublicKey()))
+		}
+	}
+}
+
+var (
+	// ConfigWatchInterval is the interval configs file is checked by WatchConfig on
+	// platforms without inotify.
+	ConfigWatchInterval = time.Second
+	// ConfigWatchDebounce is the duration configs file must be unchanged before reloading,
+	// so partially written file won't be loaded.
+	ConfigWatchDebounce = 500 * time.Millisecond
+)
+
+// ConfigWatcher watch the configs file and reload the Mux once it's changed.
+type ConfigWatcher struct {
+	mux      *Mux
+	path     string
+	notifier fileNotifier
+	failed   bool
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// WatchConfig load the configs file by LoadConfigFile and reload the Mux with it, then
+// watch the file and reload once it's changed and then unchanged for
+// ConfigWatchDebounce. The directory of file is watched by inotify on linux so files
+// replaced by rename are detected, other platforms poll the file every
+// ConfigWatchInterval. Results of reloads are reported by MuxHooks.OnReload, changes
+// not affecting the fingerprint aren't reloaded. Files included by ssh_config aren't
+// watched. The watching stops when the watcher or Mux is closed.
+func (m *Mux) WatchConfig(path string) (*ConfigWatcher, error) {
+	auth, err := LoadConfigFile(path)
+	if err == nil {
+		err = m.Reload(auth)
+	}
+	if err != nil {
+		return nil, err
+	}
+	notifier, err := watchFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &ConfigWatcher{
+		mux:      m,
+		path:     path,
+		notifier: notifier,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.watch()
+	return w, nil
+}
+
+func (w *ConfigWatcher) watch() {
+	defer close(w.done)
+	defer w.notifier.Close()
+
+	var (
+		debounce *time.Timer
+		fire     <-chan time.Time
+	)
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.mux.done:
+			return
+		case _, ok := <-w.notifier.Events():
+			if !ok {
+				return
+			}
+			if debounce == nil {
+				debounce = time.NewTimer(ConfigWatchDebounce)
+			} else {
+				if !debounce.Stop() && fire != nil {
+					<-debounce.C
+				}
+				debounce.Reset(ConfigWatchDebounce)
+			}
+			fire = debounce.C
+		case <-fire:
+			fire = nil
+			w.reload()
+		}
+	}
+}
+
+func (w *ConfigWatcher) reload() {
+	defer w.mux.recoverPanic("config watcher")
+
+	e := ReloadEvent{Path: w.path}
+	auth, err := LoadConfigFile(w.path)
+	if err == nil {
+		e.Fingerprint = auth.Fingerprint()
+		if e.Fingerprint != w.mux.Fingerprint() {
+			err = w.mux.Reload(auth)
+		} else if !w.failed {
+			return
+		}
+	}
+	// recovery from failed reloads is reported even if configs is unchanged.
+	e.Err = err
+	w.failed = err != nil
+	if w.mux.hooks.OnReload != nil {
+		w.mux.hooks.OnReload(e)
+	}
+}
+
+// Close stop watching.
+func (w *ConfigWatcher) Close() error {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+	<-w.done
+	return nil
+}
+
+// fileNotifier notify possible changes of the watched file, the events channel is
+// closed once it's closed or failed.
+type fileNotifier interface {
+	Events() <-chan struct{}
+	Close() error
+}
+
+func notifyEvent(events chan struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+// pollNotifier poll the file every ConfigWatchInterval.
+type pollNotifier struct {
+	events   chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func pollFile(path string) (fileNotifier, error) {
+	last, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	n := &pollNotifier{
+		events: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	go func() {
+		defer close(n.events)
+		ticker := time.NewTicker(ConfigWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-n.stop:
+				return
+			case <-ticker.C:
+			}
+			stat, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if stat.ModTime() != last.ModTime() || stat.Size() != last.Size() {
+				last = stat
+				notifyEvent(n.events)
+			}
+		}
+	}()
+	return n, nil
+}
+
+func (n *pollNotifier) Events() <-chan struct{} {
+	return n.events
+}
+
+func (n *pollNotifier) Close() error {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+	})
+	return nil
+}
+
+func normalizePatterns(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	normalized := make(map[string]string, len(m))
+	for pattern, value := range m {
+		normalized[NormalizePattern(pattern)] = value
+	}
+	return normalized
+}
+
+func normalizeEntries(entries []MatchEntry) []MatchEntry {
+	if entries == nil {
+		return nil
+	}
+	normalized := make([]MatchEntry, len(entries))
+	for i, e := range entries {
+		normalized[i] = MatchEntry{Pattern: NormalizePattern(e.Pattern), Value: e.Value}
+	}
+	return normalized
+}
+
+// MarshalJSON encode the configs with patterns normalized by NormalizePattern, so
+// the matcher type of each pattern is explicit. Callbacks such as hooks and host key
+// checking can't be encoded and are omitted, secrets of auth methods are kept so
+// the output can be loaded by LoadConfigFile.
+func (a MuxAuth) MarshalJSON() ([]byte, error) {
+	type muxAuth MuxAuth
+	a.AgentAuths = normalizePatterns(a.AgentAuths)
+	a.AgentGates = normalizePatterns(a.AgentGates)
+	a.AgentAuthRules = normalizeEntries(a.AgentAuthRules)
+	a.AgentGateRules = normalizeEntries(a.AgentGateRules)
+	if a.AgentKeepAlives != nil {
+		keepAlives := make(map[string]int, len(a.AgentKeepAlives))
+		for pattern, seconds := range a.AgentKeepAlives {
+			keepAlives[NormalizePattern(pattern)] = seconds
+		}
+		a.AgentKeepAlives = keepAlives
+	}
+	return json.Marshal(muxAuth(a))
+}
+
+// Config return the configs currently used by Mux, agents added by AddAgent aren't
+// included.
+func (m *Mux) Config() MuxAuth {
+	m.mu.RLock()
+	auth := m.auth
+	m.mu.RUnlock()
+	return auth
+}
@@ -0,0 +1,364 @@
+package socker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMuxAuthFingerprint(t *testing.T) {
+	newAuth := func() MuxAuth {
+		return MuxAuth{
+			AuthMethods: map[string]*Auth{
+				"foo": {User: "foo", Password: "foo"},
+				"bar": {User: "bar", Password: "bar", LocalAddr: "10.0.0.1"},
+			},
+			DefaultAuth: "foo",
+			AgentAuths: map[string]string{
+				"ipnet:192.168.1.0/24": "foo",
+				"ipnet:192.168.2.0/24": "bar",
+			},
+			AgentGates: map[string]string{
+				"ipnet:192.168.1.0/24": "10.0.1.1:22",
+			},
+			LocalAddr: "10.0.0.1",
+		}
+	}
+
+	a, b := newAuth(), newAuth()
+	if a.Fingerprint() != b.Fingerprint() {
+		t.Fatal("fingerprint should be stable")
+	}
+
+	b.AuthMethods["foo"].LocalAddr = "10.0.0.1"
+	b.KeepAliveSeconds = 300
+	b.AgentGates = map[string]string{
+		"cidr:192.168.1.0/24": "10.0.1.1:22",
+	}
+	if a.Fingerprint() != b.Fingerprint() {
+		t.Fatal("fingerprint should be normalized")
+	}
+
+	b.AgentGates["ipnet:192.168.2.0/24"] = "10.0.2.1:22"
+	if a.Fingerprint() == b.Fingerprint() {
+		t.Fatal("fingerprint should be changed")
+	}
+}
+
+func TestMuxAuthRoundTrip(t *testing.T) {
+	auth := MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"foo": {User: "foo", Password: "foo", Methods: []string{MethodPassword}},
+		},
+		DefaultAuth: "foo",
+		AgentGates: map[string]string{
+			"10.0.0.1":         "10.0.1.1:22",
+			"cidr:10.2.0.0/16": "10.0.2.1:22|10.0.3.1:22",
+		},
+		AgentAuthRules: []MatchEntry{
+			{Pattern: "re:^10\\.", Value: "foo"},
+		},
+		Hooks: MuxHooks{
+			OnDial: func(ConnEvent) {},
+		},
+		Retry: RetryPolicy{Attempts: 3, Jitter: 0.2},
+	}
+	m, err := NewMux(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	data, err := json.Marshal(m.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "socker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mux.json")
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.AgentGates["plain:10.0.0.1"] != "10.0.1.1:22" ||
+		loaded.AgentGates["ipnet:10.2.0.0/16"] == "" ||
+		loaded.AgentAuthRules[0].Pattern != "regexp:^10\\." {
+		t.Errorf("patterns aren't normalized: %s", data)
+	}
+	if loaded.Fingerprint() != auth.Fingerprint() {
+		t.Errorf("configs changed after round trip: %s", data)
+	}
+}
+
+func TestGateAgents(t *testing.T) {
+	gate := &Auth{User: "jump", Password: "jump"}
+	auth := MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth: "default",
+		GateAgents:  map[string]*Auth{"10.0.1.1:22": gate},
+		AgentGates:  map[string]string{"ipnet:192.168.1.0/24": "10.0.1.1:22"},
+		Proxy:       "socks5://127.0.0.1:1080",
+	}
+	fingerprint := auth.Fingerprint()
+	m, err := NewMux(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if a, _ := m.AgentAuth("10.0.1.1:22"); a != gate {
+		t.Errorf("gate should be authenticated by GateAgents: %v", a)
+	}
+	if a, _ := m.AgentAuth("192.168.1.2:22"); a == nil || a.User != "root" {
+		t.Errorf("destination should be authenticated by default: %v", a)
+	}
+	if gate.Proxy != auth.Proxy || gate.HostKeyCheck == nil {
+		t.Errorf("defaults should be applied to gate auth: %v", gate)
+	}
+
+	gate.Password = "changed"
+	if auth.Fingerprint() == fingerprint {
+		t.Error("fingerprint should include gate auths")
+	}
+	auth.GateAgents["10.0.2.1:22"] = nil
+	if err = m.Reload(auth); err == nil {
+		t.Error("nil gate auth should be rejected")
+	}
+}
+
+func TestMuxReloadUnchangedFingerprint(t *testing.T) {
+	newAuth := func() MuxAuth {
+		return MuxAuth{
+			AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+			DefaultAuth: "default",
+		}
+	}
+	m, err := NewMux(newAuth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	err = m.AddAgent("ipnet:10.0.0.0/8", &Auth{User: "admin", Password: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := newAuth()
+	checked := false
+	auth.AuthMethods["default"].HostKeyCheck = func(string, net.Addr, ssh.PublicKey) error {
+		checked = true
+		return nil
+	}
+	if auth.Fingerprint() != m.Fingerprint() {
+		t.Fatal("host key check shouldn't be fingerprinted")
+	}
+	if err = m.Reload(auth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := m.AgentAuth("10.0.0.1:22")
+	if err != nil || a.User != "root" {
+		t.Fatalf("agents added by AddAgent should be discarded: %v %v", a, err)
+	}
+	a.HostKeyCheck("", nil, nil)
+	if !checked {
+		t.Error("host key check should be reloaded")
+	}
+}
+
+func TestSaveConfigFile(t *testing.T) {
+	auth := MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"foo": {User: "foo", Password: "it's \"quoted\": #1", PrivateKey: "-----BEGIN KEY-----\nabc\n-----END KEY-----\n"},
+		},
+		DefaultAuth: "foo",
+		AgentGates: map[string]string{
+			"10.0.0.1":         "10.0.1.1:22",
+			"cidr:10.2.0.0/16": "10.0.2.1:22|10.0.3.1:22",
+		},
+		AgentAuthRules: []MatchEntry{
+			{Pattern: "re:^10\\.", Value: "foo"},
+			{Pattern: "glob:web-*", Value: "foo"},
+		},
+		HostLabels: map[string]map[string]string{"web-1": {"role": "web", "true": "yes"}},
+		Groups:     map[string]AddrGroup{"web": {Addrs: []string{"web-1", "web-2"}}},
+		Retry:      RetryPolicy{Attempts: 3, Jitter: 0.2},
+	}
+	dir, err := ioutil.TempDir("", "socker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mux.json")
+	if err = SaveConfigFile(path, auth); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Fingerprint() != auth.Fingerprint() || loaded.AgentAuthRules[1].Pattern != "glob:web-*" {
+		data, _ := ioutil.ReadFile(path)
+		t.Errorf("configs changed after round trip:\n%s", data)
+	}
+	if err = SaveConfigFile(filepath.Join(dir, "mux.yaml"), auth); err == nil {
+		t.Error("yaml should be unsupported")
+	}
+
+	v, err := auth.MarshalYAML()
+	m, ok := v.(map[string]interface{})
+	if err != nil || !ok || m["DefaultAuth"] != "foo" {
+		t.Errorf("unexpected yaml value: %v %v", v, err)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	debounce, interval := ConfigWatchDebounce, ConfigWatchInterval
+	ConfigWatchDebounce, ConfigWatchInterval = 100*time.Millisecond, 20*time.Millisecond
+	defer func() {
+		ConfigWatchDebounce, ConfigWatchInterval = debounce, interval
+	}()
+
+	dir, err := ioutil.TempDir("", "socker-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mux.json")
+	writeConfig := func(user string) {
+		data, err := json.Marshal(MuxAuth{
+			AuthMethods: map[string]*Auth{"default": {User: user, Password: "secret"}},
+			DefaultAuth: "default",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// replaced by rename like editors and ConfigMap volumes.
+		tmp := path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectEvent := func(events <-chan ReloadEvent) ReloadEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(3 * time.Second):
+			t.Fatal("configs isn't reloaded")
+			return ReloadEvent{}
+		}
+	}
+	expectNoEvent := func(events <-chan ReloadEvent) {
+		select {
+		case e := <-events:
+			t.Fatalf("unexpected reload: %+v", e)
+		case <-time.After(3 * ConfigWatchDebounce):
+		}
+	}
+	writeConfig("root")
+
+	events := make(chan ReloadEvent, 10)
+	m, err := NewMux(MuxAuth{Hooks: MuxHooks{OnReload: func(e ReloadEvent) { events <- e }}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	w, err := m.WatchConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Config().DefaultAuth != "default" {
+		t.Fatal("configs isn't loaded")
+	}
+
+	for _, user := range []string{"a", "b", "admin"} {
+		writeConfig(user)
+		time.Sleep(ConfigWatchDebounce / 5)
+	}
+	e := expectEvent(events)
+	if e.Err != nil || e.Path != path || e.Fingerprint != m.Fingerprint() {
+		t.Fatalf("unexpected reload: %+v", e)
+	}
+	if a, err := m.AgentAuth("10.0.0.1:22"); err != nil || a.User != "admin" {
+		t.Fatalf("configs isn't reloaded: %v %v", a, err)
+	}
+	expectNoEvent(events)
+
+	if err = ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if e = expectEvent(events); e.Err == nil {
+		t.Fatal("expect error of invalid configs")
+	}
+	if a, err := m.AgentAuth("10.0.0.1:22"); err != nil || a.User != "admin" {
+		t.Fatalf("previous configs should be kept: %v %v", a, err)
+	}
+
+	writeConfig("admin")
+	if e = expectEvent(events); e.Err != nil {
+		t.Fatal(e.Err)
+	}
+	writeConfig("admin")
+	expectNoEvent(events)
+
+	closed := make(chan struct{})
+	go func() {
+		w.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close watcher blocked")
+	}
+	writeConfig("root")
+	expectNoEvent(events)
+}
+
+func TestPollFile(t *testing.T) {
+	interval := ConfigWatchInterval
+	ConfigWatchInterval = 20 * time.Millisecond
+	defer func() {
+		ConfigWatchInterval = interval
+	}()
+
+	f, err := ioutil.TempFile("", "socker-poll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	n, err := pollFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(f.Name(), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-n.Events():
+	case <-time.After(time.Second):
+		t.Fatal("change isn't detected")
+	}
+	n.Close()
+	for range n.Events() {
+	}
+}
@@ -0,0 +1,61 @@
+package socker
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// inotifyNotifier notify events of the directory of watched file, so files replaced
+// by rename and symlink swaps of ConfigMap volumes are detected.
+type inotifyNotifier struct {
+	file   *os.File
+	events chan struct{}
+}
+
+// watchFile watch the file by inotify, it falls back to polling if inotify isn't
+// available.
+func watchFile(path string) (fileNotifier, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return pollFile(path)
+	}
+	const mask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+		syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+	_, err = syscall.InotifyAddWatch(fd, filepath.Dir(path), mask)
+	if err != nil {
+		syscall.Close(fd)
+		return pollFile(path)
+	}
+	n := &inotifyNotifier{
+		// the nonblocking fd is served by runtime poller, so Close interrupts Read.
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan struct{}, 1),
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) read() {
+	defer close(n.events)
+	buf := make([]byte, 16*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		_, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		// events are coalesced and checked by fingerprint, so they aren't parsed.
+		notifyEvent(n.events)
+	}
+}
+
+func (n *inotifyNotifier) Events() <-chan struct{} {
+	return n.events
+}
+
+func (n *inotifyNotifier) Close() error {
+	return n.file.Close()
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package socker
+
+// watchFile poll the file since inotify is only available on linux.
+func watchFile(path string) (fileNotifier, error) {
+	return pollFile(path)
+}
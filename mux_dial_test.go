@@ -0,0 +1,271 @@
+package socker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDialCoalesce(t *testing.T) {
+	var (
+		chaos Chaos
+		dials int32
+	)
+	chaos.DelayDials(50 * time.Millisecond)
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth: "default",
+		Faults:      &chaos,
+		Hooks: MuxHooks{
+			OnDial: func(ConnEvent) {
+				atomic.AddInt32(&dials, 1)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.Dial("127.0.0.1:1"); err == nil {
+				t.Error("dial should fail")
+			}
+		}()
+	}
+	wg.Wait()
+	if dials != 1 {
+		t.Errorf("expect 1 dial, got %d", dials)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	var chaos Chaos
+	chaos.DelayDials(time.Second)
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth: "default",
+		Faults:      &chaos,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	start := time.Now()
+	_, err = m.DialTimeout("127.0.0.1:1", 50*time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expect deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("dial isn't canceled in time")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	newMux := func() (*Mux, *SSH) {
+		m, err := NewMux(MuxAuth{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := LocalOnly()
+		m.sshs["127.0.0.1:22"] = s
+		return m, s.NopClose()
+	}
+
+	m, lease := newMux()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown should wait for leases: %v", err)
+	}
+	lease.Close()
+
+	m, lease = newMux()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lease.Close()
+	}()
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Dial("127.0.0.1:22"); err != ErrMuxClosed {
+		t.Errorf("dial after shutdown should fail: %v", err)
+	}
+}
+
+func TestAgentKeepAlives(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		KeepAliveSeconds: 120,
+		AgentKeepAlives:  map[string]int{"glob:bastion-*": 3600, "glob:leaf-*": 60},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if interval := m.auth.keepAliveInterval(); interval != time.Minute {
+		t.Errorf("unexpected check interval: %s", interval)
+	}
+
+	addrs := []string{"bastion-1:22", "leaf-1:22", "web-1:22"}
+	for _, addr := range addrs {
+		m.sshs[addr] = LocalOnly()
+	}
+	for _, c := range []struct {
+		After time.Duration
+		Alive []string
+	}{
+		{After: 90 * time.Second, Alive: []string{"bastion-1:22", "web-1:22"}},
+		{After: 30 * time.Minute, Alive: []string{"bastion-1:22"}},
+		{After: 2 * time.Hour, Alive: nil},
+	} {
+		m.checkAlive(time.Now().Add(c.After), 120*time.Second)
+		var alive []string
+		for _, addr := range addrs {
+			if _, has := m.sshs[addr]; has {
+				alive = append(alive, addr)
+			}
+		}
+		if !reflect.DeepEqual(alive, c.Alive) {
+			t.Errorf("unexpected alive connections after %s: %v", c.After, alive)
+		}
+	}
+
+	if err = (&MuxAuth{AgentKeepAlives: map[string]int{"glob:*": 0}}).Validate(); err == nil {
+		t.Error("non-positive keepalive should be rejected")
+	}
+}
+
+func TestTransportDialer(t *testing.T) {
+	l := startAuthServer(t)
+	defer l.Close()
+
+	var dialed []string
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth: "default",
+		TransportDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, l.Addr().String())
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	_, err = m.Dial("node.internal:22")
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expect AuthError, got %v", err)
+	}
+	if !reflect.DeepEqual(dialed, []string{"node.internal:22"}) {
+		t.Errorf("unexpected dialed addresses: %v", dialed)
+	}
+}
+
+func TestSetKeepAlive(t *testing.T) {
+	m, err := NewMux(MuxAuth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	cached := func(addr string) bool {
+		m.sshsMu.RLock()
+		defer m.sshsMu.RUnlock()
+		_, has := m.sshs[addr]
+		return has
+	}
+
+	m.SetKeepAlive(0)
+	m.sshsMu.Lock()
+	m.sshs["paused:22"] = LocalOnly()
+	m.sshsMu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	if !cached("paused:22") {
+		t.Fatal("idle connections shouldn't be closed while paused")
+	}
+
+	m.SetKeepAlive(20 * time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for cached("paused:22") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cached("paused:22") {
+		t.Error("idle connection should be closed after keepalive is resumed")
+	}
+}
+
+func TestAddAgentConcurrentDial(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	auth := MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+	}
+	m, err := NewMux(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	host, _, _ := net.SplitHostPort(l.Addr().String())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			agent, err := m.Dial(l.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			agent.Rcmd("true")
+			if agent.Error() != nil {
+				t.Error(agent.Error())
+			}
+			agent.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			err := m.AddAgent("ipnet:"+host+"/32", &Auth{User: "root", Password: "secret"})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := m.Reload(auth); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	added := &Auth{User: "root", Password: "secret"}
+	if err = m.AddAgent("ipnet:"+host+"/32", added); err != nil {
+		t.Fatal(err)
+	}
+	if added.HostKeyCheck != nil || added.config != nil {
+		t.Error("auth method shouldn't be modified")
+	}
+	if a, _ := m.AgentAuth(l.Addr().String()); a == added || a.HostKeyCheck == nil {
+		t.Errorf("auth method should be copied with defaults: %v", a)
+	}
+}
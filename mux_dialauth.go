@@ -0,0 +1,42 @@
+package socker
+
+import (
+	"context"
+)
+
+// DialWithAuth dial the address with the auth method instead of the matched one,
+// such as ad-hoc credentials supplied by operators in break-glass scenarios. The
+// route is still resolved from configs, see DialConnContext. The connection isn't
+// cached or shared, it's closed once the returned instance is closed.
+func (m *Mux) DialWithAuth(addr string, auth *Auth) (*SSH, error) {
+	return m.DialWithAuthContext(context.Background(), addr, auth)
+}
+
+// DialWithAuthContext do the same thing as DialWithAuth, but the whole dialing
+// including the gate hops is canceled once the context is done.
+func (m *Mux) DialWithAuthContext(ctx context.Context, addr string, auth *Auth) (*SSH, error) {
+	if auth == nil {
+		return nil, ErrNoAuthMethod
+	}
+	addr = m.normalize(addr)
+	config, err := auth.SSHConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+	conn, err := m.DialConnContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	agent, err := newSSHContext(ctx, conn, m.resolveHost(addr), auth, config, nil)
+	if err != nil {
+		return nil, err
+	}
+	agent.TagProcesses(m.procTag)
+	agent.DryRun(m.dryRun)
+	return agent, nil
+}
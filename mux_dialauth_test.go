@@ -0,0 +1,28 @@
+package socker
+
+import (
+	"testing"
+)
+
+func TestDialWithAuth(t *testing.T) {
+	l := startAuthServer(t)
+	defer l.Close()
+	addr := l.Addr().String()
+
+	m, err := NewMux(MuxAuth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if _, err = m.Dial(addr); err != ErrNoAuthMethod {
+		t.Fatalf("address should have no auth method: %v", err)
+	}
+	_, err = m.DialWithAuth(addr, &Auth{User: "root", Password: "secret", TimeoutMs: 3000})
+	if _, ok := err.(*AuthError); !ok {
+		t.Errorf("host should be reached with the auth method: %v", err)
+	}
+	if _, err = m.DialWithAuth(addr, nil); err != ErrNoAuthMethod {
+		t.Errorf("nil auth method should be rejected: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package socker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+var ErrNoGroup = errors.New("address group is not exist")
+
+// Balance strategies of AddrGroup.
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConns = "least-conns"
+)
+
+// AddrGroup is a named group of replicas dialed by Mux.DialGroup.
+type AddrGroup struct {
+	Addrs []string
+	// Balance is the strategy to pick the address, BalanceRoundRobin or
+	// BalanceLeastConns, default is BalanceRoundRobin.
+	Balance string
+}
+
+func (g AddrGroup) validate(name string) error {
+	if len(g.Addrs) == 0 {
+		return fmt.Errorf("address group %s is empty", name)
+	}
+	switch g.Balance {
+	case "", BalanceRoundRobin, BalanceLeastConns:
+		return nil
+	default:
+		return fmt.Errorf("unknown balance strategy of address group %s: %s", name, g.Balance)
+	}
+}
+
+type addrGroup struct {
+	AddrGroup
+	next *uint32
+}
+
+func buildGroups(groups map[string]AddrGroup, normalize func(string) string) map[string]addrGroup {
+	built := make(map[string]addrGroup, len(groups))
+	for name, g := range groups {
+		addrs := make([]string, len(g.Addrs))
+		for i, addr := range g.Addrs {
+			addrs[i] = normalize(addr)
+		}
+		g.Addrs = addrs
+		built[name] = addrGroup{AddrGroup: g, next: new(uint32)}
+	}
+	return built
+}
+
+// groupOrder return the addresses of group in the order they are tried.
+func (m *Mux) groupOrder(g addrGroup) []string {
+	n := len(g.Addrs)
+	addrs := make([]string, 0, n)
+	if g.Balance == BalanceLeastConns {
+		refs := make(map[string]int32, n)
+		m.sshsMu.RLock()
+		for _, addr := range g.Addrs {
+			if s, has := m.sshs[addr]; has {
+				_, refs[addr] = s.Status()
+			}
+		}
+		m.sshsMu.RUnlock()
+		addrs = append(addrs, g.Addrs...)
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return refs[addrs[i]] < refs[addrs[j]]
+		})
+		return addrs
+	}
+
+	start := int(atomic.AddUint32(g.next, 1)-1) % n
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, g.Addrs[(start+i)%n])
+	}
+	return addrs
+}
+
+// DialGroup do the same thing as DialGroupContext with background context.
+func (m *Mux) DialGroup(name string) (*SSH, error) {
+	return m.DialGroupContext(context.Background(), name)
+}
+
+// DialGroupContext pick an address of the group defined by MuxAuth.Groups and dial it,
+// cached connections are reused. If dialing failed, the other addresses are tried in
+// order and the last error is returned. The address of returned instance can be got
+// by SSH.Addr.
+func (m *Mux) DialGroupContext(ctx context.Context, name string) (*SSH, error) {
+	m.mu.RLock()
+	g, has := m.groups[name]
+	m.mu.RUnlock()
+	if !has {
+		return nil, ErrNoGroup
+	}
+
+	var err error
+	for _, addr := range m.groupOrder(g) {
+		var agent *SSH
+		agent, err = m.DialContext(ctx, addr)
+		if err == nil {
+			return agent, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,50 @@
+package socker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDialGroup(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret", TimeoutMs: 1000}},
+		DefaultAuth: "default",
+		Groups: map[string]AddrGroup{
+			"web":    {Addrs: []string{"web-1:22", "web-2:22", "web-3:22"}},
+			"db":     {Addrs: []string{"db-1:22", "db-2:22"}, Balance: BalanceLeastConns},
+			"closed": {Addrs: []string{"127.0.0.1:1"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	web := m.groups["web"]
+	expects := [][]string{
+		{"web-1:22", "web-2:22", "web-3:22"},
+		{"web-2:22", "web-3:22", "web-1:22"},
+		{"web-3:22", "web-1:22", "web-2:22"},
+		{"web-1:22", "web-2:22", "web-3:22"},
+	}
+	for i, expect := range expects {
+		if addrs := m.groupOrder(web); !reflect.DeepEqual(addrs, expect) {
+			t.Errorf("round robin failed: %d, expect %v, got %v", i, expect, addrs)
+		}
+	}
+	if addrs := m.groupOrder(m.groups["db"]); !reflect.DeepEqual(addrs, []string{"db-1:22", "db-2:22"}) {
+		t.Errorf("least conns failed: %v", addrs)
+	}
+
+	if _, err = m.DialGroup("cache"); err != ErrNoGroup {
+		t.Errorf("expect ErrNoGroup, got %v", err)
+	}
+	if _, err = m.DialGroup("closed"); err == nil {
+		t.Error("dial closed group should fail")
+	}
+
+	err = (&MuxAuth{Groups: map[string]AddrGroup{"web": {Addrs: []string{"web-1:22"}, Balance: "random"}}}).Validate()
+	if err == nil {
+		t.Error("unknown balance strategy should be rejected")
+	}
+}
@@ -0,0 +1,115 @@
+package socker
+
+import "time"
+
+// Reasons of connection evictions reported by MuxHooks.OnEvict.
+const (
+	EvictIdle    = "idle"
+	EvictPing    = "ping"
+	EvictLRU     = "lru"
+	EvictRecycle = "recycle"
+	EvictReboot  = "reboot"
+	// EvictBroken is the connection failed running commands, see Mux.RcmdRetry.
+	EvictBroken = "broken"
+)
+
+// ConnEvent describe a lifecycle event of the connection cached by Mux.
+type ConnEvent struct {
+	// Addr is the address of destination host.
+	Addr string
+	// Gate is the address of the gate used to connect to destination host, empty
+	// if connected directly.
+	Gate string
+	// OpenAt is the time the connection is opened, zero if dial failed.
+	OpenAt time.Time
+	// Duration is the time spent on dialing for OnDial, and the lifetime of the
+	// connection for OnEvict and OnClose.
+	Duration time.Duration
+	// Reason is the evict reason, one of EvictIdle, EvictPing, EvictLRU, EvictRecycle,
+	// EvictReboot and EvictBroken, empty for other events.
+	Reason string
+	// Err is the dial error for OnDial.
+	Err error
+}
+
+// MuxHooks are callbacks invoked on connection lifecycle events, each of them can be
+// nil. They are called synchronously and shouldn't block.
+type MuxHooks struct {
+	// OnDial is called after each new connection is established or failed.
+	OnDial func(ConnEvent)
+	// OnEvict is called before the connection is closed by keepalive, ping, MaxConns,
+	// MaxConnBytes or RebootAndWait.
+	OnEvict func(ConnEvent)
+	// OnClose is called after each cached connection is closed.
+	OnClose func(ConnEvent)
+	// OnBreaker is called after the circuit breaker of an address changed state, see
+	// MuxAuth.Breaker.
+	OnBreaker func(BreakerEvent)
+	// OnLeaseLeak is called once for each lease held longer than
+	// MuxAuth.LeaseLeakSeconds, it's called in a separate goroutine.
+	OnLeaseLeak func(LeaseEvent)
+	// OnReload is called after the configs file watched by Mux.WatchConfig is changed
+	// and reloaded or failed, it's called in the goroutine of watcher.
+	OnReload func(ReloadEvent)
+}
+
+// ReloadEvent describe the reload of configs file watched by Mux.WatchConfig.
+type ReloadEvent struct {
+	// Path is the configs file.
+	Path string
+	// Fingerprint is the fingerprint of loaded configs, empty if it can't be loaded.
+	Fingerprint string
+	// Err is the error of loading or validating the configs, the previous configs are
+	// kept if it's not nil.
+	Err error
+}
+
+func (m *Mux) connEvent(s *SSH, reason string) ConnEvent {
+	openAt, _ := s.Status()
+	e := ConnEvent{
+		Addr:     s.addr,
+		OpenAt:   openAt,
+		Duration: time.Since(openAt),
+		Reason:   reason,
+	}
+	if s.gate != nil {
+		e.Gate = s.gate.addr
+	}
+	return e
+}
+
+func (m *Mux) dialed(addr, gate string, start time.Time, s *SSH, err error) {
+	if m.hooks.OnDial == nil {
+		return
+	}
+	e := ConnEvent{
+		Addr:     addr,
+		Gate:     redactProxy(gate),
+		Duration: time.Since(start),
+		Err:      redactError(err, proxyPassword(gate)),
+	}
+	if s != nil {
+		e.OpenAt, _ = s.Status()
+	}
+	m.hooks.OnDial(e)
+}
+
+// closeConn close the connection removed from cache, reason is empty if it isn't
+// evicted.
+func (m *Mux) closeConn(s *SSH, reason string) {
+	var e ConnEvent
+	if m.hooks.OnEvict != nil || m.hooks.OnClose != nil {
+		e = m.connEvent(s, reason)
+	}
+	if reason != "" && m.hooks.OnEvict != nil {
+		m.hooks.OnEvict(e)
+	}
+	m.releaseConn()
+	if reason != "" {
+		s.done.close(reason)
+	}
+	s.Close()
+	if m.hooks.OnClose != nil {
+		m.hooks.OnClose(e)
+	}
+}
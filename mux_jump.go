@@ -0,0 +1,293 @@
+package socker
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpListener is a local ssh server which serves as the jump host of plain ssh
+// clients, e.g. "ssh -J 127.0.0.1:2222 target". The "direct-tcpip" channels opened
+// by clients are routed to the targets by the gates of Mux, the ssh session to the
+// target is still authenticated by the client itself.
+type JumpListener struct {
+	mux      *Mux
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// NewJumpListener listen on the local address and serve ssh clients with the server
+// config, the config is required. Configs accepting clients without authentication,
+// such as InsecureJumpServerConfig, are only allowed for loopback address.
+func (m *Mux) NewJumpListener(localAddr string, config *ssh.ServerConfig) (*JumpListener, error) {
+	if m.isClosed() {
+		return nil, ErrMuxClosed
+	}
+	if config == nil {
+		return nil, errors.New("jump listener requires server config")
+	}
+	if config.NoClientAuth {
+		host, _, err := net.SplitHostPort(localAddr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, errors.New("jump listener without authentication must listen on loopback address")
+		}
+	}
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &JumpListener{
+		mux:      m,
+		listener: listener,
+		config:   config,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	l.wg.Add(1)
+	go l.serve()
+	return l, nil
+}
+
+// InsecureJumpServerConfig return the server config with an ephemeral host key which
+// accepts clients WITHOUT AUTHENTICATION. Any local user or process can reach the
+// gates of Mux through the listener served with it, so it should only be used on
+// single user hosts.
+func InsecureJumpServerConfig() (*ssh.ServerConfig, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	return config, nil
+}
+
+// Addr return the bound local address.
+func (l *JumpListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *JumpListener) serve() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if !l.track(conn) {
+			conn.Close()
+			return
+		}
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			defer l.untrack(conn)
+			defer l.mux.recoverPanic("jump listener")
+			l.handle(conn)
+		}()
+	}
+}
+
+func (l *JumpListener) track(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[conn] = struct{}{}
+	return true
+}
+
+func (l *JumpListener) untrack(conn net.Conn) {
+	l.mu.Lock()
+	delete(l.conns, conn)
+	l.mu.Unlock()
+	conn.Close()
+}
+
+func (l *JumpListener) handle(conn net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, l.config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for newCh := range chans {
+		if newCh.ChannelType() != "direct-tcpip" {
+			newCh.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+		var payload struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+			newCh.Reject(ssh.ConnectionFailed, "invalid direct-tcpip payload")
+			continue
+		}
+		wg.Add(1)
+		go func(newCh ssh.NewChannel, addr string) {
+			defer wg.Done()
+			defer l.mux.recoverPanic("jump listener")
+			l.forward(newCh, addr)
+		}(newCh, net.JoinHostPort(payload.Host, strconv.FormatUint(uint64(payload.Port), 10)))
+	}
+}
+
+func (l *JumpListener) forward(newCh ssh.NewChannel, addr string) {
+	conn, err := l.mux.DialConnContext(context.Background(), addr)
+	if err != nil {
+		newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	done := make(chan struct{}, 2)
+	cp := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(ch, conn)
+	go cp(conn, ch)
+	<-done
+}
+
+// Close stop listening and close all client connections.
+func (l *JumpListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	err := l.listener.Close()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	return err
+}
+
+// DialConnContext dial the tcp connection to the address with the same route of
+// DialContext, that's the gates, proxies, transports and host names in configs, but
+// no ssh handshake is done with the address.
+func (m *Mux) DialConnContext(ctx context.Context, addr string) (net.Conn, error) {
+	if m.isClosed() {
+		return nil, ErrMuxClosed
+	}
+	addr = m.normalize(addr)
+	chains, err := m.gateChains(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(chains) == 0 {
+		return m.dialConnDirect(ctx, addr)
+	}
+	var conn net.Conn
+	for _, chain := range chains {
+		conn, err = m.dialConnVia(ctx, addr, chain)
+		if err == nil || err == ErrGateLoop || err == ErrMuxClosed || ctx.Err() != nil {
+			break
+		}
+	}
+	return conn, err
+}
+
+// connAuth return the auth method of the address for the tcp leg, the address may
+// have no auth method since it's authenticated by others.
+func (m *Mux) connAuth(addr string) *Auth {
+	auth, err := m.AgentAuth(addr)
+	if err == nil {
+		return auth
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return &Auth{LocalAddr: m.localAddr, Proxy: m.auth.Proxy, Dialer: m.dialer}
+}
+
+func (m *Mux) dialConnDirect(ctx context.Context, addr string) (net.Conn, error) {
+	if t := m.transport(addr); t != nil {
+		return t.DialContext(ctx, m.resolveHost(addr))
+	}
+	auth := m.connAuth(addr)
+	return auth.dialTCP(ctx, m.resolveHost(addr), time.Duration(auth.TimeoutMs)*time.Millisecond)
+}
+
+func (m *Mux) dialConnVia(ctx context.Context, addr string, hops []string) (net.Conn, error) {
+	gateAddr := hops[len(hops)-1]
+	if gateAddr == addr {
+		return nil, ErrGateLoop
+	}
+	if isProxyGate(gateAddr) {
+		t, err := proxyTransport(gateAddr, m.connAuth(addr))
+		if err != nil {
+			return nil, err
+		}
+		return t.DialContext(ctx, m.resolveHost(addr))
+	}
+	if len(hops) == 1 {
+		hops = nil
+	} else {
+		hops = hops[:len(hops)-1]
+	}
+
+	gate, err := m.dialChain(ctx, gateAddr, hops, []string{addr})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := gate.DialConnContext(ctx, "tcp", m.resolveHost(addr))
+	if err != nil {
+		gate.Close()
+		return nil, err
+	}
+	return &gateConn{Conn: conn, gate: gate}, nil
+}
+
+// gateConn hold the reference of gate until the connection is closed.
+type gateConn struct {
+	net.Conn
+	gate      *SSH
+	closeOnce sync.Once
+}
+
+func (c *gateConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.gate.Close)
+	return err
+}
@@ -0,0 +1,74 @@
+package socker
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestJumpListener(t *testing.T) {
+	node := startAuthServer(t)
+	defer node.Close()
+	connected := make(chan string, 10)
+	proxy := startHTTPProxy(t, connected)
+	defer proxy.Close()
+
+	m, err := NewMux(MuxAuth{
+		AgentGates: map[string]string{"plain:node:22": "http://user:pass@" + proxy.Addr().String()},
+		HostNames:  map[string]string{"node": node.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if _, err = m.NewJumpListener("127.0.0.1:0", nil); err == nil {
+		t.Error("jump listener without server config should be rejected")
+	}
+	config, err := InsecureJumpServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.NewJumpListener("0.0.0.0:0", config); err == nil {
+		t.Error("jump listener without authentication should be rejected on public address")
+	}
+	l, err := m.NewJumpListener("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	jump, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jump.Close()
+
+	for _, addr := range []string{node.Addr().String(), "node:22"} {
+		conn, err := jump.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the node rejects all passwords, the auth error means the client reached it.
+		_, _, _, err = ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+			User:            "root",
+			Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+			t.Errorf("expect auth error from %s, got %v", addr, err)
+		}
+		conn.Close()
+	}
+	if addr := <-connected; addr != node.Addr().String() {
+		t.Errorf("gate isn't used: %s", addr)
+	}
+
+	if _, err = jump.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Error("dial closed port should fail")
+	}
+}
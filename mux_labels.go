@@ -0,0 +1,143 @@
+package socker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// labelTerm is a single condition of selector, "key=value", "key!=value", "key"
+// or "!key".
+type labelTerm struct {
+	key   string
+	value string
+	op    string
+}
+
+const (
+	labelEqual    = "="
+	labelNotEqual = "!="
+	labelExists   = ""
+	labelAbsent   = "!"
+)
+
+func (t labelTerm) match(labels map[string]string) bool {
+	value, has := labels[t.key]
+	switch t.op {
+	case labelEqual:
+		return has && value == t.value
+	case labelNotEqual:
+		return !has || value != t.value
+	case labelAbsent:
+		return !has
+	default:
+		return has
+	}
+}
+
+// labelSelector is the disjunction of conjunctions of terms.
+type labelSelector [][]labelTerm
+
+// parseSelector parse the selector like "env=prod && role=db || role=cache", "&&"
+// binds tighter than "||".
+func parseSelector(selector string) (labelSelector, error) {
+	var sel labelSelector
+	for _, alt := range strings.Split(selector, "||") {
+		var terms []labelTerm
+		for _, s := range strings.Split(alt, "&&") {
+			term, err := parseLabelTerm(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector %q: %s", selector, err.Error())
+			}
+			terms = append(terms, term)
+		}
+		sel = append(sel, terms)
+	}
+	return sel, nil
+}
+
+func parseLabelTerm(s string) (labelTerm, error) {
+	var term labelTerm
+	if i := strings.Index(s, labelNotEqual); i >= 0 {
+		term = labelTerm{key: s[:i], value: s[i+len(labelNotEqual):], op: labelNotEqual}
+	} else if i = strings.Index(s, labelEqual); i >= 0 {
+		term = labelTerm{key: s[:i], value: s[i+len(labelEqual):], op: labelEqual}
+	} else if strings.HasPrefix(s, labelAbsent) {
+		term = labelTerm{key: s[len(labelAbsent):], op: labelAbsent}
+	} else {
+		term = labelTerm{key: s, op: labelExists}
+	}
+	term.key = strings.TrimSpace(term.key)
+	term.value = strings.TrimSpace(term.value)
+	if term.key == "" {
+		return term, fmt.Errorf("empty label key in %q", s)
+	}
+	return term, nil
+}
+
+func (sel labelSelector) match(labels map[string]string) bool {
+	for _, terms := range sel {
+		matched := true
+		for _, term := range terms {
+			if !term.match(labels) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Labels return the labels of the address, nil if there is none.
+func (m *Mux) Labels(addr string) map[string]string {
+	m.mu.RLock()
+	labels := m.labels[m.normalize(addr)]
+	m.mu.RUnlock()
+	if labels == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// Select return the sorted addresses in MuxAuth.HostLabels whose labels match the
+// selector. The selector is conditions joined by "&&" and "||", "&&" binds tighter.
+// Each condition is one of "key=value", "key!=value", "key" for the label exists
+// and "!key" for the label is absent, e.g. "env=prod && role=db || role=cache".
+func (m *Mux) Select(selector string) ([]string, error) {
+	sel, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	m.mu.RLock()
+	for addr, labels := range m.labels {
+		if sel.match(labels) {
+			addrs = append(addrs, addr)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+func copyLabels(hostLabels map[string]map[string]string, normalize func(string) string) map[string]map[string]string {
+	copied := make(map[string]map[string]string, len(hostLabels))
+	for addr, labels := range hostLabels {
+		if addr == "" {
+			continue
+		}
+		l := make(map[string]string, len(labels))
+		for k, v := range labels {
+			l[k] = v
+		}
+		copied[normalize(addr)] = l
+	}
+	return copied
+}
@@ -0,0 +1,51 @@
+package socker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMuxSelect(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		HostLabels: map[string]map[string]string{
+			"db-1:22":    {"env": "prod", "role": "db"},
+			"db-2:22":    {"env": "staging", "role": "db"},
+			"cache-1:22": {"env": "prod", "role": "cache", "canary": "true"},
+			"web-1:22":   {"env": "prod", "role": "web"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	type testCase struct {
+		Selector string
+		Addrs    []string
+	}
+	cases := []testCase{
+		{Selector: "env=prod && role=db", Addrs: []string{"db-1:22"}},
+		{Selector: "role=db", Addrs: []string{"db-1:22", "db-2:22"}},
+		{Selector: "env=prod && role=db || role=cache", Addrs: []string{"cache-1:22", "db-1:22"}},
+		{Selector: "env = prod && role != web", Addrs: []string{"cache-1:22", "db-1:22"}},
+		{Selector: "canary", Addrs: []string{"cache-1:22"}},
+		{Selector: "env=prod && !canary", Addrs: []string{"db-1:22", "web-1:22"}},
+		{Selector: "role=none", Addrs: nil},
+	}
+	for i, c := range cases {
+		addrs, err := m.Select(c.Selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(addrs, c.Addrs) {
+			t.Errorf("test case failed: %d, expect %v, got %v", i, c.Addrs, addrs)
+		}
+	}
+
+	if _, err = m.Select("env=prod && "); err == nil {
+		t.Error("invalid selector should be rejected")
+	}
+	if labels := m.Labels("web-1:22"); labels["role"] != "web" {
+		t.Errorf("unexpected labels: %v", labels)
+	}
+}
@@ -0,0 +1,103 @@
+package socker
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Lease is a reference of the connection cached by Mux, it must be released by
+// Release once it's no longer used.
+type Lease struct {
+	mux        *Mux
+	ssh        *SSH
+	handle     *SSH
+	addr       string
+	acquiredAt time.Time
+	caller     string
+
+	mu       sync.Mutex
+	released bool
+	timer    *time.Timer
+}
+
+// LeaseEvent describe the lease held longer than MuxAuth.LeaseLeakSeconds.
+type LeaseEvent struct {
+	Addr       string
+	AcquiredAt time.Time
+	// Caller is the "file:line" Lease is called at.
+	Caller string
+}
+
+// Lease do the same thing as Dial, but return the connection as a Lease.
+func (m *Mux) Lease(addr string) (*Lease, error) {
+	return m.lease(context.Background(), addr)
+}
+
+// LeaseContext do the same thing as DialContext, but return the connection as a
+// Lease.
+func (m *Mux) LeaseContext(ctx context.Context, addr string) (*Lease, error) {
+	return m.lease(ctx, addr)
+}
+
+func (m *Mux) lease(ctx context.Context, addr string) (*Lease, error) {
+	s, err := m.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Lease{
+		mux:        m,
+		ssh:        s,
+		addr:       addr,
+		acquiredAt: time.Now(),
+	}
+	handle := *s
+	handle.release = l.Release
+	l.handle = &handle
+	if _, file, line, ok := runtime.Caller(2); ok {
+		l.caller = fmt.Sprintf("%s:%d", file, line)
+	}
+	if m.leaseLeak > 0 && m.hooks.OnLeaseLeak != nil {
+		l.timer = time.AfterFunc(m.leaseLeak, l.leaked)
+	}
+	return l, nil
+}
+
+func (l *Lease) leaked() {
+	defer l.mux.recoverPanic("lease")
+
+	l.mu.Lock()
+	released := l.released
+	l.mu.Unlock()
+	if !released {
+		l.mux.hooks.OnLeaseLeak(LeaseEvent{Addr: l.addr, AcquiredAt: l.acquiredAt, Caller: l.caller})
+	}
+}
+
+// SSH return the connection, it shouldn't be used after released. Closing it does
+// the same thing as Release.
+func (l *Lease) SSH() *SSH {
+	return l.handle
+}
+
+// Addr return the address of the connection.
+func (l *Lease) Addr() string {
+	return l.addr
+}
+
+// Release return the connection to Mux, it's safe to be called multiple times.
+func (l *Lease) Release() {
+	l.mu.Lock()
+	if l.released {
+		l.mu.Unlock()
+		return
+	}
+	l.released = true
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	l.mu.Unlock()
+	l.ssh.Close()
+}
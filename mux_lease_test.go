@@ -0,0 +1,74 @@
+package socker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	leaks := make(chan LeaseEvent, 2)
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth:      "default",
+		LeaseLeakSeconds: 1,
+		Hooks: MuxHooks{
+			OnLeaseLeak: func(e LeaseEvent) { leaks <- e },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.sshs["web-1:22"] = LocalOnly()
+
+	released, err := m.Lease("web-1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released.SSH() == nil || released.Addr() != "web-1:22" {
+		t.Errorf("unexpected lease: %+v", released)
+	}
+	released.Release()
+	released.Release()
+
+	closed, err := m.Lease("web-1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := closed.SSH().NopClose()
+	closed.SSH().Close()
+	closed.Release()
+	closed.SSH().Close()
+	if _, refs := m.sshs["web-1:22"].Status(); refs != 1 {
+		t.Errorf("closing leased connection should release once: %d", refs)
+	}
+	clone.Close()
+	if _, refs := m.sshs["web-1:22"].Status(); refs != 0 {
+		t.Errorf("unexpected references: %d", refs)
+	}
+
+	leaked, err := m.Lease("web-1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leaked.Release()
+	select {
+	case e := <-leaks:
+		if e.Addr != "web-1:22" || e.AcquiredAt.IsZero() || e.Caller == "" {
+			t.Errorf("unexpected leak event: %+v", e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("leaked lease should be reported")
+	}
+	select {
+	case e := <-leaks:
+		t.Errorf("released lease shouldn't be reported: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err = m.Lease("127.0.0.1:1"); err == nil {
+		t.Error("lease of unreachable host should fail")
+	}
+}
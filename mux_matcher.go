@@ -3,6 +3,7 @@ package socker
 import (
 	"fmt"
 	"net"
+	"path"
 	"regexp"
 	"strings"
 	"sync"
@@ -16,6 +17,7 @@ type (
 var (
 	rules          = make(map[string]MatchRule)
 	rulePriorities = make(map[string]int)
+	ruleAliases    = make(map[string]string)
 	rulesMu        sync.RWMutex
 )
 
@@ -23,12 +25,20 @@ const (
 	RulePlain  = "plain"
 	RuleRegexp = "regexp"
 	RuleIpnet  = "ipnet"
+	RuleGlob   = "glob"
+
+	RuleRe   = "re"   // alias of RuleRegexp
+	RuleCidr = "cidr" // alias of RuleIpnet
 )
 
 func init() {
 	RegisterMatchRule(RulePlain, matchPlain, 100)
+	RegisterMatchRule(RuleGlob, MatchGlob, 75)
 	RegisterMatchRule(RuleRegexp, matchRegexp, 50)
 	RegisterMatchRule(RuleIpnet, matchIPNet, 0)
+
+	RegisterMatchRuleAlias(RuleRe, RuleRegexp)
+	RegisterMatchRuleAlias(RuleCidr, RuleIpnet)
 }
 
 func RegisterMatchRule(name string, rule MatchRule, priority int) (replaced bool) {
@@ -44,6 +54,14 @@ func RegisterMatchRule(name string, rule MatchRule, priority int) (replaced bool
 	return has
 }
 
+// RegisterMatchRuleAlias make alias refer to the rule name, the alias share the
+// same matcher and priority with the rule.
+func RegisterMatchRuleAlias(alias, name string) {
+	rulesMu.Lock()
+	ruleAliases[alias] = name
+	rulesMu.Unlock()
+}
+
 func ResetRulePriority(name string, priority int) {
 	rulesMu.Lock()
 	_, has := rules[name]
@@ -53,12 +71,31 @@ func ResetRulePriority(name string, priority int) {
 	rulesMu.Unlock()
 }
 
+// SplitRuleAndAddr split the "rule:addr" string. If the string has no rule prefix,
+// or the prefix isn't a registered rule name such as "10.0.0.1:22", the rule
+// will be RulePlain.
 func SplitRuleAndAddr(s string) (rule, addr string) {
 	index := strings.IndexByte(s, ':')
 	if index < 0 {
 		return RulePlain, s
 	}
-	return s[:index], s[index+1:]
+	rule, addr = s[:index], s[index+1:]
+	if r, _ := getMatchRule(rule); r == nil {
+		return RulePlain, s
+	}
+	return rule, addr
+}
+
+// NormalizePattern return the pattern with explicit and canonical rule name, e.g.
+// "10.0.0.1" becomes "plain:10.0.0.1" and "cidr:10.0.0.0/8" becomes "ipnet:10.0.0.0/8".
+func NormalizePattern(pattern string) string {
+	rule, addr := SplitRuleAndAddr(pattern)
+	rulesMu.RLock()
+	if alias, has := ruleAliases[rule]; has {
+		rule = alias
+	}
+	rulesMu.RUnlock()
+	return JoinRuleAndAddr(rule, addr)
 }
 
 func JoinRuleAndAddr(rule, addr string) string {
@@ -67,6 +104,9 @@ func JoinRuleAndAddr(rule, addr string) string {
 
 func getMatchRule(name string) (MatchRule, int) {
 	rulesMu.RLock()
+	if alias, has := ruleAliases[name]; has {
+		name = alias
+	}
 	rule := rules[name]
 	priority := rulePriorities[name]
 	rulesMu.RUnlock()
@@ -85,6 +125,35 @@ func createMatcher(ruleName, addr string) (Matcher, int, error) {
 	return matcher, priority, nil
 }
 
+// ruleSpecificity estimate how specific the pattern is, bigger is more specific.
+func ruleSpecificity(rule, addr string) int {
+	rulesMu.RLock()
+	if alias, has := ruleAliases[rule]; has {
+		rule = alias
+	}
+	rulesMu.RUnlock()
+
+	switch rule {
+	case RuleIpnet:
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return 0
+		}
+		ones, _ := ipnet.Mask.Size()
+		return ones
+	case RuleRegexp:
+		r, err := regexp.Compile(addr)
+		if err != nil {
+			return 0
+		}
+		prefix, _ := r.LiteralPrefix()
+		return len(prefix)
+	case RuleGlob:
+		return len(addr) - strings.Count(addr, "*") - strings.Count(addr, "?")
+	}
+	return len(addr)
+}
+
 func matchRegexp(addr string) (Matcher, error) {
 	r, err := regexp.Compile(addr)
 	if err != nil {
@@ -117,8 +186,38 @@ func matchIPNet(cidr string) (Matcher, error) {
 	}, nil
 }
 
+// matchPlain match address case-insensitively. If the address has no port, the port
+// of destination is ignored.
 func matchPlain(addr string) (Matcher, error) {
+	_, _, err := net.SplitHostPort(addr)
+	hasPort := err == nil
 	return func(dst string) bool {
-		return addr == dst
+		if !hasPort {
+			if host, _, err := net.SplitHostPort(dst); err == nil {
+				dst = host
+			}
+		}
+		return strings.EqualFold(addr, dst)
+	}, nil
+}
+
+// MatchGlob match address by shell pattern such as "*.prod.example.com:22", the
+// syntax is the same as path.Match. If the pattern has no port, the port of address
+// is ignored. It's the rule of "glob:" patterns in MuxAuth.
+func MatchGlob(pattern string) (Matcher, error) {
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return nil, err
+	}
+	hasPort := strings.IndexByte(pattern, ':') >= 0
+	return func(addr string) bool {
+		if !hasPort && strings.IndexByte(addr, ':') >= 0 {
+			host, _, err := net.SplitHostPort(addr)
+			if err == nil {
+				addr = host
+			}
+		}
+		matched, _ := path.Match(pattern, addr)
+		return matched
 	}, nil
 }
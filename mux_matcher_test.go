@@ -0,0 +1,180 @@
+package socker
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSplitRuleAndAddr(t *testing.T) {
+	type testCase struct {
+		Pattern string
+		Rule    string
+		Addr    string
+	}
+
+	cases := []testCase{
+		{Pattern: "10.0.0.1", Rule: RulePlain, Addr: "10.0.0.1"},
+		{Pattern: "10.0.0.1:22", Rule: RulePlain, Addr: "10.0.0.1:22"},
+		{Pattern: "plain:10.0.0.1:22", Rule: RulePlain, Addr: "10.0.0.1:22"},
+		{Pattern: "cidr:10.0.0.0/8", Rule: RuleCidr, Addr: "10.0.0.0/8"},
+		{Pattern: "re:^10\\.", Rule: RuleRe, Addr: "^10\\."},
+	}
+	for i, c := range cases {
+		rule, addr := SplitRuleAndAddr(c.Pattern)
+		if rule != c.Rule || addr != c.Addr {
+			t.Errorf("test case failed: %d, got %s %s", i, rule, addr)
+		}
+	}
+}
+
+func TestMatchRuleAlias(t *testing.T) {
+	matcher, priority, err := createMatcher(SplitRuleAndAddr("cidr:10.0.0.0/8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ipnetPriority := getMatchRule(RuleIpnet)
+	if priority != ipnetPriority {
+		t.Error("alias priority mismatch")
+	}
+	if !matcher("10.1.2.3:22") || matcher("192.168.1.1") {
+		t.Error("alias match failed")
+	}
+}
+
+func TestMatcherOrdering(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AgentGates: map[string]string{
+			"ipnet:10.0.0.0/8":  "wide",
+			"ipnet:10.1.0.0/16": "narrow",
+		},
+		AgentGateRules: []MatchEntry{
+			{Pattern: "ipnet:10.2.0.0/16", Value: "first"},
+			{Pattern: "ipnet:10.2.3.0/24", Value: "second"},
+		},
+		MostSpecific: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	cases := map[string]string{
+		"10.1.2.3:22": "narrow",
+		"10.3.2.3:22": "wide",
+		"10.2.3.4:22": "first",
+	}
+	for addr, gate := range cases {
+		if got := m.AgentGate(addr); got != gate {
+			t.Errorf("gate match failed %s: expect %s, got %s", addr, gate, got)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	type testCase struct {
+		Pattern string
+		Addr    string
+		Match   bool
+	}
+
+	cases := []testCase{
+		{Pattern: "*.prod.example.com:22", Addr: "db.prod.example.com:22", Match: true},
+		{Pattern: "*.prod.example.com:22", Addr: "db.prod.example.com:2222", Match: false},
+		{Pattern: "*.prod.example.com:22", Addr: "db.dev.example.com:22", Match: false},
+		{Pattern: "*.prod.example.com", Addr: "db.prod.example.com:22", Match: true},
+		{Pattern: "*.prod.example.com", Addr: "db.prod.example.com", Match: true},
+		{Pattern: "web-?.example.com", Addr: "web-1.example.com:22", Match: true},
+		{Pattern: "web-?.example.com", Addr: "web-10.example.com:22", Match: false},
+		{Pattern: "10.0.*:22", Addr: "10.0.0.1:22", Match: true},
+		{Pattern: "10.0.*", Addr: "10.1.0.1:22", Match: false},
+		{Pattern: "web-[0-9].example.com", Addr: "web-3.example.com:22", Match: true},
+	}
+	for i, c := range cases {
+		matcher, err := MatchGlob(c.Pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matcher(c.Addr) != c.Match {
+			t.Errorf("test case failed: %d", i)
+		}
+	}
+
+	if _, err := MatchGlob("[a-"); err == nil {
+		t.Error("invalid pattern should be rejected")
+	}
+}
+
+func TestGateChain(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AgentGates: map[string]string{
+			"glob:10.1.*": "jump:22",
+			"jump:22":     "bastion:22",
+			"glob:10.2.*": "bastion:22, jump2:22",
+			"loop-a:22":   "loop-b:22",
+			"loop-b:22":   "loop-a:22",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	cases := map[string]string{
+		"10.1.2.3:22": "bastion:22,jump:22",
+		"10.2.2.3:22": "bastion:22,jump2:22",
+		"10.9.2.3:22": "",
+	}
+	for addr, chain := range cases {
+		hops, err := m.GateChain(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(hops, ","); got != chain {
+			t.Errorf("gate chain failed %s: expect %s, got %s", addr, chain, got)
+		}
+	}
+	if _, err = m.GateChain("loop-a:22"); err != ErrGateLoop {
+		t.Errorf("gate loop isn't detected: %v", err)
+	}
+	if _, err = m.DialContext(context.Background(), "loop-a:22"); err != ErrGateLoop {
+		t.Errorf("gate loop isn't detected: %v", err)
+	}
+
+	_, err = NewMux(MuxAuth{
+		AgentGates: map[string]string{"10.0.0.1": "bastion:22,,jump:22"},
+	})
+	if err == nil {
+		t.Error("invalid gate chain should be rejected")
+	}
+}
+
+func TestGateFailover(t *testing.T) {
+	var dialed []string
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth: "default",
+		AgentGates: map[string]string{
+			"10.0.0.1:22": "127.0.0.1:1 | 127.0.0.1:2",
+		},
+		Hooks: MuxHooks{
+			OnDial: func(e ConnEvent) {
+				dialed = append(dialed, e.Addr)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	_, err = m.Dial("10.0.0.1:22")
+	if err == nil {
+		t.Fatal("dial should fail")
+	}
+	if got := strings.Join(dialed, ","); got != "127.0.0.1:1,127.0.0.1:2" {
+		t.Errorf("gates aren't tried in order: %s", got)
+	}
+}
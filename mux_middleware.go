@@ -0,0 +1,76 @@
+package socker
+
+import (
+	"context"
+)
+
+// Kinds of operations passed to middlewares.
+const (
+	OpDial   = "dial"
+	OpRcmd   = "rcmd"
+	OpRcmdBg = "rcmd-bg"
+	OpPut    = "put"
+	OpGet    = "get"
+)
+
+// Operation describe the operation wrapped by middlewares.
+type Operation struct {
+	Kind string
+	// Addr is the address of remote host.
+	Addr string
+	// Cmd is the command of OpRcmd and OpRcmdBg.
+	Cmd string
+	// Src and Dst are the paths of OpPut and OpGet.
+	Src string
+	Dst string
+}
+
+// Op run the operation, the op passed to middleware runs the wrapped operation and
+// can be called several times, e.g. for retrying.
+type Op func(ctx context.Context, op Operation) error
+
+// Middleware wrap the next Op to add cross-cutting logic such as auditing, retrying,
+// rate limiting and tracing.
+type Middleware func(next Op) Op
+
+// Use append middlewares which wrap dials of Mux, and commands and transfers of SSH
+// instances returned by Mux. Middlewares added earlier are outer. Instances dialed
+// before Use are not affected.
+func (m *Mux) Use(mws ...Middleware) {
+	m.mu.Lock()
+	m.middlewares = append(m.middlewares[:len(m.middlewares):len(m.middlewares)], mws...)
+	m.mu.Unlock()
+}
+
+func (m *Mux) useMiddlewares() []Middleware {
+	m.mu.RLock()
+	mws := m.middlewares
+	m.mu.RUnlock()
+	return mws
+}
+
+// runOp run the fn wrapped by middlewares, fn is called with the context passed by
+// the innermost middleware.
+func runOp(ctx context.Context, mws []Middleware, op Operation, fn func(ctx context.Context) error) error {
+	if len(mws) == 0 {
+		return fn(ctx)
+	}
+	var next Op = func(ctx context.Context, _ Operation) error {
+		return fn(ctx)
+	}
+	for i := len(mws) - 1; i >= 0; i-- {
+		next = mws[i](next)
+	}
+	return next(ctx, op)
+}
+
+func (s *SSH) runOp(op Operation, fn func() error) error {
+	return s.runOpContext(context.Background(), op, func(context.Context) error {
+		return fn()
+	})
+}
+
+func (s *SSH) runOpContext(ctx context.Context, op Operation, fn func(ctx context.Context) error) error {
+	op.Addr = s.addr
+	return runOp(ctx, s.middlewares, op, fn)
+}
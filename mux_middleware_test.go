@@ -0,0 +1,95 @@
+package socker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret", TimeoutMs: 1000}},
+		DefaultAuth: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	var ops []string
+	audit := func(next Op) Op {
+		return func(ctx context.Context, op Operation) error {
+			ops = append(ops, op.Kind+" "+op.Addr+" "+op.Cmd)
+			return next(ctx, op)
+		}
+	}
+	retry := func(next Op) Op {
+		return func(ctx context.Context, op Operation) error {
+			err := next(ctx, op)
+			if err != nil && op.Kind == OpDial {
+				err = next(ctx, op)
+			}
+			return err
+		}
+	}
+	var dials int
+	count := func(next Op) Op {
+		return func(ctx context.Context, op Operation) error {
+			dials++
+			return next(ctx, op)
+		}
+	}
+	m.Use(audit, retry)
+	m.Use(count)
+
+	_, err = m.Dial("127.0.0.1:1")
+	if err == nil {
+		t.Fatal("dial closed port should fail")
+	}
+	if dials != 2 || !reflect.DeepEqual(ops, []string{"dial 127.0.0.1:1 "}) {
+		t.Errorf("unexpected middleware calls: %d %v", dials, ops)
+	}
+
+	dir, err := ioutil.TempDir("", "socker-middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err = ioutil.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ops = nil
+	denied := errors.New("denied")
+	s := LocalOnly()
+	s.addr = "local"
+	s.DryRun(ioutil.Discard)
+	s.middlewares = []Middleware{audit, func(next Op) Op {
+		return func(ctx context.Context, op Operation) error {
+			if op.Kind == OpGet {
+				return denied
+			}
+			return next(ctx, op)
+		}
+	}}
+	s.Rcmd("uptime")
+	s.Put(src, filepath.Join(dir, "dst"))
+	if s.Error() != nil {
+		t.Fatal(s.Error())
+	}
+	if _, err = os.Stat(filepath.Join(dir, "dst")); err != nil {
+		t.Error("file isn't put")
+	}
+	s.Get(src, filepath.Join(dir, "got"))
+	if s.Error() != denied {
+		t.Errorf("expect denied, got %v", s.Error())
+	}
+	if !reflect.DeepEqual(ops, []string{"rcmd local uptime", "put local ", "get local "}) {
+		t.Errorf("unexpected operations: %v", ops)
+	}
+}
@@ -0,0 +1,188 @@
+package socker
+
+import (
+	"errors"
+	"time"
+)
+
+// Option configure the MuxAuth used by New.
+type Option func(a *options)
+
+// options is the MuxAuth configured by options.
+type options struct {
+	MuxAuth
+	// applied is the number of options applied before.
+	applied int
+	err     error
+}
+
+// New create Mux with the options. It's the options form of NewMux in the same
+// module, NewMux and MuxAuth are kept for compatibility and configs loaded from file.
+// Rules added by options are ordered, the first matched rule wins.
+func New(opts ...Option) (*Mux, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+		o.applied++
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+	return NewMux(o.MuxAuth)
+}
+
+// WithConfig use the MuxAuth as the base configs, such as loaded by LoadConfigFile,
+// following options are applied to it. It must be the first option, otherwise New
+// fails since the configs set by previous options would be discarded.
+func WithConfig(auth MuxAuth) Option {
+	return func(a *options) {
+		if a.applied > 0 {
+			a.err = errors.New("WithConfig must be the first option")
+			return
+		}
+		a.MuxAuth = auth
+	}
+}
+
+// WithAuth add the auth method with the id, it can be referenced by WithAuthRule.
+func WithAuth(id string, auth *Auth) Option {
+	return func(a *options) {
+		if a.AuthMethods == nil {
+			a.AuthMethods = make(map[string]*Auth)
+		}
+		a.AuthMethods[id] = auth
+	}
+}
+
+// WithDefaultAuth add the auth method and use it for destination hosts no rule
+// matched.
+func WithDefaultAuth(id string, auth *Auth) Option {
+	return func(a *options) {
+		WithAuth(id, auth)(a)
+		a.DefaultAuth = id
+	}
+}
+
+// WithAuthRule append an ordered rule to use the auth method of id for destination
+// hosts matched the pattern, see MuxAuth.AgentAuths for the pattern format.
+func WithAuthRule(pattern, id string) Option {
+	return func(a *options) {
+		a.AgentAuthRules = append(a.AgentAuthRules, MatchEntry{Pattern: pattern, Value: id})
+	}
+}
+
+// WithGateRule append an ordered rule to use the gate for destination hosts matched
+// the pattern, see MuxAuth.AgentGates for the pattern and gate format.
+func WithGateRule(pattern, gate string) Option {
+	return func(a *options) {
+		a.AgentGateRules = append(a.AgentGateRules, MatchEntry{Pattern: pattern, Value: gate})
+	}
+}
+
+// WithKeepalive set the lifetime of idle connections and the interval of pinging
+// cached connections, 0 ping means disabled. They are rounded up to seconds.
+func WithKeepalive(idle, ping time.Duration) Option {
+	return func(a *options) {
+		a.KeepAliveSeconds = durationSeconds(idle)
+		a.PingSeconds = durationSeconds(ping)
+	}
+}
+
+func durationSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// WithRetry set the retry policy of dials.
+func WithRetry(policy RetryPolicy) Option {
+	return func(a *options) {
+		a.Retry = policy
+	}
+}
+
+// WithDefaults set the fleet-wide defaults of dials.
+func WithDefaults(defaults MuxOptions) Option {
+	return func(a *options) {
+		a.Defaults = defaults
+	}
+}
+
+// Limits are the resource limits of Mux, see the fields of MuxAuth with the same
+// names.
+type Limits struct {
+	MaxConns         int
+	MaxConnsFailFast bool
+	MaxConnBytes     int64
+	DialRate         RateLimit
+	GateDialRate     RateLimit
+}
+
+// WithLimits set the resource limits.
+func WithLimits(limits Limits) Option {
+	return func(a *options) {
+		a.MaxConns = limits.MaxConns
+		a.MaxConnsFailFast = limits.MaxConnsFailFast
+		a.MaxConnBytes = limits.MaxConnBytes
+		a.DialRate = limits.DialRate
+		a.GateDialRate = limits.GateDialRate
+	}
+}
+
+// Logger is the logger used by WithLogger, *log.Logger satisfy it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// WithLogger log failed dials, evictions, circuit breaker changes, leaked leases, config
+// reloads and recovered panics to the logger. Hooks and PanicHandler set before it are still
+// called.
+func WithLogger(logger Logger) Option {
+	return func(a *options) {
+		hooks := a.Hooks
+		a.Hooks.OnDial = func(e ConnEvent) {
+			if e.Err != nil {
+				logger.Printf("socker: dial %s failed: %s", e.Addr, e.Err.Error())
+			}
+			if hooks.OnDial != nil {
+				hooks.OnDial(e)
+			}
+		}
+		a.Hooks.OnEvict = func(e ConnEvent) {
+			logger.Printf("socker: evict %s: %s", e.Addr, e.Reason)
+			if hooks.OnEvict != nil {
+				hooks.OnEvict(e)
+			}
+		}
+		a.Hooks.OnBreaker = func(e BreakerEvent) {
+			logger.Printf("socker: circuit breaker of %s changed from %s to %s", e.Addr, e.From, e.To)
+			if hooks.OnBreaker != nil {
+				hooks.OnBreaker(e)
+			}
+		}
+		a.Hooks.OnReload = func(e ReloadEvent) {
+			if e.Err != nil {
+				logger.Printf("socker: reload configs %s failed: %s", e.Path, e.Err.Error())
+			} else {
+				logger.Printf("socker: reload configs %s: %s", e.Path, e.Fingerprint)
+			}
+			if hooks.OnReload != nil {
+				hooks.OnReload(e)
+			}
+		}
+		a.Hooks.OnLeaseLeak = func(e LeaseEvent) {
+			logger.Printf("socker: lease of %s acquired at %s is not released since %s", e.Addr, e.Caller, e.AcquiredAt.Format(time.RFC3339))
+			if hooks.OnLeaseLeak != nil {
+				hooks.OnLeaseLeak(e)
+			}
+		}
+		handler := a.PanicHandler
+		a.PanicHandler = func(err *PanicError) {
+			logger.Printf("socker: %s\n%s", err.Error(), err.Stack)
+			if handler != nil {
+				handler(err)
+			}
+		}
+	}
+}
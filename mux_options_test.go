@@ -0,0 +1,98 @@
+package socker
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		dials int
+	)
+	m, err := New(
+		WithConfig(MuxAuth{Hooks: MuxHooks{OnDial: func(ConnEvent) { dials++ }}}),
+		WithDefaultAuth("default", &Auth{User: "root", Password: "secret"}),
+		WithAuth("admin", &Auth{User: "admin", Password: "secret"}),
+		WithAuthRule("glob:db-*", "admin"),
+		WithAuthRule("glob:*", "default"),
+		WithGateRule("glob:db-*", "bastion:22"),
+		WithKeepalive(1500*time.Millisecond, 0),
+		WithRetry(RetryPolicy{Attempts: 1}),
+		WithLimits(Limits{MaxConns: 8}),
+		WithLogger(log.New(&buf, "", 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if auth, err := m.AgentAuth("db-1:22"); err != nil || auth.User != "admin" {
+		t.Errorf("ordered rule should win: %+v %v", auth, err)
+	}
+	if cap(m.connSlots) != 8 {
+		t.Errorf("unexpected limits: %d", cap(m.connSlots))
+	}
+	if idle, _ := m.keepAliveConfig(); idle != 2*time.Second {
+		t.Errorf("keepalive should be rounded up: %s", idle)
+	}
+
+	m.Dial("127.0.0.1:1")
+	if dials != 1 || !strings.Contains(buf.String(), "socker: dial 127.0.0.1:1 failed") {
+		t.Errorf("dial failure should be logged and hooks kept: %d %q", dials, buf.String())
+	}
+
+	if _, err = New(WithAuthRule("glob:db-*", "missing")); err == nil {
+		t.Error("rule of missing auth method should be invalid")
+	}
+	if _, err = New(WithRetry(RetryPolicy{Attempts: 1}), WithConfig(MuxAuth{})); err == nil {
+		t.Error("WithConfig after other options should be rejected")
+	}
+}
+
+func TestMuxDefaults(t *testing.T) {
+	admin := &Auth{User: "admin", Password: "secret", TimeoutMs: 1000}
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+			"admin":   admin,
+		},
+		DefaultAuth: "default",
+		Defaults: MuxOptions{
+			TimeoutMs:        3000,
+			MaxSession:       4,
+			Retry:            RetryPolicy{Attempts: 3},
+			KeepAliveSeconds: 60,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	auth, err := m.AgentAuth("web-1:22")
+	if err != nil || auth.TimeoutMs != 3000 || auth.MaxSession != 4 {
+		t.Errorf("defaults should be applied: %+v %v", auth, err)
+	}
+	if admin.TimeoutMs != 1000 || admin.MaxSession != 4 {
+		t.Errorf("fields set should be kept: %+v", admin)
+	}
+	if m.retry.Attempts != 3 {
+		t.Errorf("default retry should be applied: %+v", m.retry)
+	}
+	if idle, _ := m.keepAliveConfig(); idle != time.Minute {
+		t.Errorf("default keepalive should be applied: %s", idle)
+	}
+
+	explicit := MuxAuth{KeepAliveSeconds: 60, Retry: RetryPolicy{Attempts: 3}}
+	defaults := MuxAuth{Defaults: MuxOptions{KeepAliveSeconds: 60, Retry: RetryPolicy{Attempts: 3}}}
+	if explicit.Fingerprint() != defaults.Fingerprint() {
+		t.Error("defaults should be normalized in fingerprint")
+	}
+	if _, err = NewMux(MuxAuth{Defaults: MuxOptions{Retry: RetryPolicy{Jitter: 2}}}); err == nil {
+		t.Error("invalid default retry should be rejected")
+	}
+}
@@ -0,0 +1,126 @@
+package socker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// RateLimit limit the rate of new ssh handshakes by token bucket, dials beyond the
+// limit wait for their turn in order.
+type RateLimit struct {
+	// Rate is the count of dials allowed per second, 0 means unlimited.
+	Rate float64
+	// Burst is the count of dials allowed at once, default is 1.
+	Burst int
+}
+
+func (r RateLimit) validate() error {
+	if r.Rate < 0 || r.Burst < 0 {
+		return errors.New("invalid rate limit")
+	}
+	return nil
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter hold the token buckets of keys, such as the destination address.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    limit.Rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// reserve take a token of the key and return the duration to wait for it.
+func (l *rateLimiter) reserve(key string, now time.Time) time.Duration {
+	const maxBuckets = 1024
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / l.rate * float64(time.Second))
+}
+
+// cancel give back the token of the key which isn't used.
+func (l *rateLimiter) cancel(key string) {
+	l.mu.Lock()
+	if b := l.buckets[key]; b != nil {
+		b.tokens++
+	}
+	l.mu.Unlock()
+}
+
+// prune remove the buckets which are full, called with mu locked.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// wait wait for the token of the key, it returns the context error if it's done.
+func (l *rateLimiter) wait(ctx context.Context, key string) error {
+	if l == nil || key == "" {
+		return nil
+	}
+	d := l.reserve(key, time.Now())
+	if d <= 0 {
+		return nil
+	}
+	err := sleepContext(ctx, d)
+	if err != nil {
+		l.cancel(key)
+	}
+	return err
+}
+
+// waitDialRate wait until the dial to the address through the gate is allowed by
+// MuxAuth.DialRate and MuxAuth.GateDialRate.
+func (m *Mux) waitDialRate(ctx context.Context, addr, gateAddr string) error {
+	err := m.dialRate.wait(ctx, addr)
+	if err == nil {
+		err = m.gateDialRate.wait(ctx, gateAddr)
+		if err != nil && m.dialRate != nil {
+			m.dialRate.cancel(addr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package socker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(RateLimit{Rate: 10, Burst: 2})
+	now := time.Now()
+	for i, expect := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if d := l.reserve("a", now); d != expect {
+			t.Errorf("reserve %d: expect %s, got %s", i, expect, d)
+		}
+	}
+	if d := l.reserve("b", now); d != 0 {
+		t.Errorf("keys should be limited separately: %s", d)
+	}
+	if d := l.reserve("a", now.Add(time.Second)); d != 0 {
+		t.Errorf("tokens should be refilled: %s", d)
+	}
+	if newRateLimiter(RateLimit{}) != nil {
+		t.Error("zero rate should be unlimited")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, "a"); err != context.Canceled {
+		t.Errorf("wait should be canceled: %v", err)
+	}
+}
+
+func TestDialRate(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth: "default",
+		DialRate:    RateLimit{Rate: 20},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		m.Dial("127.0.0.1:1")
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("dials should be limited: %s", d)
+	}
+
+	_, err = NewMux(MuxAuth{GateDialRate: RateLimit{Rate: -1}})
+	if err == nil {
+		t.Error("negative rate should be invalid")
+	}
+}
+
+func TestDialRateBeforeConnSlot(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth:      "default",
+		DialRate:         RateLimit{Rate: 2},
+		MaxConns:         1,
+		MaxConnsFailFast: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	m.Dial("127.0.0.1:1")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Dial("127.0.0.1:1")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if _, err = m.Dial("127.0.0.1:2"); err == ErrTooManyConns {
+		t.Error("dial waiting for the rate shouldn't hold the connection slot")
+	}
+	<-done
+}
@@ -0,0 +1,115 @@
+package socker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+const bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// RebootOptions control how RebootAndWait reboot the host and wait for it.
+type RebootOptions struct {
+	// Cmd is the reboot command, default is "reboot". It's run in background after
+	// a short delay so the session can return before the connection is dropped.
+	Cmd string
+	// PollInterval is the interval between reconnections, default is 5s.
+	PollInterval time.Duration
+	// DialTimeout is the timeout of each reconnection, default is 10s.
+	DialTimeout time.Duration
+	// CheckBootID compare the boot id of host before and after the reboot, so a
+	// host still alive before the reboot happened isn't treated as returned.
+	// Otherwise at least one failed reconnection is required.
+	CheckBootID bool
+}
+
+func (o *RebootOptions) setDefaults() {
+	if o.Cmd == "" {
+		o.Cmd = "reboot"
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = 5 * time.Second
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = 10 * time.Second
+	}
+}
+
+// RebootAndWait reboot the host, evict the cached connection of it, then wait until
+// the host is reachable again. The new connection is cached and returned, it should
+// be closed by caller. The waiting is bounded by ctx.
+func (m *Mux) RebootAndWait(ctx context.Context, addr string, opts RebootOptions) (*SSH, error) {
+	opts.setDefaults()
+	addr = m.normalize(addr)
+
+	agent, err := m.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var bootID []byte
+	if opts.CheckBootID {
+		bootID, err = readBootID(agent)
+		if err != nil {
+			agent.Close()
+			return nil, fmt.Errorf("read boot id of %s failed: %s", addr, err.Error())
+		}
+	}
+	err = agent.runRcmd(fmt.Sprintf("nohup sh -c %s >/dev/null 2>&1 &", shellQuote("sleep 1; "+opts.Cmd)))
+	agent.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reboot %s failed: %s", addr, err.Error())
+	}
+	m.evictAddr(addr, EvictReboot)
+
+	failed := false
+	timer := time.NewTimer(opts.PollInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("wait for %s to reboot: %s", addr, ctx.Err().Error())
+		case <-timer.C:
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, opts.DialTimeout)
+		agent, err = m.DialContext(dialCtx, addr)
+		cancel()
+		switch {
+		case err != nil:
+			failed = true
+		case opts.CheckBootID:
+			id, err := readBootID(agent)
+			if err == nil && !bytes.Equal(id, bootID) {
+				return agent, nil
+			}
+			agent.Close()
+			m.evictAddr(addr, EvictReboot)
+		case failed:
+			return agent, nil
+		default:
+			agent.Close()
+			m.evictAddr(addr, EvictReboot)
+		}
+		timer.Reset(opts.PollInterval)
+	}
+}
+
+func readBootID(s *SSH) ([]byte, error) {
+	id, err := s.readFile(s.rfs, bootIDPath)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(id), nil
+}
+
+// evictAddr evict the cached connection of the address.
+func (m *Mux) evictAddr(addr, reason string) bool {
+	m.sshsMu.RLock()
+	s := m.sshs[addr]
+	m.sshsMu.RUnlock()
+	if s == nil {
+		return false
+	}
+	return m.evict(addr, s, reason)
+}
@@ -0,0 +1,118 @@
+package socker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRebootAndWait(t *testing.T) {
+	var reasons []string
+	m, err := NewMux(MuxAuth{
+		Hooks: MuxHooks{
+			OnEvict: func(e ConnEvent) {
+				reasons = append(reasons, e.Reason)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	const addr = "127.0.0.1:1"
+	var cmds bytes.Buffer
+	agent := LocalOnly()
+	agent.DryRun(&cmds)
+	m.sshs[addr] = agent
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = m.RebootAndWait(ctx, addr, RebootOptions{PollInterval: 20 * time.Millisecond})
+	if err == nil {
+		t.Fatal("host shouldn't return")
+	}
+	if !strings.Contains(cmds.String(), "reboot") {
+		t.Errorf("reboot isn't issued: %q", cmds.String())
+	}
+	if len(reasons) != 1 || reasons[0] != EvictReboot {
+		t.Errorf("unexpected evictions: %v", reasons)
+	}
+	m.sshsMu.RLock()
+	_, cached := m.sshs[addr]
+	m.sshsMu.RUnlock()
+	if cached {
+		t.Error("connection should be evicted")
+	}
+}
+
+func TestRebootOptionsDefaults(t *testing.T) {
+	var opts RebootOptions
+	opts.setDefaults()
+	if opts.Cmd != "reboot" || opts.PollInterval != 5*time.Second || opts.DialTimeout != 10*time.Second {
+		t.Errorf("unexpected defaults: %+v", opts)
+	}
+}
+
+func TestRebootCmdQuoted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-reboot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := startExecServer(t)
+	defer l.Close()
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	out := filepath.Join(dir, "out")
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	// the host never goes down, only the quoting of command is checked.
+	m.RebootAndWait(ctx, l.Addr().String(), RebootOptions{
+		Cmd:          "echo 'it''s done' >" + out,
+		PollInterval: 50 * time.Millisecond,
+	})
+	for i := 0; i < 40; i++ {
+		data, _ := ioutil.ReadFile(out)
+		if string(data) == "its done\n" {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	data, _ := ioutil.ReadFile(out)
+	t.Fatalf("reboot command isn't run as is: %q", data)
+}
+
+func TestRebootSftpOnly(t *testing.T) {
+	var execs int32
+	l := startSftpOnlyServer(t, true, &execs)
+	defer l.Close()
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = m.RebootAndWait(ctx, l.Addr().String(), RebootOptions{PollInterval: 20 * time.Millisecond})
+	if err == nil || ctx.Err() != nil || !strings.Contains(err.Error(), ErrSftpOnly.Error()) {
+		t.Fatalf("reboot should fail without waiting: %v", err)
+	}
+}
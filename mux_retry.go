@@ -0,0 +1,84 @@
+package socker
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy define how failed dials of Mux are retried with exponential backoff.
+type RetryPolicy struct {
+	// Attempts is the max count of dial attempts including the first one, 0 or 1
+	// means no retry.
+	Attempts int
+	// BackoffMs is the wait duration before the first retry, it's doubled for each
+	// following retry and limited by MaxBackoffMs. Default is 100.
+	BackoffMs    int
+	MaxBackoffMs int
+	// Jitter randomize each wait duration in the range of [1-Jitter, 1+Jitter] times,
+	// it should be in [0, 1].
+	Jitter float64
+	// Retryable reports whether the dial error should be retried, default is
+	// DefaultRetryable.
+	Retryable func(err error) bool `json:"-"`
+}
+
+// DefaultRetryable retry the dial errors caused by timeout and network failures,
+// errors of authentication, host key checking and cancellation are never retried.
+func DefaultRetryable(err error) bool {
+	switch dialFailureReason(err) {
+	case FailureTimeout, FailureRefused, FailureNetwork:
+		return true
+	}
+	return false
+}
+
+// backoff return the wait duration before next attempt, false means no more attempts.
+func (p *RetryPolicy) backoff(attempt int, err error) (time.Duration, bool) {
+	if attempt+1 >= p.Attempts {
+		return 0, false
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = DefaultRetryable
+	}
+	if !retryable(err) {
+		return 0, false
+	}
+
+	const defaultBackoffMs = 100
+	backoff := time.Duration(p.BackoffMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = defaultBackoffMs * time.Millisecond
+	}
+	maxBackoff := time.Duration(p.MaxBackoffMs) * time.Millisecond
+	for i := 0; i < attempt && (maxBackoff <= 0 || backoff < maxBackoff); i++ {
+		backoff *= 2
+	}
+	if maxBackoff > 0 && backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	if p.Jitter > 0 {
+		backoff = time.Duration(float64(backoff) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return backoff, true
+}
+
+func (m *Mux) retryPolicy() RetryPolicy {
+	m.mu.RLock()
+	p := m.retry
+	m.mu.RUnlock()
+	return p
+}
+
+// sleepContext wait for the duration, it returns the context error if it's done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+package socker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Attempts: 5, BackoffMs: 100, MaxBackoffMs: 300}
+	refused := errors.New("dial tcp 127.0.0.1:1: connect: connection refused")
+
+	expects := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for attempt, expect := range expects {
+		d, ok := p.backoff(attempt, refused)
+		if !ok || d != expect {
+			t.Errorf("backoff failed: %d, expect %s, got %s %t", attempt, expect, d, ok)
+		}
+	}
+	if _, ok := p.backoff(4, refused); ok {
+		t.Error("attempts should be limited")
+	}
+	if _, ok := p.backoff(0, errors.New("ssh: unable to authenticate")); ok {
+		t.Error("auth error shouldn't be retried")
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d, _ := p.backoff(0, refused)
+		if d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("jitter out of range: %s", d)
+		}
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	var attempts int
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth: "default",
+		Retry:       RetryPolicy{Attempts: 3, BackoffMs: 1},
+		Hooks: MuxHooks{
+			OnDial: func(ConnEvent) {
+				attempts++
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	_, err = m.Dial("127.0.0.1:1")
+	if err == nil {
+		t.Fatal("dial should fail")
+	}
+	if attempts != 3 {
+		t.Errorf("expect 3 attempts, got %d", attempts)
+	}
+	if stats := m.Stats(); stats.Dials != 3 || stats.DialFailures[FailureRefused] != 3 {
+		t.Errorf("stats mismatch: %+v", stats)
+	}
+}
@@ -0,0 +1,172 @@
+package socker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WarmCheckInterval is the interval addresses in MuxAuth.WarmAddrs are checked and
+// dialed if they should be kept warm.
+var WarmCheckInterval = time.Minute
+
+// Schedule decide whether connections should be kept warm, warm connections are
+// never closed by idle keepalive checking.
+type Schedule interface {
+	// KeepWarm reports whether the connection to addr should be kept warm at the time.
+	KeepWarm(addr string, now time.Time) bool
+}
+
+// DailySchedule keep connections to matched addresses warm in a daily time window,
+// e.g. 8am-8pm on weekdays.
+type DailySchedule struct {
+	matchers []Matcher
+	start    time.Duration
+	end      time.Duration
+	days     map[time.Weekday]bool
+	loc      *time.Location
+}
+
+var _ Schedule = (*DailySchedule)(nil)
+
+// NewDailySchedule create a DailySchedule, the patterns are the format of
+// "matcher:matchor" and empty patterns matches all addresses. The start and end are
+// offsets from midnight, the window crosses midnight if end is less than start. Empty
+// days means everyday, nil location means time.Local.
+func NewDailySchedule(patterns []string, start, end time.Duration, days []time.Weekday, loc *time.Location) (*DailySchedule, error) {
+	const day = 24 * time.Hour
+	if start < 0 || start >= day || end < 0 || end > day {
+		return nil, fmt.Errorf("invalid schedule window: %s-%s", start, end)
+	}
+	s := &DailySchedule{
+		start: start,
+		end:   end,
+		loc:   loc,
+	}
+	for _, pattern := range patterns {
+		matcher, _, err := createMatcher(SplitRuleAndAddr(pattern))
+		if err != nil {
+			return nil, err
+		}
+		s.matchers = append(s.matchers, matcher)
+	}
+	if len(days) > 0 {
+		s.days = make(map[time.Weekday]bool)
+		for _, d := range days {
+			s.days[d] = true
+		}
+	}
+	if s.loc == nil {
+		s.loc = time.Local
+	}
+	return s, nil
+}
+
+func (s *DailySchedule) match(addr string) bool {
+	if len(s.matchers) == 0 {
+		return true
+	}
+	for _, matcher := range s.matchers {
+		if matcher(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DailySchedule) KeepWarm(addr string, now time.Time) bool {
+	if !s.match(addr) {
+		return false
+	}
+	now = now.In(s.loc)
+	y, mon, d := now.Date()
+	offset := now.Sub(time.Date(y, mon, d, 0, 0, 0, 0, s.loc))
+	weekday := now.Weekday()
+	var in bool
+	if s.start <= s.end {
+		in = offset >= s.start && offset < s.end
+	} else if offset >= s.start {
+		in = true
+	} else if offset < s.end {
+		// the window started yesterday.
+		in = true
+		weekday = (weekday + 6) % 7
+	}
+	return in && (s.days == nil || s.days[weekday])
+}
+
+func (m *Mux) keepWarm(addr string, now time.Time) bool {
+	return m.schedule != nil && m.schedule.KeepWarm(addr, now)
+}
+
+func (m *Mux) warm(addrs []string) {
+	go func() {
+		ticker := time.NewTicker(WarmCheckInterval)
+		defer ticker.Stop()
+
+		m.checkWarm(addrs, time.Now())
+		for {
+			select {
+			case <-m.done:
+				return
+			case now := <-ticker.C:
+				m.checkWarm(addrs, now)
+			}
+		}
+	}()
+}
+
+// checkWarm dial the addresses should be kept warm but not connected yet.
+func (m *Mux) checkWarm(addrs []string, now time.Time) {
+	defer m.recoverPanic("warm")
+
+	for _, addr := range addrs {
+		if !m.keepWarm(addr, now) {
+			continue
+		}
+		m.sshsMu.RLock()
+		_, has := m.sshs[addr]
+		m.sshsMu.RUnlock()
+		if has {
+			continue
+		}
+		agent, err := m.Dial(addr)
+		if err == nil {
+			agent.Close()
+		}
+	}
+}
+
+// Warm dial the addresses concurrently so the connections are cached before they are
+// used, gates are dialed and cached too. At most BroadcastConcurrency addresses are
+// dialed concurrently. Warmed connections are still closed after idle for the
+// keepalive duration unless they are kept warm by MuxAuth.KeepWarm. The failed
+// addresses are returned with the errors, nil if all succeeded.
+func (m *Mux) Warm(ctx context.Context, addrs ...string) map[string]error {
+	var (
+		mu      sync.Mutex
+		errs    map[string]error
+		indexes = make([]int, len(addrs))
+		failed  = func(i int, err error) {
+			mu.Lock()
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[addrs[i]] = err
+			mu.Unlock()
+		}
+	)
+	for i := range addrs {
+		indexes[i] = i
+	}
+	runLimited(ctx, indexes, BroadcastConcurrency, "warm", func(i int) {
+		agent, err := m.DialContext(ctx, addrs[i])
+		if err != nil {
+			failed(i, err)
+			return
+		}
+		agent.Close()
+	}, failed)
+	return errs
+}
@@ -0,0 +1,81 @@
+package socker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDailySchedule(t *testing.T) {
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	s, err := NewDailySchedule([]string{"glob:bastion-*"}, 8*time.Hour, 20*time.Hour, weekdays, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	night, err := NewDailySchedule(nil, 22*time.Hour, 2*time.Hour, []time.Weekday{time.Friday}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		Schedule Schedule
+		Addr     string
+		Time     string
+		Warm     bool
+	}
+	cases := []testCase{
+		{Schedule: s, Addr: "bastion-1:22", Time: "2026-10-15T08:00:00Z", Warm: true},
+		{Schedule: s, Addr: "bastion-1:22", Time: "2026-10-15T19:59:59Z", Warm: true},
+		{Schedule: s, Addr: "bastion-1:22", Time: "2026-10-15T20:00:00Z", Warm: false},
+		{Schedule: s, Addr: "bastion-1:22", Time: "2026-10-15T07:00:00Z", Warm: false},
+		{Schedule: s, Addr: "bastion-1:22", Time: "2026-10-17T10:00:00Z", Warm: false},
+		{Schedule: s, Addr: "web-1:22", Time: "2026-10-15T10:00:00Z", Warm: false},
+		{Schedule: night, Addr: "web-1:22", Time: "2026-10-16T23:00:00Z", Warm: true},
+		{Schedule: night, Addr: "web-1:22", Time: "2026-10-17T01:00:00Z", Warm: true},
+		{Schedule: night, Addr: "web-1:22", Time: "2026-10-17T23:00:00Z", Warm: false},
+		{Schedule: night, Addr: "web-1:22", Time: "2026-10-16T01:00:00Z", Warm: false},
+	}
+	for i, c := range cases {
+		now, err := time.Parse(time.RFC3339, c.Time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if warm := c.Schedule.KeepWarm(c.Addr, now); warm != c.Warm {
+			t.Errorf("test case failed: %d, expect %t, got %t", i, c.Warm, warm)
+		}
+	}
+
+	_, err = NewDailySchedule(nil, 25*time.Hour, time.Hour, nil, nil)
+	if err == nil {
+		t.Error("invalid window should be rejected")
+	}
+}
+
+func TestWarm(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	m.sshs["cached:22"] = LocalOnly()
+	errs := m.Warm(context.Background(), "cached:22", "127.0.0.1:1")
+	if len(errs) != 1 || errs["127.0.0.1:1"] == nil {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if _, refs := m.sshs["cached:22"].Status(); refs != 0 {
+		t.Errorf("warmed connection shouldn't be referenced: %d", refs)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errs = m.Warm(ctx, "127.0.0.1:1")
+	if errs["127.0.0.1:1"] == nil {
+		t.Error("warm should fail after context done")
+	}
+}
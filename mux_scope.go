@@ -0,0 +1,104 @@
+package socker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrOutOfScope is returned if the address isn't in the scope of MuxScope.
+var ErrOutOfScope = errors.New("address is out of scope")
+
+// MuxScope is a view of Mux restricted to a subset of hosts, it shares the connection
+// cache and configs with Mux. Gates are still dialed even if they are out of scope.
+type MuxScope struct {
+	mux     *Mux
+	matches []func(addr string) bool
+}
+
+// Scope return the view of Mux restricted to the hosts matched the scope. If the scope
+// has a registered rule prefix such as "glob:web-*" or "ipnet:10.0.0.0/8", it's
+// matched against the addresses, otherwise it's a label selector like Select and
+// the labels are checked each time since they may be changed by Reload.
+func (m *Mux) Scope(scope string) (*MuxScope, error) {
+	s := &MuxScope{mux: m}
+	return s.Scope(scope)
+}
+
+// Scope return the narrower view of hosts matched both scopes.
+func (s *MuxScope) Scope(scope string) (*MuxScope, error) {
+	match, err := s.mux.scopeMatcher(scope)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]func(string) bool, 0, len(s.matches)+1)
+	matches = append(matches, s.matches...)
+	return &MuxScope{mux: s.mux, matches: append(matches, match)}, nil
+}
+
+func (m *Mux) scopeMatcher(scope string) (func(addr string) bool, error) {
+	rule, addr := SplitRuleAndAddr(scope)
+	if addr != scope {
+		matcher, _, err := createMatcher(rule, addr)
+		if err != nil {
+			return nil, err
+		}
+		return matcher, nil
+	}
+	sel, err := parseSelector(scope)
+	if err != nil {
+		return nil, err
+	}
+	return func(addr string) bool {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return sel.match(m.labels[addr])
+	}, nil
+}
+
+// Contains report whether the address is in the scope.
+func (s *MuxScope) Contains(addr string) bool {
+	addr = s.mux.normalize(addr)
+	for _, match := range s.matches {
+		if !match(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Dial do the same thing as Mux.Dial, but addresses out of scope are rejected with
+// ErrOutOfScope.
+func (s *MuxScope) Dial(addr string) (*SSH, error) {
+	return s.DialContext(context.Background(), addr)
+}
+
+// DialTimeout do the same thing as Mux.DialTimeout for addresses in scope.
+func (s *MuxScope) DialTimeout(addr string, timeout time.Duration) (*SSH, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.DialContext(ctx, addr)
+}
+
+// DialContext do the same thing as Mux.DialContext for addresses in scope.
+func (s *MuxScope) DialContext(ctx context.Context, addr string) (*SSH, error) {
+	if !s.Contains(addr) {
+		return nil, ErrOutOfScope
+	}
+	return s.mux.DialContext(ctx, addr)
+}
+
+// Select do the same thing as Mux.Select, but only addresses in scope are returned.
+func (s *MuxScope) Select(selector string) ([]string, error) {
+	addrs, err := s.mux.Select(selector)
+	if err != nil {
+		return nil, err
+	}
+	scoped := addrs[:0]
+	for _, addr := range addrs {
+		if s.Contains(addr) {
+			scoped = append(scoped, addr)
+		}
+	}
+	return scoped, nil
+}
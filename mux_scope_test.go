@@ -0,0 +1,63 @@
+package socker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+		HostLabels: map[string]map[string]string{
+			"web-1:22": {"role": "web", "env": "prod"},
+			"web-2:22": {"role": "web", "env": "dev"},
+			"db-1:22":  {"role": "db", "env": "prod"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.sshs["web-1:22"] = LocalOnly()
+	m.sshs["db-1:22"] = LocalOnly()
+
+	web, err := m.Scope("glob:web-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := web.Dial("web-1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.Close()
+	if _, err = web.Dial("db-1:22"); err != ErrOutOfScope {
+		t.Errorf("address out of scope should be rejected: %v", err)
+	}
+	addrs, err := web.Select("env=prod")
+	if err != nil || !reflect.DeepEqual(addrs, []string{"web-1:22"}) {
+		t.Errorf("unexpected selected addresses: %v %v", addrs, err)
+	}
+
+	prod, err := m.Scope("env=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prod.Contains("db-1:22") || prod.Contains("web-2:22") {
+		t.Error("label scope should match labels")
+	}
+	narrow, err := prod.Scope("role=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !narrow.Contains("web-1:22") || narrow.Contains("db-1:22") || prod.Contains("web-2:22") {
+		t.Error("nested scope should match both scopes")
+	}
+
+	if _, err = m.Scope("&&"); err == nil {
+		t.Error("invalid selector should be rejected")
+	}
+	if _, err = m.Scope("regexp:("); err == nil {
+		t.Error("invalid pattern should be rejected")
+	}
+}
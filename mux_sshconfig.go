@@ -0,0 +1,377 @@
+package socker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshConfigHost is a Host block of OpenSSH config.
+type sshConfigHost struct {
+	patterns       []string
+	hostName       string
+	user           string
+	port           string
+	identityFiles  []string
+	identitiesOnly string
+	proxyJump      string
+}
+
+// matchAll reports whether the block applies to all hosts, such as "Host *".
+func (h *sshConfigHost) matchAll() bool {
+	return len(h.patterns) == 1 && h.patterns[0] == "*"
+}
+
+// match reports whether the block applies to the lower case host, negated patterns
+// exclude the host even if other patterns matched.
+func (h *sshConfigHost) match(host string) bool {
+	matched := false
+	for _, pattern := range h.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := path.Match(strings.ToLower(strings.TrimPrefix(pattern, "!")), host)
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// literal reports whether the block only applies to literal hosts.
+func (h *sshConfigHost) literal() bool {
+	for _, pattern := range h.patterns {
+		if !strings.HasPrefix(pattern, "!") && !isSSHConfigLiteral(pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+func isSSHConfigLiteral(pattern string) bool {
+	return !strings.ContainsAny(pattern, "*?!")
+}
+
+// merge fill the options which are not set from other block, the first obtained
+// value is used like OpenSSH, except identity files are accumulated.
+func (h *sshConfigHost) merge(o *sshConfigHost) {
+	set := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	set(&h.hostName, o.hostName)
+	set(&h.user, o.user)
+	set(&h.port, o.port)
+	set(&h.identitiesOnly, o.identitiesOnly)
+	set(&h.proxyJump, o.proxyJump)
+	h.identityFiles = append(h.identityFiles, o.identityFiles...)
+}
+
+// splitSSHConfigArgs split the arguments by whitespace, double quoted argument can
+// contain whitespace.
+func splitSSHConfigArgs(s string) ([]string, error) {
+	var (
+		args   []string
+		arg    strings.Builder
+		quoted bool
+		inArg  bool
+	)
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote: %s", s)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// parseSSHConfig parse the Host blocks of OpenSSH config, options before the first
+// Host are treated as "Host *", Match blocks are skipped.
+func parseSSHConfig(r io.Reader) ([]*sshConfigHost, error) {
+	var (
+		hosts   []*sshConfigHost
+		current = &sshConfigHost{patterns: []string{"*"}}
+		lineno  int
+	)
+	hosts = append(hosts, current)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		lineno++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexAny(line, " \t=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: missing argument: %s", lineno, line)
+		}
+		keyword := strings.ToLower(line[:i])
+		rest := strings.TrimSpace(line[i:])
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+		args, err := splitSSHConfigArgs(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err.Error())
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("line %d: missing argument: %s", lineno, line)
+		}
+
+		switch keyword {
+		case "host":
+			current = &sshConfigHost{patterns: args}
+			hosts = append(hosts, current)
+			continue
+		case "match":
+			current = nil
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		switch keyword {
+		case "hostname":
+			current.merge(&sshConfigHost{hostName: args[0]})
+		case "user":
+			current.merge(&sshConfigHost{user: args[0]})
+		case "port":
+			current.merge(&sshConfigHost{port: args[0]})
+		case "identityfile":
+			current.identityFiles = append(current.identityFiles, args[0])
+		case "identitiesonly":
+			current.merge(&sshConfigHost{identitiesOnly: strings.ToLower(args[0])})
+		case "proxyjump":
+			current.merge(&sshConfigHost{proxyJump: args[0]})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func expandHome(path, home string) string {
+	if path == "~" {
+		return home
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(home, path[2:])
+	}
+	return strings.Replace(path, "%d", home, -1)
+}
+
+// usableIdentityFiles return the identity files which exist, passphrase protected
+// files are skipped unless identitiesOnly is set, they are expected to be held by
+// ssh-agent.
+func usableIdentityFiles(files []string, identitiesOnly bool) []string {
+	var usable []string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil || stringsContain(usable, file) {
+			continue
+		}
+		_, err = ssh.ParsePrivateKey(data)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok && !identitiesOnly {
+			continue
+		}
+		usable = append(usable, file)
+	}
+	return usable
+}
+
+// proxyJumpChain convert the ProxyJump value to gate chain, users of jump hosts are
+// ignored, they are authenticated by the matched auth method.
+func proxyJumpChain(proxyJump string) string {
+	if proxyJump == "" || strings.ToLower(proxyJump) == "none" {
+		return GateDirect
+	}
+	hops := strings.Split(proxyJump, ",")
+	for i, hop := range hops {
+		hop = strings.TrimSpace(hop)
+		hop = strings.TrimPrefix(hop, "ssh://")
+		if at := strings.LastIndexByte(hop, '@'); at >= 0 {
+			hop = hop[at+1:]
+		}
+		if _, _, err := net.SplitHostPort(hop); err != nil {
+			hop = net.JoinHostPort(hop, "22")
+		}
+		hops[i] = hop
+	}
+	return strings.Join(hops, ",")
+}
+
+// LoadSSHConfig convert the OpenSSH config file to MuxAuth, empty path means
+// "~/.ssh/config". User and IdentityFile become auth methods with ssh-agent enabled,
+// ProxyJump becomes gate chains and HostName and Port become HostNames.
+//
+// Options of literal hosts like "Host bastion" are merged from all the matching blocks
+// in file order like OpenSSH, the first obtained value wins, their rules are checked
+// first. Other hosts are matched against the wildcard patterns by glob rules in file
+// order, options in "Host *" blocks are applied to them.
+//
+// HostName and Port of wildcard blocks, including "Host *", can't be applied to hosts
+// which aren't listed, they are rejected. Match blocks, Include and tokens except "~",
+// "%d" and "%h" aren't supported.
+func LoadSSHConfig(path string) (MuxAuth, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return MuxAuth{}, err
+	}
+	if path == "" {
+		path = filepath.Join(home, ".ssh", "config")
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return MuxAuth{}, err
+	}
+	defer fd.Close()
+	hosts, err := parseSSHConfig(fd)
+	if err != nil {
+		return MuxAuth{}, fmt.Errorf("parse ssh config %s failed: %s", path, err.Error())
+	}
+	for _, host := range hosts {
+		if !host.literal() && (host.hostName != "" || host.port != "") {
+			return MuxAuth{}, fmt.Errorf("parse ssh config %s failed: HostName and Port of wildcard hosts aren't supported: Host %s",
+				path, strings.Join(host.patterns, " "))
+		}
+	}
+
+	defaultUser := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		defaultUser = u.Username
+	}
+	defaultIdentities := []string{"id_rsa", "id_ecdsa", "id_ed25519"}
+	for i, name := range defaultIdentities {
+		defaultIdentities[i] = filepath.Join(home, ".ssh", name)
+	}
+
+	auth := MuxAuth{
+		AuthMethods: make(map[string]*Auth),
+		HostNames:   make(map[string]string),
+	}
+	addAuth := func(id string, h *sshConfigHost) {
+		files := h.identityFiles
+		if len(files) == 0 {
+			files = append(files, defaultIdentities...)
+		}
+		for j := range files {
+			files[j] = expandHome(files[j], home)
+		}
+		identitiesOnly := h.identitiesOnly == "yes"
+		username := h.user
+		if username == "" {
+			username = defaultUser
+		}
+		auth.AuthMethods[id] = &Auth{
+			User:            username,
+			PrivateKeyFiles: usableIdentityFiles(files, identitiesOnly),
+			IdentitiesOnly:  identitiesOnly,
+			Methods:         []string{MethodAgent, MethodKey},
+		}
+	}
+
+	var literals []string
+	for _, host := range hosts {
+		for _, pattern := range host.patterns {
+			pattern = strings.ToLower(pattern)
+			if isSSHConfigLiteral(pattern) && !stringsContain(literals, pattern) {
+				literals = append(literals, pattern)
+			}
+		}
+	}
+	for i, name := range literals {
+		merged := &sshConfigHost{}
+		for _, h := range hosts {
+			if h.match(name) {
+				merged.merge(h)
+			}
+		}
+		id := fmt.Sprintf("ssh-config-host-%d", i)
+		addAuth(id, merged)
+		rule := JoinRuleAndAddr(RuleGlob, name)
+		auth.AgentAuthRules = append(auth.AgentAuthRules, MatchEntry{Pattern: rule, Value: id})
+		auth.AgentGateRules = append(auth.AgentGateRules, MatchEntry{Pattern: rule, Value: proxyJumpChain(merged.proxyJump)})
+		if merged.hostName == "" && merged.port == "" {
+			continue
+		}
+		hostName := merged.hostName
+		if hostName == "" {
+			hostName = name
+		}
+		hostName = strings.Replace(hostName, "%h", name, -1)
+		if merged.port != "" {
+			hostName = net.JoinHostPort(hostName, merged.port)
+		}
+		auth.HostNames[name] = hostName
+	}
+
+	var globalRules []MatchEntry
+	for i, host := range hosts {
+		if host.literal() {
+			continue
+		}
+		// merge the "Host *" blocks in file order.
+		merged := &sshConfigHost{}
+		for j, h := range hosts {
+			if j == i || h.matchAll() {
+				merged.merge(h)
+			}
+		}
+		id := fmt.Sprintf("ssh-config-%d", i)
+		addAuth(id, merged)
+		gate := proxyJumpChain(merged.proxyJump)
+
+		if host.matchAll() {
+			auth.DefaultAuth = id
+			if merged.proxyJump != "" && len(globalRules) == 0 {
+				globalRules = append(globalRules, MatchEntry{Pattern: JoinRuleAndAddr(RuleGlob, "*"), Value: gate})
+			}
+			continue
+		}
+		for _, pattern := range host.patterns {
+			if strings.HasPrefix(pattern, "!") || isSSHConfigLiteral(pattern) {
+				continue
+			}
+			rule := JoinRuleAndAddr(RuleGlob, pattern)
+			auth.AgentAuthRules = append(auth.AgentAuthRules, MatchEntry{Pattern: rule, Value: id})
+			if merged.proxyJump != "" {
+				auth.AgentGateRules = append(auth.AgentGateRules, MatchEntry{Pattern: rule, Value: gate})
+			}
+		}
+	}
+	auth.AgentGateRules = append(auth.AgentGateRules, globalRules...)
+	return auth, nil
+}
+
+// MuxFromSSHConfig create a Mux from the OpenSSH config file, see LoadSSHConfig.
+func MuxFromSSHConfig(path string) (*Mux, error) {
+	auth, err := LoadSSHConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMux(auth)
+}
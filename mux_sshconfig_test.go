@@ -0,0 +1,116 @@
+package socker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSSHConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(path, []byte(`
+# global options
+IdentitiesOnly yes
+
+Host bastion
+    HostName 203.0.113.10
+    Port 2222
+    ProxyJump none
+
+Host jump
+    HostName=10.0.0.2
+
+Host *.prod web-?
+    User root
+    ProxyJump bastion,admin@jump:22
+
+Host web-1 db.prod
+    User alice
+    Port 2200
+
+Match host foo
+    User ignored
+
+Host *
+    User deploy
+    ProxyJump bastion
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := LoadSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadConfigFile(path); err != nil || loaded.Fingerprint() != auth.Fingerprint() {
+		t.Errorf("ssh_config isn't loaded by LoadConfigFile: %v", err)
+	}
+	m, err := NewMux(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if addr := m.resolveHost("bastion:22"); addr != "203.0.113.10:2222" {
+		t.Errorf("host name isn't resolved: %s", addr)
+	}
+	if addr := m.resolveHost("jump:22"); addr != "10.0.0.2:22" {
+		t.Errorf("host name isn't resolved: %s", addr)
+	}
+	if addr := m.resolveHost("db.prod:22"); addr != "db.prod:2200" {
+		t.Errorf("host name isn't resolved: %s", addr)
+	}
+
+	cases := map[string]string{
+		"api.prod:22": "bastion:22,jump:22",
+		"web-1:22":    "bastion:22,jump:22",
+		"db.prod:22":  "bastion:22,jump:22",
+		"bastion:22":  "",
+		"jump:22":     "bastion:22",
+		"db.dev:22":   "bastion:22",
+	}
+	for addr, chain := range cases {
+		hops, err := m.GateChain(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(hops, ","); got != chain {
+			t.Errorf("gate chain failed %s: expect %s, got %s", addr, chain, got)
+		}
+	}
+
+	users := map[string]string{
+		"api.prod:22": "root",
+		"web-1:22":    "root",
+		"web-2:22":    "root",
+		"bastion:22":  "deploy",
+		"db.dev:22":   "deploy",
+	}
+	for addr, user := range users {
+		a, err := m.AgentAuth(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.User != user || !a.IdentitiesOnly {
+			t.Errorf("auth mismatch %s: %s %t", addr, a.User, a.IdentitiesOnly)
+		}
+	}
+
+	for _, config := range []string{"Host *\n    Port 2222\n", "Host *.prod\n    HostName 10.0.0.3\n"} {
+		if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = LoadSSHConfig(path); err == nil {
+			t.Errorf("host name of wildcard hosts should be rejected: %q", config)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package socker
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons of dial failures reported by MuxStats.DialFailures.
+const (
+	FailureTimeout  = "timeout"
+	FailureCanceled = "canceled"
+	FailureRefused  = "refused"
+	FailureAuth     = "auth"
+	FailureHostKey  = "hostkey"
+	FailureLimit    = "limit"
+	FailureNetwork  = "network"
+	FailureOther    = "other"
+)
+
+// MuxStats is a snapshot of Mux counters.
+type MuxStats struct {
+	// OpenConns is the count of cached connections.
+	OpenConns int
+	// Dials is the count of new connection attempts.
+	Dials int64
+	// DialFailures is the count of failed dials by reason.
+	DialFailures map[string]int64
+	// CacheHits and CacheMisses are the count of Dial calls which are served by
+	// cached connections or not.
+	CacheHits   int64
+	CacheMisses int64
+	// IdleEvictions, PingEvictions and LRUEvictions are the count of connections
+	// closed by keepalive, ping and MaxConns.
+	IdleEvictions int64
+	PingEvictions int64
+	LRUEvictions  int64
+	// Recycles is the count of connections recycled by MaxConnBytes.
+	Recycles int64
+	// BytesIn and BytesOut are the bytes transferred by cached connections.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// CacheHitRatio return the ratio of Dial calls served by cached connections.
+func (s MuxStats) CacheHitRatio() float64 {
+	total := s.CacheHits + s.CacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.CacheHits) / float64(total)
+}
+
+type muxCounters struct {
+	dials         int64
+	cacheHits     int64
+	cacheMisses   int64
+	idleEvictions int64
+	pingEvictions int64
+	lruEvictions  int64
+	recycles      int64
+
+	failuresMu sync.Mutex
+	failures   map[string]int64
+}
+
+func (c *muxCounters) incr(counter *int64) {
+	atomic.AddInt64(counter, 1)
+}
+
+func (c *muxCounters) dialFailed(err error) {
+	reason := dialFailureReason(err)
+	c.failuresMu.Lock()
+	if c.failures == nil {
+		c.failures = make(map[string]int64)
+	}
+	c.failures[reason]++
+	c.failuresMu.Unlock()
+}
+
+func dialFailureReason(err error) string {
+	switch err {
+	case context.Canceled:
+		return FailureCanceled
+	case context.DeadlineExceeded:
+		return FailureTimeout
+	case ErrTooManyConns:
+		return FailureLimit
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return FailureTimeout
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "unable to authenticate"), strings.Contains(msg, "no auth method"):
+		return FailureAuth
+	case strings.Contains(msg, "host key"):
+		return FailureHostKey
+	case strings.Contains(msg, "connection refused"):
+		return FailureRefused
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+		return FailureTimeout
+	}
+	if _, ok := err.(net.Error); ok {
+		return FailureNetwork
+	}
+	return FailureOther
+}
+
+// Stats return the snapshot of counters.
+func (m *Mux) Stats() MuxStats {
+	c := &m.counters
+	stats := MuxStats{
+		Dials:         atomic.LoadInt64(&c.dials),
+		CacheHits:     atomic.LoadInt64(&c.cacheHits),
+		CacheMisses:   atomic.LoadInt64(&c.cacheMisses),
+		IdleEvictions: atomic.LoadInt64(&c.idleEvictions),
+		PingEvictions: atomic.LoadInt64(&c.pingEvictions),
+		LRUEvictions:  atomic.LoadInt64(&c.lruEvictions),
+		Recycles:      atomic.LoadInt64(&c.recycles),
+		DialFailures:  make(map[string]int64),
+	}
+	c.failuresMu.Lock()
+	for reason, n := range c.failures {
+		stats.DialFailures[reason] = n
+	}
+	c.failuresMu.Unlock()
+
+	m.sshsMu.RLock()
+	stats.OpenConns = len(m.sshs)
+	for _, s := range m.sshs {
+		in, out := s.Traffic()
+		stats.BytesIn += in
+		stats.BytesOut += out
+	}
+	m.sshsMu.RUnlock()
+	return stats
+}
+
+// SessionSlots return the session usage of the cached connection to the address, so
+// schedulers can put work on hosts with available sessions. If the connection isn't
+// cached, the slots are estimated by MaxSession of the auth method.
+func (m *Mux) SessionSlots(addr string) (SessionSlots, error) {
+	m.sshsMu.RLock()
+	s, has := m.sshs[m.normalize(addr)]
+	m.sshsMu.RUnlock()
+	if has {
+		return s.SessionSlots(), nil
+	}
+
+	auth, err := m.AgentAuth(addr)
+	if err != nil {
+		return SessionSlots{}, err
+	}
+	return newSessionPool(auth.MaxSession).Slots(), nil
+}
+
+// CachedSessionSlots return the session usage of all cached connections by address.
+func (m *Mux) CachedSessionSlots() map[string]SessionSlots {
+	m.sshsMu.RLock()
+	slots := make(map[string]SessionSlots, len(m.sshs))
+	for addr, s := range m.sshs {
+		slots[addr] = s.SessionSlots()
+	}
+	m.sshsMu.RUnlock()
+	return slots
+}
+
+// ConnInfo is the snapshot of a connection held by Mux.
+type ConnInfo struct {
+	Addr string
+	// Gate is the address of gate the connection goes through, empty if it's
+	// connected directly.
+	Gate   string
+	OpenAt time.Time
+	UsedAt time.Time
+	// Refs is the reference count, including the references held by connections
+	// through it as gate.
+	Refs     int32
+	BytesIn  int64
+	BytesOut int64
+	Slots    SessionSlots
+	// Retired reports whether the connection is recycled and waiting for references
+	// released, see MuxAuth.MaxConnBytes.
+	Retired bool
+}
+
+// Sessions return the snapshot of cached and retired connections sorted by address.
+func (m *Mux) Sessions() []ConnInfo {
+	info := func(s *SSH, retired bool) ConnInfo {
+		openAt, refs := s.Status()
+		in, out := s.Traffic()
+		c := ConnInfo{
+			Addr:     s.addr,
+			OpenAt:   openAt,
+			UsedAt:   s.UsedAt(),
+			Refs:     refs,
+			BytesIn:  in,
+			BytesOut: out,
+			Slots:    s.SessionSlots(),
+			Retired:  retired,
+		}
+		if s.gate != nil {
+			c.Gate = s.gate.addr
+		}
+		return c
+	}
+
+	m.sshsMu.RLock()
+	conns := make([]ConnInfo, 0, len(m.sshs)+len(m.retired))
+	for addr, s := range m.sshs {
+		c := info(s, false)
+		c.Addr = addr
+		conns = append(conns, c)
+	}
+	for _, s := range m.retired {
+		conns = append(conns, info(s, true))
+	}
+	m.sshsMu.RUnlock()
+	sort.SliceStable(conns, func(i, j int) bool {
+		if conns[i].Addr != conns[j].Addr {
+			return conns[i].Addr < conns[j].Addr
+		}
+		return !conns[i].Retired && conns[j].Retired
+	})
+	return conns
+}
@@ -0,0 +1,40 @@
+package socker
+
+import (
+	"testing"
+)
+
+func TestSessions(t *testing.T) {
+	m, err := NewMux(MuxAuth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	gate := LocalOnly()
+	gate.addr = "bastion:22"
+	agent := LocalOnly()
+	agent.addr = "web:22"
+	agent.gate = gate.NopClose()
+	retired := LocalOnly()
+	retired.addr = "web:22"
+	m.sshs["bastion:22"] = gate
+	m.sshs["web:22"] = agent
+	m.retired = append(m.retired, retired)
+	lease := agent.NopClose()
+	defer lease.Close()
+
+	conns := m.Sessions()
+	if len(conns) != 3 {
+		t.Fatalf("unexpected sessions: %+v", conns)
+	}
+	if c := conns[0]; c.Addr != "bastion:22" || c.Gate != "" || c.Refs != 1 || c.Retired {
+		t.Errorf("unexpected gate session: %+v", c)
+	}
+	if c := conns[1]; c.Addr != "web:22" || c.Gate != "bastion:22" || c.Refs != 1 || c.Retired || c.OpenAt.IsZero() {
+		t.Errorf("unexpected agent session: %+v", c)
+	}
+	if c := conns[2]; c.Addr != "web:22" || c.Refs != 0 || !c.Retired {
+		t.Errorf("unexpected retired session: %+v", c)
+	}
+}
@@ -0,0 +1,136 @@
+package socker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"text/template"
+
+	"github.com/cosiner/socker/shellq"
+)
+
+// HostInfo is the data of command templates rendered for a host.
+type HostInfo struct {
+	// Addr is the normalized address like "web-1:22".
+	Addr string
+	// Host and Port are split from Addr.
+	Host string
+	Port string
+	// HostName is the real host connected to, see MuxAuth.HostNames.
+	HostName string
+	// Label and Var are the labels and custom variables of the address, see
+	// MuxAuth.HostLabels and MuxAuth.HostVars. They are never nil.
+	Label map[string]string
+	Var   map[string]string
+}
+
+// HostInfo return the template data of the address.
+func (m *Mux) HostInfo(addr string) HostInfo {
+	addr = m.normalize(addr)
+	info := HostInfo{
+		Addr:  addr,
+		Label: m.Labels(addr),
+		Var:   make(map[string]string),
+	}
+	info.Host, info.Port, _ = net.SplitHostPort(addr)
+	info.HostName, _, _ = net.SplitHostPort(m.resolveHost(addr))
+	if info.Label == nil {
+		info.Label = make(map[string]string)
+	}
+	m.mu.RLock()
+	for k, v := range m.vars[addr] {
+		info.Var[k] = v
+	}
+	m.mu.RUnlock()
+	return info
+}
+
+// cmdWord is the value of command templates, it's printed as a shell word quoted by
+// shellq.Word.
+type cmdWord string
+
+func (w cmdWord) String() string {
+	return shellq.Word(string(w))
+}
+
+// cmdData is the HostInfo whose values are printed as shell words.
+type cmdData struct {
+	Addr     cmdWord
+	Host     cmdWord
+	Port     cmdWord
+	HostName cmdWord
+	Label    map[string]cmdWord
+	Var      map[string]cmdWord
+}
+
+func newCmdData(info HostInfo) cmdData {
+	words := func(m map[string]string) map[string]cmdWord {
+		w := make(map[string]cmdWord, len(m))
+		for k, v := range m {
+			w[k] = cmdWord(v)
+		}
+		return w
+	}
+	return cmdData{
+		Addr:     cmdWord(info.Addr),
+		Host:     cmdWord(info.Host),
+		Port:     cmdWord(info.Port),
+		HostName: cmdWord(info.HostName),
+		Label:    words(info.Label),
+		Var:      words(info.Var),
+	}
+}
+
+// rawValue return the value without quoting.
+func rawValue(v interface{}) string {
+	if w, ok := v.(cmdWord); ok {
+		return string(w)
+	}
+	return fmt.Sprint(v)
+}
+
+var templateFuncs = template.FuncMap{
+	"raw": rawValue,
+	"quote": func(v interface{}) string {
+		return shellq.Quote(rawValue(v))
+	},
+}
+
+// parseCmdTemplate parse the command template, missing keys are errors so typos
+// aren't rendered as empty strings.
+func parseCmdTemplate(tmpl string) (*template.Template, error) {
+	return template.New("cmd").Funcs(templateFuncs).Option("missingkey=error").Parse(tmpl)
+}
+
+func renderCmd(t *template.Template, info HostInfo) (string, error) {
+	var buf bytes.Buffer
+	err := t.Execute(&buf, newCmdData(info))
+	return buf.String(), err
+}
+
+// Render render the command template of text/template with the HostInfo of address,
+// e.g. "hostname > /tmp/{{.Label.role}}.txt". Missing labels and variables are errors.
+// Values are quoted by shellq.Word, so they are always single shell words, the "raw"
+// function print the value as is for trusted values containing shell syntax, e.g.
+// "{{raw .Var.pipeline}}", and "quote" always quote the value by shellq.Quote.
+func (m *Mux) Render(addr, tmpl string) (string, error) {
+	t, err := parseCmdTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	return renderCmd(t, m.HostInfo(addr))
+}
+
+// BroadcastTemplate do the same thing as Broadcast, but the command is rendered for
+// each host by Render, hosts whose command can't be rendered fail with the error
+// without running it.
+func (m *Mux) BroadcastTemplate(ctx context.Context, selector, tmpl string) ([]BroadcastResult, error) {
+	t, err := parseCmdTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	return m.broadcastAll(ctx, selector, CmdStep{Cmd: tmpl}.Name(), func(addr string) (string, error) {
+		return renderCmd(t, m.HostInfo(addr))
+	}, nil, "")
+}
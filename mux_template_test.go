@@ -0,0 +1,62 @@
+package socker
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestBroadcastTemplate(t *testing.T) {
+	l1 := startExecServer(t)
+	defer l1.Close()
+	l2 := startExecServer(t)
+	defer l2.Close()
+	addr1, addr2 := l1.Addr().String(), l2.Addr().String()
+	_, port1, _ := net.SplitHostPort(addr1)
+
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+		HostLabels: map[string]map[string]string{
+			addr1: {"role": "web"},
+			addr2: {"role": "web"},
+		},
+		HostVars: map[string]map[string]string{
+			addr1: {"motd": "it's $HOME", "cmd": "echo a; echo b"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	got, err := m.Render(addr1, "echo {{.Label.role}} {{.Port}} {{quote .Var.motd}}")
+	if err != nil || got != "echo web "+port1+` 'it'\''s $HOME'` {
+		t.Errorf("unexpected rendered command: %v %s", err, got)
+	}
+	got, err = m.Render(addr1, "echo {{.Var.motd}} {{.Var.cmd}}; {{raw .Var.cmd}}")
+	if err != nil || got != `echo 'it'\''s $HOME' 'echo a; echo b'; echo a; echo b` {
+		t.Errorf("values should be quoted unless they are raw: %v %s", err, got)
+	}
+
+	results, err := m.BroadcastTemplate(context.Background(), "role=web", "echo {{.Label.role}} {{quote .Var.motd}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		switch r.Addr {
+		case addr1:
+			if r.Err != nil || string(r.Output) != "web it's $HOME\n" {
+				t.Errorf("unexpected result: %v %q", r.Err, r.Output)
+			}
+		case addr2:
+			if r.Err == nil || r.Output != nil {
+				t.Errorf("missing variable should fail: %+v", r)
+			}
+		}
+	}
+
+	if _, err := m.BroadcastTemplate(context.Background(), "role=web", "echo {{"); err == nil {
+		t.Error("invalid template should be rejected")
+	}
+}
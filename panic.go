@@ -0,0 +1,63 @@
+package socker
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is the panic recovered in goroutines started by socker.
+type PanicError struct {
+	// Goroutine is the name of the goroutine panicked, such as "keepalive" and
+	// "tunnel".
+	Goroutine string
+	Value     interface{}
+	Stack     []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in %s: %v", e.Goroutine, e.Value)
+}
+
+// PanicHandler is called with the panics recovered in background goroutines, the
+// goroutines are kept running if possible.
+type PanicHandler func(err *PanicError)
+
+// DefaultPanicHandler handle the panics of goroutines not owned by Mux such as tunnels,
+// and Mux without MuxAuth.PanicHandler. The panics are dropped if it's nil.
+var DefaultPanicHandler PanicHandler
+
+func newPanicError(goroutine string, v interface{}) *PanicError {
+	return &PanicError{Goroutine: goroutine, Value: v, Stack: debug.Stack()}
+}
+
+// recoverPanic must be deferred directly, it recover the panic and report it to the
+// handler.
+func recoverPanic(handler PanicHandler, goroutine string) {
+	if v := recover(); v != nil {
+		handlePanic(handler, goroutine, v)
+	}
+}
+
+// recoverPanic do the same thing as recoverPanic with MuxAuth.PanicHandler.
+func (m *Mux) recoverPanic(goroutine string) {
+	if v := recover(); v != nil {
+		handlePanic(m.panicHandler, goroutine, v)
+	}
+}
+
+func handlePanic(handler PanicHandler, goroutine string, v interface{}) {
+	if handler == nil {
+		handler = DefaultPanicHandler
+	}
+	if handler != nil {
+		handler(newPanicError(goroutine, v))
+	}
+}
+
+// recoverError must be deferred directly, it recover the panic and report it as
+// error, it's used by batch workers to fail the results.
+func recoverError(goroutine string, report func(err error)) {
+	if v := recover(); v != nil {
+		report(newPanicError(goroutine, v))
+	}
+}
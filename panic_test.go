@@ -0,0 +1,93 @@
+package socker
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+type panicStep struct{}
+
+func (panicStep) Name() string {
+	return "panic"
+}
+
+func (panicStep) Check(*SSH) (Change, error) {
+	panic("broken step")
+}
+
+func (panicStep) Apply(*SSH) error {
+	return nil
+}
+
+func TestRecoverPanic(t *testing.T) {
+	panics := make(chan *PanicError, 1)
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{
+			"default": {User: "root", Password: "secret"},
+		},
+		DefaultAuth:  "default",
+		PanicHandler: func(err *PanicError) { panics <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	go func() {
+		defer m.recoverPanic("test")
+		panic("boom")
+	}()
+	e := <-panics
+	if e.Goroutine != "test" || e.Value != "boom" || len(e.Stack) == 0 || e.Error() != "panic in test: boom" {
+		t.Errorf("unexpected panic error: %+v", e)
+	}
+
+	plan := NewPlan(func(ctx context.Context, addr string) (*SSH, error) {
+		return LocalOnly(), nil
+	})
+	plan.Add("a", panicStep{})
+	results, err := plan.Apply(context.Background())
+	if _, ok := err.(*PanicError); !ok || len(results) != 1 || results[0].Err != err {
+		t.Fatalf("panic should fail the host: %+v %v", results, err)
+	}
+	if !strings.Contains(err.Error(), "broken step") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type panicSchedule struct{}
+
+func (panicSchedule) KeepWarm(string, time.Time) bool {
+	panic("broken schedule")
+}
+
+func TestRecoverPanicUnlock(t *testing.T) {
+	panics := make(chan *PanicError, 1)
+	m, err := NewMux(MuxAuth{
+		KeepWarm:     panicSchedule{},
+		PanicHandler: func(err *PanicError) { panics <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.sshs["127.0.0.1:22"] = LocalOnly()
+
+	m.checkAlive(time.Now().Add(time.Hour), time.Second)
+	if e := <-panics; e.Goroutine != "keepalive" {
+		t.Fatalf("unexpected panic: %+v", e)
+	}
+	locked := make(chan struct{})
+	go func() {
+		m.sshsMu.Lock()
+		m.sshsMu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("lock isn't released after panic")
+	}
+}
@@ -0,0 +1,445 @@
+package socker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change is the result of checking a step on a host.
+type Change struct {
+	// Changed reports whether applying the step would change the host.
+	Changed bool
+	// Diff describe the change, it's empty if nothing will be changed.
+	Diff string
+}
+
+// Step is a desired state of host, it's checked before applied so unchanged steps
+// are skipped.
+type Step interface {
+	Name() string
+	Check(s *SSH) (Change, error)
+	Apply(s *SSH) error
+}
+
+// FileStep ensure the remote file has the content and mode.
+type FileStep struct {
+	Path    string
+	Content []byte
+	// Mode is the permission bits of file, 0 means 0644 for new file and unchanged
+	// for existing file.
+	Mode os.FileMode
+}
+
+var _ Step = FileStep{}
+
+func (f FileStep) Name() string {
+	return "file " + f.Path
+}
+
+func (f FileStep) Check(s *SSH) (Change, error) {
+	path := s.rpath(f.Path)
+	stat, err := s.rfs.Stat(path)
+	if err != nil {
+		if !s.rfs.IsNotExist(err) {
+			return Change{}, err
+		}
+		return Change{Changed: true, Diff: fmt.Sprintf("create %s (%d bytes)\n%s", f.Path, len(f.Content), lineDiff(nil, f.Content))}, nil
+	}
+	if stat.IsDir() {
+		return Change{}, fmt.Errorf("%s is a directory", f.Path)
+	}
+
+	var diff strings.Builder
+	if f.Mode != 0 && stat.Mode().Perm() != f.Mode.Perm() {
+		fmt.Fprintf(&diff, "mode %s: %#o -> %#o\n", f.Path, stat.Mode().Perm(), f.Mode.Perm())
+	}
+	content, err := s.readFile(s.rfs, path)
+	if err != nil {
+		return Change{}, err
+	}
+	if !bytes.Equal(content, f.Content) {
+		fmt.Fprintf(&diff, "update %s\n%s", f.Path, lineDiff(content, f.Content))
+	}
+	return Change{Changed: diff.Len() > 0, Diff: diff.String()}, nil
+}
+
+func (f FileStep) Apply(s *SSH) error {
+	path := s.rpath(f.Path)
+	err := s.writeFile(s.rfs, path, f.Content)
+	if err == nil && f.Mode != 0 {
+		err = s.rfs.Chmod(path, f.Mode.Perm())
+	}
+	return err
+}
+
+// CmdStep run the command on remote host unless the Unless command succeeds, e.g.
+// Cmd "useradd app" with Unless "id app".
+type CmdStep struct {
+	Cmd string
+	// Unless is the checking command, empty means the Cmd is always run.
+	Unless string
+}
+
+var _ Step = CmdStep{}
+
+func (c CmdStep) Name() string {
+	return "cmd " + c.Cmd
+}
+
+func (c CmdStep) Check(s *SSH) (Change, error) {
+	if c.Unless != "" && s.runRcmd(c.Unless) == nil {
+		return Change{}, nil
+	}
+	return Change{Changed: true, Diff: "run " + c.Cmd + "\n"}, nil
+}
+
+func (c CmdStep) Apply(s *SSH) error {
+	return s.runRcmd(c.Cmd)
+}
+
+// lineDiff return the lines removed from old with "-" prefix and the lines added to
+// new with "+" prefix, based on the longest common subsequence of lines. Large files
+// are summarized.
+func lineDiff(old, new []byte) string {
+	const maxLines = 2000
+	split := func(b []byte) []string {
+		if len(b) == 0 {
+			return nil
+		}
+		return strings.SplitAfter(string(b), "\n")
+	}
+	a, b := split(old), split(new)
+	if len(a) > maxLines || len(b) > maxLines {
+		return fmt.Sprintf("-%d lines\n+%d lines\n", len(a), len(b))
+	}
+
+	// lcs[i][j] is the length of common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff strings.Builder
+	line := func(prefix, s string) {
+		diff.WriteString(prefix)
+		diff.WriteString(strings.TrimSuffix(s, "\n"))
+		diff.WriteString("\n")
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			line("-", a[i])
+			i++
+		default:
+			line("+", b[j])
+			j++
+		}
+	}
+	return diff.String()
+}
+
+// Status of steps reported by PlanEvent.
+const (
+	StepStarted   = "started"
+	StepApplying  = "applying"
+	StepChanged   = "changed"
+	StepUnchanged = "unchanged"
+	StepFailed    = "failed"
+	StepSkipped   = "skipped"
+)
+
+// Status of hosts reported by PlanEvent if Plan.Timeline is enabled, the Step of
+// them is empty.
+const (
+	HostQueued    = "queued"
+	HostDialing   = "dialing"
+	HostConnected = "connected"
+	HostDone      = "done"
+)
+
+// Phases of applying steps reported by StepApplying events.
+const (
+	PhaseRunning   = "running"
+	PhaseUploading = "uploading"
+)
+
+// PlanEvent is the progress of Plan.Apply.
+type PlanEvent struct {
+	Addr   string
+	Step   string
+	Index  int
+	Total  int
+	Status string
+	// Phase is the phase of StepApplying event, it's PhaseUploading for FileStep
+	// and PhaseRunning for others.
+	Phase string
+	// Time is the time the event happened.
+	Time time.Time
+	// Err is the error of failed or skipped step, or the first error of host for
+	// HostDone event.
+	Err error
+	// Reason is the reason of step skipped by Plan.Filter.
+	Reason string
+}
+
+// StepResult is the result of a step on a host.
+type StepResult struct {
+	Addr string
+	Step string
+	Change
+	Err error
+	// Skipped is the reason the host is skipped by Plan.Filter, the step isn't
+	// checked.
+	Skipped string
+}
+
+// Plan is a list of steps per host, it's checked by Check to show what would be
+// changed, then applied by Apply. Steps of a host are run in order and the remaining
+// ones are skipped once a step failed, hosts are run concurrently.
+type Plan struct {
+	// Concurrency is the max count of hosts run concurrently, default is
+	// BroadcastConcurrency.
+	Concurrency int
+	// OnEvent is called with the progress of Apply, it's called concurrently for
+	// different hosts.
+	OnEvent func(PlanEvent)
+	// Timeline make OnEvent called with the host events and StepApplying events
+	// too, so the timeline of each host can be rendered.
+	Timeline bool
+	// Store persist the results of Apply with the RunID, hosts which have succeeded
+	// in the stored run are skipped by Apply, so an interrupted run can be resumed.
+	// The results of them are loaded from the store.
+	Store Store
+	RunID string
+	// Filter skip hosts before they are dialed, skipped hosts aren't failures and
+	// are run again if the run is resumed.
+	Filter HostFilter
+
+	dial  func(ctx context.Context, addr string) (*SSH, error)
+	addrs []string
+	steps map[string][]Step
+
+	storeMu  sync.Mutex
+	storeErr error
+}
+
+// NewPlan create a Plan which connect to hosts by the dial function.
+func NewPlan(dial func(ctx context.Context, addr string) (*SSH, error)) *Plan {
+	return &Plan{
+		dial:  dial,
+		steps: make(map[string][]Step),
+	}
+}
+
+// Plan create a Plan which connect to hosts by Mux.DialContext.
+func (m *Mux) Plan() *Plan {
+	return NewPlan(m.DialContext)
+}
+
+// Add append steps of the host.
+func (p *Plan) Add(addr string, steps ...Step) *Plan {
+	if _, has := p.steps[addr]; !has {
+		p.addrs = append(p.addrs, addr)
+	}
+	p.steps[addr] = append(p.steps[addr], steps...)
+	return p
+}
+
+// Check check all steps without changing hosts. The results are in the order steps
+// are added, steps of a host after a failed one are reported with the error too.
+func (p *Plan) Check(ctx context.Context) ([]StepResult, error) {
+	return p.run(ctx, false)
+}
+
+// Apply check and apply the changed steps, the results are the same as Check. The
+// first error of steps is returned, or the error of Store if steps succeeded.
+func (p *Plan) Apply(ctx context.Context) ([]StepResult, error) {
+	return p.run(ctx, true)
+}
+
+func (p *Plan) run(ctx context.Context, apply bool) ([]StepResult, error) {
+	concurrency := p.Concurrency
+	if concurrency <= 0 {
+		concurrency = BroadcastConcurrency
+	}
+	var resumed map[string][]StepResult
+	if apply && p.Store != nil {
+		var err error
+		resumed, err = p.resumed()
+		if err != nil {
+			return nil, err
+		}
+		p.storeErr = nil
+	}
+
+	var (
+		results = make([][]StepResult, len(p.addrs))
+		indexes = make([]int, 0, len(p.addrs))
+	)
+	if apply {
+		for _, addr := range p.addrs {
+			if _, has := resumed[addr]; !has {
+				p.emitHost(addr, HostQueued, nil)
+			}
+		}
+	}
+	for i, addr := range p.addrs {
+		if rs, has := resumed[addr]; has {
+			results[i] = rs
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	runLimited(ctx, indexes, concurrency, "plan", func(i int) {
+		results[i] = p.runHost(ctx, p.addrs[i], apply)
+		if apply {
+			p.emitHost(p.addrs[i], HostDone, firstError(results[i]))
+		}
+	}, func(i int, err error) {
+		results[i] = p.skip(p.addrs[i], 0, err, apply)
+		if apply {
+			p.emitHost(p.addrs[i], HostDone, err)
+		}
+	})
+
+	var (
+		all      []StepResult
+		firstErr error
+	)
+	for _, rs := range results {
+		for _, r := range rs {
+			if r.Err != nil && firstErr == nil {
+				firstErr = r.Err
+			}
+			all = append(all, r)
+		}
+	}
+	if firstErr == nil && apply {
+		firstErr = p.storeErr
+	}
+	return all, firstErr
+}
+
+func (p *Plan) emit(e PlanEvent) {
+	if p.OnEvent != nil {
+		e.Time = time.Now()
+		p.OnEvent(e)
+	}
+}
+
+func (p *Plan) emitHost(addr, status string, err error) {
+	if p.Timeline {
+		p.emit(PlanEvent{Addr: addr, Total: len(p.steps[addr]), Status: status, Err: err})
+	}
+}
+
+func stepPhase(step Step) string {
+	switch step.(type) {
+	case FileStep, *FileStep:
+		return PhaseUploading
+	}
+	return PhaseRunning
+}
+
+func firstError(results []StepResult) error {
+	for _, r := range results {
+		if r.Err != nil {
+			return r.Err
+		}
+	}
+	return nil
+}
+
+// skip report the steps from the index as failed by the error.
+func (p *Plan) skip(addr string, from int, err error, apply bool) []StepResult {
+	steps := p.steps[addr]
+	results := make([]StepResult, 0, len(steps)-from)
+	for i := from; i < len(steps); i++ {
+		r := StepResult{Addr: addr, Step: steps[i].Name(), Err: err}
+		results = append(results, r)
+		if apply {
+			p.emit(PlanEvent{Addr: addr, Step: r.Step, Index: i, Total: len(steps), Status: StepSkipped, Err: err})
+			p.save(r, i, len(steps), StepSkipped, time.Now())
+		}
+	}
+	return results
+}
+
+func (p *Plan) runHost(ctx context.Context, addr string, apply bool) []StepResult {
+	if p.Filter != nil {
+		if reason := p.Filter.Skip(ctx, addr); reason != "" {
+			return p.filtered(addr, reason, apply)
+		}
+	}
+	if apply {
+		p.emitHost(addr, HostDialing, nil)
+	}
+	agent, err := p.dial(ctx, addr)
+	if err != nil {
+		return p.skip(addr, 0, err, apply)
+	}
+	defer agent.Close()
+	if apply {
+		p.emitHost(addr, HostConnected, nil)
+	}
+
+	steps := p.steps[addr]
+	results := make([]StepResult, 0, len(steps))
+	for i, step := range steps {
+		if err = ctx.Err(); err != nil {
+			return append(results, p.skip(addr, i, err, apply)...)
+		}
+		r := StepResult{Addr: addr, Step: step.Name()}
+		startAt := time.Now()
+		e := PlanEvent{Addr: addr, Step: r.Step, Index: i, Total: len(steps)}
+		if apply {
+			e.Status = StepStarted
+			p.emit(e)
+		}
+
+		r.Change, r.Err = step.Check(agent)
+		if r.Err == nil && apply && r.Changed {
+			if p.Timeline {
+				p.emit(PlanEvent{Addr: addr, Step: r.Step, Index: i, Total: len(steps), Status: StepApplying, Phase: stepPhase(step)})
+			}
+			r.Err = step.Apply(agent)
+		}
+		results = append(results, r)
+		if apply {
+			switch {
+			case r.Err != nil:
+				e.Status, e.Err = StepFailed, r.Err
+			case r.Changed:
+				e.Status = StepChanged
+			default:
+				e.Status = StepUnchanged
+			}
+			p.emit(e)
+			p.save(r, i, len(steps), e.Status, startAt)
+		}
+		if r.Err != nil {
+			return append(results, p.skip(addr, i+1, r.Err, apply)...)
+		}
+	}
+	return results
+}
@@ -0,0 +1,61 @@
+package socker
+
+import (
+	"context"
+	"time"
+)
+
+// HostFilter decide whether hosts are skipped before batch runs such as Plan.Apply,
+// e.g. hosts in maintenance windows or failing health probes.
+type HostFilter interface {
+	// Skip return the reason the host is skipped, empty means the host is run.
+	Skip(ctx context.Context, addr string) string
+}
+
+// HostFilterFunc is the function form of HostFilter.
+type HostFilterFunc func(ctx context.Context, addr string) string
+
+func (f HostFilterFunc) Skip(ctx context.Context, addr string) string {
+	return f(ctx, addr)
+}
+
+// Filters compose the filters, hosts are skipped by the first filter reports reason.
+func Filters(filters ...HostFilter) HostFilter {
+	return HostFilterFunc(func(ctx context.Context, addr string) string {
+		for _, f := range filters {
+			if f == nil {
+				continue
+			}
+			if reason := f.Skip(ctx, addr); reason != "" {
+				return reason
+			}
+		}
+		return ""
+	})
+}
+
+// ProbeFilter skip the hosts the probe function returns error for, such as health
+// checks of load balancer.
+func ProbeFilter(probe func(ctx context.Context, addr string) error) HostFilter {
+	return HostFilterFunc(func(ctx context.Context, addr string) string {
+		if err := probe(ctx, addr); err != nil {
+			return "probe failed: " + err.Error()
+		}
+		return ""
+	})
+}
+
+// filtered report the steps of host as skipped by the filter.
+func (p *Plan) filtered(addr, reason string, apply bool) []StepResult {
+	steps := p.steps[addr]
+	results := make([]StepResult, 0, len(steps))
+	for i, step := range steps {
+		r := StepResult{Addr: addr, Step: step.Name(), Skipped: reason}
+		results = append(results, r)
+		if apply {
+			p.emit(PlanEvent{Addr: addr, Step: r.Step, Index: i, Total: len(steps), Status: StepSkipped, Reason: reason})
+			p.save(r, i, len(steps), StepSkipped, time.Now())
+		}
+	}
+	return results
+}
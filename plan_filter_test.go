@@ -0,0 +1,61 @@
+package socker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestPlanFilter(t *testing.T) {
+	maintenance := HostFilterFunc(func(ctx context.Context, addr string) string {
+		if addr == "db" {
+			return "in maintenance window"
+		}
+		return ""
+	})
+	unhealthy := ProbeFilter(func(ctx context.Context, addr string) error {
+		if addr == "web-2" {
+			return errors.New("503")
+		}
+		return nil
+	})
+
+	plan := NewPlan(func(ctx context.Context, addr string) (*SSH, error) {
+		return LocalOnly(), nil
+	})
+	plan.Filter = Filters(maintenance, nil, unhealthy)
+	var applied int
+	fail := false
+	for _, addr := range []string{"web-1", "web-2", "db"} {
+		plan.Add(addr, countStep{applied: &applied, fail: &fail})
+	}
+	var (
+		mu      sync.Mutex
+		skipped []PlanEvent
+	)
+	plan.OnEvent = func(e PlanEvent) {
+		if e.Status == StepSkipped {
+			mu.Lock()
+			skipped = append(skipped, e)
+			mu.Unlock()
+		}
+	}
+
+	results, err := plan.Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 1 {
+		t.Errorf("only web-1 should be applied: %d", applied)
+	}
+	reasons := []string{"", "probe failed: 503", "in maintenance window"}
+	for i, r := range results {
+		if r.Skipped != reasons[i] || r.Err != nil {
+			t.Errorf("unexpected result: %+v", r)
+		}
+	}
+	if len(skipped) != 2 {
+		t.Errorf("unexpected skipped events: %+v", skipped)
+	}
+}
@@ -0,0 +1,350 @@
+package socker
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RunRecord is the result of a step on a host persisted by Store.
+type RunRecord struct {
+	Run   string
+	Addr  string
+	Step  string
+	Index int
+	Total int
+	// Status is one of StepChanged, StepUnchanged, StepFailed and StepSkipped.
+	Status  string
+	Diff    string `json:",omitempty"`
+	Err     string `json:",omitempty"`
+	StartAt time.Time
+	EndAt   time.Time
+	// Reason is the reason of host skipped by Plan.Filter.
+	Reason string `json:",omitempty"`
+}
+
+// Store persist the results of batch runs such as Plan.Apply, so the runs can be
+// resumed and reported after the controller restarted.
+type Store interface {
+	// Save persist the record, it's called concurrently.
+	Save(r RunRecord) error
+	// Load return the records of the run in the order they are saved.
+	Load(run string) ([]RunRecord, error)
+}
+
+// JSONLStore save records as json lines of a file.
+type JSONLStore struct {
+	mu   sync.Mutex
+	path string
+	fd   *os.File
+}
+
+var _ Store = (*JSONLStore)(nil)
+
+// NewJSONLStore open the file for appending records, it's created if not exists. The
+// last line truncated by crash is removed, so later records are appended to a new line.
+func NewJSONLStore(path string) (*JSONLStore, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = truncatePartialLine(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &JSONLStore{path: path, fd: fd}, nil
+}
+
+// truncatePartialLine truncate the file after the last newline.
+func truncatePartialLine(fd *os.File) error {
+	stat, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	var (
+		end = stat.Size()
+		pos = end
+		buf = make([]byte, 4096)
+	)
+	for pos > 0 {
+		n := int64(len(buf))
+		if n > pos {
+			n = pos
+		}
+		pos -= n
+		_, err = fd.ReadAt(buf[:n], pos)
+		if err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			pos += int64(i) + 1
+			break
+		}
+	}
+	if pos == end {
+		return nil
+	}
+	return fd.Truncate(pos)
+}
+
+func (s *JSONLStore) Save(r RunRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.fd.Write(append(line, '\n'))
+	return err
+}
+
+func (s *JSONLStore) Load(run string) ([]RunRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fd, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var records []RunRecord
+	sc := bufio.NewScanner(fd)
+	sc.Buffer(nil, 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var r RunRecord
+		if err = json.Unmarshal(sc.Bytes(), &r); err != nil {
+			// the last line may be truncated by crash.
+			if !sc.Scan() {
+				break
+			}
+			return nil, fmt.Errorf("invalid record at %s:%d: %s", s.path, line, err.Error())
+		}
+		if r.Run == run {
+			records = append(records, r)
+		}
+	}
+	return records, sc.Err()
+}
+
+// Close close the file.
+func (s *JSONLStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fd.Close()
+}
+
+var sqlTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLStore save records to the table of sql database, such as SQLite. The driver is
+// registered by caller, the statements use "?" placeholders.
+type SQLStore struct {
+	db    *sql.DB
+	table string
+}
+
+var _ Store = (*SQLStore)(nil)
+
+// NewSQLStore create the table if not exists.
+func NewSQLStore(db *sql.DB, table string) (*SQLStore, error) {
+	if !sqlTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name: %s", table)
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	run VARCHAR(255) NOT NULL,
+	addr VARCHAR(255) NOT NULL,
+	step TEXT NOT NULL,
+	idx INTEGER NOT NULL,
+	total INTEGER NOT NULL,
+	status VARCHAR(32) NOT NULL,
+	diff TEXT NOT NULL,
+	err TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	start_at BIGINT NOT NULL,
+	end_at BIGINT NOT NULL
+)`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db, table: table}, nil
+}
+
+func (s *SQLStore) Save(r RunRecord) error {
+	_, err := s.db.Exec(`INSERT INTO `+s.table+` (run, addr, step, idx, total, status, diff, err, reason, start_at, end_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Run, r.Addr, r.Step, r.Index, r.Total, r.Status, r.Diff, r.Err, r.Reason, r.StartAt.UnixNano(), r.EndAt.UnixNano())
+	return err
+}
+
+func (s *SQLStore) Load(run string) ([]RunRecord, error) {
+	rows, err := s.db.Query(`SELECT addr, step, idx, total, status, diff, err, reason, start_at, end_at FROM `+s.table+` WHERE run = ? ORDER BY id`, run)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []RunRecord
+	for rows.Next() {
+		var (
+			r            = RunRecord{Run: run}
+			startAt, end int64
+		)
+		err = rows.Scan(&r.Addr, &r.Step, &r.Index, &r.Total, &r.Status, &r.Diff, &r.Err, &r.Reason, &startAt, &end)
+		if err != nil {
+			return nil, err
+		}
+		r.StartAt, r.EndAt = time.Unix(0, startAt), time.Unix(0, end)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// RunSummary is the summary of run records.
+type RunSummary struct {
+	// Succeeded and Failed are the addresses which finished all steps or have failed
+	// steps in the latest attempt, others haven't finished.
+	Succeeded []string
+	Failed    []string
+	Pending   []string
+	// Changed is the count of changed steps.
+	Changed int
+	// StartAt and EndAt are the time of first and last step.
+	StartAt time.Time
+	EndAt   time.Time
+}
+
+// SummarizeRun summarize the records of a run, later records of a step override
+// earlier ones since the run may be resumed.
+func SummarizeRun(records []RunRecord) RunSummary {
+	type host struct {
+		total  int
+		status map[int]string
+	}
+	var (
+		summary RunSummary
+		hosts   = make(map[string]*host)
+	)
+	for _, r := range records {
+		h := hosts[r.Addr]
+		if h == nil {
+			h = &host{status: make(map[int]string)}
+			hosts[r.Addr] = h
+		}
+		h.total = r.Total
+		h.status[r.Index] = r.Status
+		if r.Status == StepChanged {
+			summary.Changed++
+		}
+		if summary.StartAt.IsZero() || r.StartAt.Before(summary.StartAt) {
+			summary.StartAt = r.StartAt
+		}
+		if r.EndAt.After(summary.EndAt) {
+			summary.EndAt = r.EndAt
+		}
+	}
+	for addr, h := range hosts {
+		succeeded, failed := 0, false
+		for _, status := range h.status {
+			switch status {
+			case StepChanged, StepUnchanged:
+				succeeded++
+			case StepFailed:
+				failed = true
+			}
+		}
+		switch {
+		case failed:
+			summary.Failed = append(summary.Failed, addr)
+		case succeeded == h.total:
+			summary.Succeeded = append(summary.Succeeded, addr)
+		default:
+			summary.Pending = append(summary.Pending, addr)
+		}
+	}
+	sort.Strings(summary.Succeeded)
+	sort.Strings(summary.Failed)
+	sort.Strings(summary.Pending)
+	return summary
+}
+
+// SucceededHosts return the addresses which have succeeded in the stored run, it's
+// the skiplist of resumed runs.
+func SucceededHosts(store Store, run string) (map[string]bool, error) {
+	records, err := store.Load(run)
+	if err != nil {
+		return nil, err
+	}
+	succeeded := make(map[string]bool)
+	for _, addr := range SummarizeRun(records).Succeeded {
+		succeeded[addr] = true
+	}
+	return succeeded, nil
+}
+
+var errNoRunID = errors.New("run with store requires run id")
+
+// resumed return the results of hosts which have succeeded in the stored run.
+func (p *Plan) resumed() (map[string][]StepResult, error) {
+	if p.RunID == "" {
+		return nil, errNoRunID
+	}
+	records, err := p.Store.Load(p.RunID)
+	if err != nil {
+		return nil, err
+	}
+	summary := SummarizeRun(records)
+	results := make(map[string][]StepResult)
+	for _, addr := range summary.Succeeded {
+		results[addr] = nil
+	}
+	for _, r := range records {
+		rs, has := results[r.Addr]
+		if !has || r.Total != len(p.steps[r.Addr]) {
+			delete(results, r.Addr)
+			continue
+		}
+		if len(rs) == 0 {
+			rs = make([]StepResult, r.Total)
+		}
+		rs[r.Index] = StepResult{Addr: r.Addr, Step: r.Step, Change: Change{Changed: r.Status == StepChanged, Diff: r.Diff}}
+		results[r.Addr] = rs
+	}
+	return results, nil
+}
+
+// save persist the result of step, the first error is reported by Apply.
+func (p *Plan) save(r StepResult, index, total int, status string, startAt time.Time) {
+	if p.Store == nil {
+		return
+	}
+	record := RunRecord{
+		Run:     p.RunID,
+		Addr:    r.Addr,
+		Step:    r.Step,
+		Index:   index,
+		Total:   total,
+		Status:  status,
+		Diff:    r.Diff,
+		Reason:  r.Skipped,
+		StartAt: startAt,
+		EndAt:   time.Now(),
+	}
+	if r.Err != nil {
+		record.Err = r.Err.Error()
+	}
+	if err := p.Store.Save(record); err != nil {
+		p.storeMu.Lock()
+		if p.storeErr == nil {
+			p.storeErr = err
+		}
+		p.storeMu.Unlock()
+	}
+}
@@ -0,0 +1,279 @@
+package socker
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countStep struct {
+	applied *int
+	fail    *bool
+}
+
+func (s countStep) Name() string {
+	return "count"
+}
+
+func (s countStep) Check(*SSH) (Change, error) {
+	return Change{Changed: true, Diff: "count\n"}, nil
+}
+
+func (s countStep) Apply(*SSH) error {
+	*s.applied++
+	if *s.fail {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func TestPlanStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewJSONLStore(filepath.Join(dir, "runs.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var (
+		appliedA, appliedB int
+		failA, failB       = false, true
+	)
+	newPlan := func() *Plan {
+		plan := NewPlan(func(ctx context.Context, addr string) (*SSH, error) {
+			return LocalOnly(), nil
+		})
+		plan.Store = store
+		plan.RunID = "deploy-1"
+		plan.Add("a", countStep{applied: &appliedA, fail: &failA})
+		plan.Add("b", countStep{applied: &appliedB, fail: &failB}, countStep{applied: &appliedB, fail: &failB})
+		return plan
+	}
+
+	if _, err = newPlan().Apply(context.Background()); err == nil {
+		t.Fatal("apply should fail")
+	}
+	records, err := store.Load("deploy-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := SummarizeRun(records)
+	if len(records) != 3 || len(summary.Succeeded) != 1 || len(summary.Failed) != 1 || summary.Changed != 1 {
+		t.Fatalf("unexpected summary: %+v %+v", summary, records)
+	}
+
+	failB = false
+	results, err := newPlan().Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appliedA != 1 || appliedB != 3 {
+		t.Errorf("succeeded host shouldn't be applied again: %d %d", appliedA, appliedB)
+	}
+	if len(results) != 3 || !results[0].Changed || results[0].Addr != "a" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+	records, _ = store.Load("deploy-1")
+	summary = SummarizeRun(records)
+	if len(summary.Succeeded) != 2 || len(summary.Failed) != 0 || summary.StartAt.After(summary.EndAt) {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+	if records, _ = store.Load("deploy-2"); len(records) != 0 {
+		t.Errorf("runs should be separated: %+v", records)
+	}
+
+	plan := newPlan()
+	plan.RunID = ""
+	if _, err = plan.Apply(context.Background()); err != errNoRunID {
+		t.Errorf("run id should be required: %v", err)
+	}
+}
+
+func TestJSONLStorePartialLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "runs.jsonl")
+	err = ioutil.WriteFile(path, []byte(`{"Run":"deploy-1","Addr":"a"}`+"\n"+`{"Run":"deploy-1","Ad`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewJSONLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err = store.Save(RunRecord{Run: "deploy-1", Addr: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Save(RunRecord{Run: "deploy-1", Addr: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := store.Load("deploy-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].Addr != "a" || records[1].Addr != "b" || records[2].Addr != "c" {
+		t.Errorf("unexpected records: %+v", records)
+	}
+}
+
+// fakeSQLDriver is a database/sql driver serving the statements of SQLStore in memory.
+type fakeSQLDriver struct {
+	mu   sync.Mutex
+	rows [][]driver.Value
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	return fakeSQLConn{d}, nil
+}
+
+type fakeSQLConn struct {
+	d *fakeSQLDriver
+}
+
+func (c fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeSQLStmt{d: c.d, query: query}, nil
+}
+
+func (c fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transaction isn't supported")
+}
+
+type fakeSQLStmt struct {
+	d     *fakeSQLDriver
+	query string
+}
+
+func (s fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (s fakeSQLStmt) NumInput() int {
+	return strings.Count(s.query, "?")
+}
+
+func (s fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE IF NOT EXISTS runs "):
+	case strings.HasPrefix(s.query, "INSERT INTO runs "):
+		s.d.mu.Lock()
+		s.d.rows = append(s.d.rows, args)
+		s.d.mu.Unlock()
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.HasPrefix(s.query, "SELECT addr, step, idx, total, status, diff, err, reason, start_at, end_at FROM runs WHERE run = ? ORDER BY id") {
+		return nil, fmt.Errorf("unexpected query: %s", s.query)
+	}
+	rows := &fakeSQLRows{}
+	s.d.mu.Lock()
+	for _, row := range s.d.rows {
+		if row[0] == args[0] {
+			rows.rows = append(rows.rows, row[1:])
+		}
+	}
+	s.d.mu.Unlock()
+	return rows, nil
+}
+
+type fakeSQLRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return []string{"addr", "step", "idx", "total", "status", "diff", "err", "reason", "start_at", "end_at"}
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var fakeSQL = &fakeSQLDriver{}
+
+func init() {
+	sql.Register("socker-fake", fakeSQL)
+}
+
+func TestSQLStore(t *testing.T) {
+	fakeSQL.mu.Lock()
+	fakeSQL.rows = nil
+	fakeSQL.mu.Unlock()
+	db, err := sql.Open("socker-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = NewSQLStore(db, "runs; DROP TABLE runs"); err == nil {
+		t.Error("invalid table name should be rejected")
+	}
+	store, err := NewSQLStore(db, "runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	records := []RunRecord{
+		{Run: "deploy-1", Addr: "a", Step: "count", Total: 1, Status: StepChanged, Diff: "count\n", StartAt: now, EndAt: now.Add(time.Second)},
+		{Run: "deploy-2", Addr: "a", Step: "count", Total: 1, Status: StepFailed, Err: "failed", StartAt: now, EndAt: now},
+		{Run: "deploy-1", Addr: "b", Step: "count", Total: 1, Status: StepSkipped, Reason: "in maintenance window", StartAt: now, EndAt: now},
+	}
+	for _, r := range records {
+		if err = store.Save(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, err := store.Load("deploy-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 {
+		t.Fatalf("unexpected records: %+v", loaded)
+	}
+	for i, r := range []RunRecord{records[0], records[2]} {
+		l := loaded[i]
+		if l.Run != r.Run || l.Addr != r.Addr || l.Status != r.Status || l.Diff != r.Diff || l.Reason != r.Reason ||
+			!l.StartAt.Equal(r.StartAt) || !l.EndAt.Equal(r.EndAt) {
+			t.Errorf("unexpected record: %+v", l)
+		}
+	}
+	succeeded, err := SucceededHosts(store, "deploy-1")
+	if err != nil || len(succeeded) != 1 || !succeeded["a"] {
+		t.Errorf("unexpected succeeded hosts: %v %v", succeeded, err)
+	}
+}
@@ -0,0 +1,137 @@
+package socker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	diff := lineDiff([]byte("a\nb\nc\n"), []byte("a\nc\nd\n"))
+	if diff != "-b\n+d\n" {
+		t.Errorf("unexpected diff: %q", diff)
+	}
+	if diff = lineDiff(nil, []byte("a")); diff != "+a\n" {
+		t.Errorf("unexpected diff: %q", diff)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	unchanged := filepath.Join(dir, "unchanged")
+	updated := filepath.Join(dir, "updated")
+	created := filepath.Join(dir, "created")
+	if err = ioutil.WriteFile(unchanged, []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(updated, []byte("a\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := NewPlan(func(ctx context.Context, addr string) (*SSH, error) {
+		return LocalOnly(), nil
+	})
+	plan.Add("local",
+		FileStep{Path: unchanged, Content: []byte("x\n")},
+		FileStep{Path: updated, Content: []byte("a\nc\n"), Mode: 0600},
+		FileStep{Path: created, Content: []byte("new\n")},
+		FileStep{Path: dir, Content: []byte("dir")},
+		FileStep{Path: created, Content: []byte("never\n")},
+	)
+	var events []PlanEvent
+	plan.OnEvent = func(e PlanEvent) {
+		events = append(events, e)
+	}
+
+	results, err := plan.Check(context.Background())
+	if err == nil || len(results) != 5 || len(events) != 0 {
+		t.Fatalf("unexpected check results: %+v %v", results, err)
+	}
+	if results[0].Changed || !results[1].Changed || !results[2].Changed || results[3].Err == nil || results[4].Err == nil {
+		t.Errorf("unexpected check results: %+v", results)
+	}
+	if results[1].Diff != "mode "+updated+": 0644 -> 0600\nupdate "+updated+"\n-b\n+c\n" {
+		t.Errorf("unexpected diff: %q", results[1].Diff)
+	}
+	if _, err = os.Stat(created); !os.IsNotExist(err) {
+		t.Error("check shouldn't change host")
+	}
+
+	_, err = plan.Apply(context.Background())
+	if err == nil {
+		t.Error("apply should fail")
+	}
+	if data, _ := ioutil.ReadFile(updated); string(data) != "a\nc\n" {
+		t.Errorf("file isn't updated: %q", data)
+	}
+	if stat, _ := os.Stat(updated); stat.Mode().Perm() != 0600 {
+		t.Errorf("mode isn't updated: %s", stat.Mode())
+	}
+	if data, _ := ioutil.ReadFile(created); string(data) != "new\n" {
+		t.Errorf("file isn't created: %q", data)
+	}
+	statuses := []string{
+		StepStarted, StepUnchanged, StepStarted, StepChanged, StepStarted, StepChanged,
+		StepStarted, StepFailed, StepSkipped,
+	}
+	if len(events) != len(statuses) {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	for i, e := range events {
+		if e.Status != statuses[i] {
+			t.Errorf("unexpected event: %d %+v", i, e)
+		}
+	}
+}
+
+func TestPlanTimeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plan := NewPlan(func(ctx context.Context, addr string) (*SSH, error) {
+		return LocalOnly(), nil
+	})
+	var applied int
+	fail := false
+	plan.Add("local",
+		FileStep{Path: filepath.Join(dir, "file"), Content: []byte("x")},
+		countStep{applied: &applied, fail: &fail},
+	)
+	var events []PlanEvent
+	plan.Timeline = true
+	plan.OnEvent = func(e PlanEvent) {
+		events = append(events, e)
+	}
+	if _, err = plan.Apply(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expects := []struct {
+		status, phase string
+	}{
+		{HostQueued, ""}, {HostDialing, ""}, {HostConnected, ""},
+		{StepStarted, ""}, {StepApplying, PhaseUploading}, {StepChanged, ""},
+		{StepStarted, ""}, {StepApplying, PhaseRunning}, {StepChanged, ""},
+		{HostDone, ""},
+	}
+	if len(events) != len(expects) {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	for i, e := range events {
+		if e.Status != expects[i].status || e.Phase != expects[i].phase || e.Time.IsZero() {
+			t.Errorf("unexpected event: %d %+v", i, e)
+		}
+		if i > 0 && e.Time.Before(events[i-1].Time) {
+			t.Errorf("events should be in time order: %d", i)
+		}
+	}
+}
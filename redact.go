@@ -0,0 +1,67 @@
+package socker
+
+import (
+	"fmt"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// redactedError hide the secrets in the message of underlying error, errors.Is and
+// errors.As still work on the underlying error.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError replace all the secrets appeared in error message by "[REDACTED]".
+func redactError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	msg := redactString(err.Error(), secrets...)
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, msg: msg}
+}
+
+func redactString(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.Replace(s, secret, redacted, -1)
+		}
+	}
+	return s
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// String return the description of Auth with secrets redacted, so it's safe to be
+// logged or printed by panics.
+func (a Auth) String() string {
+	return fmt.Sprintf("{User:%s Password:%s PrivateKey:%s PrivateKeyFile:%s PrivateKeyFiles:%v Signers:%d Methods:%v TimeoutMs:%d MaxSession:%d LocalAddr:%s Proxy:%s OutputEncoding:%s}",
+		a.User, redactSecret(a.Password), redactSecret(a.PrivateKey), a.PrivateKeyFile, a.PrivateKeyFiles, len(a.Signers), a.Methods, a.TimeoutMs, a.MaxSession, a.LocalAddr, redactString(a.Proxy, proxyPassword(a.Proxy)), a.OutputEncoding)
+}
+
+// GoString do the same thing as String for the %#v format.
+func (a Auth) GoString() string {
+	return "socker.Auth" + a.String()
+}
+
+func (a *Auth) secrets() []string {
+	return []string{a.Password, a.PrivateKey, proxyPassword(a.Proxy)}
+}
@@ -0,0 +1,39 @@
+package socker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAuthRedacted(t *testing.T) {
+	auth := &Auth{User: "root", Password: "p@ssw0rd", PrivateKey: "-----BEGIN KEY-----"}
+	for _, format := range []string{"%s", "%v", "%+v", "%#v"} {
+		for _, v := range []interface{}{auth, *auth, map[string]*Auth{"root": auth}} {
+			s := fmt.Sprintf(format, v)
+			if strings.Contains(s, auth.Password) || strings.Contains(s, auth.PrivateKey) {
+				t.Errorf("secrets leaked by format %s: %s", format, s)
+			}
+		}
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	base := errors.New("login p@ssw0rd failed")
+	err := redactError(base, "p@ssw0rd", "")
+	if err.Error() != "login [REDACTED] failed" {
+		t.Fatal("redact failed:", err)
+	}
+	if !errors.Is(err, base) {
+		t.Fatal("underlying error should be kept")
+	}
+	if redactError(base, "other") != base {
+		t.Fatal("error without secrets should be kept")
+	}
+
+	_, err = (&Auth{User: "root", PrivateKey: "not a key"}).SSHConfig()
+	if err == nil || strings.Contains(err.Error(), "not a key") {
+		t.Fatal("invalid private key error should be redacted:", err)
+	}
+}
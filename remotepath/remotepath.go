@@ -0,0 +1,59 @@
+// Package remotepath manipulate slash separated paths of remote hosts served by
+// sftp, regardless of the local operating system. The results are the same as the
+// remote paths resolved by socker for unix hosts, backslashes are normal characters.
+package remotepath
+
+import (
+	"path"
+	"strings"
+)
+
+// Join join the elements and clean the result, empty elements are ignored.
+func Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// Clean return the shortest path name equivalent to the path.
+func Clean(p string) string {
+	return path.Clean(p)
+}
+
+// IsAbs reports whether the path is absolute.
+func IsAbs(p string) bool {
+	return strings.HasPrefix(p, "/")
+}
+
+// Abs return the path joined to the work dir if it isn't absolute, absolute paths
+// are returned as is like the remote paths of SSH.
+func Abs(wd, p string) string {
+	if IsAbs(p) {
+		return p
+	}
+	return Join(wd, p)
+}
+
+// Dir return all but the last element of path.
+func Dir(p string) string {
+	return path.Dir(p)
+}
+
+// Base return the last element of path.
+func Base(p string) string {
+	return path.Base(p)
+}
+
+// Rel return the path relative to the base path, false if the target isn't under the
+// base path.
+func Rel(basepath, targpath string) (string, bool) {
+	base, targ := Clean(basepath), Clean(targpath)
+	if base == targ {
+		return ".", true
+	}
+	if base != "/" {
+		base += "/"
+	}
+	if !strings.HasPrefix(targ, base) {
+		return "", false
+	}
+	return targ[len(base):], true
+}
@@ -0,0 +1,37 @@
+package remotepath
+
+import "testing"
+
+func TestPath(t *testing.T) {
+	if got := Join("/home", "user/", "../app", "bin"); got != "/home/app/bin" {
+		t.Errorf("join failed: %s", got)
+	}
+	if got := Clean(`/srv/a\b/../c`); got != "/srv/c" {
+		t.Errorf("clean failed: %s", got)
+	}
+	if got := Abs("/home/user", "app/../bin"); got != "/home/user/bin" {
+		t.Errorf("abs failed: %s", got)
+	}
+	if got := Abs("/home/user", "/etc//hosts"); got != "/etc//hosts" {
+		t.Errorf("abs failed: %s", got)
+	}
+	if got := Clean(`dir\file`); got != `dir\file` {
+		t.Errorf("backslash should be kept: %s", got)
+	}
+
+	tests := []struct {
+		base, targ, rel string
+		ok              bool
+	}{
+		{"/home/user", "/home/user/app/bin", "app/bin", true},
+		{"/home/user", "/home/user", ".", true},
+		{"/", "/etc", "etc", true},
+		{"/home/user", "/home/username", "", false},
+	}
+	for _, test := range tests {
+		rel, ok := Rel(test.base, test.targ)
+		if rel != test.rel || ok != test.ok {
+			t.Errorf("rel %s %s failed: %s %t", test.base, test.targ, rel, ok)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Package shellq quote strings for POSIX shell command lines run on remote hosts.
+package shellq
+
+import "strings"
+
+// Quote quote the string as a single POSIX shell word, it's never expanded by the
+// shell.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Word return the string as is if it only contains characters which are never special
+// for shell, such as "restart" and "/var/log/a.log", otherwise it's quoted by Quote.
+func Word(s string) string {
+	if s == "" {
+		return "''"
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("_-+=@%:,./", c) >= 0:
+		default:
+			return Quote(s)
+		}
+	}
+	return s
+}
+
+// Command quote each argument by Word and join them by space, the result is more
+// readable than Join, e.g. Command("systemctl", "restart", "a b") returns
+// "systemctl restart 'a b'".
+func Command(name string, args ...string) string {
+	words := make([]string, len(args)+1)
+	words[0] = Word(name)
+	for i, arg := range args {
+		words[i+1] = Word(arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// Join quote each argument and join them by space, e.g. Join("rm", "-f", "a b")
+// returns "'rm' '-f' 'a b'".
+func Join(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = Quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// EscapeGlob escape the glob meta characters by backslash so the string only
+// matches itself in patterns of path.Match, sftp Glob and "find -name". It doesn't
+// quote the string for shell, use Quote for the result if it's a shell word.
+func EscapeGlob(s string) string {
+	if !strings.ContainsAny(s, `*?[]\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
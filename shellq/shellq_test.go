@@ -0,0 +1,43 @@
+package shellq
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	tests := map[string]string{
+		"":        "''",
+		"a b":     "'a b'",
+		"it's":    `'it'\''s'`,
+		"$HOME":   "'$HOME'",
+		"a*b?[c]": "'a*b?[c]'",
+	}
+	for s, expect := range tests {
+		if got := Quote(s); got != expect {
+			t.Errorf("quote %q failed: expect %s, got %s", s, expect, got)
+		}
+	}
+	if got := Join("rm", "-f", "a b"); got != "'rm' '-f' 'a b'" {
+		t.Errorf("join failed: %s", got)
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	if got := EscapeGlob(`log[1]*?\x`); got != `log\[1\]\*\?\\x` {
+		t.Errorf("escape failed: %s", got)
+	}
+	if got := EscapeGlob("plain"); got != "plain" {
+		t.Errorf("escape failed: %s", got)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	tests := map[string][]string{
+		"systemctl restart nginx.service": {"systemctl", "restart", "nginx.service"},
+		"rm -f '' 'a b' '$(reboot)' /a/b": {"rm", "-f", "", "a b", "$(reboot)", "/a/b"},
+		`echo 'it'\''s' '*' 'a;b'`:        {"echo", "it's", "*", "a;b"},
+	}
+	for expect, args := range tests {
+		if got := Command(args[0], args[1:]...); got != expect {
+			t.Errorf("command %q failed: expect %s, got %s", args, expect, got)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package socker
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,14 +12,22 @@ import (
 	"os/exec"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/cosiner/socker/shellq"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
-var ErrConnClosed = errors.New("connection closed")
+var (
+	ErrConnClosed  = errors.New("connection closed")
+	ErrPingTimeout = errors.New("ping timeout")
+	// ErrCmdTimeout reports the remote command runs longer than the timeout set by
+	// SSH.CmdTimeout.
+	ErrCmdTimeout = errors.New("command timeout")
+)
 
 type SSH struct {
 	lastErr    error
@@ -42,19 +51,53 @@ type SSH struct {
 	rwd string
 	cwd string
 
-	gate   *SSH
-	openAt time.Time
-	_refs  *int32
+	addr      string
+	procTag   string
+	dryRun    io.Writer
+	decode    OutputDecoder
+	gate      *SSH
+	openAt    time.Time
+	_refs     *int32
+	usedAt    *int64
+	execState *int32
+	traffic   *connTraffic
+	lanes     *connLanes
+	done      *connDone
+
+	// middlewares wrap operations of instances leased from Mux.
+	middlewares []Middleware
+	// cmdTimeout limit the run time of remote commands, see SSH.CmdTimeout.
+	cmdTimeout time.Duration
+	// recorder create recorders of sessions, see SSH.RecordSessions.
+	recorder func(info RecordInfo) (Recorder, error)
+	// maxOutput limit the size of buffered output, see SSH.MaxOutputBytes.
+	maxOutput int
+	// reportPID report pid of commands started by RcmdStart, see SSH.ReportPID.
+	reportPID bool
+	// syncHash is the hash algorithm of delta sync, see SSH.SyncHash.
+	syncHash string
+	// recordInput record input of terminals, see SSH.RecordInput.
+	recordInput bool
+	// release is called by Close instead of closing, see Lease.SSH.
+	release func()
 }
 
 func LocalOnly() *SSH {
-	var refs int32
+	var (
+		refs      int32
+		now       = time.Now()
+		usedAt    = now.UnixNano()
+		execState = execAvailable
+	)
 	return &SSH{
 		lfs:         FsLocal{},
 		rfs:         FsLocal{},
 		sessionPool: newSessionPool(0),
-		openAt:      time.Now(),
+		openAt:      now,
 		_refs:       &refs,
+		usedAt:      &usedAt,
+		execState:   &execState,
+		done:        newConnDone(),
 	}
 }
 
@@ -64,7 +107,11 @@ func NewSSH(client *ssh.Client, maxSession int, gate *SSH) (*SSH, error) {
 		return nil, err
 	}
 
-	var refs int32
+	var (
+		refs, execState int32
+		now             = time.Now()
+		usedAt          = now.UnixNano()
+	)
 	s := &SSH{
 		conn:        client,
 		sftp:        sftpClient,
@@ -73,10 +120,17 @@ func NewSSH(client *ssh.Client, maxSession int, gate *SSH) (*SSH, error) {
 		rfs: NewFsSftp(sftpClient),
 		lfs: FsLocal{},
 
-		gate:   gate,
-		openAt: time.Now(),
-		_refs:  &refs,
+		gate:      gate,
+		openAt:    now,
+		_refs:     &refs,
+		usedAt:    &usedAt,
+		execState: &execState,
+		done:      newConnDone(),
 	}
+	go func() {
+		client.Wait()
+		s.done.close(CloseBroken)
+	}()
 	if err == nil {
 		s.cwd, err = os.Getwd()
 		if err == nil && !s.lfs.Filepath().IsAbs(s.cwd) {
@@ -98,23 +152,81 @@ func NewSSH(client *ssh.Client, maxSession int, gate *SSH) (*SSH, error) {
 
 // Dial create a SSH instance, only first gate was used if it exist and isn't nil
 func Dial(addr string, auth *Auth, gate ...*SSH) (*SSH, error) {
+	return DialContext(context.Background(), addr, auth, gate...)
+}
+
+// DialContext do the same thing as Dial, but the whole dialing including tcp connecting
+// and ssh handshake is canceled once the context is done.
+func DialContext(ctx context.Context, addr string, auth *Auth, gate ...*SSH) (*SSH, error) {
 	if len(gate) > 0 && gate[0] != nil {
-		return gate[0].Dial(addr, auth)
+		return gate[0].DialContext(ctx, addr, auth)
 	}
 	config, err := auth.SSHConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := ssh.Dial("tcp", addr, config)
+	conn, err := auth.dialTCP(ctx, addr, config.Timeout)
 	if err != nil {
 		return nil, err
 	}
+	return newSSHContext(ctx, conn, addr, auth, config, nil)
+}
+
+// newSSHContext do the ssh handshake on the connection and create the SSH instance,
+// the connection is closed if the context is done before finished.
+func newSSHContext(ctx context.Context, conn net.Conn, addr string, auth *Auth, config *ssh.ClientConfig, gate *SSH) (*SSH, error) {
+	var (
+		finished = make(chan struct{})
+		exited   = make(chan struct{})
+		canceled bool
+	)
+	if ctx.Done() != nil {
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				canceled = true
+				conn.Close()
+			case <-finished:
+			}
+		}()
+	} else {
+		close(exited)
+	}
 
-	s, err := NewSSH(client, auth.MaxSession, nil)
+	var (
+		s       *SSH
+		traffic = &connTraffic{}
+	)
+	config, trace := auth.traceConfig(ctx, config)
+	c, chans, reqs, err := ssh.NewClientConn(&countingConn{Conn: conn, traffic: traffic}, addr, config)
+	if err == nil {
+		client := ssh.NewClient(c, chans, reqs)
+		if gate != nil {
+			gate = gate.NopClose()
+		}
+		s, err = NewSSH(client, auth.MaxSession, gate)
+		if err != nil {
+			client.Close()
+		} else {
+			s.addr = addr
+			s.traffic = traffic
+			s.decode, _ = auth.outputDecoder()
+		}
+	}
+	close(finished)
+	<-exited
+
+	if canceled {
+		if s != nil {
+			s.Close()
+		}
+		return nil, ctx.Err()
+	}
 	if err != nil {
-		client.Close()
-		return nil, err
+		conn.Close()
+		return nil, redactError(auth.authError(err, trace), auth.secrets()...)
 	}
 	return s, nil
 }
@@ -123,29 +235,64 @@ func (s *SSH) DialConn(net, addr string) (net.Conn, error) {
 	return s.conn.Dial(net, addr)
 }
 
-func (s *SSH) Dial(addr string, auth *Auth) (*SSH, error) {
-	conn, err := s.conn.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
+// DialConnContext do the same thing as DialConn, but return once the context is done.
+func (s *SSH) DialConnContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if ctx.Done() == nil {
+		return s.DialConn(network, addr)
 	}
-	config, err := auth.SSHConfig()
+	err := ctx.Err()
 	if err != nil {
 		return nil, err
 	}
 
-	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		conn, err := s.DialConn(network, addr)
+		c <- result{conn: conn, err: err}
+	}()
+	select {
+	case r := <-c:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			r := <-c
+			if r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// ListenConn request the remote host to listen on the address, connections accepted
+// by remote host are forwarded to returned listener.
+func (s *SSH) ListenConn(net, addr string) (net.Listener, error) {
+	if s.conn == nil {
+		return nil, ErrConnClosed
+	}
+	return s.conn.Listen(net, addr)
+}
+
+func (s *SSH) Dial(addr string, auth *Auth) (*SSH, error) {
+	return s.DialContext(context.Background(), addr, auth)
+}
+
+// DialContext do the same thing as Dial, but the dialing is canceled once the context
+// is done.
+func (s *SSH) DialContext(ctx context.Context, addr string, auth *Auth) (*SSH, error) {
+	config, err := auth.SSHConfig()
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
-
-	client := ssh.NewClient(c, chans, reqs)
-	ssh, err := NewSSH(client, auth.MaxSession, s.NopClose())
+	conn, err := s.DialConnContext(ctx, "tcp", addr)
 	if err != nil {
-		client.Close()
 		return nil, err
 	}
-	return ssh, nil
+	return newSSHContext(ctx, conn, addr, auth, config, s)
 }
 
 func (s *SSH) incrRefs() int32 {
@@ -160,6 +307,98 @@ func (s *SSH) Status() (openAt time.Time, refs int32) {
 	return s.openAt, atomic.LoadInt32(s._refs)
 }
 
+// Ping send a keepalive@openssh.com request and wait for the reply, it returns error
+// if the connection is broken or no reply is received in timeout.
+func (s *SSH) Ping(timeout time.Duration) error {
+	if s.conn == nil {
+		return nil
+	}
+
+	return pingWithTimeout(timeout, func() error {
+		_, _, err := s.conn.SendRequest("keepalive@openssh.com", true, nil)
+		return err
+	})
+}
+
+// Probe open a trivial session and close it, it returns error if the connection is
+// broken or the session isn't opened in timeout. The session is opened directly
+// instead of from session pool, and refused session is considered as healthy since
+// the server is responding.
+func (s *SSH) Probe(timeout time.Duration) error {
+	if s.conn == nil {
+		return nil
+	}
+
+	return pingWithTimeout(timeout, func() error {
+		sess, err := s.conn.NewSession()
+		if err == nil {
+			sess.Close()
+		} else if _, ok := err.(*ssh.OpenChannelError); ok {
+			err = nil
+		}
+		return err
+	})
+}
+
+func pingWithTimeout(timeout time.Duration, ping func() error) error {
+	c := make(chan error, 1)
+	go func() {
+		c <- ping()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-c:
+		return err
+	case <-timer.C:
+		return ErrPingTimeout
+	}
+}
+
+// Traffic return the bytes read from and written to the underlying connection,
+// including ssh protocol overhead.
+func (s *SSH) Traffic() (in, out int64) {
+	if s.traffic == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&s.traffic.in), atomic.LoadInt64(&s.traffic.out)
+}
+
+type connTraffic struct {
+	in, out int64
+}
+
+type countingConn struct {
+	net.Conn
+	traffic *connTraffic
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.traffic.in, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.traffic.out, int64(n))
+	return n, err
+}
+
+// Addr return the address of remote host, it's empty for LocalOnly instance.
+func (s *SSH) Addr() string {
+	return s.addr
+}
+
+// UsedAt return the last time the instance is leased by Mux.
+func (s *SSH) UsedAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(s.usedAt))
+}
+
+func (s *SSH) touch() {
+	atomic.StoreInt64(s.usedAt, time.Now().UnixNano())
+}
+
 func (s *SSH) clean() {
 	s.lastErr = nil
 	s.lastOutput = nil
@@ -168,16 +407,24 @@ func (s *SSH) clean() {
 // Closed should be called only if reference count is zero or it's Cloned by NopClose
 func (s *SSH) Close() {
 	s.clean()
+	if s.release != nil {
+		s.release()
+		return
+	}
 	if s.nopClose {
 		s.decrRefs()
 		return
 	}
+	s.done.close(CloseExplicit)
 	if s.gate != nil {
 		s.gate.decrRefs()
 	}
 	if s.sessionPool != nil {
 		s.sessionPool.Close()
 	}
+	if s.lanes != nil {
+		s.lanes.close()
+	}
 	if s.sftp != nil {
 		s.sftp.Close()
 	}
@@ -186,6 +433,8 @@ func (s *SSH) Close() {
 	}
 }
 
+// RemotePipeInput set the stdin of following remote commands, see RcmdInput for a
+// single command.
 func (s *SSH) RemotePipeInput(stdin io.Reader) {
 	s.rIn = stdin
 }
@@ -204,6 +453,31 @@ func (s *SSH) LocalPipeOutput(stdout, stderr io.Writer) {
 	s.lErr = stderr
 }
 
+// CmdTimeout limit the run time of each command run by Rcmd and its variants and Sudo,
+// the command is sent SIGTERM and the session is closed once it's exceeded, the error
+// is ErrCmdTimeout. It's independent of the context passed to RcmdContext, 0 means no
+// limit.
+func (s *SSH) CmdTimeout(timeout time.Duration) {
+	s.cmdTimeout = timeout
+}
+
+// MaxOutputBytes limit the size of output buffered for Output, output exceeds the limit
+// is discarded and the error is an *OutputTruncatedError with the partial output kept.
+// The command isn't stopped, use CmdTimeout to limit runaway commands. Output written
+// to writers set by RemotePipeOutput, LocalPipeOutput and RcmdStream isn't limited.
+// 0 means no limit.
+func (s *SSH) MaxOutputBytes(n int) {
+	s.maxOutput = n
+}
+
+// SyncHash enable delta sync of Put and Get by the hash algorithm, such as HashSHA256.
+// Files with the same hash on both sides are skipped, copied files are verified by
+// hashing the destination afterwards. Hashes of remote trees are computed by
+// HashTree. Empty algo disables it.
+func (s *SSH) SyncHash(algo string) {
+	s.syncHash = algo
+}
+
 func (s *SSH) withErrorCheck(fn func() error) {
 	if s.lastErr == nil {
 		s.lastErr = fn()
@@ -216,7 +490,7 @@ func (s *SSH) Error() error {
 
 // save error state from external, such as fs op
 func (s *SSH) SetError(err error) {
-	s.lastErr = s.lastErr
+	s.lastErr = err
 }
 
 func (s *SSH) ClearError() {
@@ -231,13 +505,14 @@ func (s *SSH) Output() []byte {
 // The Close method of returned instance will do nothing but decrease parent reference count.
 func (s *SSH) NopClose() *SSH {
 	s.incrRefs()
-	if s.nopClose {
+	if s.nopClose && s.release == nil {
 		return s
 	}
 	ns := *s
 
 	ns.clean()
 	ns.nopClose = true
+	ns.release = nil
 
 	return &ns
 }
@@ -252,7 +527,98 @@ func (s *SSH) Rfs() Fs {
 
 func (s *SSH) Rcmd(cmd string, env ...string) {
 	s.withErrorCheck(func() error {
-		return s.runRcmd(cmd, env...)
+		return s.runOp(Operation{Kind: OpRcmd, Cmd: cmd}, func() error {
+			return s.runRcmd(cmd, env...)
+		})
+	})
+}
+
+// RcmdContext do the same thing as Rcmd, but the remote command is sent SIGTERM and
+// the session is closed once the context is done, the error is the context error.
+func (s *SSH) RcmdContext(ctx context.Context, cmd string, env ...string) {
+	s.withErrorCheck(func() error {
+		return s.runOpContext(ctx, Operation{Kind: OpRcmd, Cmd: cmd}, func(ctx context.Context) error {
+			return s.runRcmdContext(ctx, cmd, env...)
+		})
+	})
+}
+
+// RcmdStream do the same thing as RcmdContext, but the stdout and stderr of remote
+// command are written to the writers as the command runs instead of buffered in
+// memory, regardless of RemotePipeOutput. Nil writer discards the output. Output
+// returns nil after it and Auth.OutputEncoding isn't applied.
+func (s *SSH) RcmdStream(ctx context.Context, cmd string, stdout, stderr io.Writer, env ...string) {
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	s.withErrorCheck(func() error {
+		return s.runOpContext(ctx, Operation{Kind: OpRcmd, Cmd: cmd}, func(ctx context.Context) error {
+			stream := *s
+			stream.rOut, stream.rErr = stdout, stderr
+			s.lastOutput = nil
+			return stream.runRcmdContext(ctx, cmd, env...)
+		})
+	})
+}
+
+// RcmdInput do the same thing as Rcmd, but the reader is copied to the stdin of remote
+// command and the stdin is closed at EOF, e.g. feeding a local sql file to "psql"
+// without uploading it. It doesn't change the stdin set by RemotePipeInput.
+func (s *SSH) RcmdInput(stdin io.Reader, cmd string, env ...string) {
+	s.withErrorCheck(func() error {
+		return s.runOp(Operation{Kind: OpRcmd, Cmd: cmd}, func() error {
+			input := *s
+			input.rIn = stdin
+			err := input.runRcmd(cmd, env...)
+			s.lastOutput = input.lastOutput
+			return err
+		})
+	})
+}
+
+// RcmdScript run the local script file on remote host by the interpreter without
+// uploading it, the script is streamed to the stdin of "interpreter /dev/stdin args...",
+// so the script can't read stdin. Empty interpreter means "sh". The interpreter isn't
+// quoted, so it can contain options like "python3 -u", the args are quoted.
+func (s *SSH) RcmdScript(path, interpreter string, args ...string) {
+	if interpreter == "" {
+		interpreter = "sh"
+	}
+	cmd := interpreter + " /dev/stdin"
+	for _, arg := range args {
+		cmd += " " + shellQuote(arg)
+	}
+	s.withErrorCheck(func() error {
+		return s.runOp(Operation{Kind: OpRcmd, Cmd: cmd}, func() error {
+			if s.dryRun != nil {
+				return s.runRcmd(cmd)
+			}
+			fd, err := s.openFile(s.lfs, s.lpath(path), os.O_RDONLY, 0644)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+
+			script := *s
+			script.rIn = fd
+			err = script.runRcmd(cmd)
+			s.lastOutput = script.lastOutput
+			return err
+		})
+	})
+}
+
+// RcmdWithEnv do the same thing as Rcmd, the env are sent by setenv requests, so the
+// values needn't be quoted. Servers only accept the names listed in AcceptEnv of sshd,
+// rejected env are exported by the command prefix "export KEY='VALUE';" instead.
+func (s *SSH) RcmdWithEnv(cmd string, env map[string]string) {
+	s.withErrorCheck(func() error {
+		return s.runOp(Operation{Kind: OpRcmd, Cmd: cmd}, func() error {
+			return s.runRcmdVars(context.Background(), cmd, env)
+		})
 	})
 }
 
@@ -262,8 +628,26 @@ func (s *SSH) Lcmd(cmd string, env ...string) {
 	})
 }
 
+// LcmdContext do the same thing as Lcmd, but the local command is killed once the
+// context is done.
+func (s *SSH) LcmdContext(ctx context.Context, cmd string, env ...string) {
+	s.withErrorCheck(func() error {
+		return s.runLcmdContext(ctx, cmd, env...)
+	})
+}
+
 func (s *SSH) RcmdBg(cmd, stdout, stderr string, env ...string) {
-	s.Rcmd(s.cmdStrBg(cmd, stdout, stderr), env...)
+	s.withErrorCheck(func() error {
+		if s.dryRun == nil {
+			err := s.checkExec("RcmdBg")
+			if err != nil {
+				return err
+			}
+		}
+		return s.runOp(Operation{Kind: OpRcmdBg, Cmd: cmd}, func() error {
+			return s.runRcmd(s.cmdStrBg(cmd, stdout, stderr), env...)
+		})
+	})
 }
 
 func (s *SSH) LcmdBg(cmd, stdout, stderr string, env ...string) {
@@ -332,13 +716,17 @@ func (s *SSH) Rreaddir(path string, n int) []os.FileInfo {
 
 func (s *SSH) Put(path, remotePath string) {
 	s.withErrorCheck(func() error {
-		return s.sync(s.lfs, s.rfs, s.lpath(path), s.rpath(remotePath))
+		return s.runOp(Operation{Kind: OpPut, Src: path, Dst: remotePath}, func() error {
+			return s.syncTree(s.lfs, s.rfs, s.lpath(path), s.rpath(remotePath), false)
+		})
 	})
 }
 
 func (s *SSH) Get(remotePath, path string) {
 	s.withErrorCheck(func() error {
-		return s.sync(s.rfs, s.lfs, s.rpath(remotePath), s.lpath(path))
+		return s.runOp(Operation{Kind: OpGet, Src: remotePath, Dst: path}, func() error {
+			return s.syncTree(s.rfs, s.lfs, s.rpath(remotePath), s.lpath(path), true)
+		})
 	})
 }
 
@@ -417,6 +805,9 @@ func (s *SSH) TmpLcd(cwd string) *SSH {
 // private
 
 func (s *SSH) rcmdStr(cmd, env string) string {
+	if tag := s.processTag(); tag != "" {
+		env = strings.TrimSpace(tag + " " + env)
+	}
 	return s.cmdStr(s.rwd, env, cmd)
 }
 
@@ -434,6 +825,18 @@ func (s *SSH) cmdStr(cwd, env, cmd string) string {
 	return cwd + " " + env + " " + cmd
 }
 
+// Command build the command line with the name and arguments quoted for POSIX shell,
+// so arguments from user input can't inject commands, e.g.
+// Rcmd(Command("systemctl", "restart", svc)). See package shellq for more helpers.
+func Command(name string, args ...string) string {
+	return shellq.Command(name, args...)
+}
+
+// shellQuote quote the string as a single POSIX shell word.
+func shellQuote(s string) string {
+	return shellq.Quote(s)
+}
+
 func (s *SSH) remove(fs Fs, path string, recursive bool) error {
 	if recursive {
 		return fs.RemoveAll(path)
@@ -474,11 +877,18 @@ func (s *SSH) runCmd(isRemote bool, stdin *io.Reader, stdout, stderr *io.Writer,
 	}
 	*stdin = in
 	if ow == nil && ew == nil {
-		var b bytes.Buffer
+		// stdout and stderr of ssh session are copied concurrently.
+		b := lockedBuffer{limit: s.maxOutput}
 		*stdout = &b
 		*stderr = &b
 		err := run()
 		s.lastOutput = b.Bytes()
+		if isRemote {
+			s.lastOutput = s.decodeOutput(s.lastOutput)
+		}
+		if b.truncated {
+			err = &OutputTruncatedError{Limit: b.limit, Err: err}
+		}
 		return err
 	}
 
@@ -488,36 +898,187 @@ func (s *SSH) runCmd(isRemote bool, stdin *io.Reader, stdout, stderr *io.Writer,
 	return run()
 }
 
-func (s *SSH) runRcmd(cmd string, env ...string) error {
+// lockedBuffer is the buffer safe for concurrent writing, data exceeds the limit is
+// discarded if the limit is positive.
+type lockedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	if b.limit > 0 && b.buf.Len()+len(p) > b.limit {
+		p = p[:b.limit-b.buf.Len()]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+func (s *SSH) openSession() (*ssh.Session, *session, error) {
+	return s.takeSession(true)
+}
+
+// tryOpenSession do the same thing as openSession, but the error is errNoSession if
+// all sessions are in use instead of waiting for one.
+func (s *SSH) tryOpenSession() (*ssh.Session, *session, error) {
+	return s.takeSession(false)
+}
+
+func (s *SSH) takeSession(wait bool) (*ssh.Session, *session, error) {
+	conn, pool := s.conn, s.sessionPool
+	if s.lanes != nil {
+		conn, pool = s.lanes.pick(conn, pool)
+	}
+	var limitErr error
 	for {
-		session, ok := s.sessionPool.Take()
+		take := pool.Take
+		if !wait {
+			take = pool.tryTake
+		}
+		session, ok := take()
 		if !ok {
-			return ErrConnClosed
+			if limitErr != nil && pool.exhausted() {
+				return nil, nil, limitErr
+			}
+			if !wait && !pool.isClosed() {
+				return nil, nil, errNoSession
+			}
+			return nil, nil, ErrConnClosed
 		}
 
-		sess, err := s.conn.NewSession()
+		sess, err := conn.NewSession()
 		if err != nil {
 			if chanErr, ok := err.(*ssh.OpenChannelError); ok {
-				if chanErr.Reason == ssh.Prohibited {
+				switch chanErr.Reason {
+				case ssh.Prohibited:
+					// the sessions exceed the limit of server, retry with the pool shrank.
+					limitErr = &SessionLimitError{Addr: s.addr, Active: int(atomic.LoadInt32(&pool.active)) - 1, Err: err}
 					session.Drop()
+					if pool.exhausted() {
+						return nil, nil, limitErr
+					}
 					continue
+				case ssh.ResourceShortage:
+					err = &SessionLimitError{Addr: s.addr, Active: int(atomic.LoadInt32(&pool.active)) - 1, Err: err}
 				}
 			}
 
 			session.Release()
-			return err
+			return nil, nil, err
 		}
+		return sess, session, nil
+	}
+}
 
-		defer func() {
-			sess.Close()
-			session.Release()
-		}()
+func (s *SSH) runRcmd(cmd string, env ...string) error {
+	return s.runRcmdContext(context.Background(), cmd, env...)
+}
 
-		cmd := s.rcmdStr(cmd, strings.Join(env, " "))
-		return s.runCmd(true, &sess.Stdin, &sess.Stdout, &sess.Stderr, func() error {
-			return sess.Run(cmd)
-		})
+func (s *SSH) runRcmdContext(ctx context.Context, cmd string, env ...string) error {
+	return s.runRcmdVars(ctx, cmd, nil, env...)
+}
+
+// runRcmdVars run the remote command with vars sent by setenv requests and env
+// exported by command prefix.
+func (s *SSH) runRcmdVars(ctx context.Context, cmd string, vars map[string]string, env ...string) error {
+	if s.dryRun != nil {
+		env = append(env[:len(env):len(env)], exportVars(vars, nil)...)
+		return s.echoCmd(s.rcmdStr(cmd, strings.Join(env, " ")))
+	}
+	err := s.checkExec("Rcmd")
+	if err != nil {
+		return err
+	}
+
+	sess, session, err := s.openSession()
+	if err != nil {
+		return err
 	}
+	defer func() {
+		sess.Close()
+		session.Release()
+	}()
+	env = append(env[:len(env):len(env)], exportVars(vars, sess.Setenv)...)
+	rec, err := s.startRecord(RecordInfo{Cmd: cmd})
+	if err != nil {
+		return err
+	}
+	defer rec.close()
+
+	tail := tailBuffer{size: ExitStderrSize}
+	err = s.runCmd(true, &sess.Stdin, &sess.Stdout, &sess.Stderr, func() error {
+		sess.Stdout, sess.Stderr = rec.writer(sess.Stdout), rec.writer(sess.Stderr)
+		if sess.Stderr != nil {
+			sess.Stderr = io.MultiWriter(sess.Stderr, &tail)
+		} else {
+			sess.Stderr = &tail
+		}
+		return s.runSession(ctx, sess, s.rcmdStr(cmd, strings.Join(env, " ")))
+	})
+	return wrapExitError(cmd, err, tail.Bytes())
+}
+
+// runSession run the command in session, the command is sent SIGTERM and the session
+// is closed once the context is done or SSH.CmdTimeout is exceeded.
+func (s *SSH) runSession(ctx context.Context, sess *ssh.Session, cmd string) error {
+	done := ctx.Done()
+	var timeout <-chan time.Time
+	if s.cmdTimeout > 0 {
+		timer := time.NewTimer(s.cmdTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	if done == nil && timeout == nil {
+		return sess.Run(cmd)
+	}
+	if err := sess.Start(cmd); err != nil {
+		return err
+	}
+	c := make(chan error, 1)
+	go func() {
+		c <- sess.Wait()
+	}()
+	var err error
+	select {
+	case err := <-c:
+		return err
+	case <-done:
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrCmdTimeout
+	}
+	sess.Signal(ssh.SIGTERM)
+	sess.Close()
+	<-c
+	return err
+}
+
+// exportVars send the vars by setenv in order of names, and return the rejected ones
+// as "KEY='VALUE'" for exporting. All vars are returned if setenv is nil.
+func exportVars(vars map[string]string, setenv func(name, value string) error) []string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var export []string
+	for _, name := range names {
+		if setenv == nil || setenv(name, vars[name]) != nil {
+			export = append(export, name+"="+shellQuote(vars[name]))
+		}
+	}
+	return export
 }
 
 func (s *SSH) cmdStrBg(cmd, stdout, stderr string) string {
@@ -531,7 +1092,11 @@ func (s *SSH) cmdStrBg(cmd, stdout, stderr string) string {
 }
 
 func (s *SSH) runLcmd(cmd string, env ...string) error {
-	c := exec.Command("sh", "-c", s.lcmdStr(cmd, strings.Join(env, " ")))
+	return s.runLcmdContext(context.Background(), cmd, env...)
+}
+
+func (s *SSH) runLcmdContext(ctx context.Context, cmd string, env ...string) error {
+	c := exec.CommandContext(ctx, "sh", "-c", s.lcmdStr(cmd, strings.Join(env, " ")))
 	if len(env) > 0 {
 		c.Env = append(c.Env, env...)
 	}
@@ -570,7 +1135,7 @@ func (s *SSH) exists(fs Fs, path string) (bool, error) {
 	return true, nil
 }
 
-func (s *SSH) sync(fs, remoteFs Fs, path, remotePath string) error {
+func (s *SSH) sync(fs, remoteFs Fs, path, remotePath string, delta *syncDelta) error {
 	fd, err := fs.Open(path)
 	if err != nil {
 		return err
@@ -582,7 +1147,18 @@ func (s *SSH) sync(fs, remoteFs Fs, path, remotePath string) error {
 		return err
 	}
 	if !info.IsDir() {
-		return s.syncFile(remoteFs, remotePath, fd, info)
+		if delta == nil {
+			return s.syncFile(remoteFs, remotePath, fd, info)
+		}
+		rel, unchanged := delta.unchanged(fs.Filepath(), path)
+		if unchanged {
+			return nil
+		}
+		err = s.syncFile(remoteFs, remotePath, fd, info)
+		if err == nil {
+			delta.copied = append(delta.copied, rel)
+		}
+		return err
 	}
 
 	dirnames, err := fd.Readdir(-1)
@@ -593,7 +1169,7 @@ func (s *SSH) sync(fs, remoteFs Fs, path, remotePath string) error {
 	lfpath, rfpath := fs.Filepath(), remoteFs.Filepath()
 	for _, dirname := range dirnames {
 		name := dirname.Name()
-		err = s.sync(fs, remoteFs, lfpath.Join(path, name), rfpath.Join(remotePath, name))
+		err = s.sync(fs, remoteFs, lfpath.Join(path, name), rfpath.Join(remotePath, name), delta)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,281 @@
+package socker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RemoteCmd is the remote command started by RcmdStart.
+type RemoteCmd struct {
+	cmd   string
+	sess  *ssh.Session
+	tail  *tailBuffer
+	close func() error
+	s     *SSH
+	pidW  *pidWriter
+
+	mu    sync.Mutex
+	pid   int
+	start time.Time
+	end   time.Time
+
+	waitOnce  sync.Once
+	waitErr   error
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// RcmdStart start the remote command and return without waiting for it, so it can be
+// interrupted by signals. The stdout and stderr of command are written to the writers,
+// nil writer discards the output. The RemoteCmd holds a session and a reference of the
+// SSH instance until it's waited or closed. SSH.CmdTimeout isn't applied.
+//
+// In dry run mode the command line is written and the returned RemoteCmd does nothing.
+func (s *SSH) RcmdStart(cmd string, stdout, stderr io.Writer, env ...string) (*RemoteCmd, error) {
+	if s.dryRun != nil {
+		return &RemoteCmd{cmd: cmd}, s.echoCmd(s.rcmdStr(cmd, strings.Join(env, " ")))
+	}
+	err := s.checkExec("RcmdStart")
+	if err != nil {
+		return nil, err
+	}
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	rec, err := s.startRecord(RecordInfo{Cmd: cmd})
+	if err != nil {
+		return nil, err
+	}
+	var pidMarker string
+	if s.reportPID {
+		var marker [8]byte
+		_, err = io.ReadFull(rand.Reader, marker[:])
+		if err != nil {
+			rec.close()
+			return nil, err
+		}
+		pidMarker = "[socker-pid-" + hex.EncodeToString(marker[:]) + "]"
+	}
+	sess, session, err := s.openSession()
+	if err != nil {
+		rec.close()
+		return nil, err
+	}
+	ref := s.NopClose()
+	c := &RemoteCmd{
+		cmd:  cmd,
+		sess: sess,
+		tail: &tailBuffer{size: ExitStderrSize},
+		s:    ref,
+		close: func() error {
+			err := sess.Close()
+			session.Release()
+			ref.Close()
+			rec.close()
+			if err == io.EOF {
+				// the channel is closed by server after command exits.
+				err = nil
+			}
+			return err
+		},
+	}
+	sess.Stdin = s.rIn
+	sess.Stdout = rec.writer(stdout)
+	sess.Stderr = rec.writer(io.MultiWriter(stderr, c.tail))
+	if pidMarker != "" {
+		c.pidW = &pidWriter{marker: []byte(pidMarker), cmd: c, next: sess.Stderr}
+		sess.Stderr = c.pidW
+		cmd = fmt.Sprintf("echo %s$$ >&2; exec sh -c %s", pidMarker, shellQuote(cmd))
+	}
+	c.start = time.Now()
+	err = sess.Start(s.rcmdStr(cmd, strings.Join(env, " ")))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReportPID report the pid of commands started by RcmdStart, so RemoteCmd.PID is
+// available and RemoteCmd.Kill can kill the process by kill command if signals of
+// session are ignored by server. The pid is printed by the shell with a marker line in
+// stderr which is removed from output and the command is run by "exec sh -c", so it
+// requires POSIX shell of remote user, don't enable it for Windows or network devices.
+func (s *SSH) ReportPID(enable bool) {
+	s.reportPID = enable
+}
+
+// pidWriter parse the pid from the first line of stderr if it's the marker line, and
+// remove it from output.
+type pidWriter struct {
+	marker []byte
+	cmd    *RemoteCmd
+	next   io.Writer
+
+	done bool
+	line []byte
+}
+
+func (w *pidWriter) Write(b []byte) (int, error) {
+	if w.done {
+		return w.next.Write(b)
+	}
+	w.line = append(w.line, b...)
+	i := bytes.IndexByte(w.line, '\n')
+	if i < 0 && len(w.line) < len(w.marker)+32 {
+		return len(b), nil
+	}
+	w.done = true
+	data := w.line
+	w.line = nil
+	if i >= 0 && bytes.HasPrefix(data, w.marker) {
+		pid, err := strconv.Atoi(string(data[len(w.marker):i]))
+		if err == nil {
+			w.cmd.mu.Lock()
+			w.cmd.pid = pid
+			w.cmd.mu.Unlock()
+			data = data[i+1:]
+		}
+	}
+	if len(data) > 0 {
+		if _, err := w.next.Write(data); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// flush write the buffered data, it's called after stderr is closed.
+func (w *pidWriter) flush() {
+	if !w.done && len(w.line) > 0 {
+		w.done = true
+		w.next.Write(w.line)
+		w.line = nil
+	}
+}
+
+// PID return the pid of remote command, it's 0 if SSH.ReportPID isn't enabled or the
+// pid isn't reported yet.
+func (c *RemoteCmd) PID() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pid
+}
+
+// Elapsed return the duration since the command is started, until it's waited.
+func (c *RemoteCmd) Elapsed() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.start.IsZero() {
+		return 0
+	}
+	if !c.end.IsZero() {
+		return c.end.Sub(c.start)
+	}
+	return time.Since(c.start)
+}
+
+// Kill send SIGTERM to the remote command and SIGKILL if it doesn't exit in the grace
+// period, then close the session if it still doesn't exit in another grace period.
+// Signals are sent by session, and by kill command with the pid if SSH.ReportPID is
+// enabled since some servers ignore signals of session, the process group is killed
+// if the command is the group leader. The session is closed at once if SIGKILL can't
+// be sent by kill command since no session is available. It waits the command, call
+// Wait for the error.
+func (c *RemoteCmd) Kill(grace time.Duration) error {
+	if c.sess == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(done)
+	}()
+	for _, sig := range []ssh.Signal{ssh.SIGTERM, ssh.SIGKILL} {
+		if err := c.kill(sig); err == errNoSession && sig == ssh.SIGKILL {
+			break
+		}
+		timer := time.NewTimer(grace)
+		select {
+		case <-done:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+	err := c.Close()
+	<-done
+	return err
+}
+
+// kill send the signal by session, and by kill command without waiting for a session
+// if the pid is reported.
+func (c *RemoteCmd) kill(sig ssh.Signal) error {
+	c.sess.Signal(sig)
+	pid := c.PID()
+	if pid <= 0 {
+		return nil
+	}
+	p := strconv.Itoa(pid)
+	_, err := c.s.tryRcmdOutput("Kill", fmt.Sprintf("kill -%s -- -%s 2>/dev/null || kill -%s %s", sig, p, sig, p))
+	return err
+}
+
+// Signal send the signal to remote process, such as ssh.SIGINT and ssh.SIGTERM. Some
+// servers such as OpenSSH before 7.9 ignore signals, Close the command if it doesn't
+// exit.
+func (c *RemoteCmd) Signal(sig ssh.Signal) error {
+	if c.sess == nil {
+		return nil
+	}
+	return c.sess.Signal(sig)
+}
+
+// Wait wait the remote command exits and release the session, the error is an
+// *ExitError if it exits with non-zero status or is killed by signal.
+func (c *RemoteCmd) Wait() error {
+	if c.sess == nil {
+		return nil
+	}
+	c.waitOnce.Do(func() {
+		err := c.sess.Wait()
+		if c.pidW != nil {
+			c.pidW.flush()
+		}
+		c.mu.Lock()
+		c.end = time.Now()
+		c.mu.Unlock()
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			err = newExitError(c.cmd, exitErr, c.tail.Bytes())
+		}
+		c.waitErr = err
+		c.Close()
+	})
+	return c.waitErr
+}
+
+// Close close the session without waiting for the command, it's safe to call it
+// concurrently with Wait.
+func (c *RemoteCmd) Close() error {
+	if c.sess == nil {
+		return nil
+	}
+	c.closeOnce.Do(func() {
+		c.closeErr = c.close()
+	})
+	return c.closeErr
+}
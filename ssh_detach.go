@@ -0,0 +1,205 @@
+package socker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Detached is the remote process started by RcmdDetach, it runs in a new session by
+// setsid and survives the SSH connection. The PID and ExitFile can be saved to
+// manage the process from another connection by SSH.Detached.
+type Detached struct {
+	Cmd string
+	PID int
+	// ExitFile is the remote file the exit status of command is written to.
+	ExitFile string
+
+	s *SSH
+}
+
+// RcmdDetach start the remote command by nohup and setsid and return once it's started,
+// the stdout and stderr are redirected to the remote files like RcmdBg. The methods of
+// returned process need the SSH instance to be open.
+//
+// In dry run mode the command line is written and the returned process does nothing.
+func (s *SSH) RcmdDetach(cmd, stdout, stderr string, env ...string) *Detached {
+	var d *Detached
+	s.withErrorCheck(func() error {
+		return s.runOp(Operation{Kind: OpRcmdBg, Cmd: cmd}, func() error {
+			var err error
+			d, err = s.runDetach(cmd, stdout, stderr, env...)
+			return err
+		})
+	})
+	return d
+}
+
+// Detached return the process started by RcmdDetach, maybe from another connection.
+func (s *SSH) Detached(cmd string, pid int, exitFile string) *Detached {
+	return &Detached{Cmd: cmd, PID: pid, ExitFile: exitFile, s: s}
+}
+
+func (s *SSH) detachCmdStr(cmd, stdout, stderr, exitFile string, env ...string) string {
+	script := s.cmdStr("", strings.Join(env, " "), cmd)
+	// the command runs in subshell so exit is captured, the exit file is renamed
+	// after written so it's never read partially.
+	script = fmt.Sprintf("(\n%s\n)\necho $? >%s.tmp && mv %s.tmp %s", script, exitFile, exitFile, exitFile)
+	launch := s.cmdStrBg("$(command -v setsid) sh -c "+shellQuote(script), stdout, stderr)
+	return s.rcmdStr(launch+" echo $!", "")
+}
+
+func (s *SSH) runDetach(cmd, stdout, stderr string, env ...string) (*Detached, error) {
+	var id [8]byte
+	_, err := io.ReadFull(rand.Reader, id[:])
+	if err != nil {
+		return nil, err
+	}
+	d := s.Detached(cmd, 0, "/tmp/socker-detach-"+hex.EncodeToString(id[:])+".exit")
+	cmdStr := s.detachCmdStr(cmd, stdout, stderr, d.ExitFile, env...)
+	if s.dryRun != nil {
+		return d, s.echoCmd(cmdStr)
+	}
+	out, err := s.rcmdOutput("RcmdDetach", cmdStr)
+	if err != nil {
+		return nil, err
+	}
+	d.PID, err = strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pid: %s", strings.TrimSpace(string(out)))
+	}
+	return d, nil
+}
+
+// rcmdOutput run the command in a new session and return the stdout.
+func (s *SSH) rcmdOutput(feature, cmd string) ([]byte, error) {
+	return s.runOutput(feature, cmd, s.openSession)
+}
+
+// tryRcmdOutput do the same thing as rcmdOutput, but the error is errNoSession if no
+// session is available instead of waiting for one.
+func (s *SSH) tryRcmdOutput(feature, cmd string) ([]byte, error) {
+	return s.runOutput(feature, cmd, s.tryOpenSession)
+}
+
+func (s *SSH) runOutput(feature, cmd string, open func() (*ssh.Session, *session, error)) ([]byte, error) {
+	err := s.checkExec(feature)
+	if err != nil {
+		return nil, err
+	}
+	sess, session, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		sess.Close()
+		session.Release()
+	}()
+	return sess.Output(cmd)
+}
+
+// status return the exit status of process, running is true if it hasn't exited.
+// Exited processes without exit status, such as killed ones, have status -1.
+func (d *Detached) status() (code int, running bool, err error) {
+	pid := strconv.Itoa(d.PID)
+	// the exit file is checked first so a reused pid isn't treated as running, and
+	// again after the process so the exit between the checks is never missed. Zombies
+	// which aren't reaped by init are treated as exited.
+	out, err := d.s.rcmdOutput("Detached", fmt.Sprintf(`if [ -f %s ]; then cat %s
+elif kill -0 %s 2>/dev/null && ! grep -q '^%s ([^)]*) Z' /proc/%s/stat 2>/dev/null; then echo running
+elif [ -f %s ]; then cat %s
+else echo -1; fi`, d.ExitFile, d.ExitFile, pid, pid, pid, d.ExitFile, d.ExitFile))
+	if err != nil {
+		return 0, false, err
+	}
+	s := strings.TrimSpace(string(out))
+	if s == "running" {
+		return 0, true, nil
+	}
+	code, err = strconv.Atoi(s)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid exit status: %s", s)
+	}
+	return code, false, nil
+}
+
+// Alive check whether the process is still running.
+func (d *Detached) Alive() (bool, error) {
+	if d.PID <= 0 {
+		return false, nil
+	}
+	_, running, err := d.status()
+	return running, err
+}
+
+// Wait poll the process every interval until it exits or the context is done, the
+// interval is 1 second if it's not positive. The error is an *ExitError if it exits
+// with non-zero status, the Code is -1 and Signal is empty if it exits without
+// status, such as killed by signal.
+func (d *Detached) Wait(ctx context.Context, interval time.Duration) error {
+	if d.PID <= 0 {
+		return nil
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		code, running, err := d.status()
+		if err != nil {
+			return err
+		}
+		if !running {
+			if code != 0 {
+				return &ExitError{Cmd: d.Cmd, Code: code}
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Signal send the signal to the process group of process, such as ssh.SIGTERM, or the
+// process only if setsid isn't available.
+func (d *Detached) Signal(sig ssh.Signal) error {
+	if d.PID <= 0 {
+		return nil
+	}
+	pid := strconv.Itoa(d.PID)
+	cmd := fmt.Sprintf("kill -%s -- -%s 2>/dev/null || kill -%s %s", sig, pid, sig, pid)
+	if d.s.dryRun != nil {
+		return d.s.echoCmd(cmd)
+	}
+	_, err := d.s.rcmdOutput("Detached", cmd)
+	return err
+}
+
+// Kill kill the process group of process by SIGKILL.
+func (d *Detached) Kill() error {
+	return d.Signal(ssh.SIGKILL)
+}
+
+// Cleanup remove the exit file of the exited process.
+func (d *Detached) Cleanup() error {
+	if d.PID <= 0 {
+		return nil
+	}
+	cmd := "rm -f " + d.ExitFile + " " + d.ExitFile + ".tmp"
+	if d.s.dryRun != nil {
+		return d.s.echoCmd(cmd)
+	}
+	_, err := d.s.rcmdOutput("Detached", cmd)
+	return err
+}
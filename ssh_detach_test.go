@@ -0,0 +1,76 @@
+package socker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRcmdDetach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-detach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	out := filepath.Join(dir, "out")
+	d := agent.RcmdDetach("sleep 0.3; echo $GREETING; exit 3", out, "", "GREETING=hello")
+	if agent.Error() != nil {
+		t.Fatal(agent.Error())
+	}
+	defer d.Cleanup()
+	if d.PID <= 0 {
+		t.Fatalf("invalid pid: %d", d.PID)
+	}
+	if alive, err := d.Alive(); err != nil || !alive {
+		t.Errorf("expect process alive: %v %v", alive, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = d.Wait(ctx, 50*time.Millisecond)
+	if e, ok := err.(*ExitError); !ok || e.Code != 3 {
+		t.Errorf("expect exit status 3: %v", err)
+	}
+	data, _ := ioutil.ReadFile(out)
+	if string(data) != "hello\n" {
+		t.Errorf("unexpected output: %q", data)
+	}
+
+	d = agent.RcmdDetach("sleep 30", "/dev/null", "")
+	if agent.Error() != nil {
+		t.Fatal(agent.Error())
+	}
+	defer d.Cleanup()
+	err = agent.Detached(d.Cmd, d.PID, d.ExitFile).Kill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Wait(ctx, 50*time.Millisecond)
+	if e, ok := err.(*ExitError); !ok || e.Code != -1 {
+		t.Errorf("expect killed process: %v", err)
+	}
+	if alive, err := d.Alive(); err != nil || alive {
+		t.Errorf("expect process exited: %v %v", alive, err)
+	}
+
+	// the pid is reused by another running process once the command exited.
+	exitFile := filepath.Join(dir, "exit")
+	if err := ioutil.WriteFile(exitFile, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reused := agent.Detached("true", os.Getpid(), exitFile)
+	if alive, err := reused.Alive(); err != nil || alive {
+		t.Errorf("exit file should be checked before the pid: %v %v", alive, err)
+	}
+}
@@ -0,0 +1,48 @@
+package socker
+
+import "sync"
+
+// Reasons of closed connections reported by SSH.DoneReason, besides the reasons of
+// evictions by Mux such as EvictPing.
+const (
+	CloseExplicit = "closed"
+	CloseBroken   = "broken"
+)
+
+// connDone is closed once the connection is closed, it's shared by the instances
+// cloned by NopClose.
+type connDone struct {
+	once   sync.Once
+	ch     chan struct{}
+	reason string
+}
+
+func newConnDone() *connDone {
+	return &connDone{ch: make(chan struct{})}
+}
+
+func (d *connDone) close(reason string) {
+	d.once.Do(func() {
+		d.reason = reason
+		close(d.ch)
+	})
+}
+
+// Done return a channel which is closed after the underlying connection is closed,
+// such as evicted by Mux or broken, so holders of references like tunnels can react
+// and redial.
+func (s *SSH) Done() <-chan struct{} {
+	return s.done.ch
+}
+
+// DoneReason return the reason the connection is closed, empty if it's still open.
+// It's CloseExplicit if closed by Close or Mux.Close, CloseBroken if the connection
+// is broken, or the evict reason like EvictPing.
+func (s *SSH) DoneReason() string {
+	select {
+	case <-s.done.ch:
+		return s.done.reason
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,48 @@
+package socker
+
+import (
+	"testing"
+)
+
+func TestDone(t *testing.T) {
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.sshs["web-1:22"] = LocalOnly()
+	m.sshs["web-2:22"] = LocalOnly()
+
+	evicted, err := m.Dial("web-1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer evicted.Close()
+	closed, err := m.Dial("web-2:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closed.Close()
+	if evicted.DoneReason() != "" {
+		t.Error("open connection shouldn't be done")
+	}
+
+	m.evictAddr("web-1:22", EvictPing)
+	select {
+	case <-evicted.Done():
+	default:
+		t.Fatal("evicted connection should be done")
+	}
+	if r := evicted.DoneReason(); r != EvictPing {
+		t.Errorf("unexpected reason: %s", r)
+	}
+
+	m.Close()
+	<-closed.Done()
+	if r := closed.DoneReason(); r != CloseExplicit {
+		t.Errorf("unexpected reason: %s", r)
+	}
+}
@@ -0,0 +1,32 @@
+package socker
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrDryRun reports the interactive feature such as Shell and Terminal can't be used
+// in dry run mode, since the commands can't be known in advance.
+var ErrDryRun = errors.New("interactive session is unavailable in dry run mode")
+
+// DryRun make Rcmd and RcmdBg write the command lines to the writer instead of running
+// them, the lines are exactly what would be sent to remote host, including the work
+// dir, env and process tag. The line is also saved as the output, see SSH.Output.
+// Scripts of CleanupOrphans and Detached signals are written too, Shell, Terminal and
+// ShellSession fail with ErrDryRun. Nil writer disables it. The writer should be safe
+// for concurrent use if it's shared by several instances.
+func (s *SSH) DryRun(w io.Writer) {
+	s.dryRun = w
+}
+
+// IsDryRun report whether remote commands are written instead of run.
+func (s *SSH) IsDryRun() bool {
+	return s.dryRun != nil
+}
+
+func (s *SSH) echoCmd(cmd string) error {
+	line := []byte(cmd + "\n")
+	s.lastOutput = line
+	_, err := s.dryRun.Write(line)
+	return err
+}
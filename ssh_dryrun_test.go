@@ -0,0 +1,49 @@
+package socker
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	var buf bytes.Buffer
+	s := LocalOnly()
+	s.rwd = "/srv"
+	s.DryRun(&buf)
+	s.TagProcesses("deploy")
+
+	s.Rcmd("echo $A", "A=1")
+	expect := "cd /srv && export " + s.processTag() + " A=1 && echo $A\n"
+	if s.Error() != nil || string(s.Output()) != expect {
+		t.Errorf("unexpected command line: %q %v", s.Output(), s.Error())
+	}
+	s.RcmdBg("sleep 10", "", "")
+	expect += "cd /srv && export " + s.processTag() + " && nohup sleep 10 >nohup.out 2>&1 </dev/null &\n"
+	if s.Error() != nil || buf.String() != expect {
+		t.Errorf("unexpected command lines: %q", buf.String())
+	}
+
+	// destructive scripts are written, interactive sessions are refused.
+	buf.Reset()
+	if pids := s.CleanupOrphans("deploy"); s.Error() != nil || pids != nil || !strings.Contains(buf.String(), "kill -TERM") {
+		t.Errorf("orphans script isn't written: %q %v %v", buf.String(), pids, s.Error())
+	}
+	if err := s.Detached("sleep 10", 100, "/tmp/exit").Kill(); err != nil || !strings.Contains(buf.String(), "kill -KILL -- -100") {
+		t.Errorf("kill isn't written: %q %v", buf.String(), err)
+	}
+	if _, err := s.Shell(); err != ErrDryRun {
+		t.Errorf("shell should be refused: %v", err)
+	}
+	if _, err := s.Terminal(TerminalOptions{}); err != ErrDryRun {
+		t.Errorf("terminal should be refused: %v", err)
+	}
+	if _, err := s.ShellSession(TerminalOptions{}); err != ErrDryRun {
+		t.Errorf("shell session should be refused: %v", err)
+	}
+
+	s.DryRun(nil)
+	if s.IsDryRun() {
+		t.Error("dry run isn't disabled")
+	}
+}
@@ -0,0 +1,131 @@
+package socker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encodings of remote command output supported by Auth.OutputEncoding, others such
+// as EUC and Shift-JIS can be decoded by Auth.OutputDecoder, e.g. the Bytes method of
+// decoders in golang.org/x/text/encoding.
+const (
+	EncodingUTF8        = "utf-8"
+	EncodingLatin1      = "iso-8859-1"
+	EncodingWindows1252 = "windows-1252"
+	EncodingUTF16LE     = "utf-16le"
+	EncodingUTF16BE     = "utf-16be"
+)
+
+// OutputDecoder transcode the command output to UTF-8.
+type OutputDecoder func(b []byte) ([]byte, error)
+
+// windows1252 is the characters of windows-1252 in range 0x80-0x9f, others are the
+// same as iso-8859-1.
+var windows1252 = [32]rune{
+	'€', utf8.RuneError, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', utf8.RuneError, 'Ž', utf8.RuneError,
+	utf8.RuneError, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', utf8.RuneError, 'ž', 'Ÿ',
+}
+
+// NewOutputDecoder return the decoder of the encoding, the name is case insensitive
+// and empty means utf-8 which doesn't need to be decoded.
+func NewOutputDecoder(encoding string) (OutputDecoder, error) {
+	switch strings.ToLower(encoding) {
+	case "", EncodingUTF8, "utf8":
+		return nil, nil
+	case EncodingLatin1, "latin1":
+		return decodeLatin1, nil
+	case EncodingWindows1252, "cp1252":
+		return decodeWindows1252, nil
+	case EncodingUTF16LE:
+		return func(b []byte) ([]byte, error) {
+			return decodeUTF16(b, false)
+		}, nil
+	case EncodingUTF16BE:
+		return func(b []byte) ([]byte, error) {
+			return decodeUTF16(b, true)
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported output encoding: %s", encoding)
+}
+
+func decodeLatin1(b []byte) ([]byte, error) {
+	buf := make([]byte, 0, len(b))
+	for _, c := range b {
+		buf = appendRune(buf, rune(c))
+	}
+	return buf, nil
+}
+
+func decodeWindows1252(b []byte) ([]byte, error) {
+	buf := make([]byte, 0, len(b))
+	for _, c := range b {
+		r := rune(c)
+		if c >= 0x80 && c <= 0x9f {
+			r = windows1252[c-0x80]
+		}
+		buf = appendRune(buf, r)
+	}
+	return buf, nil
+}
+
+// decodeUTF16 decode the utf-16 bytes, the byte order mark is skipped.
+func decodeUTF16(b []byte, bigEndian bool) ([]byte, error) {
+	if len(b)%2 != 0 {
+		return nil, errors.New("utf-16 output has odd length")
+	}
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i < len(b); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+		} else {
+			units = append(units, uint16(b[i+1])<<8|uint16(b[i]))
+		}
+	}
+	if len(units) > 0 && units[0] == 0xfeff {
+		units = units[1:]
+	}
+	buf := make([]byte, 0, len(units))
+	for _, r := range utf16.Decode(units) {
+		buf = appendRune(buf, r)
+	}
+	return buf, nil
+}
+
+func appendRune(buf []byte, r rune) []byte {
+	if r < utf8.RuneSelf {
+		return append(buf, byte(r))
+	}
+	var tmp [utf8.UTFMax]byte
+	n := utf8.EncodeRune(tmp[:], r)
+	return append(buf, tmp[:n]...)
+}
+
+// outputDecoder return the decoder of remote command output, OutputDecoder wins
+// OutputEncoding.
+func (a *Auth) outputDecoder() (OutputDecoder, error) {
+	if a.OutputDecoder != nil {
+		return a.OutputDecoder, nil
+	}
+	return NewOutputDecoder(a.OutputEncoding)
+}
+
+// DecodeOutput make the captured output of remote commands transcoded to UTF-8 by
+// the decoder, see SSH.Output. Output written to pipes isn't decoded. Nil decoder
+// disables it. The output is kept as is if it can't be decoded.
+func (s *SSH) DecodeOutput(dec OutputDecoder) {
+	s.decode = dec
+}
+
+func (s *SSH) decodeOutput(b []byte) []byte {
+	if s.decode == nil || len(b) == 0 {
+		return b
+	}
+	decoded, err := s.decode(b)
+	if err != nil {
+		return b
+	}
+	return decoded
+}
@@ -0,0 +1,50 @@
+package socker
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOutputDecoder(t *testing.T) {
+	tests := []struct {
+		encoding string
+		input    []byte
+		expect   string
+	}{
+		{"latin1", []byte("caf\xe9"), "café"},
+		{EncodingWindows1252, []byte("\x80 \x93ok\x94"), "€ “ok”"},
+		{EncodingUTF16LE, []byte("\xff\xfeo\x00k\x00\xe9\x00"), "oké"},
+		{"UTF-16BE", []byte("\x00o\x00k\x00\xe9"), "oké"},
+	}
+	for _, test := range tests {
+		dec, err := NewOutputDecoder(test.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := dec(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != test.expect {
+			t.Errorf("decode %s failed: expect %q, got %q", test.encoding, test.expect, output)
+		}
+	}
+
+	if dec, err := NewOutputDecoder("utf-8"); err != nil || dec != nil {
+		t.Errorf("utf-8 shouldn't be decoded: %v", err)
+	}
+	if _, err := NewOutputDecoder("ebcdic"); err == nil {
+		t.Error("unsupported encoding should fail")
+	}
+	if _, err := (&Auth{User: "root", Password: "secret", OutputEncoding: "ebcdic"}).SSHConfig(); err == nil {
+		t.Error("auth with unsupported encoding should be invalid")
+	}
+
+	s := LocalOnly()
+	s.DecodeOutput(func(b []byte) ([]byte, error) {
+		return nil, errors.New("invalid")
+	})
+	if output := s.decodeOutput([]byte("raw")); string(output) != "raw" {
+		t.Errorf("undecodable output should be kept: %q", output)
+	}
+}
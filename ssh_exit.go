@@ -0,0 +1,131 @@
+package socker
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ExitStderrSize is the max size of stderr tail kept by ExitError.
+var ExitStderrSize = 4096
+
+// ExitError is returned by Rcmd and its variants if the remote command exits with
+// non-zero status or is killed by signal.
+//
+// Breaking change: these errors were *ssh.ExitError before, type assertions of it
+// no longer match. Use AsExitError instead, the *ssh.ExitError is still reachable
+// by ExitError.SSHExitError and Unwrap.
+type ExitError struct {
+	Cmd string
+	// Code is the exit status, it's -1 if the command is killed by signal.
+	Code int
+	// Signal is the name of signal terminated the command without "SIG" prefix,
+	// such as "TERM", it's empty if the command exits normally.
+	Signal string
+	// Stderr is the tail of stderr output, at most ExitStderrSize bytes.
+	Stderr []byte
+
+	err *ssh.ExitError
+}
+
+func newExitError(cmd string, err *ssh.ExitError, stderr []byte) *ExitError {
+	e := &ExitError{
+		Cmd:    cmd,
+		Code:   err.ExitStatus(),
+		Signal: err.Signal(),
+		Stderr: stderr,
+		err:    err,
+	}
+	if e.Signal != "" {
+		e.Code = -1
+	}
+	return e
+}
+
+// wrapExitError convert the *ssh.ExitError, include the one wrapped by
+// *OutputTruncatedError, to *ExitError.
+func wrapExitError(cmd string, err error, stderr []byte) error {
+	switch e := err.(type) {
+	case *ssh.ExitError:
+		return newExitError(cmd, e, stderr)
+	case *OutputTruncatedError:
+		e.Err = wrapExitError(cmd, e.Err, stderr)
+	}
+	return err
+}
+
+// AsExitError return the *ExitError of the error, include the one wrapped by
+// *OutputTruncatedError.
+func AsExitError(err error) (*ExitError, bool) {
+	if e, ok := err.(*OutputTruncatedError); ok {
+		err = e.Err
+	}
+	e, ok := err.(*ExitError)
+	return e, ok
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("command killed by signal %s: %s", e.Signal, e.Cmd)
+	}
+	return fmt.Sprintf("command exited with status %d: %s", e.Code, e.Cmd)
+}
+
+// SSHExitError return the underlying *ssh.ExitError which was returned by Rcmd and
+// its variants before ExitError is introduced.
+func (e *ExitError) SSHExitError() *ssh.ExitError {
+	return e.err
+}
+
+// Unwrap return the underlying *ssh.ExitError.
+func (e *ExitError) Unwrap() error {
+	return e.err
+}
+
+// tailBuffer keep the last bytes written.
+type tailBuffer struct {
+	size int
+	buf  []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.size <= 0 {
+		return n, nil
+	}
+	if len(p) >= b.size {
+		b.buf = append(b.buf[:0], p[len(p)-b.size:]...)
+		return n, nil
+	}
+	if over := len(b.buf) + len(p) - b.size; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+func (b *tailBuffer) Bytes() []byte {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	return b.buf
+}
+
+// OutputTruncatedError is returned if the output of command exceeds the limit set by
+// SSH.MaxOutputBytes, Err is the error of command, nil if it succeeds.
+type OutputTruncatedError struct {
+	Limit int
+	Err   error
+}
+
+func (e *OutputTruncatedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("output truncated to %d bytes: %s", e.Limit, e.Err.Error())
+	}
+	return fmt.Sprintf("output truncated to %d bytes", e.Limit)
+}
+
+// Unwrap return the error of command.
+func (e *OutputTruncatedError) Unwrap() error {
+	return e.Err
+}
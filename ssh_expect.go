@@ -0,0 +1,129 @@
+package socker
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrExpectTimeout reports the expected pattern doesn't appear in time.
+var ErrExpectTimeout = errors.New("expect timeout")
+
+// ShellSession is a interactive login shell kept alive across commands, it's driven
+// by Send and Expect like the expect tool. It's useful for network devices and
+// appliances which have no posix shell or are slow to open exec sessions, see Shell
+// for hosts with posix shell.
+type ShellSession struct {
+	term  *Terminal
+	stdin io.WriteCloser
+
+	mu     sync.Mutex
+	buf    []byte
+	err    error
+	notify chan struct{}
+}
+
+// ShellSession start the login shell in a pseudo terminal, the Cmd, Stdin, Stdout and
+// Stderr of options are ignored. The default Term is "dumb" and echo is disabled by
+// default, so the output contains no color codes and sent lines.
+func (s *SSH) ShellSession(opts TerminalOptions) (*ShellSession, error) {
+	if opts.Term == "" {
+		opts.Term = "dumb"
+	}
+	if opts.Modes == nil {
+		opts.Modes = ssh.TerminalModes{ssh.ECHO: 0}
+	}
+	stdoutR, stdout := io.Pipe()
+	opts.Cmd = ""
+	opts.Stdin, opts.Stdout, opts.Stderr = nil, stdout, stdout
+
+	var stdin io.WriteCloser
+	term, err := s.terminal(opts, &stdin)
+	if err != nil {
+		return nil, err
+	}
+	sh := &ShellSession{
+		term:   term,
+		stdin:  stdin,
+		notify: make(chan struct{}),
+	}
+	go func() {
+		err := term.Wait()
+		if err == nil {
+			err = ErrShellExited
+		}
+		stdout.CloseWithError(err)
+	}()
+	go sh.read(stdoutR)
+	return sh, nil
+}
+
+func (sh *ShellSession) read(r io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		sh.mu.Lock()
+		sh.buf = append(sh.buf, buf[:n]...)
+		if err != nil {
+			sh.err = err
+		}
+		close(sh.notify)
+		sh.notify = make(chan struct{})
+		sh.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Send write the line and a newline to the shell.
+func (sh *ShellSession) Send(line string) error {
+	_, err := io.WriteString(sh.stdin, line+"\n")
+	if err == io.EOF {
+		err = ErrShellExited
+	}
+	return err
+}
+
+// Expect wait the output matches the regexp pattern and return the output until the
+// end of match, the returned output is consumed. The error is ErrExpectTimeout if it
+// doesn't match in time, and ErrShellExited or *ExitError if the shell exits, the
+// output not consumed is also returned in the cases.
+func (sh *ShellSession) Expect(pattern string, timeout time.Duration) ([]byte, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		sh.mu.Lock()
+		if loc := re.FindIndex(sh.buf); loc != nil {
+			out := append([]byte(nil), sh.buf[:loc[1]]...)
+			sh.buf = sh.buf[loc[1]:]
+			sh.mu.Unlock()
+			return out, nil
+		}
+		out, err, notify := append([]byte(nil), sh.buf...), sh.err, sh.notify
+		sh.mu.Unlock()
+		if err != nil {
+			return out, err
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return out, ErrExpectTimeout
+		}
+	}
+}
+
+// Close terminate the shell and release the session.
+func (sh *ShellSession) Close() error {
+	sh.stdin.Close()
+	return sh.term.Close()
+}
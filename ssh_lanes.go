@@ -0,0 +1,174 @@
+package socker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// connLanes are the extra connections to the same host, sessions are spread across
+// the connection and them by the count of active sessions. They are dialed when all
+// connections have active sessions.
+type connLanes struct {
+	max        int
+	maxSession int
+	dial       func() (*ssh.Client, error)
+	// release is called after each extra connection is closed.
+	release func()
+
+	mu      sync.Mutex
+	closed  bool
+	dialing bool
+	lanes   []*connLane
+}
+
+type connLane struct {
+	conn *ssh.Client
+	pool *sessionPool
+}
+
+func newConnLanes(max, maxSession int, dial func() (*ssh.Client, error), release func()) *connLanes {
+	return &connLanes{
+		max:        max,
+		maxSession: maxSession,
+		dial:       dial,
+		release:    release,
+	}
+}
+
+// pick return the connection with least active sessions, an extra connection is dialed
+// in background if all connections are busy.
+func (l *connLanes) pick(conn *ssh.Client, pool *sessionPool) (*ssh.Client, *sessionPool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	active := atomic.LoadInt32(&pool.active)
+	for _, lane := range l.lanes {
+		if n := atomic.LoadInt32(&lane.pool.active); n < active {
+			conn, pool, active = lane.conn, lane.pool, n
+		}
+	}
+	if active > 0 && !l.closed && !l.dialing && len(l.lanes)+1 < l.max {
+		l.dialing = true
+		go l.spawn()
+	}
+	return conn, pool
+}
+
+func (l *connLanes) spawn() {
+	defer recoverPanic(nil, "conn lanes")
+
+	conn, err := l.dial()
+	l.mu.Lock()
+	l.dialing = false
+	if err != nil || l.closed {
+		l.mu.Unlock()
+		if err == nil {
+			conn.Close()
+			l.release()
+		}
+		return
+	}
+	lane := &connLane{conn: conn, pool: newSessionPool(l.maxSession)}
+	l.lanes = append(l.lanes, lane)
+	l.mu.Unlock()
+
+	go func() {
+		conn.Wait()
+		if l.remove(lane) {
+			lane.pool.Close()
+			l.release()
+		}
+	}()
+}
+
+func (l *connLanes) remove(lane *connLane) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ln := range l.lanes {
+		if ln == lane {
+			l.lanes = append(l.lanes[:i], l.lanes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// count return the count of extra connections.
+func (l *connLanes) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.lanes)
+}
+
+func (l *connLanes) close() {
+	l.mu.Lock()
+	l.closed = true
+	lanes := l.lanes
+	l.lanes = nil
+	l.mu.Unlock()
+	for _, lane := range lanes {
+		lane.pool.Close()
+		lane.conn.Close()
+		l.release()
+	}
+}
+
+// dialLane dial an extra connection to the address with the same route and auth
+// method, it's limited by MuxAuth.MaxConns but never waits.
+func (m *Mux) dialLane(addr string, auth *Auth, traffic *connTraffic) (*ssh.Client, error) {
+	if m.isClosed() {
+		return nil, ErrMuxClosed
+	}
+	if m.connSlots != nil {
+		select {
+		case m.connSlots <- struct{}{}:
+		default:
+			return nil, ErrTooManyConns
+		}
+	}
+	client, err := m.dialLaneClient(addr, auth, traffic)
+	if err != nil {
+		m.releaseConn()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (m *Mux) dialLaneClient(addr string, auth *Auth, traffic *connTraffic) (*ssh.Client, error) {
+	config, err := auth.SSHConfig()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+	conn, err := m.DialConnContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(&countingConn{Conn: conn, traffic: traffic}, m.resolveHost(addr), config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// Conns return the count of physical connections the sessions are spread across, see
+// MuxAuth.ConnsPerHost.
+func (s *SSH) Conns() int {
+	if s.lanes == nil {
+		return 1
+	}
+	return s.lanes.count() + 1
+}
@@ -0,0 +1,53 @@
+package socker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnLanes(t *testing.T) {
+	dials := make(chan struct{}, 4)
+	l := newConnLanes(3, 0, func() (*ssh.Client, error) {
+		dials <- struct{}{}
+		return nil, errors.New("refused")
+	}, func() {})
+	primary, lane := newSessionPool(0), &connLane{pool: newSessionPool(0)}
+	l.lanes = append(l.lanes, lane)
+
+	if _, pool := l.pick(nil, primary); pool != primary {
+		t.Error("idle primary connection should be picked")
+	}
+	select {
+	case <-dials:
+		t.Error("idle connections shouldn't spawn new one")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s, _ := primary.Take()
+	defer s.Release()
+	if _, pool := l.pick(nil, primary); pool != lane.pool {
+		t.Error("connection with least active sessions should be picked")
+	}
+	s2, _ := lane.pool.Take()
+	defer s2.Release()
+	l.pick(nil, primary)
+	select {
+	case <-dials:
+	case <-time.After(time.Second):
+		t.Fatal("busy connections should spawn new one")
+	}
+
+	if !l.remove(lane) || l.count() != 0 {
+		t.Error("lane should be removed")
+	}
+	l.close()
+	l.pick(nil, primary)
+	select {
+	case <-dials:
+		t.Error("closed lanes shouldn't spawn")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,78 @@
+package socker
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// Stream is the output stream of remote command.
+type Stream int
+
+// Stdout and Stderr are the streams passed to the function of RcmdLines.
+const (
+	Stdout Stream = iota + 1
+	Stderr
+)
+
+func (s Stream) String() string {
+	switch s {
+	case Stdout:
+		return "stdout"
+	case Stderr:
+		return "stderr"
+	}
+	return "unknown"
+}
+
+// RcmdLines do the same thing as RcmdStream, but the function is called with each
+// line of output as it arrives, the line doesn't contain the trailing newline and is
+// only valid during the call. The calls are serialized, the last line without newline
+// is passed after the command exits.
+func (s *SSH) RcmdLines(ctx context.Context, cmd string, fn func(stream Stream, line []byte), env ...string) {
+	var mu sync.Mutex
+	stdout := &lineWriter{stream: Stdout, mu: &mu, fn: fn}
+	stderr := &lineWriter{stream: Stderr, mu: &mu, fn: fn}
+	s.RcmdStream(ctx, cmd, stdout, stderr, env...)
+	stdout.flush()
+	stderr.flush()
+}
+
+// lineWriter split the written data into lines.
+type lineWriter struct {
+	stream Stream
+	mu     *sync.Mutex
+	fn     func(stream Stream, line []byte)
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(p)
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			break
+		}
+		if len(w.buf) > 0 {
+			w.buf = append(w.buf, p[:i]...)
+			w.fn(w.stream, w.buf)
+			w.buf = w.buf[:0]
+		} else {
+			w.fn(w.stream, p[:i])
+		}
+		p = p[i+1:]
+	}
+	w.buf = append(w.buf, p...)
+	return n, nil
+}
+
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.fn(w.stream, w.buf)
+		w.buf = nil
+	}
+}
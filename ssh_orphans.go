@@ -0,0 +1,117 @@
+package socker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ProcessTagEnv is the environment variable used to tag remote processes, the value
+// is the format of "name:runID".
+const ProcessTagEnv = "SOCKER_TAG"
+
+// ErrNoProcessTag reports the process tag isn't set for cleaning up orphans.
+var ErrNoProcessTag = errors.New("process tag isn't set")
+
+// RunID identify current controller process, processes tagged by previous runs are
+// considered orphaned.
+var RunID = newRunID()
+
+func newRunID() string {
+	var b [6]byte
+	rand.Read(b[:])
+	return strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(b[:])
+}
+
+// TagProcesses tag remote processes started by Rcmd, RcmdBg and Shell with the name
+// and RunID, so orphaned processes of crashed runs can be found by CleanupOrphans.
+// The name should be unique for each controller, otherwise processes of other alive
+// controllers are considered orphaned. Empty name disable tagging.
+func (s *SSH) TagProcesses(name string) {
+	s.procTag = name
+}
+
+func (s *SSH) processTag() string {
+	if s.procTag == "" {
+		return ""
+	}
+	return ProcessTagEnv + "=" + shellQuote(s.procTag+":"+RunID)
+}
+
+// CleanupOrphans find remote processes tagged with the name by previous runs and
+// send SIGTERM to them, it returns the pids of killed processes. It requires procfs
+// on remote host, processes of other users can't be found unless it's run by root.
+//
+// In dry run mode the script is written and no process is killed.
+func (s *SSH) CleanupOrphans(name string) []int {
+	var pids []int
+	s.withErrorCheck(func() error {
+		if name == "" {
+			return ErrNoProcessTag
+		}
+		if s.dryRun != nil {
+			return s.echoCmd(orphansScript(name, RunID))
+		}
+		err := s.checkExec("CleanupOrphans")
+		if err != nil {
+			return err
+		}
+		sess, session, err := s.openSession()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			sess.Close()
+			session.Release()
+		}()
+
+		out, err := sess.Output(orphansScript(name, RunID))
+		if err != nil {
+			return err
+		}
+		for _, field := range strings.Fields(string(out)) {
+			pid, err := strconv.Atoi(field)
+			if err != nil {
+				return fmt.Errorf("invalid pid: %s", field)
+			}
+			pids = append(pids, pid)
+		}
+		return nil
+	})
+	return pids
+}
+
+// orphansScript find and kill the processes tagged with the name but not the runID,
+// then print their pids.
+func orphansScript(name, runID string) string {
+	return fmt.Sprintf(`N=%s; R=%s; P=""
+for f in /proc/[0-9]*/environ; do
+  t=$(tr '\0' '\n' <"$f" 2>/dev/null | grep "^%s=" | head -n 1)
+  case "$t" in
+    "%s=$N:$R") ;;
+    "%s=$N:"*) p=${f#/proc/}; P="$P ${p%%/environ}" ;;
+  esac
+done
+[ -n "$P" ] && kill -TERM $P 2>/dev/null
+echo $P`, shellQuote(name), shellQuote(runID), ProcessTagEnv, ProcessTagEnv, ProcessTagEnv)
+}
+
+// CleanupOrphans dial the address and cleanup orphaned processes tagged by
+// MuxAuth.ProcessTag, see SSH.CleanupOrphans.
+func (m *Mux) CleanupOrphans(addr string) ([]int, error) {
+	if m.procTag == "" {
+		return nil, ErrNoProcessTag
+	}
+	agent, err := m.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer agent.Close()
+
+	pids := agent.CleanupOrphans(m.procTag)
+	return pids, agent.Error()
+}
@@ -0,0 +1,40 @@
+package socker
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOrphansScript(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("procfs is required")
+	}
+
+	start := func(runID string) *exec.Cmd {
+		c := exec.Command("sleep", "30")
+		c.Env = append(os.Environ(), ProcessTagEnv+"=orphans-test:"+runID)
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	orphan := start("previous")
+	alive := start("current")
+	defer alive.Process.Kill()
+	defer orphan.Process.Kill()
+
+	out, err := exec.Command("sh", "-c", orphansScript("orphans-test", "current")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pids := strings.Fields(string(out)); len(pids) != 1 || pids[0] != strconv.Itoa(orphan.Process.Pid) {
+		t.Fatalf("orphans mismatch: %s", out)
+	}
+	if orphan.Wait() == nil {
+		t.Error("orphan isn't killed")
+	}
+}
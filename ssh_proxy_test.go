@@ -0,0 +1,210 @@
+package socker
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startHTTPProxy start a http proxy which only serves CONNECT with the basic auth
+// "user:pass", the connected addresses are sent to the channel.
+func startHTTPProxy(t *testing.T, connected chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				user, password, _ := (&http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth()
+				if req.Method != http.MethodConnect || user != "user" || password != "pass" {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				connected <- req.Host
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestHTTPProxyGate(t *testing.T) {
+	node := startAuthServer(t)
+	defer node.Close()
+	connected := make(chan string, 10)
+	proxy := startHTTPProxy(t, connected)
+	defer proxy.Close()
+
+	dials := make(chan ConnEvent, 10)
+	newMux := func(gate string) *Mux {
+		m, err := NewMux(MuxAuth{
+			AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+			DefaultAuth: "default",
+			AgentGates:  map[string]string{"plain:" + node.Addr().String(): gate},
+			Hooks: MuxHooks{
+				OnDial: func(e ConnEvent) { dials <- e },
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// the node rejects all passwords, AuthError means the handshake went through the proxy.
+	m := newMux("http://user:pass@" + proxy.Addr().String())
+	defer m.Close()
+	_, err := m.Dial(node.Addr().String())
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expect AuthError, got %v", err)
+	}
+	if addr := <-connected; addr != node.Addr().String() {
+		t.Errorf("unexpected connected address: %s", addr)
+	}
+	if e := <-dials; e.Gate != "http://user:[REDACTED]@"+proxy.Addr().String() {
+		t.Errorf("proxy password should be redacted: %s", e.Gate)
+	}
+	if hops, err := m.GateChain(node.Addr().String()); err != nil || len(hops) != 1 || strings.Contains(hops[0], "pass") {
+		t.Errorf("proxy password should be redacted: %v %v", hops, err)
+	}
+
+	m = newMux("http://user:wrong@" + proxy.Addr().String())
+	defer m.Close()
+	_, err = m.Dial(node.Addr().String())
+	if err == nil || errors.As(err, &authErr) {
+		t.Errorf("proxy error should be returned: %v", err)
+	}
+
+	for _, gate := range []string{"bastion:22,http://proxy:3128", "socks4://proxy:1080", "http://"} {
+		if _, err := parseGates(gate); err == nil {
+			t.Errorf("invalid proxy gate should be rejected: %s", gate)
+		}
+	}
+}
+
+// startSOCKS5Proxy start a socks5 proxy which requires the username "user" and password
+// "pass", the connected addresses are sent to the channel.
+func startSOCKS5Proxy(t *testing.T, connected chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readString := func(r io.Reader) string {
+		var size [1]byte
+		io.ReadFull(r, size[:])
+		b := make([]byte, size[0])
+		io.ReadFull(r, b)
+		return string(b)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var buf [4]byte
+				io.ReadFull(conn, buf[:1])
+				readString(conn)
+				conn.Write([]byte{5, 2})
+				io.ReadFull(conn, buf[:1])
+				if readString(conn) != "user" || readString(conn) != "pass" {
+					conn.Write([]byte{1, 1})
+					return
+				}
+				conn.Write([]byte{1, 0})
+
+				io.ReadFull(conn, buf[:4])
+				var host string
+				switch buf[3] {
+				case 1:
+					ip := make([]byte, 4)
+					io.ReadFull(conn, ip)
+					host = net.IP(ip).String()
+				case 3:
+					host = readString(conn)
+				}
+				var port [2]byte
+				io.ReadFull(conn, port[:])
+				addr := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+				connected <- addr
+				target, err := net.Dial("tcp", addr)
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	node := startAuthServer(t)
+	defer node.Close()
+	connected := make(chan string, 10)
+	proxy := startSOCKS5Proxy(t, connected)
+	defer proxy.Close()
+
+	// the node rejects all passwords, AuthError means the handshake went through the proxy.
+	_, err := Dial(node.Addr().String(), &Auth{User: "root", Password: "secret", Proxy: "socks5://user:pass@" + proxy.Addr().String()})
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expect AuthError, got %v", err)
+	}
+	if addr := <-connected; addr != node.Addr().String() {
+		t.Errorf("unexpected connected address: %s", addr)
+	}
+
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+		AgentGates:  map[string]string{"glob:localhost:*": "socks5://user:pass@" + proxy.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	_, port, _ := net.SplitHostPort(node.Addr().String())
+	_, err = m.Dial("localhost:" + port)
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expect AuthError, got %v", err)
+	}
+	if addr := <-connected; addr != "localhost:"+port {
+		t.Errorf("host name should be resolved by proxy: %s", addr)
+	}
+
+	_, err = Dial(node.Addr().String(), &Auth{User: "root", Password: "secret", Proxy: "socks5://user:wrong@" + proxy.Addr().String()})
+	if err == nil || errors.As(err, &authErr) || strings.Contains(err.Error(), "wrong") {
+		t.Errorf("proxy error should be returned with password redacted: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package socker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RecordKind is the kind of recorded data.
+type RecordKind string
+
+const (
+	RecordOutput RecordKind = "o"
+	RecordInput  RecordKind = "i"
+	// RecordResize is the window change of Terminal, the data is like "100x40".
+	RecordResize RecordKind = "r"
+)
+
+// RecordInfo describe the recorded session.
+type RecordInfo struct {
+	Addr string
+	// Cmd is the command, empty for login shell.
+	Cmd string
+	// Term, Cols and Rows are the terminal settings, the size is 80x24 for sessions
+	// without terminal.
+	Term       string
+	Cols, Rows int
+	Start      time.Time
+}
+
+// Recorder record the data of a session, it's created for each session by the function
+// passed to SSH.RecordSessions. The data is only valid during the call.
+type Recorder interface {
+	Record(elapsed time.Duration, kind RecordKind, data []byte) error
+	// Close is called after the session is closed.
+	Close() error
+}
+
+// RecordSessions record the sessions of commands run by Rcmd and its variants, Sudo,
+// RcmdStart, Terminal and ShellSession by the recorders created by the function, such
+// as NewAsciicastRecorder and NewScriptRecorder with writers streaming to files or
+// object storage. Commands fail if the recorder can't be created, errors of recording
+// are ignored so commands aren't interrupted. Stdout and stderr are both recorded as
+// output, input isn't recorded unless it's enabled by RecordInput. Nil function
+// disables it.
+func (s *SSH) RecordSessions(open func(info RecordInfo) (Recorder, error)) {
+	s.recorder = open
+}
+
+// RecordInput enable recording the input of Terminal and ShellSession, it's disabled
+// by default like asciinema. The input contains every keystroke, including passwords
+// typed at sudo, su and ssh prompts with echo off, so only enable it if the recordings
+// are protected as secrets. Stdin of other commands is never recorded.
+func (s *SSH) RecordInput(enable bool) {
+	s.recordInput = enable
+}
+
+// sessionRecord is the recording of a session, all methods are no-op for nil record.
+type sessionRecord struct {
+	mu    sync.Mutex
+	rec   Recorder
+	start time.Time
+	// input enable recording input, see SSH.RecordInput.
+	input bool
+}
+
+func (s *SSH) startRecord(info RecordInfo) (*sessionRecord, error) {
+	if s.recorder == nil {
+		return nil, nil
+	}
+	info.Addr = s.addr
+	info.Start = time.Now()
+	if info.Cols <= 0 || info.Rows <= 0 {
+		info.Cols, info.Rows = 80, 24
+	}
+	rec, err := s.recorder(info)
+	if err != nil {
+		return nil, fmt.Errorf("create session recorder failed: %s", err.Error())
+	}
+	return &sessionRecord{rec: rec, start: info.Start, input: s.recordInput}, nil
+}
+
+func (r *sessionRecord) record(kind RecordKind, data []byte) {
+	if r == nil || len(data) == 0 {
+		return
+	}
+	r.mu.Lock()
+	if r.rec != nil {
+		r.rec.Record(time.Since(r.start), kind, data)
+	}
+	r.mu.Unlock()
+}
+
+func (r *sessionRecord) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if r.rec != nil {
+		r.rec.Close()
+		r.rec = nil
+	}
+	r.mu.Unlock()
+}
+
+// writer record the data written to w as output, nil w discards the data.
+func (r *sessionRecord) writer(w io.Writer) io.Writer {
+	if r == nil {
+		return w
+	}
+	return recordWriter{record: r, kind: RecordOutput, w: w}
+}
+
+type recordWriter struct {
+	record *sessionRecord
+	kind   RecordKind
+	w      io.Writer
+}
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	var err error
+	if w.w != nil {
+		n, err = w.w.Write(p)
+	}
+	w.record.record(w.kind, p[:n])
+	return n, err
+}
+
+// reader record the data read from rd as input if it's enabled.
+func (r *sessionRecord) reader(rd io.Reader) io.Reader {
+	if r == nil || !r.input || rd == nil {
+		return rd
+	}
+	return recordReader{record: r, r: rd}
+}
+
+type recordReader struct {
+	record *sessionRecord
+	r      io.Reader
+}
+
+func (r recordReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.record.record(RecordInput, p[:n])
+	return n, err
+}
+
+// writeCloser record the data written to wc as input if it's enabled.
+func (r *sessionRecord) writeCloser(wc io.WriteCloser) io.WriteCloser {
+	if r == nil || !r.input {
+		return wc
+	}
+	return recordWriteCloser{recordWriter{record: r, kind: RecordInput, w: wc}, wc}
+}
+
+type recordWriteCloser struct {
+	recordWriter
+	io.Closer
+}
+
+type asciicastRecorder struct {
+	w io.WriteCloser
+}
+
+// NewAsciicastRecorder create the Recorder writing asciicast v2 format of asciinema
+// to the writer, the header is written at once.
+func NewAsciicastRecorder(w io.WriteCloser, info RecordInfo) (Recorder, error) {
+	header := struct {
+		Version   int               `json:"version"`
+		Width     int               `json:"width"`
+		Height    int               `json:"height"`
+		Timestamp int64             `json:"timestamp"`
+		Command   string            `json:"command,omitempty"`
+		Title     string            `json:"title,omitempty"`
+		Env       map[string]string `json:"env,omitempty"`
+	}{
+		Version:   2,
+		Width:     info.Cols,
+		Height:    info.Rows,
+		Timestamp: info.Start.Unix(),
+		Command:   info.Cmd,
+		Title:     info.Addr,
+	}
+	if info.Term != "" {
+		header.Env = map[string]string{"TERM": info.Term}
+	}
+	data, err := json.Marshal(header)
+	if err == nil {
+		_, err = w.Write(append(data, '\n'))
+	}
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return asciicastRecorder{w: w}, nil
+}
+
+func (r asciicastRecorder) Record(elapsed time.Duration, kind RecordKind, data []byte) error {
+	event, err := json.Marshal([]interface{}{elapsed.Seconds(), kind, string(data)})
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(append(event, '\n'))
+	return err
+}
+
+func (r asciicastRecorder) Close() error {
+	return r.w.Close()
+}
+
+type scriptRecorder struct {
+	typescript io.WriteCloser
+	timing     io.WriteCloser
+	last       time.Duration
+}
+
+// NewScriptRecorder create the Recorder writing the output in typescript and timing
+// format of "script --timing", so it can be replayed by scriptreplay. Input isn't
+// recorded in the format.
+func NewScriptRecorder(typescript, timing io.WriteCloser, info RecordInfo) (Recorder, error) {
+	_, err := fmt.Fprintf(typescript, "Script started on %s [COMMAND=%q TERM=%q COLUMNS=%d LINES=%d]\n",
+		info.Start.Format("2006-01-02 15:04:05-07:00"), info.Cmd, info.Term, info.Cols, info.Rows)
+	if err != nil {
+		typescript.Close()
+		timing.Close()
+		return nil, err
+	}
+	return &scriptRecorder{typescript: typescript, timing: timing}, nil
+}
+
+func (r *scriptRecorder) Record(elapsed time.Duration, kind RecordKind, data []byte) error {
+	if kind != RecordOutput {
+		return nil
+	}
+	delay := elapsed - r.last
+	r.last = elapsed
+	_, err := r.typescript.Write(data)
+	if err == nil {
+		_, err = io.WriteString(r.timing, strconv.FormatFloat(delay.Seconds(), 'f', 6, 64)+" "+strconv.Itoa(len(data))+"\n")
+	}
+	return err
+}
+
+func (r *scriptRecorder) Close() error {
+	err := r.typescript.Close()
+	if e := r.timing.Close(); err == nil {
+		err = e
+	}
+	return err
+}
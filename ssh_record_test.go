@@ -0,0 +1,105 @@
+package socker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordSessions(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	var buf bytes.Buffer
+	agent.RecordSessions(func(info RecordInfo) (Recorder, error) {
+		return NewAsciicastRecorder(nopWriteCloser{&buf}, info)
+	})
+	agent.Rcmd("echo hi")
+	if agent.Error() != nil || string(agent.Output()) != "hi\n" {
+		t.Fatalf("unexpected output: %v %q", agent.Error(), agent.Output())
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected recording: %q", buf.String())
+	}
+	var header struct {
+		Version int
+		Width   int
+		Command string
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || header.Version != 2 || header.Width != 80 || header.Command != "echo hi" {
+		t.Errorf("unexpected header: %v %s", err, lines[0])
+	}
+	var event []interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || len(event) != 3 || event[1] != "o" || event[2] != "hi\n" {
+		t.Errorf("unexpected event: %v %s", err, lines[1])
+	}
+}
+
+func TestRecordInput(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	var buf bytes.Buffer
+	agent.RecordSessions(func(info RecordInfo) (Recorder, error) {
+		return NewAsciicastRecorder(nopWriteCloser{&buf}, info)
+	})
+	for _, enable := range []bool{false, true} {
+		buf.Reset()
+		agent.RecordInput(enable)
+		term, err := agent.Terminal(TerminalOptions{
+			Cmd:    "read line; echo ok",
+			Stdin:  strings.NewReader("secret\n"),
+			Stdout: ioutil.Discard,
+			Stderr: ioutil.Discard,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := term.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		term.Close()
+
+		if recorded := strings.Contains(buf.String(), `"i","secret`); recorded != enable {
+			t.Errorf("input recorded %t, expect %t: %q", recorded, enable, buf.String())
+		}
+		if !strings.Contains(buf.String(), `"o","ok\n"`) {
+			t.Errorf("output isn't recorded: %q", buf.String())
+		}
+	}
+}
+
+func TestScriptRecorder(t *testing.T) {
+	var typescript, timing bytes.Buffer
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec, err := NewScriptRecorder(nopWriteCloser{&typescript}, nopWriteCloser{&timing}, RecordInfo{Cmd: "top", Cols: 80, Rows: 24, Start: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Record(100*time.Millisecond, RecordOutput, []byte("abc"))
+	rec.Record(200*time.Millisecond, RecordInput, []byte("q"))
+	rec.Record(350*time.Millisecond, RecordOutput, []byte("de"))
+	rec.Close()
+
+	if !strings.HasPrefix(typescript.String(), "Script started on 2020-01-02 03:04:05+00:00") || !strings.HasSuffix(typescript.String(), "]\nabcde") {
+		t.Errorf("unexpected typescript: %q", typescript.String())
+	}
+	if timing.String() != "0.100000 3\n0.250000 2\n" {
+		t.Errorf("unexpected timing: %q", timing.String())
+	}
+}
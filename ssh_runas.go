@@ -0,0 +1,101 @@
+package socker
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// suPrompt is the password prompt of su in C locale.
+const suPrompt = "Password: "
+
+// RcmdAs run the command as the user by "su - user -c cmd", it's useful if the user
+// can't login directly. The su command reads password from terminal, so a pseudo
+// terminal is requested and the password is written once su prompts for it, the
+// prompt is removed from output. Stdout and stderr of command are merged by the
+// terminal. The error is an *ExitError with the exit code of command if it fails, su
+// exits with 1 if the password is incorrect.
+//
+// If password is empty, the command is run by "runuser -l user -c cmd" which needs no
+// password but must be run as root, su is used if runuser isn't installed.
+func (s *SSH) RcmdAs(user, cmd, password string) {
+	s.withErrorCheck(func() error {
+		return s.runOp(Operation{Kind: OpRcmd, Cmd: cmd}, func() error {
+			if password == "" {
+				return s.runRcmd(runuserCmdStr(user, cmd))
+			}
+			return s.runSu(user, cmd, password)
+		})
+	})
+}
+
+func runuserCmdStr(user, cmd string) string {
+	user, cmd = shellQuote(user), shellQuote(cmd)
+	return "if command -v runuser >/dev/null 2>&1; then runuser -l " + user + " -c " + cmd +
+		"; else su - " + user + " -c " + cmd + "; fi"
+}
+
+func suCmdStr(user, cmd string) string {
+	return "LC_ALL=C su - " + shellQuote(user) + " -c " + shellQuote(cmd)
+}
+
+func (s *SSH) runSu(user, cmd, password string) error {
+	if s.dryRun != nil {
+		return s.echoCmd(s.rcmdStr(suCmdStr(user, cmd), ""))
+	}
+	err := s.checkExec("RcmdAs")
+	if err != nil {
+		return err
+	}
+
+	sess, session, err := s.openSession()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sess.Close()
+		session.Release()
+	}()
+	rec, err := s.startRecord(RecordInfo{Cmd: cmd})
+	if err != nil {
+		return err
+	}
+	defer rec.close()
+
+	// disable the conversion of "\n" to "\r\n" so the output is the same as exec.
+	err = sess.RequestPty("dumb", 24, 80, ssh.TerminalModes{ssh.ECHO: 0, ssh.ONLCR: 0})
+	if err != nil {
+		return err
+	}
+	tail := tailBuffer{size: ExitStderrSize}
+	err = s.runCmd(true, &sess.Stdin, &sess.Stdout, &sess.Stderr, func() error {
+		sess.Stdin = nil
+		stdin, err := sess.StdinPipe()
+		if err != nil {
+			return err
+		}
+		stdout, stderr := sess.Stdout, sess.Stderr
+		if stdout == nil {
+			stdout = ioutil.Discard
+		}
+		if stderr == nil {
+			stderr = &tail
+		} else {
+			stderr = io.MultiWriter(stderr, &tail)
+		}
+		prompt := &passwordPrompt{
+			prompt:   []byte(suPrompt),
+			password: password,
+			stdin:    stdin,
+			next:     rec.writer(stdout),
+			once:     true,
+		}
+		sess.Stdout, sess.Stderr = prompt, rec.writer(stderr)
+		err = s.runSession(context.Background(), sess, s.rcmdStr(suCmdStr(user, cmd), ""))
+		prompt.flush()
+		return err
+	})
+	return wrapExitError(cmd, err, tail.Bytes())
+}
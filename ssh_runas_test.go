@@ -0,0 +1,78 @@
+package socker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSu prompts for password "secret" like "su - user -c cmd" in terminal, and runs
+// the command as current user.
+const fakeSu = `#!/bin/sh
+printf 'Password: '
+read -r password
+if [ "$password" != secret ]; then
+	echo "su: Authentication failure"
+	exit 1
+fi
+exec sh -c "$4"
+`
+
+// fakeRunuser runs "runuser -l user -c cmd" as current user.
+const fakeRunuser = `#!/bin/sh
+exec sh -c "$4"
+`
+
+func TestRcmdAs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-su")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, script := range map[string]string{"su": fakeSu, "runuser": fakeRunuser} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	agent.RcmdAs("postgres", "echo 'Password: is kept'; exit 3", "secret")
+	if e, ok := agent.Error().(*ExitError); !ok || e.Code != 3 {
+		t.Errorf("expect exit status 3: %v", agent.Error())
+	}
+	if string(agent.Output()) != "Password: is kept\n" {
+		t.Errorf("unexpected output: %q", agent.Output())
+	}
+	agent.ClearError()
+
+	agent.RcmdAs("postgres", "echo ok", "wrong")
+	if e, ok := agent.Error().(*ExitError); !ok || e.Code != 1 {
+		t.Errorf("incorrect password should fail: %v", agent.Error())
+	}
+	agent.ClearError()
+
+	agent.RcmdAs("postgres", "echo \"$0\"", "")
+	if agent.Error() != nil || string(agent.Output()) != "sh\n" {
+		t.Errorf("unexpected result of runuser: %v %q", agent.Error(), agent.Output())
+	}
+
+	var buf bytes.Buffer
+	agent.DryRun(&buf)
+	agent.RcmdAs("postgres", "id", "secret")
+	if !strings.Contains(buf.String(), "su - 'postgres' -c 'id'") || strings.Contains(buf.String(), "secret") {
+		t.Errorf("unexpected dry run output: %q", buf.String())
+	}
+}
@@ -0,0 +1,144 @@
+package socker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RusageCmd is the GNU time compatible command used to capture resource usage.
+var RusageCmd = "/usr/bin/time"
+
+// Rusage is the resource usage of remote command reported by GNU time.
+type Rusage struct {
+	User    time.Duration
+	System  time.Duration
+	Elapsed time.Duration
+	// MaxRSS is the maximum resident set size in bytes.
+	MaxRSS int64
+	// FsInputs and FsOutputs are the count of file system inputs and outputs.
+	FsInputs  int64
+	FsOutputs int64
+	// VoluntarySwitches and InvoluntarySwitches are the count of context switches.
+	VoluntarySwitches   int64
+	InvoluntarySwitches int64
+}
+
+func (u *Rusage) String() string {
+	return fmt.Sprintf("user %s, sys %s, elapsed %s, maxrss %dKB, fs in %d out %d",
+		u.User, u.System, u.Elapsed, u.MaxRSS/1024, u.FsInputs, u.FsOutputs)
+}
+
+// RcmdUsage do the same thing as Rcmd and return the resource usage of the command.
+// The command is wrapped by RusageCmd, if it's unavailable on remote host, the command
+// is run directly and nil is returned.
+func (s *SSH) RcmdUsage(cmd string, env ...string) *Rusage {
+	var usage *Rusage
+	s.withErrorCheck(func() error {
+		var b [8]byte
+		_, err := io.ReadFull(rand.Reader, b[:])
+		if err != nil {
+			return err
+		}
+		path := "/tmp/socker-rusage-" + hex.EncodeToString(b[:])
+		defer s.rfs.Remove(path)
+
+		timeCmd := shellQuote(RusageCmd)
+		cmd = shellQuote(s.rcmdStr(cmd, strings.Join(env, " ")))
+		err = s.runRcmd(fmt.Sprintf("if %s -v -o %s true >/dev/null 2>&1; then %s -v -o %s sh -c %s; else sh -c %s; fi",
+			timeCmd, path, timeCmd, path, cmd, cmd))
+
+		data, rerr := s.readFile(s.rfs, path)
+		if rerr == nil {
+			usage, rerr = parseRusage(data)
+		}
+		if rerr != nil {
+			usage = nil
+		}
+		return err
+	})
+	return usage
+}
+
+func parseRusage(data []byte) (*Rusage, error) {
+	var (
+		u      Rusage
+		parsed bool
+	)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		i := strings.LastIndex(line, ": ")
+		if i < 0 {
+			continue
+		}
+		key, val := line[:i], line[i+2:]
+
+		var err error
+		switch key {
+		case "User time (seconds)":
+			u.User, err = parseSeconds(val)
+		case "System time (seconds)":
+			u.System, err = parseSeconds(val)
+		case "Elapsed (wall clock) time (h:mm:ss or m:ss)":
+			u.Elapsed, err = parseClock(val)
+		case "Maximum resident set size (kbytes)":
+			u.MaxRSS, err = strconv.ParseInt(val, 10, 64)
+			u.MaxRSS *= 1024
+		case "File system inputs":
+			u.FsInputs, err = strconv.ParseInt(val, 10, 64)
+		case "File system outputs":
+			u.FsOutputs, err = strconv.ParseInt(val, 10, 64)
+		case "Voluntary context switches":
+			u.VoluntarySwitches, err = strconv.ParseInt(val, 10, 64)
+		case "Involuntary context switches":
+			u.InvoluntarySwitches, err = strconv.ParseInt(val, 10, 64)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rusage line: %s", line)
+		}
+		parsed = true
+	}
+	if !parsed {
+		return nil, fmt.Errorf("no rusage found")
+	}
+	return &u, nil
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// parseClock parse the "h:mm:ss" or "m:ss.ss" format duration.
+func parseClock(s string) (time.Duration, error) {
+	var d time.Duration
+	parts := strings.Split(s, ":")
+	for i, part := range parts {
+		if i < len(parts)-1 {
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, err
+			}
+			d = d*60 + time.Duration(n)*time.Second
+			continue
+		}
+		sec, err := parseSeconds(part)
+		if err != nil {
+			return 0, err
+		}
+		d = d*60 + sec
+	}
+	return d, nil
+}
@@ -0,0 +1,46 @@
+package socker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRusage(t *testing.T) {
+	data := []byte(`	Command being timed: "sh -c sleep 1"
+	User time (seconds): 0.25
+	System time (seconds): 1.50
+	Percent of CPU: 0%
+	Elapsed (wall clock) time (h:mm:ss or m:ss): 1:02.50
+	Maximum resident set size (kbytes): 2048
+	Voluntary context switches: 3
+	Involuntary context switches: 4
+	File system inputs: 8
+	File system outputs: 16
+	Exit status: 0
+`)
+	u, err := parseRusage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := Rusage{
+		User:                250 * time.Millisecond,
+		System:              1500 * time.Millisecond,
+		Elapsed:             62500 * time.Millisecond,
+		MaxRSS:              2048 * 1024,
+		FsInputs:            8,
+		FsOutputs:           16,
+		VoluntarySwitches:   3,
+		InvoluntarySwitches: 4,
+	}
+	if *u != expect {
+		t.Errorf("parse rusage failed: %s", u)
+	}
+
+	d, err := parseClock("1:02:03")
+	if err != nil || d != time.Hour+2*time.Minute+3*time.Second {
+		t.Errorf("parse clock failed: %s %v", d, err)
+	}
+	if _, err = parseRusage([]byte("sh: time: not found")); err == nil {
+		t.Error("invalid rusage should be rejected")
+	}
+}
@@ -1,11 +1,27 @@
 package socker
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
+// SessionLimitError reports the server refuses to open more sessions on the
+// connection, e.g. the MaxSessions of sshd, default 10, is less than Auth.MaxSession.
+type SessionLimitError struct {
+	Addr string
+	// Active is the count of sessions opened on the connection when it's refused.
+	Active int
+	Err    error
+}
+
+func (e *SessionLimitError) Error() string {
+	return fmt.Sprintf("session limit of %s reached with %d active sessions, lower Auth.MaxSession to MaxSessions of server: %s", e.Addr, e.Active, e.Err.Error())
+}
+
+var errNoSession = errors.New("no session available")
+
 const (
 	sessionActive int32 = iota
 	sessionIdle
@@ -21,6 +37,7 @@ func (s *session) Release() {
 	if !atomic.CompareAndSwapInt32(&s.status, sessionActive, sessionIdle) {
 		return
 	}
+	atomic.AddInt32(&s.pool.active, -1)
 	s.pool.put(s)
 }
 
@@ -28,87 +45,132 @@ func (s *session) Drop() {
 	if !atomic.CompareAndSwapInt32(&s.status, sessionActive, sessionInvalid) {
 		return
 	}
+	atomic.AddInt32(&s.pool.active, -1)
+	s.pool.mu.Lock()
+	s.pool.dropped++
+	var waiters []chan bool
+	if s.pool.size > 0 && s.pool.dropped >= s.pool.size {
+		// no session can be released to waiters.
+		waiters = s.pool.waiters
+		s.pool.waiters = nil
+	}
+	s.pool.mu.Unlock()
+	for _, w := range waiters {
+		w <- false
+	}
 }
 
+// sessionPool limit the count of concurrent sessions of a connection, callers
+// waiting for a session are served in FIFO order so early callers aren't starved
+// by later ones.
 type sessionPool struct {
 	size int
-
-	mu sync.RWMutex
-	c  chan struct{}
-}
-
-func initPoolChan(size int) chan struct{} {
-	c := make(chan struct{}, size)
-	for i := 0; i < size; i++ {
-		c <- struct{}{}
-	}
-	return c
+	// active is the count of sessions taken and not released.
+	active int32
+	// dropped is the count of sessions prohibited by server, they are never
+	// returned to the pool.
+	dropped int
+
+	mu      sync.Mutex
+	closed  bool
+	avail   int
+	waiters []chan bool
 }
 
 func newSessionPool(size int) *sessionPool {
 	const defaultMaxSession = 10
 
-	var c chan struct{}
 	if size == 0 {
 		size = defaultMaxSession
 	}
+	p := &sessionPool{size: size}
 	if size > 0 {
-		c = initPoolChan(size)
-	}
-	return &sessionPool{
-		size: size,
-		c:    c,
+		p.avail = size
 	}
+	return p
 }
 
 func (p *sessionPool) Size() int {
 	return p.size
 }
 
+// exhausted report whether all sessions are prohibited by server, it's always true
+// for unlimited pool since sessions are never waited.
+func (p *sessionPool) exhausted() bool {
+	if p.size <= 0 {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropped >= p.size
+}
+
 func (p *sessionPool) Close() {
 	if p.size <= 0 {
 		return
 	}
-	if p.c != nil {
-		p.mu.Lock()
-		if p.c != nil {
-			close(p.c)
-			p.c = nil
-		}
-		p.mu.Unlock()
-	}
-}
 
-func (p *sessionPool) takeWithTimeout() bool {
-	timer := time.NewTimer(time.Millisecond * 10)
-	select {
-	case <-p.c:
-		timer.Stop()
-		return true
-	case <-timer.C:
-		return false
+	p.mu.Lock()
+	p.closed = true
+	waiters := p.waiters
+	p.waiters = nil
+	p.mu.Unlock()
+	for _, w := range waiters {
+		w <- false
 	}
 }
 
 func (p *sessionPool) Take() (*session, bool) {
 	if p.size <= 0 {
+		atomic.AddInt32(&p.active, 1)
 		return &session{pool: p, status: sessionActive}, true
 	}
 
-	if p.c != nil {
-		var taken bool
-		p.mu.RLock()
-		if p.c != nil {
-			<-p.c
-			taken = true
-		}
-		p.mu.RUnlock()
-		if taken {
-			return &session{pool: p, status: sessionActive}, true
-		}
+	p.mu.Lock()
+	if p.closed || p.dropped >= p.size {
+		p.mu.Unlock()
+		return nil, false
+	}
+	if p.avail > 0 && len(p.waiters) == 0 {
+		p.avail--
+		atomic.AddInt32(&p.active, 1)
+		p.mu.Unlock()
+		return &session{pool: p, status: sessionActive}, true
 	}
+	w := make(chan bool, 1)
+	p.waiters = append(p.waiters, w)
+	p.mu.Unlock()
 
-	return nil, false
+	if !<-w {
+		return nil, false
+	}
+	atomic.AddInt32(&p.active, 1)
+	return &session{pool: p, status: sessionActive}, true
+}
+
+// tryTake take a session without waiting, it fails if all sessions are in use.
+func (p *sessionPool) tryTake() (*session, bool) {
+	if p.size <= 0 {
+		return p.Take()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.dropped >= p.size || p.avail <= 0 || len(p.waiters) > 0 {
+		return nil, false
+	}
+	p.avail--
+	atomic.AddInt32(&p.active, 1)
+	return &session{pool: p, status: sessionActive}, true
+}
+
+func (p *sessionPool) isClosed() bool {
+	if p.size <= 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
 }
 
 func (p *sessionPool) put(s *session) bool {
@@ -118,19 +180,62 @@ func (p *sessionPool) put(s *session) bool {
 	if p.size <= 0 {
 		return true
 	}
-	if p.c == nil {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
 		return false
 	}
+	if len(p.waiters) > 0 {
+		w := p.waiters[0]
+		p.waiters[0] = nil
+		p.waiters = p.waiters[1:]
+		w <- true
+		return true
+	}
+	if p.avail >= p.size {
+		return false
+	}
+	p.avail++
+	return true
+}
+
+// SessionSlots is the snapshot of session usage of a connection.
+type SessionSlots struct {
+	// Limit is the max count of concurrent sessions, -1 means unlimited. Sessions
+	// prohibited by server are excluded.
+	Limit int
+	// Active is the count of opened sessions, such as running commands, shells and
+	// udp relays. The sftp subsystem isn't included.
+	Active int
+	// Waiting is the count of callers waiting for a session.
+	Waiting int
+	// Available is the count of sessions can be opened without waiting, -1 means
+	// unlimited.
+	Available int
+}
+
+func (p *sessionPool) Slots() SessionSlots {
+	slots := SessionSlots{
+		Limit:     -1,
+		Active:    int(atomic.LoadInt32(&p.active)),
+		Available: -1,
+	}
+	if p.size <= 0 {
+		return slots
+	}
+	p.mu.Lock()
+	slots.Limit = p.size - p.dropped
+	slots.Waiting = len(p.waiters)
+	slots.Available = p.avail
+	p.mu.Unlock()
+	return slots
+}
 
-	var putted bool
-	p.mu.RLock()
-	if p.c != nil {
-		select {
-		case p.c <- struct{}{}:
-			putted = true
-		default:
-		}
+// SessionSlots return the session usage of the connection.
+func (s *SSH) SessionSlots() SessionSlots {
+	if s.sessionPool == nil {
+		return SessionSlots{Limit: -1, Available: -1}
 	}
-	p.mu.RUnlock()
-	return putted
+	return s.sessionPool.Slots()
 }
@@ -2,6 +2,7 @@ package socker
 
 import (
 	"fmt"
+	"runtime"
 	"testing"
 )
 
@@ -21,3 +22,103 @@ func TestSessionPool(t *testing.T) {
 	defer token.Release()
 	fmt.Println(3)
 }
+
+func TestSessionPoolFIFO(t *testing.T) {
+	pool := newSessionPool(1)
+	defer pool.Close()
+
+	token, _ := pool.Take()
+	var (
+		order = make(chan int, 3)
+		ready = make(chan struct{})
+	)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			ready <- struct{}{}
+			token, ok := pool.Take()
+			if !ok {
+				return
+			}
+			order <- i
+			token.Release()
+		}(i)
+		<-ready
+		for {
+			pool.mu.Lock()
+			n := len(pool.waiters)
+			pool.mu.Unlock()
+			if n == i+1 {
+				break
+			}
+			runtime.Gosched()
+		}
+	}
+	token.Release()
+
+	for i := 0; i < 3; i++ {
+		if got := <-order; got != i {
+			t.Fatalf("session pool isn't FIFO: expect %d, got %d", i, got)
+		}
+	}
+}
+
+func TestSessionPoolClose(t *testing.T) {
+	pool := newSessionPool(1)
+	pool.Take()
+
+	done := make(chan bool)
+	go func() {
+		_, ok := pool.Take()
+		done <- ok
+	}()
+	for {
+		pool.mu.Lock()
+		n := len(pool.waiters)
+		pool.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		runtime.Gosched()
+	}
+	pool.Close()
+	if <-done {
+		t.Fatal("take should fail after pool closed")
+	}
+}
+
+func TestSessionSlots(t *testing.T) {
+	pool := newSessionPool(3)
+	defer pool.Close()
+
+	a, _ := pool.Take()
+	b, _ := pool.Take()
+	b.Drop()
+	if slots := pool.Slots(); slots != (SessionSlots{Limit: 2, Active: 1, Available: 1}) {
+		t.Errorf("unexpected slots: %+v", slots)
+	}
+	a.Release()
+	a.Release()
+	if slots := pool.Slots(); slots != (SessionSlots{Limit: 2, Active: 0, Available: 2}) {
+		t.Errorf("unexpected slots: %+v", slots)
+	}
+
+	unlimited := newSessionPool(-1)
+	c, _ := unlimited.Take()
+	defer c.Release()
+	if slots := unlimited.Slots(); slots != (SessionSlots{Limit: -1, Active: 1, Available: -1}) {
+		t.Errorf("unexpected slots: %+v", slots)
+	}
+
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret", MaxSession: 4}},
+		DefaultAuth: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	slots, err := m.SessionSlots("10.0.0.1:22")
+	if err != nil || slots != (SessionSlots{Limit: 4, Available: 4}) {
+		t.Errorf("unexpected estimated slots: %+v %v", slots, err)
+	}
+}
@@ -0,0 +1,99 @@
+package socker
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrSftpOnly reports that the remote account has no shell, e.g. it's restricted
+// by "ForceCommand internal-sftp", so only sftp based features are available.
+var ErrSftpOnly = errors.New("remote account only allows sftp")
+
+// UnavailableError is returned by features which require remote command execution
+// when the remote account is sftp only.
+type UnavailableError struct {
+	Feature string
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Feature + " is unavailable: " + ErrSftpOnly.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return ErrSftpOnly
+}
+
+const (
+	execUnknown int32 = iota
+	execAvailable
+	execUnavailable
+)
+
+const execProbeMarker = "socker-exec-probe"
+
+// SftpOnly report whether the remote account is sftp only. File helpers such as
+// Put, Get, RreadFile, RwriteFile, Rreaddir, Rremove and Rexists always work via
+// sftp, but Rcmd and RcmdBg will fail with an *UnavailableError.
+//
+// The result is detected by the first command execution and cached for the
+// connection.
+func (s *SSH) SftpOnly() bool {
+	var sftpOnly bool
+	s.withErrorCheck(func() error {
+		err := s.probeExec()
+		sftpOnly = atomic.LoadInt32(s.execState) == execUnavailable
+		return err
+	})
+	return sftpOnly
+}
+
+func (s *SSH) checkExec(feature string) error {
+	err := s.probeExec()
+	if err != nil {
+		return err
+	}
+	if atomic.LoadInt32(s.execState) == execUnavailable {
+		return &UnavailableError{Feature: feature}
+	}
+	return nil
+}
+
+func (s *SSH) probeExec() error {
+	state := s.execState
+	if atomic.LoadInt32(state) != execUnknown {
+		return nil
+	}
+
+	sess, session, err := s.openSession()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sess.Close()
+		session.Release()
+	}()
+
+	// a forced internal-sftp command never echo the marker back, it exits when
+	// stdin is closed or rejects the exec request.
+	out, err := sess.Output("echo " + execProbeMarker)
+	switch err.(type) {
+	case nil:
+		if strings.TrimSpace(string(out)) == execProbeMarker {
+			atomic.CompareAndSwapInt32(state, execUnknown, execAvailable)
+		} else {
+			atomic.CompareAndSwapInt32(state, execUnknown, execUnavailable)
+		}
+	case *ssh.ExitError, *ssh.ExitMissingError:
+		atomic.CompareAndSwapInt32(state, execUnknown, execUnavailable)
+	default:
+		if err.Error() == "ssh: command echo "+execProbeMarker+" failed" {
+			atomic.CompareAndSwapInt32(state, execUnknown, execUnavailable)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package socker
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSftpOnlyServer start a ssh server which only serves sftp like the account
+// restricted by "ForceCommand internal-sftp". Exec requests are rejected if
+// rejectExec is true, otherwise they are served by sftp too as sshd does. The
+// number of exec requests is counted.
+func startSftpOnlyServer(t *testing.T, rejectExec bool, execs *int32) net.Listener {
+	return startTestServer(t, func(conn net.Conn, config *ssh.ServerConfig) {
+		defer conn.Close()
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			if newCh.ChannelType() != "session" {
+				newCh.Reject(ssh.UnknownChannelType, "only session is supported")
+				continue
+			}
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				for req := range reqs {
+					switch req.Type {
+					case "exec", "shell":
+						atomic.AddInt32(execs, 1)
+						if rejectExec {
+							req.Reply(false, nil)
+							continue
+						}
+					case "subsystem":
+					default:
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+					server, err := sftp.NewServer(ch)
+					if err == nil {
+						server.Serve()
+					}
+					ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+					return
+				}
+			}()
+		}
+	})
+}
+
+func TestSftpOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-sftponly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, rejectExec := range []bool{true, false} {
+		var execs int32
+		l := startSftpOnlyServer(t, rejectExec, &execs)
+		agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !agent.SftpOnly() || agent.Error() != nil {
+			t.Fatalf("sftp only account isn't detected: %v", agent.Error())
+		}
+		agent.Rcmd("echo hello")
+		var unavailable *UnavailableError
+		if err = agent.Error(); !errors.As(err, &unavailable) || unavailable.Feature != "Rcmd" || unavailable.Unwrap() != ErrSftpOnly {
+			t.Fatalf("expect unavailable error, got %v", err)
+		}
+		if err.Error() != "Rcmd is unavailable: "+ErrSftpOnly.Error() {
+			t.Errorf("unexpected error message: %s", err.Error())
+		}
+		agent.ClearError()
+		if _, err = agent.UDPTunnel("127.0.0.1:0", "127.0.0.1:53"); !errors.As(err, &unavailable) {
+			t.Errorf("expect unavailable error, got %v", err)
+		}
+
+		// file helpers and hashing fall back to sftp.
+		path := filepath.Join(dir, "file")
+		agent.RwriteFile(path, []byte("hello\n"))
+		data := agent.RreadFile(path)
+		tree := agent.HashTree(dir, HashMD5)
+		if err = agent.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello\n" || tree["file"] != "b1946ac92492d2347c6235b4d2611184" {
+			t.Errorf("sftp helpers failed: %q %v", data, tree)
+		}
+		if n := atomic.LoadInt32(&execs); n != 1 {
+			t.Errorf("exec should be probed once, got %d", n)
+		}
+		agent.Close()
+		l.Close()
+	}
+
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	if agent.SftpOnly() || agent.checkExec("Rcmd") != nil {
+		t.Error("exec should be available")
+	}
+}
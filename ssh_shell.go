@@ -0,0 +1,165 @@
+package socker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrShellExited reports the persistent shell process has exited, e.g. "exit" is run.
+var ErrShellExited = errors.New("shell exited")
+
+// ShellExitError is returned by Shell.Run if the command exits with non-zero status.
+type ShellExitError struct {
+	Cmd  string
+	Code int
+}
+
+func (e *ShellExitError) Error() string {
+	return fmt.Sprintf("command exited with status %d: %s", e.Code, e.Cmd)
+}
+
+// Shell is a persistent remote shell process, sequential commands are run by the
+// same process, so there is no session setup for each command, and shell states
+// such as work dir and exported variables are kept between commands.
+//
+// Commands are run one by one, stdin of each command is /dev/null and stderr is
+// merged into stdout.
+type Shell struct {
+	marker []byte
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	close  func() error
+
+	mu     sync.Mutex
+	exited bool
+}
+
+// Shell start a persistent shell process in the remote work dir. The Shell holds a
+// session and a reference of the SSH instance until it's closed.
+func (s *SSH) Shell() (*Shell, error) {
+	if s.dryRun != nil {
+		return nil, ErrDryRun
+	}
+	err := s.checkExec("Shell")
+	if err != nil {
+		return nil, err
+	}
+	sess, session, err := s.openSession()
+	if err != nil {
+		return nil, err
+	}
+
+	ref := s.NopClose()
+	closeSess := func() error {
+		err := sess.Close()
+		session.Release()
+		ref.Close()
+		return err
+	}
+	stdin, err := sess.StdinPipe()
+	if err == nil {
+		var stdout io.Reader
+		stdout, err = sess.StdoutPipe()
+		if err == nil {
+			err = sess.Start(s.rcmdStr("exec sh", ""))
+		}
+		if err == nil {
+			var sh *Shell
+			sh, err = newShell(stdin, stdout, closeSess)
+			if err == nil {
+				return sh, nil
+			}
+		}
+	}
+	closeSess()
+	return nil, err
+}
+
+func newShell(stdin io.WriteCloser, stdout io.Reader, close func() error) (*Shell, error) {
+	var marker [16]byte
+	_, err := io.ReadFull(rand.Reader, marker[:])
+	if err != nil {
+		return nil, err
+	}
+	sh := &Shell{
+		marker: []byte("socker-shell-" + hex.EncodeToString(marker[:]) + " "),
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		close:  close,
+	}
+	_, err = io.WriteString(stdin, "exec 2>&1\n")
+	if err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// Run run the command and return it's output. Env like "A=1" only applies to this
+// command, the command is run in a subshell if env isn't empty.
+func (sh *Shell) Run(cmd string, env ...string) ([]byte, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.exited {
+		return nil, ErrShellExited
+	}
+
+	script := "{\n" + cmd + "\n} </dev/null"
+	if len(env) > 0 {
+		script = "(\nexport " + strings.Join(env, " ") + "\n" + cmd + "\n) </dev/null"
+	}
+	// the output may not end with newline, so the marker line starts with one.
+	script += "\nprintf '\\n%s%d\\n' " + shellQuote(string(sh.marker)) + " $?\n"
+	_, err := io.WriteString(sh.stdin, script)
+	if err != nil {
+		sh.exited = true
+		return nil, ErrShellExited
+	}
+
+	var out bytes.Buffer
+	for {
+		line, err := sh.stdout.ReadBytes('\n')
+		if err != nil {
+			sh.exited = true
+			return out.Bytes(), ErrShellExited
+		}
+		if !bytes.HasPrefix(line, sh.marker) {
+			out.Write(line)
+			continue
+		}
+
+		code, err := strconv.Atoi(string(bytes.TrimSpace(line[len(sh.marker):])))
+		if err != nil {
+			return nil, fmt.Errorf("invalid shell exit status: %s", line)
+		}
+		output := out.Bytes()
+		if n := len(output); n > 0 && output[n-1] == '\n' {
+			output = output[:n-1]
+		}
+		if code != 0 {
+			return output, &ShellExitError{Cmd: cmd, Code: code}
+		}
+		return output, nil
+	}
+}
+
+// Close terminate the shell process and release the session.
+func (sh *Shell) Close() error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.close == nil {
+		return nil
+	}
+	sh.exited = true
+	sh.stdin.Close()
+	err := sh.close()
+	sh.close = nil
+	return err
+}
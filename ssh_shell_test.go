@@ -0,0 +1,59 @@
+package socker
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestShell(t *testing.T) {
+	c := exec.Command("sh")
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, err := newShell(stdin, stdout, c.Wait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sh.Close()
+
+	type testCase struct {
+		Cmd  string
+		Env  []string
+		Out  string
+		Code int
+	}
+	cases := []testCase{
+		{Cmd: "A=1; cd /", Out: ""},
+		{Cmd: "echo $A; pwd", Out: "1\n/\n"},
+		{Cmd: "echo $B", Env: []string{"B=2"}, Out: "2\n"},
+		{Cmd: "echo $B", Out: "\n"},
+		{Cmd: "printf abc", Out: "abc"},
+		{Cmd: "cat; echo err >&2; false", Out: "err\n", Code: 1},
+	}
+	for i, c := range cases {
+		out, err := sh.Run(c.Cmd, c.Env...)
+		var code int
+		if e, ok := err.(*ShellExitError); ok {
+			code = e.Code
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != c.Out || code != c.Code {
+			t.Errorf("test case failed: %d, got %q %d", i, out, code)
+		}
+	}
+
+	_, err = sh.Run("exit")
+	if err != ErrShellExited {
+		t.Errorf("exit isn't detected: %v", err)
+	}
+}
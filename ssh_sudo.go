@@ -0,0 +1,161 @@
+package socker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+// Sudo run the remote command as root by "sudo -S", the password is written to stdin
+// once sudo prompts for it and the prompt is removed from output. The error is an
+// *ExitError with the exit code of command if it fails, sudo exits with 1 if the
+// password is incorrect.
+//
+// Stdin of command is closed after the password is written, so the command shouldn't
+// read stdin. The env are exported in the command run by sudo.
+func (s *SSH) Sudo(cmd, password string, env ...string) {
+	s.withErrorCheck(func() error {
+		return s.runOp(Operation{Kind: OpRcmd, Cmd: cmd}, func() error {
+			return s.runSudo(cmd, password, env...)
+		})
+	})
+}
+
+func (s *SSH) sudoCmdStr(cmd, prompt string, env ...string) string {
+	script := s.cmdStr("", strings.Join(env, " "), cmd)
+	return s.rcmdStr("sudo -S -p "+shellQuote(prompt)+" sh -c "+shellQuote(script), "")
+}
+
+func (s *SSH) runSudo(cmd, password string, env ...string) error {
+	var marker [8]byte
+	_, err := io.ReadFull(rand.Reader, marker[:])
+	if err != nil {
+		return err
+	}
+	prompt := "[socker-sudo-" + hex.EncodeToString(marker[:]) + "]"
+	if s.dryRun != nil {
+		return s.echoCmd(s.sudoCmdStr(cmd, prompt, env...))
+	}
+	err = s.checkExec("Sudo")
+	if err != nil {
+		return err
+	}
+
+	sess, session, err := s.openSession()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sess.Close()
+		session.Release()
+	}()
+
+	rec, err := s.startRecord(RecordInfo{Cmd: cmd})
+	if err != nil {
+		return err
+	}
+	defer rec.close()
+
+	tail := tailBuffer{size: ExitStderrSize}
+	err = s.runCmd(true, &sess.Stdin, &sess.Stdout, &sess.Stderr, func() error {
+		sess.Stdin = nil
+		sess.Stdout = rec.writer(sess.Stdout)
+		stdin, err := sess.StdinPipe()
+		if err != nil {
+			return err
+		}
+		stderr := sess.Stderr
+		if stderr == nil {
+			stderr = &tail
+		} else {
+			stderr = io.MultiWriter(stderr, &tail)
+		}
+		scrub := &passwordPrompt{
+			prompt:   []byte(prompt),
+			password: password,
+			stdin:    stdin,
+			next:     rec.writer(stderr),
+		}
+		sess.Stderr = scrub
+		err = s.runSession(context.Background(), sess, s.sudoCmdStr(cmd, prompt, env...))
+		scrub.flush()
+		return err
+	})
+	return wrapExitError(cmd, err, tail.Bytes())
+}
+
+// passwordPrompt remove the password prompt from output and answer it with the
+// password, stdin is closed after the first answer so sudo fails instead of prompting
+// again.
+type passwordPrompt struct {
+	prompt   []byte
+	password string
+	stdin    io.WriteCloser
+	next     io.Writer
+	// once answer the first prompt only, stdin is kept open and later output isn't
+	// matched since the prompt isn't unique, such as "Password: " of su.
+	once bool
+
+	answered bool
+	// pending is the end of written data which may be the beginning of prompt.
+	pending []byte
+}
+
+func (p *passwordPrompt) Write(b []byte) (int, error) {
+	data := append(p.pending, b...)
+	p.pending = nil
+	var out []byte
+	for !p.once || !p.answered {
+		i := bytes.Index(data, p.prompt)
+		if i < 0 {
+			break
+		}
+		out = append(out, data[:i]...)
+		data = data[i+len(p.prompt):]
+		if !p.answered {
+			p.answered = true
+			io.WriteString(p.stdin, p.password+"\n")
+		}
+		if !p.once {
+			p.stdin.Close()
+		}
+	}
+	keep := 0
+	if !p.once || !p.answered {
+		keep = partialPrefix(data, p.prompt)
+	}
+	out = append(out, data[:len(data)-keep]...)
+	p.pending = append(p.pending, data[len(data)-keep:]...)
+	if len(out) > 0 {
+		if _, err := p.next.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// flush write the pending data, it's called after stderr is closed.
+func (p *passwordPrompt) flush() {
+	if len(p.pending) > 0 {
+		p.next.Write(p.pending)
+		p.pending = nil
+	}
+}
+
+// partialPrefix return the length of the longest suffix of data which is a proper
+// prefix of prompt.
+func partialPrefix(data, prompt []byte) int {
+	n := len(prompt) - 1
+	if n > len(data) {
+		n = len(data)
+	}
+	for ; n > 0; n-- {
+		if bytes.HasSuffix(data, prompt[:n]) {
+			return n
+		}
+	}
+	return 0
+}
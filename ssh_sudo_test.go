@@ -0,0 +1,90 @@
+package socker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSudo prompts for password "secret" like "sudo -S -p prompt" and runs the
+// command as current user.
+const fakeSudo = `#!/bin/sh
+shift
+printf '%s' "$2" >&2
+shift 2
+read -r password
+if [ "$password" != secret ]; then
+	echo "Sorry, try again." >&2
+	exit 1
+fi
+exec "$@"
+`
+
+func TestSudo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socker-sudo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "sudo"), []byte(fakeSudo), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	agent.Sudo(`echo "$A"; echo failed >&2; exit 4`, "secret", "A=1")
+	e, ok := agent.Error().(*ExitError)
+	if !ok || e.Code != 4 || string(e.Stderr) != "failed\n" {
+		t.Fatalf("expect exit status 4: %v", agent.Error())
+	}
+	if out := string(agent.Output()); strings.Contains(out, "socker-sudo") || !strings.Contains(out, "1\n") {
+		t.Errorf("unexpected output: %q", out)
+	}
+	agent.ClearError()
+
+	agent.Sudo("echo ok", "wrong")
+	if e, ok := agent.Error().(*ExitError); !ok || e.Code != 1 {
+		t.Errorf("incorrect password should fail: %v", agent.Error())
+	}
+	agent.ClearError()
+
+	var buf bytes.Buffer
+	agent.DryRun(&buf)
+	agent.Sudo("id", "secret")
+	if !strings.Contains(buf.String(), "sudo -S -p") || strings.Contains(buf.String(), "secret") {
+		t.Errorf("unexpected dry run output: %q", buf.String())
+	}
+}
+
+func TestPasswordPrompt(t *testing.T) {
+	var stdin, stderr bytes.Buffer
+	p := &passwordPrompt{prompt: []byte("[prompt]"), password: "pw", stdin: nopWriteCloser{&stdin}, next: &stderr}
+	for _, s := range []string{"a[pro", "mpt]b[", "x"} {
+		p.Write([]byte(s))
+	}
+	p.Write([]byte("[pr"))
+	p.flush()
+	if stderr.String() != "ab[x[pr" || stdin.String() != "pw\n" {
+		t.Errorf("unexpected result: %q %q", stderr.String(), stdin.String())
+	}
+}
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,177 @@
+package socker
+
+import (
+	"io"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TerminalOptions is the options of Terminal.
+type TerminalOptions struct {
+	// Cmd is the command run in terminal, empty means the login shell.
+	Cmd string
+	// Term is the value of TERM, default is "xterm".
+	Term string
+	// Cols and Rows are the initial window size, default is 80x24.
+	Cols int
+	Rows int
+	// Modes is the terminal modes, default enables echo.
+	Modes ssh.TerminalModes
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Terminal is a remote session with pseudo terminal for interactive programs such as
+// shells and TUIs.
+type Terminal struct {
+	cmd   string
+	sess  *ssh.Session
+	rec   *sessionRecord
+	close func() error
+
+	mu     sync.Mutex
+	stops  []func()
+	closed bool
+}
+
+// Terminal start the command in a pseudo terminal. The Terminal holds a session and
+// a reference of the SSH instance until it's closed.
+func (s *SSH) Terminal(opts TerminalOptions) (*Terminal, error) {
+	return s.terminal(opts, nil)
+}
+
+// terminal start the Terminal, the stdin pipe is used instead of opts.Stdin if it's
+// not nil.
+func (s *SSH) terminal(opts TerminalOptions, stdin *io.WriteCloser) (*Terminal, error) {
+	if s.dryRun != nil {
+		return nil, ErrDryRun
+	}
+	err := s.checkExec("Terminal")
+	if err != nil {
+		return nil, err
+	}
+	if opts.Term == "" {
+		opts.Term = "xterm"
+	}
+	if opts.Cols <= 0 || opts.Rows <= 0 {
+		opts.Cols, opts.Rows = 80, 24
+	}
+	if opts.Modes == nil {
+		opts.Modes = ssh.TerminalModes{ssh.ECHO: 1}
+	}
+
+	rec, err := s.startRecord(RecordInfo{Cmd: opts.Cmd, Term: opts.Term, Cols: opts.Cols, Rows: opts.Rows})
+	if err != nil {
+		return nil, err
+	}
+	sess, session, err := s.openSession()
+	if err != nil {
+		rec.close()
+		return nil, err
+	}
+	ref := s.NopClose()
+	t := &Terminal{
+		cmd:  opts.Cmd,
+		sess: sess,
+		rec:  rec,
+		close: func() error {
+			err := sess.Close()
+			session.Release()
+			ref.Close()
+			rec.close()
+			return err
+		},
+	}
+	sess.Stdin, sess.Stdout, sess.Stderr = rec.reader(opts.Stdin), rec.writer(opts.Stdout), rec.writer(opts.Stderr)
+	if stdin != nil {
+		sess.Stdin = nil
+		*stdin, err = sess.StdinPipe()
+		if err == nil {
+			*stdin = rec.writeCloser(*stdin)
+		}
+	}
+	if err == nil {
+		err = sess.RequestPty(opts.Term, opts.Rows, opts.Cols, opts.Modes)
+	}
+	if err == nil {
+		if opts.Cmd == "" {
+			err = sess.Shell()
+		} else {
+			err = sess.Start(s.rcmdStr(opts.Cmd, ""))
+		}
+	}
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Resize change the window size of remote terminal.
+func (t *Terminal) Resize(cols, rows int) error {
+	err := t.sess.WindowChange(rows, cols)
+	if err == nil {
+		t.rec.record(RecordResize, []byte(strconv.Itoa(cols)+"x"+strconv.Itoa(rows)))
+	}
+	return err
+}
+
+// WatchResize resize the remote terminal to the size of local terminal once it's
+// changed, the size function return the local terminal size, such as term.GetSize
+// of golang.org/x/term. The window changes are notified by SIGWINCH, it's not
+// supported on windows. The returned function stop watching, it's also stopped when
+// the Terminal is closed.
+func (t *Terminal) WatchResize(size func() (cols, rows int, err error)) (stop func()) {
+	stop = notifyResize(func() {
+		cols, rows, err := size()
+		if err == nil {
+			t.Resize(cols, rows)
+		}
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		stop()
+		return func() {}
+	}
+	t.stops = append(t.stops, stop)
+	return stop
+}
+
+// Signal send the signal to remote process.
+func (t *Terminal) Signal(sig ssh.Signal) error {
+	return t.sess.Signal(sig)
+}
+
+// Wait wait the remote process exits, the error is an *ExitError if it exits with
+// non-zero status, stderr isn't captured. It also wait the Stdin reaches EOF.
+func (t *Terminal) Wait() error {
+	err := t.sess.Wait()
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return newExitError(t.cmd, exitErr, nil)
+	}
+	return err
+}
+
+// Close stop watching resizes and release the session.
+func (t *Terminal) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	stops := t.stops
+	t.stops = nil
+	t.mu.Unlock()
+
+	for _, stop := range stops {
+		stop()
+	}
+	return t.close()
+}
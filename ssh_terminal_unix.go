@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package socker
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// notifyResize call the function once SIGWINCH is received until stopped.
+func notifyResize(fn func()) (stop func()) {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, syscall.SIGWINCH)
+	go func() {
+		defer recoverPanic(nil, "terminal resize")
+		for {
+			select {
+			case <-c:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,6 @@
+package socker
+
+// notifyResize is a no-op since windows has no SIGWINCH.
+func notifyResize(fn func()) (stop func()) {
+	return func() {}
+}
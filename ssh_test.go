@@ -0,0 +1,716 @@
+package socker
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+var testSignalNames = map[syscall.Signal]string{
+	syscall.SIGKILL: "KILL",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGINT:  "INT",
+}
+
+// startExecServer start a ssh server which accepts any password, runs exec requests
+// by local shell and serves the sftp subsystem on local file system.
+func startExecServer(t *testing.T) net.Listener {
+	return startLimitedExecServer(t, 0)
+}
+
+// startLimitedExecServer do the same thing as startExecServer, but sessions of each
+// connection exceed the limit are prohibited like MaxSessions of sshd, 0 means
+// unlimited.
+func startLimitedExecServer(t *testing.T, maxSessions int32) net.Listener {
+	return startTestServer(t, func(conn net.Conn, config *ssh.ServerConfig) {
+		serveExec(conn, config, maxSessions)
+	})
+}
+
+// startTestServer start a ssh server which accepts any password and serves each
+// connection by the serve function.
+func startTestServer(t *testing.T, serve func(conn net.Conn, config *ssh.ServerConfig)) net.Listener {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn, config)
+		}
+	}()
+	return l
+}
+
+func serveExec(conn net.Conn, config *ssh.ServerConfig, maxSessions int32) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	var sessions int32
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only session is supported")
+			continue
+		}
+		if maxSessions > 0 && atomic.AddInt32(&sessions, 1) > maxSessions {
+			atomic.AddInt32(&sessions, -1)
+			newCh.Reject(ssh.Prohibited, "no more sessions")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			atomic.AddInt32(&sessions, -1)
+			continue
+		}
+		go func() {
+			serveSession(ch, reqs)
+			atomic.AddInt32(&sessions, -1)
+		}()
+	}
+}
+
+func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	var (
+		cmd *exec.Cmd
+		env []string
+	)
+	done := make(chan struct{})
+	for {
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				if cmd != nil && cmd.Process != nil {
+					cmd.Process.Kill()
+				}
+				return
+			}
+			var payload struct{ Value string }
+			ssh.Unmarshal(req.Payload, &payload)
+			switch {
+			case req.Type == "subsystem" && payload.Value == "sftp":
+				req.Reply(true, nil)
+				server, err := sftp.NewServer(ch)
+				if err == nil {
+					server.Serve()
+				}
+				return
+			case req.Type == "pty-req":
+				// the pty isn't allocated, the size is exported as COLUMNS and LINES.
+				var pty struct {
+					Term       string
+					Cols, Rows uint32
+					W, H       uint32
+					Modes      string
+				}
+				ssh.Unmarshal(req.Payload, &pty)
+				env = append(env, fmt.Sprintf("COLUMNS=%d", pty.Cols), fmt.Sprintf("LINES=%d", pty.Rows))
+				req.Reply(true, nil)
+			case req.Type == "env":
+				// like the default AcceptEnv of sshd.
+				var kv struct{ Name, Value string }
+				ssh.Unmarshal(req.Payload, &kv)
+				ok := strings.HasPrefix(kv.Name, "LC_")
+				if ok {
+					env = append(env, kv.Name+"="+kv.Value)
+				}
+				req.Reply(ok, nil)
+			case req.Type == "window-change":
+				var size struct{ Cols, Rows, W, H uint32 }
+				ssh.Unmarshal(req.Payload, &size)
+				fmt.Fprintf(ch.Stderr(), "resize %dx%d\n", size.Cols, size.Rows)
+			case (req.Type == "exec" || req.Type == "shell") && cmd == nil:
+				req.Reply(true, nil)
+				if req.Type == "shell" {
+					payload.Value = "exec sh"
+				}
+				cmd = exec.Command("sh", "-c", payload.Value)
+				cmd.Env = append(os.Environ(), env...)
+				cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+				// like sshd, the command may exit before client closes stdin.
+				if stdin, err := cmd.StdinPipe(); err == nil {
+					go func() {
+						io.Copy(stdin, ch)
+						stdin.Close()
+					}()
+				}
+				err := cmd.Start()
+				go func() {
+					var status [4]byte
+					if err == nil {
+						err = cmd.Wait()
+					}
+					if e, ok := err.(*exec.ExitError); ok {
+						// report killed processes by exit-signal like OpenSSH.
+						ws, _ := e.Sys().(syscall.WaitStatus)
+						if name := testSignalNames[ws.Signal()]; ws.Signaled() && name != "" {
+							ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+								Signal     string
+								CoreDumped bool
+								Msg, Lang  string
+							}{Signal: name}))
+							close(done)
+							return
+						}
+					}
+					if err != nil {
+						code := 1
+						if e, ok := err.(*exec.ExitError); ok && e.ExitCode() > 0 {
+							code = e.ExitCode()
+						}
+						binary.BigEndian.PutUint32(status[:], uint32(code))
+					}
+					ch.SendRequest("exit-status", false, status[:])
+					close(done)
+				}()
+			case req.Type == "signal":
+				if cmd != nil && cmd.Process != nil {
+					cmd.Process.Signal(syscall.SIGTERM)
+				}
+			default:
+				req.Reply(false, nil)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func TestCmdContext(t *testing.T) {
+	agent := LocalOnly()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	agent.LcmdContext(ctx, "exec sleep 5")
+	if agent.Error() == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("command should be killed once context is done: %v", agent.Error())
+	}
+	agent.ClearError()
+
+	agent.LcmdContext(context.Background(), "echo ok")
+	if agent.Error() != nil || strings.TrimSpace(string(agent.Output())) != "ok" {
+		t.Errorf("unexpected result: %v %q", agent.Error(), agent.Output())
+	}
+
+	var buf bytes.Buffer
+	agent.DryRun(&buf)
+	agent.RcmdContext(context.Background(), "uptime")
+	if agent.Error() != nil || !strings.Contains(buf.String(), "uptime") {
+		t.Errorf("dry run command should be echoed: %v %q", agent.Error(), buf.String())
+	}
+}
+
+func TestRcmdStream(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	var stdout, stderr bytes.Buffer
+	agent.RcmdStream(context.Background(), "echo out; echo err >&2", &stdout, &stderr)
+	if agent.Error() != nil || stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("unexpected output: %v %q %q", agent.Error(), stdout.String(), stderr.String())
+	}
+	if agent.Output() != nil {
+		t.Errorf("streamed output shouldn't be buffered: %q", agent.Output())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	agent.RcmdStream(ctx, "exec sleep 5", nil, nil)
+	if agent.Error() != context.DeadlineExceeded || time.Since(start) > 2*time.Second {
+		t.Errorf("command should be canceled: %v", agent.Error())
+	}
+	agent.ClearError()
+
+	agent.Rcmd("echo ok")
+	if agent.Error() != nil || string(agent.Output()) != "ok\n" {
+		t.Errorf("unexpected output: %v %q", agent.Error(), agent.Output())
+	}
+}
+
+func TestRcmdExitError(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	agent.Rcmd("echo out; echo failed >&2; exit 3")
+	e, ok := agent.Error().(*ExitError)
+	if !ok {
+		t.Fatalf("expect *ExitError: %v", agent.Error())
+	}
+	if e.Code != 3 || e.Signal != "" || string(e.Stderr) != "failed\n" {
+		t.Errorf("unexpected exit error: %d %q %q", e.Code, e.Signal, e.Stderr)
+	}
+	if out := string(agent.Output()); !strings.Contains(out, "out\n") || !strings.Contains(out, "failed\n") {
+		t.Errorf("unexpected output: %q", agent.Output())
+	}
+	if _, ok := e.Unwrap().(*ssh.ExitError); !ok {
+		t.Errorf("expect wrapped *ssh.ExitError: %v", e.Unwrap())
+	}
+	if se := e.SSHExitError(); se == nil || se.ExitStatus() != 3 {
+		t.Errorf("unexpected *ssh.ExitError: %v", se)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := tailBuffer{size: 4}
+	b.Write([]byte("ab"))
+	b.Write([]byte("cde"))
+	if string(b.Bytes()) != "bcde" {
+		t.Errorf("unexpected tail: %q", b.Bytes())
+	}
+	b.Write([]byte("123456"))
+	if string(b.Bytes()) != "3456" {
+		t.Errorf("unexpected tail: %q", b.Bytes())
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	stdin, stdinW := io.Pipe()
+	stdoutR, stdout := io.Pipe()
+	stderrR, stderr := io.Pipe()
+	term, err := agent.Terminal(TerminalOptions{
+		Cmd:    "echo $COLUMNS $LINES; read line; exit 2",
+		Cols:   120,
+		Rows:   30,
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	line := make([]byte, 7)
+	if _, err := io.ReadFull(stdoutR, line); err != nil || string(line) != "120 30\n" {
+		t.Fatalf("unexpected initial size: %v %q", err, line)
+	}
+	if err := term.Resize(100, 40); err != nil {
+		t.Fatal(err)
+	}
+	line = make([]byte, 14)
+	if _, err := io.ReadFull(stderrR, line); err != nil || string(line) != "resize 100x40\n" {
+		t.Fatalf("unexpected resize: %v %q", err, line)
+	}
+	stdinW.Write([]byte("\n"))
+	stdinW.Close()
+	if e, ok := term.Wait().(*ExitError); !ok || e.Code != 2 {
+		t.Errorf("expect exit status 2: %v", e)
+	}
+}
+
+func TestRcmdWithEnv(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	agent.RcmdWithEnv(`printf '%s|%s' "$LC_A" "$B"`, map[string]string{"LC_A": "a b", "B": "it's $HOME"})
+	if agent.Error() != nil || string(agent.Output()) != "a b|it's $HOME" {
+		t.Errorf("unexpected output: %v %q", agent.Error(), agent.Output())
+	}
+
+	var buf bytes.Buffer
+	agent.DryRun(&buf)
+	agent.RcmdWithEnv("true", map[string]string{"B": "b", "A": "a"})
+	if !strings.Contains(buf.String(), "export A='a' B='b'") {
+		t.Errorf("rejected env should be exported: %q", buf.String())
+	}
+}
+
+func TestCmdTimeout(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	agent.CmdTimeout(100 * time.Millisecond)
+	start := time.Now()
+	agent.Rcmd("exec sleep 5")
+	if agent.Error() != ErrCmdTimeout || time.Since(start) > 2*time.Second {
+		t.Errorf("command should be timeout: %v", agent.Error())
+	}
+	agent.ClearError()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	agent.RcmdContext(ctx, "exec sleep 5")
+	if agent.Error() != context.Canceled {
+		t.Errorf("context error should be kept: %v", agent.Error())
+	}
+	agent.ClearError()
+
+	agent.Rcmd("echo ok")
+	if agent.Error() != nil || string(agent.Output()) != "ok\n" {
+		t.Errorf("unexpected output: %v %q", agent.Error(), agent.Output())
+	}
+}
+
+func TestRcmdStart(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	stdoutR, stdout := io.Pipe()
+	cmd, err := agent.RcmdStart("trap 'echo interrupted; exit 5' TERM; echo started; while true; do sleep 0.05; done", stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Close()
+	line := make([]byte, 8)
+	if _, err := io.ReadFull(stdoutR, line); err != nil || string(line) != "started\n" {
+		t.Fatalf("unexpected output: %v %q", err, line)
+	}
+	if err := cmd.Signal(ssh.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	line = make([]byte, 12)
+	if _, err := io.ReadFull(stdoutR, line); err != nil || string(line) != "interrupted\n" {
+		t.Fatalf("unexpected output: %v %q", err, line)
+	}
+	if e, ok := cmd.Wait().(*ExitError); !ok || e.Code != 5 {
+		t.Errorf("expect exit status 5: %v", e)
+	}
+	if cmd.Close() != nil {
+		t.Error("close after wait should be nop")
+	}
+}
+
+func TestRcmdStartKill(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	// the test server sends SIGTERM for all signals of session, the command is killed
+	// by kill command with pid.
+	const ignoreTerm = "echo started >&2; trap '' TERM; i=0; while [ $i -lt 100 ]; do sleep 0.05; i=$((i+1)); done"
+	cmd, err := agent.RcmdStart(ignoreTerm, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if cmd.PID() != 0 {
+		t.Error("pid shouldn't be reported by default")
+	}
+	cmd.Close()
+
+	agent.ReportPID(true)
+	var stderr bytes.Buffer
+	cmd, err = agent.RcmdStart(ignoreTerm, nil, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Close()
+	for i := 0; cmd.PID() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cmd.PID() == 0 {
+		t.Fatal("pid isn't reported")
+	}
+	if err := cmd.Kill(200 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := cmd.Wait().(*ExitError); !ok || e.Code != -1 || e.Signal != "KILL" {
+		t.Errorf("expect killed by SIGKILL: %v", cmd.Wait())
+	}
+	if stderr.String() != "started\n" {
+		t.Errorf("unexpected stderr: %q", stderr.String())
+	}
+	if d := cmd.Elapsed(); d < 200*time.Millisecond || d != cmd.Elapsed() {
+		t.Errorf("unexpected elapsed time: %s", d)
+	}
+
+	// the kill command can't be sent since the only session is in use.
+	single, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret", MaxSession: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+	single.ReportPID(true)
+	cmd, err = single.RcmdStart(ignoreTerm, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; cmd.PID() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	cmd.Kill(100 * time.Millisecond)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("kill should close session if no session is available: %s", d)
+	}
+	if slots := single.SessionSlots(); slots.Active != 0 {
+		t.Errorf("session should be released: %+v", slots)
+	}
+}
+
+func TestRcmdInput(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	agent.RcmdInput(strings.NewReader("select 1;\nselect 2;\n"), "grep -c select")
+	if agent.Error() != nil || string(agent.Output()) != "2\n" {
+		t.Errorf("unexpected output: %v %q", agent.Error(), agent.Output())
+	}
+	agent.Rcmd("cat")
+	if agent.Error() != nil || len(agent.Output()) != 0 {
+		t.Errorf("stdin shouldn't be kept: %v %q", agent.Error(), agent.Output())
+	}
+}
+
+func TestRcmdScript(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	fd, err := ioutil.TempFile("", "socker-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("echo \"$#:$1:$2\"\nexit 3\n")
+	fd.Close()
+
+	agent.RcmdScript(fd.Name(), "", "a b", "it's")
+	if e, ok := agent.Error().(*ExitError); !ok || e.Code != 3 {
+		t.Errorf("expect exit status 3: %v", agent.Error())
+	}
+	if string(agent.Output()) != "2:a b:it's\n" {
+		t.Errorf("unexpected output: %q", agent.Output())
+	}
+	agent.ClearError()
+
+	agent.RcmdScript(fd.Name()+".missing", "sh")
+	if !os.IsNotExist(agent.Error()) {
+		t.Errorf("expect not exist error: %v", agent.Error())
+	}
+}
+
+func TestShellSession(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	sh, err := agent.ShellSession(TerminalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sh.Close()
+
+	if err := sh.Send("cd /tmp; echo hello; pwd"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := sh.Expect(`hel+o\n`, time.Second)
+	if err != nil || string(out) != "hello\n" {
+		t.Fatalf("unexpected output: %v %q", err, out)
+	}
+	out, err = sh.Expect(`/tmp\n`, time.Second)
+	if err != nil || string(out) != "/tmp\n" {
+		t.Fatalf("shell states should be kept: %v %q", err, out)
+	}
+	if _, err := sh.Expect("never", 50*time.Millisecond); err != ErrExpectTimeout {
+		t.Errorf("expect timeout: %v", err)
+	}
+
+	sh.Send("echo bye; exit 0")
+	out, err = sh.Expect("never", time.Second)
+	if err != ErrShellExited || string(out) != "bye\n" {
+		t.Errorf("expect shell exited: %v %q", err, out)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	var buf bytes.Buffer
+	agent := LocalOnly()
+	agent.DryRun(&buf)
+	agent.Rcmd(Command("systemctl", "restart", "nginx; reboot"))
+	if !strings.Contains(buf.String(), "systemctl restart 'nginx; reboot'") {
+		t.Errorf("arguments should be quoted: %q", buf.String())
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	// the sftp subsystem takes one session.
+	l := startLimitedExecServer(t, 2)
+	defer l.Close()
+
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret", MaxSession: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	cmd, err := agent.RcmdStart("sleep 0.2", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cmd.Wait()
+	// the prohibited session is dropped and it waits for the running one.
+	agent.Rcmd("echo ok")
+	if agent.Error() != nil || string(agent.Output()) != "ok\n" {
+		t.Errorf("unexpected result: %v %q", agent.Error(), agent.Output())
+	}
+	if slots := agent.SessionSlots(); slots.Limit != 1 {
+		t.Errorf("session limit should shrink to 1: %+v", slots)
+	}
+
+	unlimited, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret", MaxSession: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlimited.Close()
+	cmd, err = unlimited.RcmdStart("sleep 0.2", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	unlimited.Rcmd("echo ok")
+	if e, ok := unlimited.Error().(*SessionLimitError); !ok || e.Active != 1 {
+		t.Errorf("expect session limit error: %v", unlimited.Error())
+	}
+}
+
+func TestRcmdLines(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	lines := make(map[Stream][]string)
+	agent.RcmdLines(context.Background(), "echo 10%; echo warn >&2; printf '50%%\n100%%'", func(stream Stream, line []byte) {
+		lines[stream] = append(lines[stream], string(line))
+	})
+	if agent.Error() != nil {
+		t.Fatal(agent.Error())
+	}
+	if strings.Join(lines[Stdout], ",") != "10%,50%,100%" || strings.Join(lines[Stderr], ",") != "warn" {
+		t.Errorf("unexpected lines: %q", lines)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{stream: Stdout, mu: new(sync.Mutex), fn: func(stream Stream, line []byte) {
+		lines = append(lines, string(line))
+	}}
+	for _, s := range []string{"a", "b\nc\n", "\nd"} {
+		w.Write([]byte(s))
+	}
+	w.flush()
+	if strings.Join(lines, ",") != "ab,c,,d" {
+		t.Errorf("unexpected lines: %q", lines)
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	agent.MaxOutputBytes(10)
+	agent.Rcmd("head -c 100000 /dev/zero | tr '\\0' a; exit 2")
+	e, ok := agent.Error().(*OutputTruncatedError)
+	if !ok || e.Limit != 10 || string(agent.Output()) != "aaaaaaaaaa" {
+		t.Fatalf("expect truncated output: %v %q", agent.Error(), agent.Output())
+	}
+	if exitErr, ok := e.Err.(*ExitError); !ok || exitErr.Code != 2 {
+		t.Errorf("command error should be kept: %v", e.Err)
+	}
+	agent.ClearError()
+
+	agent.Rcmd("echo ok")
+	if agent.Error() != nil || string(agent.Output()) != "ok\n" {
+		t.Errorf("unexpected output: %v %q", agent.Error(), agent.Output())
+	}
+}
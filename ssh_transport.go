@@ -0,0 +1,296 @@
+package socker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Transport create the underlying connection to ssh server instead of dialing tcp
+// directly, it's used to reach hosts behind access proxies.
+type Transport interface {
+	// DialContext return a connection which carries the ssh protocol to addr.
+	DialContext(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// DialTransport do the same thing as DialContext, but the connection to ssh server is
+// created by the transport.
+func DialTransport(ctx context.Context, addr string, auth *Auth, transport Transport) (*SSH, error) {
+	config, err := auth.SSHConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+	conn, err := transport.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newSSHContext(ctx, conn, addr, auth, config, nil)
+}
+
+// TransportRule apply the transport to addresses matched by the "matcher:matchor"
+// pattern.
+type TransportRule struct {
+	Pattern   string
+	Transport Transport
+}
+
+// TeleportTransport reach nodes through the ssh proxy of Teleport, the connection to
+// node is the "proxy:host:port[@cluster]" subsystem of the proxy, so nodes don't need
+// to be reachable from local host. The proxy connection is shared by all nodes and
+// redialed once it's broken.
+type TeleportTransport struct {
+	// Proxy is the ssh address of Teleport proxy, e.g. "teleport.example.com:3023".
+	Proxy string
+	// Auth is used to connect to the proxy, it usually holds the user certificate
+	// issued by Teleport, see Auth.Signers and Auth.Credentials.
+	Auth *Auth
+	// Cluster is the name of cluster the nodes belong to, empty means the cluster
+	// of the proxy.
+	Cluster string
+
+	mu     sync.Mutex
+	proxy  *ssh.Client
+	broken chan struct{}
+}
+
+var _ Transport = (*TeleportTransport)(nil)
+
+func (t *TeleportTransport) subsystem(addr string) string {
+	if t.Cluster == "" {
+		return "proxy:" + addr
+	}
+	return fmt.Sprintf("proxy:%s@%s", addr, t.Cluster)
+}
+
+// proxyConn return the proxy connection, the proxy only serves the subsystem so
+// it's a raw ssh client instead of SSH instance which requires sftp.
+func (t *TeleportTransport) proxyConn(ctx context.Context) (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.proxy != nil {
+		select {
+		case <-t.broken:
+			t.proxy.Close()
+			t.proxy = nil
+		default:
+			return t.proxy, nil
+		}
+	}
+	proxy, err := t.dialProxy(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("dial teleport proxy %s failed: %s", t.Proxy, err.Error())
+	}
+	broken := make(chan struct{})
+	go func() {
+		proxy.Wait()
+		close(broken)
+	}()
+	t.proxy = proxy
+	t.broken = broken
+	return proxy, nil
+}
+
+func (t *TeleportTransport) dialProxy(ctx context.Context) (*ssh.Client, error) {
+	config, err := t.Auth.SSHConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.Auth.dialTCP(ctx, t.Proxy, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, t.Proxy, config)
+	if err != nil {
+		conn.Close()
+		return nil, redactError(err, t.Auth.secrets()...)
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func (t *TeleportTransport) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	proxy, err := t.proxyConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := subsystemConn(ctx, proxy, t.subsystem(addr))
+	if err != nil {
+		return nil, fmt.Errorf("open teleport proxy subsystem for %s failed: %s", addr, err.Error())
+	}
+	return conn, nil
+}
+
+// Close close the proxy connection, connections opened through it are closed too.
+func (t *TeleportTransport) Close() error {
+	t.mu.Lock()
+	proxy := t.proxy
+	t.proxy = nil
+	t.mu.Unlock()
+	if proxy != nil {
+		return proxy.Close()
+	}
+	return nil
+}
+
+// subsystemConn start the subsystem and return it's stdin and stdout as connection.
+func subsystemConn(ctx context.Context, client *ssh.Client, name string) (net.Conn, error) {
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := sess.StdinPipe()
+	if err == nil {
+		var stdout io.Reader
+		stdout, err = sess.StdoutPipe()
+		if err == nil {
+			err = requestSubsystem(ctx, sess, name)
+		}
+		if err == nil {
+			return &sessionConn{
+				sess:   sess,
+				stdin:  stdin,
+				stdout: stdout,
+				local:  client.LocalAddr(),
+				remote: subsystemAddr(name),
+			}, nil
+		}
+	}
+	sess.Close()
+	return nil, err
+}
+
+func requestSubsystem(ctx context.Context, sess *ssh.Session, name string) error {
+	if ctx.Done() == nil {
+		return sess.RequestSubsystem(name)
+	}
+	c := make(chan error, 1)
+	go func() {
+		c <- sess.RequestSubsystem(name)
+	}()
+	select {
+	case err := <-c:
+		return err
+	case <-ctx.Done():
+		sess.Close()
+		return ctx.Err()
+	}
+}
+
+// sessionConn is the connection over stdin and stdout of ssh session.
+type sessionConn struct {
+	sess   *ssh.Session
+	stdin  io.WriteCloser
+	stdout io.Reader
+	local  net.Addr
+	remote net.Addr
+
+	closeOnce sync.Once
+}
+
+type subsystemAddr string
+
+func (a subsystemAddr) Network() string {
+	return "ssh-subsystem"
+}
+
+func (a subsystemAddr) String() string {
+	return string(a)
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *sessionConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.sess.Close()
+	})
+	return nil
+}
+
+func (c *sessionConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *sessionConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// deadlines aren't supported by ssh channels, the connection is closed instead by
+// callers on timeout.
+func (c *sessionConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sessionConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sessionConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type transportMatcher struct {
+	Matcher
+	Transport Transport
+}
+
+func buildTransports(rules []TransportRule) ([]transportMatcher, error) {
+	var matchers []transportMatcher
+	for _, rule := range rules {
+		if rule.Transport == nil {
+			return nil, fmt.Errorf("transport of %s is nil", rule.Pattern)
+		}
+		matcher, _, err := createMatcher(SplitRuleAndAddr(rule.Pattern))
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, transportMatcher{Matcher: matcher, Transport: rule.Transport})
+	}
+	return matchers, nil
+}
+
+func (m *Mux) transport(addr string) Transport {
+	for _, t := range m.transports {
+		if t.Matcher(addr) {
+			return t.Transport
+		}
+	}
+	return nil
+}
+
+// dialAgent connect to the address through the gate, the proxy gate, or the transport
+// if there is no gate.
+func (m *Mux) dialAgent(ctx context.Context, addr string, auth *Auth, gateAddr string, gate *SSH) (*SSH, error) {
+	if gate == nil && isProxyGate(gateAddr) {
+		t, err := proxyTransport(gateAddr, auth)
+		if err != nil {
+			return nil, err
+		}
+		return DialTransport(ctx, m.resolveHost(addr), auth, t)
+	}
+	if gate == nil {
+		if t := m.transport(addr); t != nil {
+			return DialTransport(ctx, m.resolveHost(addr), auth, t)
+		}
+	}
+	return DialContext(ctx, m.resolveHost(addr), auth, gate)
+}
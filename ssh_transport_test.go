@@ -0,0 +1,154 @@
+package socker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startTeleportProxy start a ssh server which forwards the "proxy:host:port[@cluster]"
+// subsystem to the node, the requested subsystems are sent to the channel.
+func startTeleportProxy(t *testing.T, subsystems chan<- string) net.Listener {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "proxy" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTeleportProxy(conn, config, subsystems)
+		}
+	}()
+	return l
+}
+
+func serveTeleportProxy(conn net.Conn, config *ssh.ServerConfig, subsystems chan<- string) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				var payload struct{ Name string }
+				if req.Type != "subsystem" || ssh.Unmarshal(req.Payload, &payload) != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				subsystems <- payload.Name
+				addr := strings.TrimPrefix(payload.Name, "proxy:")
+				if i := strings.LastIndex(addr, "@"); i >= 0 {
+					addr = addr[:i]
+				}
+				node, err := net.Dial("tcp", addr)
+				req.Reply(err == nil, nil)
+				if err != nil {
+					return
+				}
+				var wg sync.WaitGroup
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					io.Copy(ch, node)
+					ch.CloseWrite()
+				}()
+				io.Copy(node, ch)
+				node.Close()
+				wg.Wait()
+				return
+			}
+		}()
+	}
+}
+
+func TestTeleportTransport(t *testing.T) {
+	node := startAuthServer(t)
+	defer node.Close()
+	subsystems := make(chan string, 10)
+	proxy := startTeleportProxy(t, subsystems)
+	defer proxy.Close()
+
+	transport := &TeleportTransport{
+		Proxy:   proxy.Addr().String(),
+		Auth:    &Auth{User: "alice", Password: "proxy"},
+		Cluster: "root",
+	}
+	defer transport.Close()
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"node": {User: "root", Password: "secret"}},
+		DefaultAuth: "node",
+		Transports:  []TransportRule{{Pattern: "glob:127.0.0.1:*", Transport: transport}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// the node rejects all passwords, AuthError means the handshake went through the proxy.
+	for i := 0; i < 2; i++ {
+		_, err = m.Dial(node.Addr().String())
+		var authErr *AuthError
+		if !errors.As(err, &authErr) {
+			t.Fatalf("expect AuthError, got %v", err)
+		}
+		if name := <-subsystems; name != "proxy:"+node.Addr().String()+"@root" {
+			t.Errorf("unexpected subsystem: %s", name)
+		}
+	}
+
+	local := &TeleportTransport{Proxy: proxy.Addr().String(), Auth: &Auth{User: "alice", Password: "proxy"}}
+	defer local.Close()
+	_, err = DialTransport(context.Background(), node.Addr().String(), &Auth{User: "root", Password: "secret"}, local)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expect AuthError, got %v", err)
+	}
+	if name := <-subsystems; name != "proxy:"+node.Addr().String() {
+		t.Errorf("cluster should be omitted if it's empty: %s", name)
+	}
+
+	transport.Auth.Password = "wrong"
+	transport.Auth.config = nil
+	transport.Close()
+	_, err = DialTransport(context.Background(), node.Addr().String(), &Auth{User: "root", Password: "secret"}, transport)
+	if err == nil || !strings.Contains(err.Error(), "teleport proxy") {
+		t.Errorf("proxy error should be returned: %v", err)
+	}
+}
@@ -0,0 +1,356 @@
+package socker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Tunnel forward connections accepted by the listener to remote address through
+// the ssh connections.
+type Tunnel struct {
+	remote   string
+	listener net.Listener
+	dial     func(network, addr string) (net.Conn, error)
+	refs     []*SSH
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+	done   chan struct{}
+}
+
+// Tunnel listen on local address and forward each accepted connection to remote
+// address, the remote address is dialed from the ssh server. The local address
+// is the format of "host:port", port 0 means an random port, the bound address
+// can be retrieved by Tunnel.Addr.
+//
+// The Tunnel holds a reference of the SSH instance until it's closed.
+func (s *SSH) Tunnel(local, remote string) (*Tunnel, error) {
+	if s.conn == nil {
+		return nil, ErrConnClosed
+	}
+	listener, err := net.Listen("tcp", local)
+	if err != nil {
+		return nil, err
+	}
+
+	s = s.NopClose()
+	return newTunnel(listener, s.DialConn, remote, s), nil
+}
+
+func newTunnel(listener net.Listener, dial func(network, addr string) (net.Conn, error), remote string, refs ...*SSH) *Tunnel {
+	t := &Tunnel{
+		remote:   remote,
+		listener: listener,
+		dial:     dial,
+		refs:     refs,
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.serve()
+	return t
+}
+
+// TunnelContext do the same thing as Tunnel, but the tunnel will be closed once
+// the context is done. It's useful for throwaway tunnels with local address like
+// "127.0.0.1:0".
+func (s *SSH) TunnelContext(ctx context.Context, local, remote string) (*Tunnel, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.Tunnel(local, remote)
+	if err != nil {
+		return nil, err
+	}
+	t.closeOnDone(ctx)
+	return t, nil
+}
+
+func (t *Tunnel) closeOnDone(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.Close()
+		case <-t.done:
+		}
+	}()
+}
+
+// Done return a channel which is closed after the tunnel is closed.
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Addr return the bound listening address.
+func (t *Tunnel) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Remote return the remote address connections are forwarded to.
+func (t *Tunnel) Remote() string {
+	return t.remote
+}
+
+func (t *Tunnel) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *Tunnel) untrack(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+}
+
+func (t *Tunnel) serve() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if !t.track(conn) {
+			conn.Close()
+			return
+		}
+
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			defer t.untrack(conn)
+			defer recoverPanic(nil, "tunnel")
+
+			t.forward(conn)
+		}()
+	}
+}
+
+func (t *Tunnel) forward(conn net.Conn) {
+	defer conn.Close()
+
+	rconn, err := t.dial("tcp", t.remote)
+	if err != nil {
+		return
+	}
+	defer rconn.Close()
+	pipeConn(conn, rconn)
+}
+
+// pipeConn copy data between two connections until one of them is finished.
+func pipeConn(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+}
+
+// Close stop listening, close all forwarding connections and release the SSH instance.
+func (t *Tunnel) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.done)
+	err := t.listener.Close()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+	for _, ref := range t.refs {
+		ref.Close()
+	}
+	return err
+}
+
+// TunnelPreset is a named tunnel configuration.
+type TunnelPreset struct {
+	// Via is the address of the ssh host the tunnel goes through, gates are applied
+	// as Mux.Dial does.
+	Via string
+	// Remote is the "host:port" address dialed from the Via host.
+	Remote string
+	// Local is the local listening address, empty or "auto" means "127.0.0.1:0".
+	Local string
+}
+
+func (p TunnelPreset) localAddr() string {
+	if p.Local == "" || p.Local == "auto" {
+		return "127.0.0.1:0"
+	}
+	return p.Local
+}
+
+// OpenPreset open the tunnel defined in MuxAuth.TunnelPresets and return the bound
+// local address. The tunnel is shared by all callers and lives until ClosePreset
+// or Mux.Close is called.
+func (m *Mux) OpenPreset(name string) (string, error) {
+	if m.isClosed() {
+		return "", ErrMuxClosed
+	}
+
+	m.tunnelsMu.Lock()
+	if t, has := m.tunnels[name]; has {
+		m.tunnelsMu.Unlock()
+		return t.Addr().String(), nil
+	}
+	// the lock isn't held while dialing so other presets aren't blocked, concurrent
+	// openings of the same preset are coalesced, followers wait for the leader.
+	call, has := m.presetCalls[name]
+	if has {
+		m.tunnelsMu.Unlock()
+		<-call.done
+		if call.err != nil {
+			return "", call.err
+		}
+		return m.OpenPreset(name)
+	}
+	preset, has := m.presets[name]
+	if !has {
+		m.tunnelsMu.Unlock()
+		return "", fmt.Errorf("tunnel preset %s is not exist", name)
+	}
+	call = &dialCall{done: make(chan struct{})}
+	m.presetCalls[name] = call
+	m.tunnelsMu.Unlock()
+
+	t, err := m.openPreset(preset)
+	m.tunnelsMu.Lock()
+	delete(m.presetCalls, name)
+	if err == nil && m.isClosed() {
+		err = ErrMuxClosed
+	}
+	if err == nil {
+		m.tunnels[name] = t
+	}
+	m.tunnelsMu.Unlock()
+	call.err = err
+	close(call.done)
+	if err != nil {
+		if t != nil {
+			t.Close()
+		}
+		return "", err
+	}
+	return t.Addr().String(), nil
+}
+
+func (m *Mux) openPreset(preset TunnelPreset) (*Tunnel, error) {
+	agent, err := m.Dial(preset.Via)
+	if err != nil {
+		return nil, err
+	}
+	defer agent.Close()
+
+	return agent.Tunnel(preset.localAddr(), preset.Remote)
+}
+
+// OpenPresetContext open a private tunnel defined in MuxAuth.TunnelPresets, which
+// isn't shared with OpenPreset callers and will be closed once the context is done.
+func (m *Mux) OpenPresetContext(ctx context.Context, name string) (*Tunnel, error) {
+	m.tunnelsMu.Lock()
+	preset, has := m.presets[name]
+	m.tunnelsMu.Unlock()
+	if !has {
+		return nil, fmt.Errorf("tunnel preset %s is not exist", name)
+	}
+	return m.Tunnel(ctx, preset.Via, preset.localAddr(), preset.Remote)
+}
+
+// Tunnel dial the via address and open a tunnel through it, the tunnel will be
+// closed once the context is done.
+func (m *Mux) Tunnel(ctx context.Context, via, local, remote string) (*Tunnel, error) {
+	if m.isClosed() {
+		return nil, ErrMuxClosed
+	}
+	agent, err := m.Dial(via)
+	if err != nil {
+		return nil, err
+	}
+	defer agent.Close()
+
+	return agent.TunnelContext(ctx, local, remote)
+}
+
+// Bridge listen on the listenAddr of host listenVia and forward each accepted connection
+// to remote address dialed from host dialVia, data is relayed by current process.
+// It's useful to connect services in different networks which can't reach each other.
+// The listenAddr is the format of "host:port" on listenVia host, port 0 means an random
+// port, the bound address can be retrieved by Tunnel.Addr. The tunnel will be closed
+// once the context is done.
+func (m *Mux) Bridge(ctx context.Context, listenVia, listenAddr, dialVia, remote string) (*Tunnel, error) {
+	if m.isClosed() {
+		return nil, ErrMuxClosed
+	}
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	listenAgent, err := m.Dial(listenVia)
+	if err != nil {
+		return nil, err
+	}
+	dialAgent, err := m.Dial(dialVia)
+	if err != nil {
+		listenAgent.Close()
+		return nil, err
+	}
+	listener, err := listenAgent.ListenConn("tcp", listenAddr)
+	if err != nil {
+		listenAgent.Close()
+		dialAgent.Close()
+		return nil, err
+	}
+
+	t := newTunnel(listener, dialAgent.DialConn, remote, listenAgent, dialAgent)
+	t.closeOnDone(ctx)
+	return t, nil
+}
+
+// ClosePreset close the tunnel opened by OpenPreset, it reports whether the tunnel
+// is opened.
+func (m *Mux) ClosePreset(name string) bool {
+	m.tunnelsMu.Lock()
+	t, has := m.tunnels[name]
+	delete(m.tunnels, name)
+	m.tunnelsMu.Unlock()
+	if has {
+		t.Close()
+	}
+	return has
+}
+
+func (m *Mux) closeTunnels() {
+	m.tunnelsMu.Lock()
+	tunnels := m.tunnels
+	m.tunnels = make(map[string]*Tunnel)
+	m.tunnelsMu.Unlock()
+	for _, t := range tunnels {
+		t.Close()
+	}
+}
@@ -0,0 +1,106 @@
+package socker
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenPresetConcurrent(t *testing.T) {
+	// the handshakes with hang listener block until the connections are closed.
+	hang, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hang.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := hang.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	l := startExecServer(t)
+	defer l.Close()
+
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+		TunnelPresets: map[string]TunnelPreset{
+			"slow": {Via: hang.Addr().String(), Remote: "127.0.0.1:1"},
+			"fast": {Via: l.Addr().String(), Remote: "127.0.0.1:1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	slow := make(chan error, 2)
+	openSlow := func() {
+		_, err := m.OpenPreset("slow")
+		slow <- err
+	}
+	go openSlow()
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("slow preset isn't dialed")
+	}
+	go openSlow()
+
+	// other presets aren't blocked by the slow one, concurrent openings share the tunnel.
+	var (
+		wg    sync.WaitGroup
+		addrs = make([]string, 5)
+		errs  = make([]error, 5)
+	)
+	for i := range addrs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addrs[i], errs[i] = m.OpenPreset("fast")
+		}(i)
+	}
+	opened := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(opened)
+	}()
+	select {
+	case <-opened:
+	case <-time.After(3 * time.Second):
+		t.Fatal("open preset is blocked by another preset")
+	}
+	for i := range addrs {
+		if errs[i] != nil || addrs[i] != addrs[0] {
+			t.Fatalf("tunnel isn't shared: %v %v", addrs, errs)
+		}
+	}
+
+	conn.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err = <-slow:
+			if err == nil {
+				t.Error("slow preset should fail")
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("slow preset isn't finished")
+		}
+	}
+	select {
+	case conn = <-accepted:
+		conn.Close()
+		t.Error("concurrent openings of the same preset should be coalesced")
+	default:
+	}
+	if m.ClosePreset("slow") || !m.ClosePreset("fast") {
+		t.Error("only the fast preset should be opened")
+	}
+}
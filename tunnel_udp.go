@@ -0,0 +1,399 @@
+package socker
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrNoUDPRelay = errors.New("neither python3 nor socat is available on remote host")
+
+// UDPIdleTimeout is the duration a local udp peer is forgotten after it's idle,
+// it's remote relay process will be terminated.
+var UDPIdleTimeout = 60 * time.Second
+
+const (
+	udpRelayPython = "python3"
+	udpRelaySocat  = "socat"
+)
+
+// udpRelayScript read datagrams framed by 2 bytes big endian length from stdin and
+// send them to target, datagrams from target are written to stdout in the same framing.
+const udpRelayScript = `import socket,struct,sys,threading
+a=socket.getaddrinfo(sys.argv[1],int(sys.argv[2]),0,socket.SOCK_DGRAM)[0]
+s=socket.socket(a[0],socket.SOCK_DGRAM)
+s.connect(a[4])
+i=sys.stdin.buffer
+o=sys.stdout.buffer
+def r():
+    while True:
+        d=s.recv(65535)
+        o.write(struct.pack('>H',len(d))+d)
+        o.flush()
+t=threading.Thread(target=r)
+t.daemon=True
+t.start()
+while True:
+    n=i.read(2)
+    if len(n)<2:
+        break
+    s.send(i.read(struct.unpack('>H',n)[0]))
+`
+
+// UDPTunnel forward datagrams received by local udp socket to remote address through
+// the ssh connection. The remote host must have python3 or socat installed to relay
+// datagrams. With python3 datagrams boundaries are always kept, with socat each
+// datagram is sent by an individual write, the boundaries are kept in most cases
+// but not guaranteed.
+type UDPTunnel struct {
+	ssh    *SSH
+	remote string
+	relay  string
+	conn   net.PacketConn
+
+	mu     sync.Mutex
+	closed bool
+	peers  map[string]*udpPeer
+	wg     sync.WaitGroup
+	done   chan struct{}
+}
+
+type udpPeer struct {
+	addr    net.Addr
+	sess    *ssh.Session
+	session *session
+	stdin   io.WriteCloser
+	active  time.Time
+}
+
+// UDPTunnel listen on local udp address and forward datagrams to remote address,
+// each local peer address has it's own remote relay process and session. Datagrams
+// of new peers are dropped while all sessions are in use, see Auth.MaxSession.
+//
+// The UDPTunnel holds a reference of the SSH instance until it's closed.
+func (s *SSH) UDPTunnel(local, remote string) (*UDPTunnel, error) {
+	if s.conn == nil {
+		return nil, ErrConnClosed
+	}
+	_, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkExec("UDPTunnel")
+	if err != nil {
+		return nil, err
+	}
+	relay, err := s.detectUDPRelay()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", local)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &UDPTunnel{
+		ssh:    s.NopClose(),
+		remote: remote,
+		relay:  relay,
+		conn:   conn,
+		peers:  make(map[string]*udpPeer),
+		done:   make(chan struct{}),
+	}
+	t.wg.Add(2)
+	go t.serve()
+	go t.reap()
+	return t, nil
+}
+
+// UDPTunnelContext do the same thing as UDPTunnel, but the tunnel will be closed once
+// the context is done.
+func (s *SSH) UDPTunnelContext(ctx context.Context, local, remote string) (*UDPTunnel, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.UDPTunnel(local, remote)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				t.Close()
+			case <-t.done:
+			}
+		}()
+	}
+	return t, nil
+}
+
+// UDPTunnel dial the via address and open an udp tunnel through it, the tunnel will be
+// closed once the context is done.
+func (m *Mux) UDPTunnel(ctx context.Context, via, local, remote string) (*UDPTunnel, error) {
+	if m.isClosed() {
+		return nil, ErrMuxClosed
+	}
+	agent, err := m.Dial(via)
+	if err != nil {
+		return nil, err
+	}
+	defer agent.Close()
+
+	return agent.UDPTunnelContext(ctx, local, remote)
+}
+
+func (s *SSH) detectUDPRelay() (string, error) {
+	sess, session, err := s.openSession()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		sess.Close()
+		session.Release()
+	}()
+
+	out, err := sess.Output("command -v python3 >/dev/null 2>&1 && echo python3 || { command -v socat >/dev/null 2>&1 && echo socat; }")
+	if err != nil {
+		if _, ok := err.(*ssh.ExitError); !ok {
+			return "", err
+		}
+	}
+	switch relay := strings.TrimSpace(string(out)); relay {
+	case udpRelayPython, udpRelaySocat:
+		return relay, nil
+	}
+	return "", ErrNoUDPRelay
+}
+
+func (t *UDPTunnel) relayCmd() string {
+	host, port, _ := net.SplitHostPort(t.remote)
+	if t.relay == udpRelayPython {
+		return fmt.Sprintf("python3 -u -c %s %s %s", shellQuote(udpRelayScript), shellQuote(host), shellQuote(port))
+	}
+	return fmt.Sprintf("socat - %s", shellQuote("UDP:"+net.JoinHostPort(host, port)))
+}
+
+// Addr return the bound local address.
+func (t *UDPTunnel) Addr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+// Remote return the remote address datagrams are forwarded to.
+func (t *UDPTunnel) Remote() string {
+	return t.remote
+}
+
+// Done return a channel which is closed after the tunnel is closed.
+func (t *UDPTunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *UDPTunnel) serve() {
+	defer t.wg.Done()
+	defer recoverPanic(nil, "udp tunnel")
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		peer, err := t.peer(addr)
+		if err != nil {
+			continue
+		}
+		err = t.send(peer, buf[:n])
+		if err != nil {
+			t.dropPeer(addr.String(), peer)
+		}
+	}
+}
+
+func (t *UDPTunnel) send(peer *udpPeer, data []byte) error {
+	if t.relay == udpRelayPython {
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(data)))
+		data = append(size[:], data...)
+	}
+	_, err := peer.stdin.Write(data)
+	return err
+}
+
+// peer return the relay of the local peer, a new relay is started if it's not exist.
+// The session is opened without waiting and outside the lock, so datagrams of new
+// peers are dropped if all sessions are in use.
+func (t *UDPTunnel) peer(addr net.Addr) (*udpPeer, error) {
+	key := addr.String()
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrConnClosed
+	}
+	if peer, has := t.peers[key]; has {
+		peer.active = time.Now()
+		t.mu.Unlock()
+		return peer, nil
+	}
+	t.mu.Unlock()
+
+	sess, session, err := t.ssh.tryOpenSession()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		stdin  io.WriteCloser
+		stdout io.Reader
+	)
+	stdin, err = sess.StdinPipe()
+	if err == nil {
+		stdout, err = sess.StdoutPipe()
+	}
+	if err == nil {
+		err = sess.Start(t.relayCmd())
+	}
+	if err != nil {
+		sess.Close()
+		session.Release()
+		return nil, err
+	}
+	peer := &udpPeer{
+		addr:    addr,
+		sess:    sess,
+		session: session,
+		stdin:   stdin,
+		active:  time.Now(),
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		peer.close()
+		return nil, ErrConnClosed
+	}
+	if opened, has := t.peers[key]; has {
+		opened.active = time.Now()
+		t.mu.Unlock()
+		peer.close()
+		return opened, nil
+	}
+	t.peers[key] = peer
+	t.wg.Add(1)
+	t.mu.Unlock()
+	go t.receive(peer, stdout)
+	return peer, nil
+}
+
+func (t *UDPTunnel) receive(peer *udpPeer, stdout io.Reader) {
+	defer t.wg.Done()
+	defer t.dropPeer(peer.addr.String(), peer)
+	defer recoverPanic(nil, "udp tunnel")
+
+	if t.relay != udpRelayPython {
+		buf := make([]byte, 65535)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				t.conn.WriteTo(buf[:n], peer.addr)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	r := bufio.NewReader(stdout)
+	var (
+		size [2]byte
+		buf  = make([]byte, 65535)
+	)
+	for {
+		_, err := io.ReadFull(r, size[:])
+		if err != nil {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(size[:]))
+		_, err = io.ReadFull(r, buf[:n])
+		if err != nil {
+			return
+		}
+		t.conn.WriteTo(buf[:n], peer.addr)
+	}
+}
+
+func (t *UDPTunnel) dropPeer(key string, peer *udpPeer) {
+	t.mu.Lock()
+	if t.peers[key] == peer {
+		delete(t.peers, key)
+	}
+	t.mu.Unlock()
+	peer.close()
+}
+
+func (p *udpPeer) close() {
+	p.stdin.Close()
+	p.sess.Close()
+	p.session.Release()
+}
+
+func (t *UDPTunnel) reap() {
+	defer t.wg.Done()
+	defer recoverPanic(nil, "udp tunnel")
+
+	ticker := time.NewTicker(UDPIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			var idles []*udpPeer
+			t.mu.Lock()
+			for key, peer := range t.peers {
+				if now.Sub(peer.active) >= UDPIdleTimeout {
+					idles = append(idles, peer)
+					delete(t.peers, key)
+				}
+			}
+			t.mu.Unlock()
+			for _, peer := range idles {
+				peer.close()
+			}
+		}
+	}
+}
+
+// Close stop listening, terminate all relay processes and release the SSH instance.
+func (t *UDPTunnel) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.done)
+	err := t.conn.Close()
+	peers := t.peers
+	t.peers = make(map[string]*udpPeer)
+	t.mu.Unlock()
+
+	for _, peer := range peers {
+		peer.close()
+	}
+	t.wg.Wait()
+	t.ssh.Close()
+	return err
+}
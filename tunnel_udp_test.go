@@ -0,0 +1,201 @@
+package socker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func startUDPEcho(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPTunnel(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is required to relay datagrams")
+	}
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	tunnel, err := agent.UDPTunnel("127.0.0.1:0", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.relay != udpRelayPython {
+		t.Fatalf("unexpected relay: %s", tunnel.relay)
+	}
+
+	// each client has it's own relay, the datagram boundaries are kept.
+	for c := 0; c < 2; c++ {
+		client, err := net.Dial("udp", tunnel.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+
+		var sent [][]byte
+		for i := 0; i < 3; i++ {
+			data := bytes.Repeat([]byte(fmt.Sprintf("client %d datagram %d;", c, i)), 1+i*100)
+			sent = append(sent, data)
+			if _, err = client.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buf := make([]byte, 65535)
+		for _, data := range sent {
+			n, err := client.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], data) {
+				t.Fatalf("unexpected datagram: %q", buf[:n])
+			}
+		}
+	}
+	tunnel.mu.Lock()
+	peers := len(tunnel.peers)
+	tunnel.mu.Unlock()
+	if peers != 2 {
+		t.Errorf("expect 2 peers, got %d", peers)
+	}
+
+	if err = tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-tunnel.Done():
+	default:
+		t.Error("tunnel should be done after closed")
+	}
+	if _, err = agent.UDPTunnel("127.0.0.1:0", "no-port"); err == nil {
+		t.Error("invalid remote address should be rejected")
+	}
+}
+
+func TestMuxUDPTunnelContext(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is required to relay datagrams")
+	}
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	l := startExecServer(t)
+	defer l.Close()
+	m, err := NewMux(MuxAuth{
+		AuthMethods: map[string]*Auth{"default": {User: "root", Password: "secret"}},
+		DefaultAuth: "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel, err := m.UDPTunnel(ctx, l.Addr().String(), "127.0.0.1:0", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("udp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("unexpected datagram: %q %v", buf[:n], err)
+	}
+
+	cancel()
+	select {
+	case <-tunnel.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel isn't closed with context")
+	}
+}
+
+func TestUDPTunnelSessionsExhausted(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is required to relay datagrams")
+	}
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	l := startExecServer(t)
+	defer l.Close()
+	agent, err := Dial(l.Addr().String(), &Auth{User: "root", Password: "secret", MaxSession: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	tunnel, err := agent.UDPTunnel("127.0.0.1:0", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("udp", tunnel.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	buf := make([]byte, 16)
+	clients[0].SetDeadline(time.Now().Add(5 * time.Second))
+	clients[0].Write([]byte("first"))
+	if n, err := clients[0].Read(buf); err != nil || string(buf[:n]) != "first" {
+		t.Fatalf("unexpected datagram: %q %v", buf[:n], err)
+	}
+	// the second peer has no session, its datagrams are dropped.
+	clients[1].SetDeadline(time.Now().Add(300 * time.Millisecond))
+	clients[1].Write([]byte("second"))
+	if _, err := clients[1].Read(buf); err == nil {
+		t.Error("datagram of peer without session should be dropped")
+	}
+	clients[0].SetDeadline(time.Now().Add(5 * time.Second))
+	clients[0].Write([]byte("again"))
+	if n, err := clients[0].Read(buf); err != nil || string(buf[:n]) != "again" {
+		t.Fatalf("tunnel is blocked: %q %v", buf[:n], err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		tunnel.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("close tunnel blocked")
+	}
+}